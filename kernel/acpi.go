@@ -0,0 +1,324 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// ACPI tables and power management. The FADT tells where the power management
+// registers are, the sleep types for power off come from \_S5 in the DSDT.
+
+const (
+	ACPI_RSDP_V1_SIZE   = 20
+	ACPI_HEADER_SIZE    = 36
+	ACPI_SEARCH_START   = 0xe0000
+	ACPI_SEARCH_SIZE    = 0x20000
+	ACPI_EBDA_SEARCH    = 1024
+	ACPI_MAX_TABLE_SIZE = 0x100000
+
+	// Generic address spaces
+	ACPI_ADDRESS_MEMORY = 0
+	ACPI_ADDRESS_IO     = 1
+
+	// FADT sizes of the optional parts
+	FADT_RESET_SIZE = 129
+	FADT_X_DSDT_END = 148
+
+	FADT_RESET_REG_SUP = 1 << 10
+
+	ACPI_PM1_SCI_EN      = 1 << 0
+	ACPI_PM1_SLP_TYP     = 10 // Shift
+	ACPI_PM1_SLP_EN      = 1 << 13
+	ACPI_ENABLE_TIMEOUT  = 300
+	ACPI_ENABLE_DELAY_US = 10000
+)
+
+type acpiRsdp struct {
+	signature [8]byte
+	checksum  uint8
+	oemId     [6]byte
+	revision  uint8
+	rsdtAddr  uint32
+
+	// Revision 2 and later
+	length      uint32
+	xsdtAddr    uint64
+	extChecksum uint8
+	reserved    [3]byte
+}
+
+type acpiHeader struct {
+	signature       [4]byte
+	length          uint32
+	revision        uint8
+	checksum        uint8
+	oemId           [6]byte
+	oemTableId      [8]byte
+	oemRevision     uint32
+	creatorId       uint32
+	creatorRevision uint32
+}
+
+type acpiGas struct {
+	addressSpace   uint8
+	registerWidth  uint8
+	registerOffset uint8
+	accessSize     uint8
+	address        uint64
+}
+
+type acpiFadt struct {
+	header         acpiHeader
+	firmwareCtrl   uint32
+	dsdt           uint32
+	reserved       uint8
+	pmProfile      uint8
+	sciInterrupt   uint16
+	smiCommand     uint32
+	acpiEnable     uint8
+	acpiDisable    uint8
+	s4biosRequest  uint8
+	pstateControl  uint8
+	pm1aEventBlock uint32
+	pm1bEventBlock uint32
+	pm1aControl    uint32
+	pm1bControl    uint32
+	pm2Control     uint32
+	pmTimerBlock   uint32
+	gpe0Block      uint32
+	gpe1Block      uint32
+	pm1EventLength uint8
+	pm1ControlLen  uint8
+	pm2ControlLen  uint8
+	pmTimerLength  uint8
+	gpe0Length     uint8
+	gpe1Length     uint8
+	gpe1Base       uint8
+	cstateControl  uint8
+	c2Latency      uint16
+	c3Latency      uint16
+	flushSize      uint16
+	flushStride    uint16
+	dutyOffset     uint8
+	dutyWidth      uint8
+	dayAlarm       uint8
+	monthAlarm     uint8
+	century        uint8
+	bootArch       [2]byte // Unaligned
+	reserved2      uint8
+	flags          uint32
+	resetRegister  acpiGas
+	resetValue     uint8
+	armBootArch    [2]byte
+	minorVersion   uint8
+	xFirmwareCtrl  uint64
+	xDsdt          uint64
+}
+
+var (
+	acpiRsdpPtr *acpiRsdp
+	// RSDT or XSDT
+	acpiRoot      *acpiHeader
+	acpiEntrySize uintptr
+
+	fadt *acpiFadt
+	dsdt *acpiHeader
+	// Sleep types of \_S5 for PM1a and PM1b, valid if acpiCanPowerOff is set
+	acpiSlpTypA     uint16
+	acpiSlpTypB     uint16
+	acpiCanPowerOff bool
+)
+
+// Identity map physical memory outside of the RAM into the kernel address space
+func mapPhysical(addr uintptr, length uintptr, flags uint8) {
+	for page := addr &^ (PAGE_SIZE - 1); page < addr+length; page += PAGE_SIZE {
+		mm.KernelMemSpace.TryMapPage(page, page, flags|mm.PAGE_PERM_KERNEL)
+		if page+PAGE_SIZE < page {
+			// Overflow at 4G
+			break
+		}
+	}
+}
+
+func acpiChecksumValid(addr uintptr, length uintptr) bool {
+	return mpChecksum(addr, length) == 0
+}
+
+func acpiScanRsdp(addr uintptr, length uintptr) *acpiRsdp {
+	if addr == 0 {
+		return nil
+	}
+	for p := addr; p+ACPI_RSDP_V1_SIZE <= addr+length; p += 16 {
+		rsdp := (*acpiRsdp)(unsafe.Pointer(p))
+		if rsdp.signature == [8]byte{'R', 'S', 'D', ' ', 'P', 'T', 'R', ' '} && acpiChecksumValid(p, ACPI_RSDP_V1_SIZE) {
+			return rsdp
+		}
+	}
+	return nil
+}
+
+func acpiFindRsdp() *acpiRsdp {
+	ebda := uintptr(*(*uint16)(unsafe.Pointer(uintptr(BDA_EBDA_SEGMENT)))) << 4
+	if rsdp := acpiScanRsdp(ebda, ACPI_EBDA_SEARCH); rsdp != nil {
+		return rsdp
+	}
+	return acpiScanRsdp(ACPI_SEARCH_START, ACPI_SEARCH_SIZE)
+}
+
+// Map a table and check it. Returns nil if it is broken.
+func acpiMapTable(addr uintptr) *acpiHeader {
+	if addr == 0 {
+		return nil
+	}
+	mapPhysical(addr, ACPI_HEADER_SIZE, 0)
+	header := (*acpiHeader)(unsafe.Pointer(addr))
+	if header.length < ACPI_HEADER_SIZE || header.length > ACPI_MAX_TABLE_SIZE {
+		return nil
+	}
+	mapPhysical(addr, uintptr(header.length), 0)
+	if !acpiChecksumValid(addr, uintptr(header.length)) {
+		log.KErrorLn("[ACPI] Invalid checksum for table at ", addr)
+		return nil
+	}
+	return header
+}
+
+// Returns the first table with the signature or nil
+func acpiFindTable(signature [4]byte) *acpiHeader {
+	if acpiRoot == nil {
+		return nil
+	}
+	entries := uintptr(unsafe.Pointer(acpiRoot)) + ACPI_HEADER_SIZE
+	count := (uintptr(acpiRoot.length) - ACPI_HEADER_SIZE) / acpiEntrySize
+	for i := uintptr(0); i < count; i++ {
+		entry := entries + i*acpiEntrySize
+		var addr uint64
+		if acpiEntrySize == 8 {
+			addr = *(*uint64)(unsafe.Pointer(entry))
+		} else {
+			addr = uint64(*(*uint32)(unsafe.Pointer(entry)))
+		}
+		if addr == 0 || addr >= 1<<32 {
+			continue
+		}
+		// Only map the header until we know it is the right table
+		mapPhysical(uintptr(addr), ACPI_HEADER_SIZE, 0)
+		if (*acpiHeader)(unsafe.Pointer(uintptr(addr))).signature != signature {
+			continue
+		}
+		if table := acpiMapTable(uintptr(addr)); table != nil {
+			return table
+		}
+	}
+	return nil
+}
+
+// Needs paging
+func InitAcpiTables() {
+	acpiRsdpPtr = acpiFindRsdp()
+	if acpiRsdpPtr == nil {
+		log.KDebugLn("[ACPI] No RSDP found")
+		return
+	}
+	rsdpAddr := uintptr(unsafe.Pointer(acpiRsdpPtr))
+	if acpiRsdpPtr.revision >= 2 && acpiRsdpPtr.xsdtAddr != 0 && acpiRsdpPtr.xsdtAddr < 1<<32 &&
+		acpiChecksumValid(rsdpAddr, uintptr(acpiRsdpPtr.length)) {
+		acpiRoot = acpiMapTable(uintptr(acpiRsdpPtr.xsdtAddr))
+		acpiEntrySize = 8
+	}
+	if acpiRoot == nil {
+		acpiRoot = acpiMapTable(uintptr(acpiRsdpPtr.rsdtAddr))
+		acpiEntrySize = 4
+	}
+	if acpiRoot == nil {
+		log.KErrorLn("[ACPI] No valid RSDT or XSDT")
+		return
+	}
+	log.KDebugLn("[ACPI] Revision ", acpiRsdpPtr.revision, ", root table at ", uintptr(unsafe.Pointer(acpiRoot)))
+	acpiReadFadt()
+}
+
+func acpiReadFadt() {
+	fadt = (*acpiFadt)(unsafe.Pointer(acpiFindTable([4]byte{'F', 'A', 'C', 'P'})))
+	if fadt == nil {
+		log.KErrorLn("[ACPI] No FADT")
+		return
+	}
+	dsdtAddr := uintptr(fadt.dsdt)
+	if fadt.header.length >= FADT_X_DSDT_END && fadt.xDsdt != 0 && fadt.xDsdt < 1<<32 {
+		dsdtAddr = uintptr(fadt.xDsdt)
+	}
+	dsdt = acpiMapTable(dsdtAddr)
+	if dsdt == nil || dsdt.signature != [4]byte{'D', 'S', 'D', 'T'} {
+		log.KErrorLn("[ACPI] No valid DSDT")
+		dsdt = nil
+		return
+	}
+
+	var r amlReader
+	if amlFindPackage(dsdt, [4]byte{'_', 'S', '5', '_'}, &r) >= 2 {
+		acpiSlpTypA = uint16(r.integer())
+		acpiSlpTypB = uint16(r.integer())
+		acpiCanPowerOff = r.ok && fadt.pm1aControl != 0
+	}
+	if !acpiCanPowerOff {
+		log.KErrorLn("[ACPI] Could not read \\_S5, power off is not supported")
+		return
+	}
+	log.KDebugLn("[ACPI] \\_S5 sleep types ", acpiSlpTypA, " ", acpiSlpTypB)
+}
+
+// Some firmware starts in legacy mode and has to be asked to hand over the PM registers
+func acpiEnableMode() {
+	if Inw(uint16(fadt.pm1aControl))&ACPI_PM1_SCI_EN != 0 || fadt.smiCommand == 0 || fadt.acpiEnable == 0 {
+		return
+	}
+	Outb(uint16(fadt.smiCommand), fadt.acpiEnable)
+	for i := 0; i < ACPI_ENABLE_TIMEOUT; i++ {
+		if Inw(uint16(fadt.pm1aControl))&ACPI_PM1_SCI_EN != 0 {
+			return
+		}
+		pitDelay(ACPI_ENABLE_DELAY_US)
+	}
+	log.KErrorLn("[ACPI] Could not enable ACPI mode")
+}
+
+// Enter S5. Only returns if it did not work.
+func AcpiPowerOff() {
+	if !acpiCanPowerOff {
+		return
+	}
+	acpiEnableMode()
+	control := Inw(uint16(fadt.pm1aControl)) &^ (0x7 << ACPI_PM1_SLP_TYP)
+	Outw(uint16(fadt.pm1aControl), control|acpiSlpTypA<<ACPI_PM1_SLP_TYP|ACPI_PM1_SLP_EN)
+	if fadt.pm1bControl != 0 {
+		control = Inw(uint16(fadt.pm1bControl)) &^ (0x7 << ACPI_PM1_SLP_TYP)
+		Outw(uint16(fadt.pm1bControl), control|acpiSlpTypB<<ACPI_PM1_SLP_TYP|ACPI_PM1_SLP_EN)
+	}
+	pitDelay(ACPI_ENABLE_DELAY_US)
+}
+
+// Write the reset value to the reset register. Only returns if it did not work.
+func AcpiReset() {
+	if fadt == nil || fadt.header.length < FADT_RESET_SIZE || fadt.flags&FADT_RESET_REG_SUP == 0 {
+		return
+	}
+	reg := &fadt.resetRegister
+	switch reg.addressSpace {
+	case ACPI_ADDRESS_IO:
+		Outb(uint16(reg.address), fadt.resetValue)
+	case ACPI_ADDRESS_MEMORY:
+		if reg.address >= 1<<32 {
+			return
+		}
+		addr := uintptr(reg.address)
+		mapPhysical(addr, 1, mm.PAGE_RW|mm.PAGE_DISABLE_CACHE)
+		*(*uint8)(unsafe.Pointer(addr)) = fadt.resetValue
+	default:
+		log.KErrorLn("[ACPI] Unsupported reset register address space ", reg.addressSpace)
+		return
+	}
+	pitDelay(ACPI_ENABLE_DELAY_US)
+}
@@ -0,0 +1,538 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// AHCI SATA controllers. Every port with a disk gets a command list with a
+// command table per slot. The slots are used for requests of different
+// threads at the same time: with NCQ the disk works on them in any order,
+// without it the controller issues them one after another.
+// Before there are threads the port registers are polled.
+
+const (
+	AHCI_PCI_CLASS = 0x0106 // Mass storage, SATA
+	AHCI_PROG_IF   = 0x01
+	AHCI_ABAR      = 5
+
+	// HBA registers
+	AHCI_CAP  = 0x00
+	AHCI_GHC  = 0x04
+	AHCI_IS   = 0x08
+	AHCI_PI   = 0x0c
+	AHCI_CAP2 = 0x24
+	AHCI_BOHC = 0x28
+
+	AHCI_CAP_NCS_SHIFT = 8
+	AHCI_CAP_NCS_MASK  = 0x1f
+	AHCI_CAP_SSS       = 1 << 27
+	AHCI_CAP_SNCQ      = 1 << 30
+
+	AHCI_GHC_HR = 1 << 0
+	AHCI_GHC_IE = 1 << 1
+	AHCI_GHC_AE = 1 << 31
+
+	AHCI_CAP2_BOH = 1 << 0
+	AHCI_BOHC_BOS = 1 << 0
+	AHCI_BOHC_OOS = 1 << 1
+
+	// Port registers
+	AHCI_PORT_BASE = 0x100
+	AHCI_PORT_SIZE = 0x80
+	AHCI_PxCLB     = 0x00
+	AHCI_PxCLBU    = 0x04
+	AHCI_PxFB      = 0x08
+	AHCI_PxFBU     = 0x0c
+	AHCI_PxIS      = 0x10
+	AHCI_PxIE      = 0x14
+	AHCI_PxCMD     = 0x18
+	AHCI_PxTFD     = 0x20
+	AHCI_PxSIG     = 0x24
+	AHCI_PxSSTS    = 0x28
+	AHCI_PxSERR    = 0x30
+	AHCI_PxSACT    = 0x34
+	AHCI_PxCI      = 0x38
+
+	AHCI_PxCMD_ST  = 1 << 0
+	AHCI_PxCMD_SUD = 1 << 1
+	AHCI_PxCMD_POD = 1 << 2
+	AHCI_PxCMD_FRE = 1 << 4
+	AHCI_PxCMD_FR  = 1 << 14
+	AHCI_PxCMD_CR  = 1 << 15
+
+	AHCI_PxIS_DHRS  = 1 << 0
+	AHCI_PxIS_SDBS  = 1 << 3
+	AHCI_PxIS_IFS   = 1 << 27
+	AHCI_PxIS_HBDS  = 1 << 28
+	AHCI_PxIS_HBFS  = 1 << 29
+	AHCI_PxIS_TFES  = 1 << 30
+	AHCI_PxIS_ERROR = AHCI_PxIS_IFS | AHCI_PxIS_HBDS | AHCI_PxIS_HBFS | AHCI_PxIS_TFES
+
+	AHCI_SSTS_DET_MASK    = 0xf
+	AHCI_SSTS_DET_PRESENT = 3
+
+	AHCI_SIG_ATA = 0x00000101
+
+	AHCI_TFD_ERR = 1 << 0
+	AHCI_TFD_DRQ = 1 << 3
+	AHCI_TFD_BSY = 1 << 7
+
+	// Command header
+	AHCI_CMD_FIS_LENGTH  = 5 // dwords
+	AHCI_CMD_WRITE       = 1 << 6
+	AHCI_CMD_PRDTL_SHIFT = 16
+	AHCI_PRD_INTERRUPT   = 1 << 31
+
+	AHCI_CMD_LIST_SIZE     = 32 * 32
+	AHCI_RECEIVED_FIS_SIZE = 256
+	// Command FIS, ATAPI command, reserved and one PRD entry, rounded up to the alignment
+	AHCI_CMD_TABLE_SIZE = 0x100
+	AHCI_CMD_TABLE_PRDT = 0x80
+
+	FIS_TYPE_REG_H2D = 0x27
+	FIS_H2D_COMMAND  = 1 << 7
+	ATA_DEVICE_LBA   = 1 << 6
+	ATA_DEVICE_FUA   = 1 << 7
+
+	ATA_CMD_READ_DMA_EXT       = 0x25
+	ATA_CMD_WRITE_DMA_EXT      = 0x35
+	ATA_CMD_READ_FPDMA_QUEUED  = 0x60
+	ATA_CMD_WRITE_FPDMA_QUEUED = 0x61
+	ATA_CMD_FLUSH_CACHE_EXT    = 0xea
+	ATA_CMD_IDENTIFY           = 0xec
+
+	// Identify words
+	ATA_ID_QUEUE_DEPTH   = 75
+	ATA_ID_SATA_CAPS     = 76
+	ATA_ID_LBA28_SECTORS = 60
+	ATA_ID_COMMAND_SET_2 = 83
+	ATA_ID_LBA48_SECTORS = 100
+
+	ATA_ID_SATA_NCQ = 1 << 8
+	ATA_ID_LBA48    = 1 << 10
+
+	AHCI_MAX_PORTS = 32
+	AHCI_MAX_SLOTS = 32
+	AHCI_MAX_DISKS = 4
+
+	AHCI_RESET_TIMEOUT   = 1000000000 // ns
+	AHCI_LINK_TIMEOUT    = 10000000
+	AHCI_STOP_TIMEOUT    = 500000000
+	AHCI_COMMAND_TIMEOUT = 5000000000
+)
+
+type ahciSlot struct {
+	done   bool
+	failed bool
+	waiter WaitQueue
+}
+
+type ahciDisk struct {
+	abar     uintptr
+	port     uintptr // Register base of the port
+	portNum  uint8
+	cmdList  uintptr
+	fis      uintptr
+	tables   uintptr
+	numSlots uint8
+	ncq      bool
+	lba48    bool
+	sectors  uint64
+	// Polled until the controller's interrupt handler is registered
+	polling bool
+
+	busy   uint32 // Slots that belong to a request
+	issued uint32 // Slots given to the controller
+	slots  [AHCI_MAX_SLOTS]ahciSlot
+	// Threads waiting for a free slot
+	freeWaiters WaitQueue
+}
+
+var (
+	ahciDriver = PciDriver{
+		Name:    "ahci",
+		Matches: []PciMatch{{Vendor: PCI_ANY_ID, Device: PCI_ANY_ID, Class: AHCI_PCI_CLASS}},
+		Probe:   ahciProbe,
+	}
+
+	ahciDisks    [AHCI_MAX_DISKS]ahciDisk
+	numAhciDisks = 0
+	ahciNames    = [AHCI_MAX_DISKS]string{"sda", "sdb", "sdc", "sdd"}
+	// IRQs the interrupt handler is registered for
+	ahciIrqs uint32
+
+	// Word aligned as the controller needs it
+	ahciIdentifyData [256]uint16
+)
+
+func ahciRead(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func ahciWrite(addr uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(addr)) = value
+}
+
+func (d *ahciDisk) Sectors() uint64 {
+	return d.sectors
+}
+
+func (d *ahciDisk) ReadSectors(address int, count uint8, buffer []byte) syscall.Errno {
+	if err := d.checkRequest(address, count, buffer); err != ESUCCESS || count == 0 {
+		return err
+	}
+	if d.ncq {
+		return d.request(ATA_CMD_READ_FPDMA_QUEUED, uint64(address), count, buffer)
+	}
+	return d.request(ATA_CMD_READ_DMA_EXT, uint64(address), count, buffer)
+}
+
+func (d *ahciDisk) WriteSectors(address int, count uint8, buffer []byte) syscall.Errno {
+	if err := d.checkRequest(address, count, buffer); err != ESUCCESS || count == 0 {
+		return err
+	}
+	if d.ncq {
+		// Queued writes go through to the disk with FUA
+		return d.request(ATA_CMD_WRITE_FPDMA_QUEUED, uint64(address), count, buffer)
+	}
+	if err := d.request(ATA_CMD_WRITE_DMA_EXT, uint64(address), count, buffer); err != ESUCCESS {
+		return err
+	}
+	return d.request(ATA_CMD_FLUSH_CACHE_EXT, 0, 0, nil)
+}
+
+// The controller can only do DMA to word aligned addresses
+func (d *ahciDisk) checkRequest(address int, count uint8, buffer []byte) syscall.Errno {
+	if err := blockCheckRequest(d.sectors, address, count, buffer); err != ESUCCESS {
+		return err
+	}
+	if count > 0 && uintptr(unsafe.Pointer(&buffer[0]))&1 != 0 {
+		return syscall.EINVAL
+	}
+	return ESUCCESS
+}
+
+// Sleep on q until something completes or the deadline (0 for none) passes
+func (d *ahciDisk) wait(q *WaitQueue, deadline uint64) {
+	if d.polling || !schedulerStarted {
+		Pause()
+		d.complete()
+		return
+	}
+	q.WaitUntil(deadline)
+}
+
+func (d *ahciDisk) allocSlot() uint8 {
+	for {
+		for slot := uint8(0); slot < d.numSlots; slot++ {
+			if d.busy&(1<<slot) == 0 {
+				d.busy |= 1 << slot
+				return slot
+			}
+		}
+		d.wait(&d.freeWaiters, 0)
+	}
+}
+
+// Fill in the command header and table of the slot
+func (d *ahciDisk) setupCommand(slot uint8, command uint8, lba uint64, count uint8, buffer []byte) {
+	table := d.tables + uintptr(slot)*AHCI_CMD_TABLE_SIZE
+	fis := unsafe.Slice((*byte)(unsafe.Pointer(table)), AHCI_CMD_TABLE_PRDT)
+	clear(fis)
+	fis[0] = FIS_TYPE_REG_H2D
+	fis[1] = FIS_H2D_COMMAND
+	fis[2] = command
+	fis[4] = uint8(lba)
+	fis[5] = uint8(lba >> 8)
+	fis[6] = uint8(lba >> 16)
+	fis[7] = ATA_DEVICE_LBA
+	fis[8] = uint8(lba >> 24)
+	fis[9] = uint8(lba >> 32)
+	fis[10] = uint8(lba >> 40)
+	switch command {
+	case ATA_CMD_READ_FPDMA_QUEUED, ATA_CMD_WRITE_FPDMA_QUEUED:
+		// The count moves to the feature register, the tag takes its place
+		fis[3] = count
+		fis[12] = slot << 3
+		if command == ATA_CMD_WRITE_FPDMA_QUEUED {
+			fis[7] |= ATA_DEVICE_FUA
+		}
+	case ATA_CMD_IDENTIFY:
+		fis[7] = 0
+	default:
+		fis[12] = count
+	}
+
+	header := d.cmdList + uintptr(slot)*32
+	flags := uint32(AHCI_CMD_FIS_LENGTH)
+	if command == ATA_CMD_WRITE_DMA_EXT || command == ATA_CMD_WRITE_FPDMA_QUEUED {
+		flags |= AHCI_CMD_WRITE
+	}
+	if len(buffer) > 0 {
+		// The buffer is a kernel address, which is the same as the physical one
+		prd := table + AHCI_CMD_TABLE_PRDT
+		ahciWrite(prd, uint32(uintptr(unsafe.Pointer(&buffer[0]))))
+		ahciWrite(prd+4, 0)
+		ahciWrite(prd+8, 0)
+		ahciWrite(prd+12, uint32(len(buffer)-1)|AHCI_PRD_INTERRUPT)
+		flags |= 1 << AHCI_CMD_PRDTL_SHIFT
+	}
+	ahciWrite(header, flags)
+	ahciWrite(header+4, 0) // Bytes transferred
+	ahciWrite(header+8, uint32(table))
+	ahciWrite(header+12, 0)
+}
+
+func (d *ahciDisk) request(command uint8, lba uint64, count uint8, buffer []byte) syscall.Errno {
+	slot := d.allocSlot()
+	s := &d.slots[slot]
+	s.done = false
+	s.failed = false
+	d.setupCommand(slot, command, lba, count, buffer[:int(count)*BLOCK_SECTOR_SIZE])
+
+	d.issued |= 1 << slot
+	if command == ATA_CMD_READ_FPDMA_QUEUED || command == ATA_CMD_WRITE_FPDMA_QUEUED {
+		ahciWrite(d.port+AHCI_PxSACT, 1<<slot)
+	}
+	ahciWrite(d.port+AHCI_PxCI, 1<<slot)
+
+	deadline := MonotonicTime() + AHCI_COMMAND_TIMEOUT
+	for !s.done {
+		// The device may never answer, even with interrupts
+		if MonotonicTime() >= deadline {
+			log.KErrorLn("[AHCI] Command ", command, " on port ", d.portNum, " timed out")
+			d.recover()
+			break
+		}
+		d.wait(&s.waiter, deadline)
+	}
+
+	failed := s.failed
+	d.busy &^= 1 << slot
+	d.freeWaiters.WakeOne()
+	if failed {
+		log.KErrorLn("[AHCI] Command ", command, " for sector ", lba, " failed")
+		return syscall.EIO
+	}
+	return ESUCCESS
+}
+
+func (d *ahciDisk) finish(slot uint8, failed bool) {
+	s := &d.slots[slot]
+	d.issued &^= 1 << slot
+	s.done = true
+	s.failed = failed
+	s.waiter.WakeAll()
+}
+
+// Stop the command engine, clear the errors and start again. All commands
+// the controller had fail.
+func (d *ahciDisk) recover() {
+	for slot := uint8(0); slot < d.numSlots; slot++ {
+		if d.issued&(1<<slot) != 0 {
+			d.finish(slot, true)
+		}
+	}
+	log.KErrorLn("[AHCI] Port ", d.portNum, " error, task file ", ahciRead(d.port+AHCI_PxTFD))
+	d.stop()
+	ahciWrite(d.port+AHCI_PxSERR, 0xffffffff)
+	ahciWrite(d.port+AHCI_PxIS, 0xffffffff)
+	d.start()
+}
+
+// Finish all commands the controller is done with
+func (d *ahciDisk) complete() {
+	status := ahciRead(d.port + AHCI_PxIS)
+	ahciWrite(d.port+AHCI_PxIS, status)
+	if status&AHCI_PxIS_ERROR != 0 {
+		d.recover()
+		return
+	}
+	running := ahciRead(d.port+AHCI_PxCI) | ahciRead(d.port+AHCI_PxSACT)
+	for slot := uint8(0); slot < d.numSlots; slot++ {
+		if d.issued&(1<<slot) != 0 && running&(1<<slot) == 0 {
+			d.finish(slot, false)
+		}
+	}
+}
+
+func ahciInterrupt() {
+	for i := 0; i < numAhciDisks; i++ {
+		d := &ahciDisks[i]
+		if d.polling || ahciRead(d.abar+AHCI_IS)&(1<<d.portNum) == 0 {
+			continue
+		}
+		d.complete()
+		ahciWrite(d.abar+AHCI_IS, 1<<d.portNum)
+	}
+}
+
+func (d *ahciDisk) stop() bool {
+	cmd := ahciRead(d.port + AHCI_PxCMD)
+	ahciWrite(d.port+AHCI_PxCMD, cmd&^AHCI_PxCMD_ST)
+	if !mmioWait(d.port+AHCI_PxCMD, AHCI_PxCMD_CR, 0, AHCI_STOP_TIMEOUT) {
+		return false
+	}
+	cmd = ahciRead(d.port + AHCI_PxCMD)
+	ahciWrite(d.port+AHCI_PxCMD, cmd&^AHCI_PxCMD_FRE)
+	return mmioWait(d.port+AHCI_PxCMD, AHCI_PxCMD_FR, 0, AHCI_STOP_TIMEOUT)
+}
+
+func (d *ahciDisk) start() bool {
+	ahciWrite(d.port+AHCI_PxCMD, ahciRead(d.port+AHCI_PxCMD)|AHCI_PxCMD_FRE)
+	if !mmioWait(d.port+AHCI_PxTFD, AHCI_TFD_BSY|AHCI_TFD_DRQ, 0, AHCI_RESET_TIMEOUT) {
+		return false
+	}
+	ahciWrite(d.port+AHCI_PxCMD, ahciRead(d.port+AHCI_PxCMD)|AHCI_PxCMD_ST)
+	return true
+}
+
+func (d *ahciDisk) identify() bool {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ahciIdentifyData)), unsafe.Sizeof(ahciIdentifyData))
+	if d.request(ATA_CMD_IDENTIFY, 0, 1, buf) != ESUCCESS {
+		return false
+	}
+	id := &ahciIdentifyData
+	d.lba48 = id[ATA_ID_COMMAND_SET_2]&ATA_ID_LBA48 != 0
+	if d.lba48 {
+		d.sectors = uint64(id[ATA_ID_LBA48_SECTORS]) | uint64(id[ATA_ID_LBA48_SECTORS+1])<<16 |
+			uint64(id[ATA_ID_LBA48_SECTORS+2])<<32 | uint64(id[ATA_ID_LBA48_SECTORS+3])<<48
+	} else {
+		d.sectors = uint64(id[ATA_ID_LBA28_SECTORS]) | uint64(id[ATA_ID_LBA28_SECTORS+1])<<16
+	}
+	if d.ncq && id[ATA_ID_SATA_CAPS]&ATA_ID_SATA_NCQ != 0 {
+		d.numSlots = min(d.numSlots, uint8(id[ATA_ID_QUEUE_DEPTH]&0x1f)+1)
+	} else {
+		d.ncq = false
+	}
+	return true
+}
+
+// Set up the port for a disk. Returns false if there is no usable disk.
+func (d *ahciDisk) init(abar uintptr, portNum uint8, capabilities uint32) bool {
+	d.abar = abar
+	d.port = abar + AHCI_PORT_BASE + uintptr(portNum)*AHCI_PORT_SIZE
+	d.portNum = portNum
+	d.numSlots = uint8((capabilities>>AHCI_CAP_NCS_SHIFT)&AHCI_CAP_NCS_MASK) + 1
+	d.ncq = capabilities&AHCI_CAP_SNCQ != 0
+	d.polling = true
+
+	if capabilities&AHCI_CAP_SSS != 0 {
+		ahciWrite(d.port+AHCI_PxCMD, ahciRead(d.port+AHCI_PxCMD)|AHCI_PxCMD_SUD|AHCI_PxCMD_POD)
+	}
+	if !mmioWait(d.port+AHCI_PxSSTS, AHCI_SSTS_DET_MASK, AHCI_SSTS_DET_PRESENT, AHCI_LINK_TIMEOUT) {
+		return false
+	}
+	if !d.stop() {
+		log.KErrorLn("[AHCI] Could not stop port ", portNum)
+		return false
+	}
+
+	if d.cmdList == 0 {
+		d.cmdList = dmaAlloc(AHCI_CMD_LIST_SIZE, 1024)
+		d.fis = dmaAlloc(AHCI_RECEIVED_FIS_SIZE, 256)
+		d.tables = dmaAlloc(AHCI_MAX_SLOTS*AHCI_CMD_TABLE_SIZE, 128)
+		if d.cmdList == 0 || d.fis == 0 || d.tables == 0 {
+			return false
+		}
+	}
+	ahciWrite(d.port+AHCI_PxCLB, uint32(d.cmdList))
+	ahciWrite(d.port+AHCI_PxCLBU, 0)
+	ahciWrite(d.port+AHCI_PxFB, uint32(d.fis))
+	ahciWrite(d.port+AHCI_PxFBU, 0)
+	ahciWrite(d.port+AHCI_PxSERR, 0xffffffff)
+	ahciWrite(d.port+AHCI_PxIS, 0xffffffff)
+	if !d.start() {
+		log.KErrorLn("[AHCI] Disk on port ", portNum, " stays busy")
+		return false
+	}
+	// Only ATA disks, no ATAPI drives and port multipliers. The signature is there once the disk is ready.
+	if sig := ahciRead(d.port + AHCI_PxSIG); sig != AHCI_SIG_ATA {
+		log.KDebugLn("[AHCI] Port ", portNum, " has no disk, signature ", sig)
+		d.stop()
+		return false
+	}
+	ahciWrite(d.port+AHCI_PxIE, AHCI_PxIS_DHRS|AHCI_PxIS_SDBS|AHCI_PxIS_ERROR)
+	if !d.identify() {
+		d.stop()
+		return false
+	}
+	if !d.lba48 {
+		log.KErrorLn("[AHCI] Disk on port ", portNum, " does not support LBA48")
+		d.stop()
+		return false
+	}
+	return true
+}
+
+// Take the controller from the firmware and reset it
+func ahciReset(abar uintptr) bool {
+	if ahciRead(abar+AHCI_CAP2)&AHCI_CAP2_BOH != 0 {
+		ahciWrite(abar+AHCI_BOHC, ahciRead(abar+AHCI_BOHC)|AHCI_BOHC_OOS)
+		mmioWait(abar+AHCI_BOHC, AHCI_BOHC_BOS, 0, AHCI_STOP_TIMEOUT)
+	}
+	ahciWrite(abar+AHCI_GHC, ahciRead(abar+AHCI_GHC)|AHCI_GHC_AE)
+	ahciWrite(abar+AHCI_GHC, ahciRead(abar+AHCI_GHC)|AHCI_GHC_HR)
+	if !mmioWait(abar+AHCI_GHC, AHCI_GHC_HR, 0, AHCI_RESET_TIMEOUT) {
+		return false
+	}
+	ahciWrite(abar+AHCI_GHC, ahciRead(abar+AHCI_GHC)|AHCI_GHC_AE)
+	return true
+}
+
+func ahciProbe(pci *PciDevice) bool {
+	if pci.ProgIf != AHCI_PROG_IF {
+		return false
+	}
+	pci.Enable()
+	pci.setCommand(0, PCI_COMMAND_INTX_DISABLE)
+	abar := pci.MapBar(AHCI_ABAR)
+	if abar == 0 {
+		log.KErrorLn("[AHCI] Controller without register BAR")
+		return false
+	}
+	if !ahciReset(abar) {
+		log.KErrorLn("[AHCI] Controller reset timed out")
+		return false
+	}
+	capabilities := ahciRead(abar + AHCI_CAP)
+	implemented := ahciRead(abar + AHCI_PI)
+
+	first := numAhciDisks
+	for port := uint8(0); port < AHCI_MAX_PORTS && numAhciDisks < AHCI_MAX_DISKS; port++ {
+		if implemented&(1<<port) == 0 {
+			continue
+		}
+		d := &ahciDisks[numAhciDisks]
+		if d.init(abar, port, capabilities) {
+			numAhciDisks++
+		}
+	}
+
+	irq := pci.IrqLine
+	hasIrq := irq < IRQ_COUNT
+	if hasIrq && ahciIrqs&(1<<irq) == 0 {
+		ahciIrqs |= 1 << irq
+		AddIRQHandler(irq, ahciInterrupt)
+		EnableIRQ(irq)
+	}
+	ahciWrite(abar+AHCI_IS, 0xffffffff)
+	ahciWrite(abar+AHCI_GHC, ahciRead(abar+AHCI_GHC)|AHCI_GHC_IE)
+
+	for i := first; i < numAhciDisks; i++ {
+		d := &ahciDisks[i]
+		d.polling = !hasIrq
+		log.KDebugLn("[AHCI] Disk on port ", d.portNum, ", ", d.numSlots, " slots, NCQ: ", d.ncq)
+		RegisterBlockDevice(ahciNames[i], d)
+	}
+	pci.DriverData = abar
+	return numAhciDisks > first
+}
+
+// Has to run before InitPci
+func InitAhci() {
+	RegisterPciDriver(&ahciDriver)
+}
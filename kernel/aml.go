@@ -0,0 +1,109 @@
+package kernel
+
+import (
+	"unsafe"
+)
+
+// Just enough AML to read sleep type packages like \_S5 from the DSDT. There
+// is no namespace, the definition block is searched for the name.
+
+const (
+	AML_ZERO_OP      = 0x00
+	AML_ONE_OP       = 0x01
+	AML_NAME_OP      = 0x08
+	AML_BYTE_PREFIX  = 0x0a
+	AML_WORD_PREFIX  = 0x0b
+	AML_DWORD_PREFIX = 0x0c
+	AML_QWORD_PREFIX = 0x0e
+	AML_PACKAGE_OP   = 0x12
+	AML_ROOT_CHAR    = '\\'
+	AML_ONES_OP      = 0xff
+)
+
+type amlReader struct {
+	data []byte
+	pos  int
+	ok   bool
+}
+
+func (r *amlReader) next() byte {
+	if r.pos >= len(r.data) {
+		r.ok = false
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+// Little endian integer of n bytes
+func (r *amlReader) bytes(n int) uint64 {
+	var value uint64
+	for i := 0; i < n; i++ {
+		value |= uint64(r.next()) << (8 * i)
+	}
+	return value
+}
+
+// The two top bits of the lead byte are the number of bytes that follow.
+// With following bytes only the low nibble of the lead byte is used.
+func (r *amlReader) pkgLength() int {
+	lead := r.next()
+	count := int(lead >> 6)
+	if count == 0 {
+		return int(lead & 0x3f)
+	}
+	return int(lead&0xf) | int(r.bytes(count))<<4
+}
+
+func (r *amlReader) integer() uint64 {
+	switch op := r.next(); op {
+	case AML_ZERO_OP:
+		return 0
+	case AML_ONE_OP:
+		return 1
+	case AML_ONES_OP:
+		return ^uint64(0)
+	case AML_BYTE_PREFIX:
+		return r.bytes(1)
+	case AML_WORD_PREFIX:
+		return r.bytes(2)
+	case AML_DWORD_PREFIX:
+		return r.bytes(4)
+	case AML_QWORD_PREFIX:
+		return r.bytes(8)
+	default:
+		// Anything else needs a real interpreter
+		r.ok = false
+		return 0
+	}
+}
+
+// Find Name(name, Package() {...}) in the table. The reader is left at the
+// first element and the element count is returned.
+func amlFindPackage(table *acpiHeader, name [4]byte, r *amlReader) int {
+	length := int(table.length) - ACPI_HEADER_SIZE
+	data := unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(table), ACPI_HEADER_SIZE)), length)
+	for i := 0; i+4 < length; i++ {
+		if data[i] != name[0] || data[i+1] != name[1] || data[i+2] != name[2] || data[i+3] != name[3] {
+			continue
+		}
+		// The name has to be defined here, not just used
+		nameOp := i - 1
+		if nameOp >= 0 && data[nameOp] == AML_ROOT_CHAR {
+			nameOp--
+		}
+		if nameOp < 0 || data[nameOp] != AML_NAME_OP || data[i+4] != AML_PACKAGE_OP {
+			continue
+		}
+		r.data = data
+		r.pos = i + 5
+		r.ok = true
+		r.pkgLength()
+		count := int(r.next())
+		if r.ok {
+			return count
+		}
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// ARP for IPv4 over ethernet. Entries are learned from requests for our
+// address and from replies. A packet for an address that is not resolved yet
+// waits in its entry, only the newest one is kept.
+
+const (
+	ETH_P_ARP = 0x0806
+
+	ARP_PACKET_SIZE = 28
+	ARP_HTYPE_ETHER = 1
+	ARP_OP_REQUEST  = 1
+	ARP_OP_REPLY    = 2
+
+	ARP_CACHE_SIZE = 32
+	ARP_TIMEOUT    = 600 * NS_PER_SECOND
+	ARP_RETRY      = NS_PER_SECOND
+)
+
+type arpEntry struct {
+	netif     *NetInterface
+	ip        Ipv4Address
+	mac       MacAddress
+	resolved  bool
+	expires   uint64
+	requested uint64 // Time of the last request, 0 if none was sent
+
+	pending    [ETH_MTU]byte
+	pendingLen int
+}
+
+var (
+	arpCache [ARP_CACHE_SIZE]arpEntry
+	arpTxBuf [ARP_PACKET_SIZE]byte
+)
+
+func arpFind(n *NetInterface, ip Ipv4Address) *arpEntry {
+	now := MonotonicTime()
+	for i := range arpCache {
+		e := &arpCache[i]
+		if e.netif == n && e.ip == ip {
+			if e.resolved && e.expires < now {
+				e.resolved = false
+				e.requested = 0
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// Take a free entry or the one that expires first
+func arpAllocate(n *NetInterface, ip Ipv4Address) *arpEntry {
+	e := &arpCache[0]
+	for i := range arpCache {
+		if arpCache[i].netif == nil {
+			e = &arpCache[i]
+			break
+		}
+		if arpCache[i].expires < e.expires {
+			e = &arpCache[i]
+		}
+	}
+	*e = arpEntry{}
+	e.netif = n
+	e.ip = ip
+	e.expires = MonotonicTime() + ARP_TIMEOUT
+	return e
+}
+
+func arpSend(n *NetInterface, op uint16, dstMac MacAddress, targetMac MacAddress, targetIp Ipv4Address) {
+	p := arpTxBuf[:]
+	putUint16(p[0:], ARP_HTYPE_ETHER)
+	putUint16(p[2:], ETH_P_IP)
+	p[4] = ETH_ALEN
+	p[5] = 4
+	putUint16(p[6:], op)
+	copy(p[8:14], n.Mac[:])
+	copy(p[14:18], n.Ipv4.Address[:])
+	copy(p[18:24], targetMac[:])
+	copy(p[24:28], targetIp[:])
+	n.SendFrame(dstMac, ETH_P_ARP, p)
+}
+
+func arpUpdate(e *arpEntry, mac MacAddress) {
+	e.mac = mac
+	e.resolved = true
+	e.expires = MonotonicTime() + ARP_TIMEOUT
+	if e.pendingLen > 0 {
+		size := e.pendingLen
+		e.pendingLen = 0
+		e.netif.SendFrame(mac, ETH_P_IP, e.pending[:size])
+	}
+}
+
+// Protocol handler for ETH_P_ARP
+func arpInput(n *NetInterface, src MacAddress, data []byte) {
+	if len(data) < ARP_PACKET_SIZE || n.Loopback {
+		return
+	}
+	if getUint16(data[0:]) != ARP_HTYPE_ETHER || getUint16(data[2:]) != ETH_P_IP || data[4] != ETH_ALEN || data[5] != 4 {
+		return
+	}
+	op := getUint16(data[6:])
+	var senderMac MacAddress
+	var senderIp, targetIp Ipv4Address
+	copy(senderMac[:], data[8:14])
+	copy(senderIp[:], data[14:18])
+	copy(targetIp[:], data[24:28])
+
+	e := arpFind(n, senderIp)
+	if e != nil {
+		arpUpdate(e, senderMac)
+	}
+	if !n.Ipv4.Configured || targetIp != n.Ipv4.Address {
+		return
+	}
+	if e == nil && !senderIp.IsAny() {
+		// They will talk to us soon
+		arpUpdate(arpAllocate(n, senderIp), senderMac)
+	}
+	if op == ARP_OP_REQUEST {
+		arpSend(n, ARP_OP_REPLY, senderMac, senderMac, senderIp)
+	}
+}
+
+// Send an IPv4 packet to a host on the link of n
+func arpOutput(n *NetInterface, ip Ipv4Address, packet []byte) syscall.Errno {
+	e := arpFind(n, ip)
+	if e != nil && e.resolved {
+		return n.SendFrame(e.mac, ETH_P_IP, packet)
+	}
+	if e == nil {
+		e = arpAllocate(n, ip)
+	}
+	if len(packet) > len(e.pending) {
+		return syscall.EMSGSIZE
+	}
+	copy(e.pending[:], packet)
+	e.pendingLen = len(packet)
+	now := MonotonicTime()
+	if e.requested == 0 || now-e.requested >= ARP_RETRY {
+		e.requested = now
+		arpSend(n, ARP_OP_REQUEST, MAC_BROADCAST, MacAddress{}, ip)
+	}
+	return ESUCCESS
+}
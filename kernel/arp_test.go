@@ -0,0 +1,124 @@
+package kernel
+
+import (
+	"testing"
+)
+
+func testArpPacket(op uint16, senderMac MacAddress, senderIp Ipv4Address, targetMac MacAddress, targetIp Ipv4Address) []byte {
+	p := make([]byte, ARP_PACKET_SIZE)
+	putUint16(p[0:], ARP_HTYPE_ETHER)
+	putUint16(p[2:], ETH_P_IP)
+	p[4] = ETH_ALEN
+	p[5] = 4
+	putUint16(p[6:], op)
+	copy(p[8:14], senderMac[:])
+	copy(p[14:18], senderIp[:])
+	copy(p[18:24], targetMac[:])
+	copy(p[24:28], targetIp[:])
+	return p
+}
+
+func TestArpReplyToRequest(t *testing.T) {
+	n := netTestSetup(t)
+	var buf [ETH_FRAME_MAX]byte
+	n.Receive(testFrame(buf[:], MAC_BROADCAST, ETH_P_ARP, testArpPacket(ARP_OP_REQUEST, testPeerMac, testPeerIp, MacAddress{}, testIp)))
+
+	if testEth.count != 1 {
+		t.Fatalf("Sent %d frames, want one reply", testEth.count)
+	}
+	frame := testEth.frame(0)
+	if len(frame) != ETH_HEADER_SIZE+ARP_PACKET_SIZE {
+		t.Fatalf("Reply has %d bytes", len(frame))
+	}
+	if MacAddress(frame[0:6]) != testPeerMac || MacAddress(frame[6:12]) != testMac || getUint16(frame[12:]) != ETH_P_ARP {
+		t.Errorf("Bad ethernet header % x", frame[:ETH_HEADER_SIZE])
+	}
+	reply := frame[ETH_HEADER_SIZE:]
+	if getUint16(reply[6:]) != ARP_OP_REPLY {
+		t.Errorf("Op is %d, want reply", getUint16(reply[6:]))
+	}
+	if MacAddress(reply[8:14]) != testMac || Ipv4Address(reply[14:18]) != testIp {
+		t.Errorf("Reply is not from us: % x", reply[8:18])
+	}
+	if MacAddress(reply[18:24]) != testPeerMac || Ipv4Address(reply[24:28]) != testPeerIp {
+		t.Errorf("Reply is not for the requester: % x", reply[18:28])
+	}
+
+	// The requester is learned
+	e := arpFind(n, testPeerIp)
+	if e == nil || !e.resolved || e.mac != testPeerMac {
+		t.Errorf("Requester was not added to the cache: %+v", e)
+	}
+}
+
+func TestArpIgnoresRequestsForOthers(t *testing.T) {
+	n := netTestSetup(t)
+	var buf [ETH_FRAME_MAX]byte
+	n.Receive(testFrame(buf[:], MAC_BROADCAST, ETH_P_ARP, testArpPacket(ARP_OP_REQUEST, testPeerMac, testPeerIp, MacAddress{}, Ipv4Address{10, 0, 2, 99})))
+	if testEth.count != 0 {
+		t.Errorf("Answered a request for another host")
+	}
+	if arpFind(n, testPeerIp) != nil {
+		t.Errorf("Learned a host that did not talk to us")
+	}
+}
+
+func TestArpDropsMalformedPackets(t *testing.T) {
+	n := netTestSetup(t)
+	var buf [ETH_FRAME_MAX]byte
+	good := testArpPacket(ARP_OP_REQUEST, testPeerMac, testPeerIp, MacAddress{}, testIp)
+
+	short := good[:ARP_PACKET_SIZE-1]
+	badHtype := append([]byte{}, good...)
+	putUint16(badHtype[0:], 6)
+	badProto := append([]byte{}, good...)
+	putUint16(badProto[2:], ETH_P_ARP)
+	badLen := append([]byte{}, good...)
+	badLen[4] = 8
+
+	for _, p := range [][]byte{short, badHtype, badProto, badLen} {
+		n.Receive(testFrame(buf[:], MAC_BROADCAST, ETH_P_ARP, p))
+	}
+	if testEth.count != 0 {
+		t.Errorf("Answered %d malformed requests", testEth.count)
+	}
+	if arpFind(n, testPeerIp) != nil {
+		t.Errorf("Learned an address from a malformed packet")
+	}
+}
+
+func TestArpOutputWaitsForReply(t *testing.T) {
+	n := netTestSetup(t)
+	packet := []byte{0x45, 1, 2, 3}
+	if err := arpOutput(n, testPeerIp, packet); err != ESUCCESS {
+		t.Fatalf("arpOutput returned %v", err)
+	}
+	if testEth.count != 1 {
+		t.Fatalf("Sent %d frames, want one request", testEth.count)
+	}
+	request := testEth.frame(0)
+	if MacAddress(request[0:6]) != MAC_BROADCAST || getUint16(request[ETH_HEADER_SIZE+6:]) != ARP_OP_REQUEST ||
+		Ipv4Address(request[ETH_HEADER_SIZE+24:ETH_HEADER_SIZE+28]) != testPeerIp {
+		t.Fatalf("Bad request % x", request)
+	}
+
+	// A second packet does not send another request right away
+	if err := arpOutput(n, testPeerIp, packet); err != ESUCCESS || testEth.count != 1 {
+		t.Fatalf("Sent another request, err %v, frames %d", err, testEth.count)
+	}
+
+	var buf [ETH_FRAME_MAX]byte
+	n.Receive(testFrame(buf[:], testMac, ETH_P_ARP, testArpPacket(ARP_OP_REPLY, testPeerMac, testPeerIp, testMac, testIp)))
+	if testEth.count != 2 {
+		t.Fatalf("Pending packet was not sent after the reply")
+	}
+	frame := testEth.frame(1)
+	if MacAddress(frame[0:6]) != testPeerMac || getUint16(frame[12:]) != ETH_P_IP || string(frame[ETH_HEADER_SIZE:]) != string(packet) {
+		t.Errorf("Bad pending packet % x", frame)
+	}
+
+	// Resolved addresses are sent to directly
+	if err := arpOutput(n, testPeerIp, packet); err != ESUCCESS || testEth.count != 3 {
+		t.Errorf("Packet to a resolved address was not sent, err %v, frames %d", err, testEth.count)
+	}
+}
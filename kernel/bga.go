@@ -0,0 +1,164 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+	"github.com/sanserogames/letsgo-os/kernel/multiboot"
+)
+
+// Bochs Graphics Adapter (the "std" VGA of Bochs and QEMU). The mode is set with
+// the VBE DISPI registers so it also works after the BIOS is gone.
+
+const (
+	BGA_PCI_VENDOR = 0x1234
+	BGA_PCI_DEVICE = 0x1111
+
+	VBE_DISPI_IOPORT_INDEX uint16 = 0x01CE
+	VBE_DISPI_IOPORT_DATA  uint16 = 0x01CF
+
+	VBE_DISPI_INDEX_ID               = 0x0
+	VBE_DISPI_INDEX_XRES             = 0x1
+	VBE_DISPI_INDEX_YRES             = 0x2
+	VBE_DISPI_INDEX_BPP              = 0x3
+	VBE_DISPI_INDEX_ENABLE           = 0x4
+	VBE_DISPI_INDEX_BANK             = 0x5
+	VBE_DISPI_INDEX_VIRT_WIDTH       = 0x6
+	VBE_DISPI_INDEX_VIRT_HEIGHT      = 0x7
+	VBE_DISPI_INDEX_X_OFFSET         = 0x8
+	VBE_DISPI_INDEX_Y_OFFSET         = 0x9
+	VBE_DISPI_INDEX_VIDEO_MEMORY_64K = 0xA
+
+	VBE_DISPI_ID0 = 0xB0C0
+	VBE_DISPI_ID5 = 0xB0C5
+
+	VBE_DISPI_DISABLED    = 0x00
+	VBE_DISPI_ENABLED     = 0x01
+	VBE_DISPI_GETCAPS     = 0x02
+	VBE_DISPI_LFB_ENABLED = 0x40
+	VBE_DISPI_NOCLEARMEM  = 0x80
+
+	BGA_DEFAULT_WIDTH  = 1024
+	BGA_DEFAULT_HEIGHT = 768
+	BGA_DEFAULT_BPP    = 32
+
+	BGA_DEFAULT_VRAM = 4 << 20 // Older versions don't report the memory size
+)
+
+var (
+	bgaDriver = PciDriver{
+		Name:    "bga",
+		Matches: []PciMatch{{Vendor: BGA_PCI_VENDOR, Device: BGA_PCI_DEVICE, Class: PCI_ANY_CLASS}},
+		Probe:   bgaProbe,
+	}
+
+	bgaVramSize  uintptr
+	bgaMaxWidth  uint32
+	bgaMaxHeight uint32
+	bgaMaxBpp    uint32
+)
+
+func bgaWrite(index uint16, value uint16) {
+	Outw(VBE_DISPI_IOPORT_INDEX, index)
+	Outw(VBE_DISPI_IOPORT_DATA, value)
+}
+
+func bgaRead(index uint16) uint16 {
+	Outw(VBE_DISPI_IOPORT_INDEX, index)
+	return Inw(VBE_DISPI_IOPORT_DATA)
+}
+
+func bgaSetMode(width uint32, height uint32, bpp uint32) syscall.Errno {
+	switch bpp {
+	case 15, 16, 24, 32:
+	default:
+		return syscall.EINVAL
+	}
+	if width == 0 || height == 0 || width > bgaMaxWidth || height > bgaMaxHeight || bpp > bgaMaxBpp {
+		return syscall.EINVAL
+	}
+	pitch := width * ((bpp + 7) / 8)
+	if uintptr(pitch)*uintptr(height) > bgaVramSize {
+		return syscall.EINVAL
+	}
+
+	bgaWrite(VBE_DISPI_INDEX_ENABLE, VBE_DISPI_DISABLED)
+	bgaWrite(VBE_DISPI_INDEX_XRES, uint16(width))
+	bgaWrite(VBE_DISPI_INDEX_YRES, uint16(height))
+	bgaWrite(VBE_DISPI_INDEX_BPP, uint16(bpp))
+	bgaWrite(VBE_DISPI_INDEX_VIRT_WIDTH, uint16(width))
+	bgaWrite(VBE_DISPI_INDEX_X_OFFSET, 0)
+	bgaWrite(VBE_DISPI_INDEX_Y_OFFSET, 0)
+	bgaWrite(VBE_DISPI_INDEX_ENABLE, VBE_DISPI_ENABLED|VBE_DISPI_LFB_ENABLED)
+
+	fbDevice.Width = width
+	fbDevice.Height = height
+	fbDevice.Bpp = bpp
+	fbDevice.Pitch = pitch
+	switch bpp {
+	case 32, 24:
+		fbDevice.red = newFbBitfield(16, 8)
+		fbDevice.green = newFbBitfield(8, 8)
+		fbDevice.blue = newFbBitfield(0, 8)
+	case 16:
+		fbDevice.red = newFbBitfield(11, 5)
+		fbDevice.green = newFbBitfield(5, 6)
+		fbDevice.blue = newFbBitfield(0, 5)
+	case 15:
+		fbDevice.red = newFbBitfield(10, 5)
+		fbDevice.green = newFbBitfield(5, 5)
+		fbDevice.blue = newFbBitfield(0, 5)
+	}
+	log.KDebugLn("[BGA] Mode set to ", width, "x", height, "x", bpp)
+
+	fbConsoleModeChanged()
+	return ESUCCESS
+}
+
+func bgaProbe(dev *PciDevice) bool {
+	id := bgaRead(VBE_DISPI_INDEX_ID)
+	if id < VBE_DISPI_ID0 || id > VBE_DISPI_ID5 {
+		log.KDebugLn("[BGA] Unsupported version ", uintptr(id))
+		return false
+	}
+
+	lfb := dev.Bars[0].Base
+	bgaVramSize = uintptr(bgaRead(VBE_DISPI_INDEX_VIDEO_MEMORY_64K)) * (64 << 10)
+	if bgaVramSize == 0 {
+		bgaVramSize = BGA_DEFAULT_VRAM
+	}
+
+	// Read the maximum values instead of the current ones
+	bgaWrite(VBE_DISPI_INDEX_ENABLE, VBE_DISPI_GETCAPS)
+	bgaMaxWidth = uint32(bgaRead(VBE_DISPI_INDEX_XRES))
+	bgaMaxHeight = uint32(bgaRead(VBE_DISPI_INDEX_YRES))
+	bgaMaxBpp = uint32(bgaRead(VBE_DISPI_INDEX_BPP))
+	bgaWrite(VBE_DISPI_INDEX_ENABLE, VBE_DISPI_DISABLED)
+
+	for i := uintptr(0); i < bgaVramSize; i += PAGE_SIZE {
+		mm.KernelMemSpace.MapPage(lfb+i, lfb+i, mm.PAGE_RW|mm.PAGE_PERM_KERNEL|mm.PAGE_WRITETHROUGH)
+	}
+
+	// The font can only be read as long as the VGA is still in text mode
+	if BootFramebuffer.MultibootTag.Type != 8 || BootFramebuffer.FramebufferType == multiboot.FRAMEBUFFER_TYPE_EGA_TEXT {
+		LoadVGAFont()
+	}
+
+	fbDevice.PhysAddr = lfb
+	fbDevice.id = [16]byte{}
+	copy(fbDevice.id[:], "bochs-bga")
+	fbDevice.setMode = bgaSetMode
+	if err := bgaSetMode(BGA_DEFAULT_WIDTH, BGA_DEFAULT_HEIGHT, BGA_DEFAULT_BPP); err != ESUCCESS {
+		log.KErrorLn("[BGA] Could not set default mode")
+		return false
+	}
+	log.KDebugLn("[BGA] ", bgaMaxWidth, "x", bgaMaxHeight, "x", bgaMaxBpp, " max, ", bgaVramSize>>10, "K video memory at ", lfb)
+	fbDevice.register()
+	return true
+}
+
+// Needs paging to be set up, since the video memory gets mapped into the kernel space
+func InitBGA() {
+	RegisterPciDriver(&bgaDriver)
+}
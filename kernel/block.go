@@ -0,0 +1,63 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Disks by name. Addresses and counts are in BLOCK_SECTOR_SIZE sectors.
+// Buffers have to be in kernel memory, drivers may hand them to the device
+// for DMA.
+
+const (
+	BLOCK_SECTOR_SIZE = 512
+	BLOCK_MAX_DEVICES = 8
+)
+
+type BlockDevice interface {
+	// Size of the disk in sectors
+	Sectors() uint64
+	ReadSectors(address int, count uint8, buffer []byte) syscall.Errno
+	WriteSectors(address int, count uint8, buffer []byte) syscall.Errno
+}
+
+type blockDeviceEntry struct {
+	name string
+	dev  BlockDevice
+}
+
+var (
+	blockDevices    [BLOCK_MAX_DEVICES]blockDeviceEntry
+	numBlockDevices = 0
+)
+
+func RegisterBlockDevice(name string, dev BlockDevice) {
+	if numBlockDevices == len(blockDevices) {
+		log.KErrorLn("[BLOCK] Too many block devices, ignoring ", name)
+		return
+	}
+	blockDevices[numBlockDevices] = blockDeviceEntry{name: name, dev: dev}
+	numBlockDevices++
+	log.KDebugLn("[BLOCK] ", name, ": ", dev.Sectors()/2, " KiB")
+}
+
+func FindBlockDevice(name string) BlockDevice {
+	for i := 0; i < numBlockDevices; i++ {
+		if blockDevices[i].name == name {
+			return blockDevices[i].dev
+		}
+	}
+	return nil
+}
+
+// Common argument check for the drivers
+func blockCheckRequest(sectors uint64, address int, count uint8, buffer []byte) syscall.Errno {
+	if address < 0 || uint64(address)+uint64(count) > sectors {
+		return syscall.EINVAL
+	}
+	if int(count)*BLOCK_SECTOR_SIZE > len(buffer) {
+		return syscall.EINVAL
+	}
+	return ESUCCESS
+}
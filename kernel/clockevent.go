@@ -0,0 +1,74 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Clock event devices raise a timer interrupt once after a delay. Every CPU has
+// one: the application processors use their local APIC timer, the boot CPU the
+// best device it has.
+//
+// The scheduler tick is a timer like any other. It only runs while the CPU
+// executes a thread, an idle CPU sleeps until the next timer or interrupt.
+
+const (
+	// Shorter deltas are rounded up so the interrupt does not arrive before the device is set up
+	CLOCKEVENT_MIN_DELTA = 1000 // ns
+)
+
+type ClockEventDevice interface {
+	Name() string
+	// Longest delta in ns that can be programmed
+	MaxDelta() uint64
+	// Raise one interrupt after delta ns, replaces the previous event
+	SetNextEvent(delta uint64)
+	Stop()
+}
+
+func schedTimerTick(timer *HrTimer) {
+	schedTick(CurrentThread)
+	PerformSchedule = true
+	next := timer.Deadline + SCHED_TICK_NS
+	if now := MonotonicTime(); next <= now {
+		// Missed ticks are not made up
+		next = now + SCHED_TICK_NS
+	}
+	StartHrTimer(timer, next)
+}
+
+// Start the tick when the CPU runs a thread
+func tickStart() {
+	cpu := thisCpu
+	if cpu.clockEvent != nil && !cpu.tickTimer.IsActive() {
+		StartHrTimer(&cpu.tickTimer, MonotonicTime()+SCHED_TICK_NS)
+	}
+}
+
+// Stop the tick when the CPU goes idle
+func tickStop() {
+	CancelHrTimer(&thisCpu.tickTimer)
+	hrtimerReprogram(thisCpu)
+}
+
+// Use dev for the timers of the current CPU
+func setClockEvent(dev ClockEventDevice) {
+	cpu := thisCpu
+	cpu.clockEvent = dev
+	cpu.tickTimer.Callback = schedTimerTick
+	log.KDebugLn("[CLOCKEVENT] CPU ", cpu.Index, " uses the ", dev.Name())
+	tickStart()
+	hrtimerReprogram(cpu)
+}
+
+// Needs the local APIC and the HPET to be initialized
+func InitClockEvents() {
+	switch {
+	case lapicTimerPerSecond != 0:
+		setClockEvent(&lapicTimer)
+	case hpetStartClockEvent():
+		setClockEvent(&hpetTimer)
+	default:
+		pitStartClockEvent()
+		setClockEvent(&pitTimer)
+	}
+}
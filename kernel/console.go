@@ -0,0 +1,57 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Console that is used as stdin, stdout and stderr of every program.
+// Input is read from the serial device and output goes to the kernel log writers.
+type consoleFile struct {
+	FileBase
+	isError bool
+}
+
+var (
+	consoleIn  = consoleFile{}
+	consoleOut = consoleFile{}
+	consoleErr = consoleFile{isError: true}
+)
+
+func (c *consoleFile) Read(buf []byte) (int, syscall.Errno) {
+	num := 0
+	// I don't use keyboard anymore, since I have serial.
+	for num == 0 && len(buf) > 0 {
+		SerialDevice.WaitForData()
+
+		for SerialDevice.HasReceivedData() && num < len(buf) {
+			buf[num] = SerialDevice.Read()
+			num++
+		}
+	}
+	return num, ESUCCESS
+}
+
+func (c *consoleFile) Poll(pt *PollTable) uint32 {
+	pt.Wait(&serialInputQueue)
+	events := uint32(POLLOUT | POLLWRNORM)
+	if SerialDevice.HasReceivedData() {
+		events |= POLLIN | POLLRDNORM
+	}
+	return events
+}
+
+func (c *consoleFile) Write(buf []byte) (int, syscall.Errno) {
+	if len(buf) == 0 {
+		return 0, ESUCCESS
+	}
+	s := unsafe.String(&buf[0], len(buf))
+	if c.isError {
+		log.KError(s)
+	} else {
+		log.KPrint(s)
+	}
+	return len(buf), ESUCCESS
+}
@@ -2,8 +2,36 @@ package kernel
 
 func Inb(port uint16) uint8
 func Inw(port uint16) uint16
+func Inl(port uint16) uint32
 
 func Outb(port uint16, value uint8)
 func Outw(port uint16, value uint16)
+func Outl(port uint16, value uint32)
 
 func Hlt()
+
+// Time stamp counter
+func Rdtsc() uint64
+
+const (
+	CPUID_FEATURES     = 1
+	CPUID_FEATURE_APIC = 1 << 9 // edx
+)
+
+func Rdmsr(msr uint32) uint64
+
+func Cpuid(leaf uint32) (eax, ebx, ecx, edx uint32)
+
+// Spin loop hint
+func Pause()
+
+// Full memory barrier, orders stores before later loads as well
+func Mfence()
+
+// Atomically swap the value at addr and return the old one
+func xchg(addr *uint32, value uint32) uint32
+
+func hasCpuFeature(edxFlag uint32) bool {
+	_, _, _, edx := Cpuid(CPUID_FEATURES)
+	return edx&edxFlag != 0
+}
@@ -12,6 +12,12 @@ TEXT ·Inw(SB),NOSPLIT,$0-6
     MOVW AX, ret+4(FP)
     RET
 
+TEXT ·Inl(SB),NOSPLIT,$0-8
+    MOVW port+0(FP), DX
+    INL
+    MOVL AX, ret+4(FP)
+    RET
+
 TEXT ·Outb(SB),NOSPLIT,$0
     MOVW port+0(FP), DX
     MOVB value+2(FP), AX
@@ -24,6 +30,50 @@ TEXT ·Outw(SB),NOSPLIT,$0
     OUTW
     RET
 
+TEXT ·Outl(SB),NOSPLIT,$0
+    MOVW port+0(FP), DX
+    MOVL value+4(FP), AX
+    OUTL
+    RET
+
 TEXT ·Hlt(SB),NOSPLIT,$0
     HLT
     RET
+
+TEXT ·Rdtsc(SB),NOSPLIT,$0-8
+    RDTSC
+    MOVL AX, ret_lo+0(FP)
+    MOVL DX, ret_hi+4(FP)
+    RET
+
+TEXT ·Rdmsr(SB),NOSPLIT,$0-12
+    MOVL msr+0(FP), CX
+    RDMSR
+    MOVL AX, ret_lo+4(FP)
+    MOVL DX, ret_hi+8(FP)
+    RET
+
+TEXT ·Cpuid(SB),NOSPLIT,$0-20
+    MOVL leaf+0(FP), AX
+    MOVL $0, CX
+    CPUID
+    MOVL AX, eax+4(FP)
+    MOVL BX, ebx+8(FP)
+    MOVL CX, ecx+12(FP)
+    MOVL DX, edx+16(FP)
+    RET
+
+TEXT ·Pause(SB),NOSPLIT,$0
+    PAUSE
+    RET
+
+TEXT ·Mfence(SB),NOSPLIT,$0
+    MFENCE
+    RET
+
+TEXT ·xchg(SB),NOSPLIT,$0-12
+    MOVL addr+0(FP), BX
+    MOVL value+4(FP), AX
+    XCHGL AX, 0(BX)
+    MOVL AX, ret+8(FP)
+    RET
@@ -0,0 +1,85 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Open a device file. Devices are usually singletons, so open mostly
+// returns a pointer to a global variable.
+type DeviceOpenFunc func() (File, syscall.Errno)
+
+// Called when a device file registered with RegisterDeviceFile is opened
+type DeviceFileOpenFunc func(f File) syscall.Errno
+
+type deviceEntry struct {
+	path string
+	open DeviceOpenFunc
+	// Opened without an open function
+	file     File
+	openFile DeviceFileOpenFunc
+}
+
+var (
+	devices    [32]deviceEntry
+	numDevices = 0
+
+	nullDev nullDevice
+)
+
+func RegisterDevice(path string, open DeviceOpenFunc) {
+	if numDevices == len(devices) {
+		kernelPanic("Too many devices registered")
+	}
+	if ENABLE_DEBUG {
+		log.KDebugLn("Registered device ", path)
+	}
+	devices[numDevices] = deviceEntry{path: path, open: open}
+	numDevices++
+}
+
+// For devices of which there can be several, so no open function per device is needed.
+// open may be nil.
+func RegisterDeviceFile(path string, f File, open DeviceFileOpenFunc) {
+	RegisterDevice(path, nil)
+	devices[numDevices-1].file = f
+	devices[numDevices-1].openFile = open
+}
+
+func OpenDevice(path string) (File, syscall.Errno) {
+	for i := 0; i < numDevices; i++ {
+		if devices[i].path == path {
+			if devices[i].open == nil {
+				if devices[i].openFile != nil {
+					if err := devices[i].openFile(devices[i].file); err != ESUCCESS {
+						return nil, err
+					}
+				}
+				return devices[i].file, ESUCCESS
+			}
+			return devices[i].open()
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+type nullDevice struct {
+	FileBase
+}
+
+func (d *nullDevice) Read(buf []byte) (int, syscall.Errno) {
+	return 0, ESUCCESS
+}
+
+func (d *nullDevice) Write(buf []byte) (int, syscall.Errno) {
+	return len(buf), ESUCCESS
+}
+
+func openNullDevice() (File, syscall.Errno) {
+	return &nullDev, ESUCCESS
+}
+
+func InitDevices() {
+	RegisterDevice("/dev/null", openNullDevice)
+}
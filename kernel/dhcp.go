@@ -0,0 +1,268 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Minimal DHCP client. It gets an address, netmask and router and renews the
+// lease at half time. All messages are broadcast, so it works before the
+// interface has an address and without ARP.
+
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+
+	DHCP_OP_REQUEST     = 1
+	DHCP_OP_REPLY       = 2
+	DHCP_FLAG_BROADCAST = 0x8000
+	DHCP_MAGIC          = 0x63825363
+
+	// BOOTP fixed part, the options follow the magic cookie
+	DHCP_OFFSET_XID     = 4
+	DHCP_OFFSET_FLAGS   = 10
+	DHCP_OFFSET_CIADDR  = 12
+	DHCP_OFFSET_YIADDR  = 16
+	DHCP_OFFSET_CHADDR  = 28
+	DHCP_OFFSET_MAGIC   = 236
+	DHCP_OFFSET_OPTIONS = 240
+	DHCP_MESSAGE_SIZE   = 300 // BOOTP minimum
+
+	DHCP_OPT_PAD          = 0
+	DHCP_OPT_NETMASK      = 1
+	DHCP_OPT_ROUTER       = 3
+	DHCP_OPT_REQUESTED_IP = 50
+	DHCP_OPT_LEASE_TIME   = 51
+	DHCP_OPT_MESSAGE_TYPE = 53
+	DHCP_OPT_SERVER_ID    = 54
+	DHCP_OPT_PARAMS       = 55
+	DHCP_OPT_END          = 255
+
+	DHCP_DISCOVER = 1
+	DHCP_OFFER    = 2
+	DHCP_REQUEST  = 3
+	DHCP_ACK      = 5
+	DHCP_NAK      = 6
+
+	DHCP_RETRY         = 4 * NS_PER_SECOND
+	DHCP_REQUEST_TRIES = 4
+	DHCP_DEFAULT_LEASE = 3600
+)
+
+const (
+	DHCP_STATE_OFF = iota
+	DHCP_STATE_SELECTING
+	DHCP_STATE_REQUESTING
+	DHCP_STATE_BOUND
+	DHCP_STATE_RENEWING
+)
+
+type dhcpClient struct {
+	netif   *NetInterface
+	state   int
+	xid     uint32
+	tries   int
+	offered Ipv4Address
+	server  Ipv4Address
+	// Monotonic time the lease runs out, 0 for infinite leases
+	leaseEnd uint64
+	timer    HrTimer
+}
+
+var (
+	dhcpClients  [NETIF_MAX]dhcpClient
+	dhcpEndpoint udpEndpoint
+	dhcpTxBuf    [DHCP_MESSAGE_SIZE]byte
+)
+
+func dhcpFindClient(n *NetInterface) *dhcpClient {
+	for i := range dhcpClients {
+		if dhcpClients[i].netif == n {
+			return &dhcpClients[i]
+		}
+	}
+	return nil
+}
+
+// Start configuring n with DHCP
+func StartDhcp(n *NetInterface) {
+	if !dhcpEndpoint.bound {
+		dhcpEndpoint.receive = dhcpReceive
+		if udpBind(&dhcpEndpoint, IPV4_ANY, DHCP_CLIENT_PORT) != ESUCCESS {
+			log.KErrorLn("[DHCP] Port in use")
+			return
+		}
+	}
+	c := dhcpFindClient(n)
+	for i := 0; c == nil && i < len(dhcpClients); i++ {
+		if dhcpClients[i].netif == nil {
+			c = &dhcpClients[i]
+			c.netif = n
+			c.timer.Callback = dhcpTimeout
+			c.timer.Arg = uintptr(i)
+		}
+	}
+	if c == nil {
+		return
+	}
+	log.KDebugLn("[DHCP] ", n.Name, ": Discovering")
+	dhcpDiscover(c)
+}
+
+func dhcpDiscover(c *dhcpClient) {
+	// No random numbers, the MAC and the time make different clients differ
+	mac := c.netif.Mac
+	c.xid = getUint32(mac[2:]) ^ uint32(MonotonicTime())
+	c.state = DHCP_STATE_SELECTING
+	c.tries = 0
+	dhcpSend(c, DHCP_DISCOVER)
+	StartHrTimer(&c.timer, MonotonicTime()+DHCP_RETRY)
+}
+
+func dhcpRequest(c *dhcpClient, state int) {
+	c.state = state
+	c.tries = 0
+	dhcpSend(c, DHCP_REQUEST)
+	StartHrTimer(&c.timer, MonotonicTime()+DHCP_RETRY)
+}
+
+func dhcpSend(c *dhcpClient, msgType uint8) {
+	n := c.netif
+	msg := dhcpTxBuf[:]
+	for i := range msg {
+		msg[i] = 0
+	}
+	msg[0] = DHCP_OP_REQUEST
+	msg[1] = ARP_HTYPE_ETHER
+	msg[2] = ETH_ALEN
+	putUint32(msg[DHCP_OFFSET_XID:], c.xid)
+	putUint16(msg[DHCP_OFFSET_FLAGS:], DHCP_FLAG_BROADCAST)
+	copy(msg[DHCP_OFFSET_CHADDR:], n.Mac[:])
+	putUint32(msg[DHCP_OFFSET_MAGIC:], DHCP_MAGIC)
+
+	o := msg[DHCP_OFFSET_OPTIONS:]
+	o[0], o[1], o[2] = DHCP_OPT_MESSAGE_TYPE, 1, msgType
+	o = o[3:]
+	if msgType == DHCP_REQUEST {
+		if c.state == DHCP_STATE_RENEWING {
+			copy(msg[DHCP_OFFSET_CIADDR:], n.Ipv4.Address[:])
+		} else {
+			o[0], o[1] = DHCP_OPT_REQUESTED_IP, 4
+			copy(o[2:6], c.offered[:])
+			o[6], o[7] = DHCP_OPT_SERVER_ID, 4
+			copy(o[8:12], c.server[:])
+			o = o[12:]
+		}
+	}
+	o[0], o[1], o[2], o[3] = DHCP_OPT_PARAMS, 2, DHCP_OPT_NETMASK, DHCP_OPT_ROUTER
+	o[4] = DHCP_OPT_END
+
+	r := ipv4Route{netif: n, nextHop: IPV4_BROADCAST}
+	if c.state == DHCP_STATE_RENEWING {
+		r.src = n.Ipv4.Address
+	}
+	udpSendRoute(&dhcpEndpoint, &r, IPV4_BROADCAST, DHCP_SERVER_PORT, msg)
+}
+
+func dhcpTimeout(t *HrTimer) {
+	c := &dhcpClients[t.Arg]
+	now := MonotonicTime()
+	switch c.state {
+	case DHCP_STATE_SELECTING:
+		dhcpSend(c, DHCP_DISCOVER)
+	case DHCP_STATE_REQUESTING:
+		c.tries++
+		if c.tries == DHCP_REQUEST_TRIES {
+			dhcpDiscover(c)
+			return
+		}
+		dhcpSend(c, DHCP_REQUEST)
+	case DHCP_STATE_BOUND:
+		log.KDebugLn("[DHCP] ", c.netif.Name, ": Renewing")
+		dhcpRequest(c, DHCP_STATE_RENEWING)
+		return
+	case DHCP_STATE_RENEWING:
+		if now >= c.leaseEnd {
+			log.KDebugLn("[DHCP] ", c.netif.Name, ": Lease expired")
+			ClearIpv4Config(c.netif)
+			dhcpDiscover(c)
+			return
+		}
+		dhcpSend(c, DHCP_REQUEST)
+	default:
+		return
+	}
+	StartHrTimer(&c.timer, now+DHCP_RETRY)
+}
+
+func dhcpBound(c *dhcpClient, address, netmask, router Ipv4Address, lease uint32) {
+	now := MonotonicTime()
+	if c.state != DHCP_STATE_RENEWING || c.netif.Ipv4.Address != address {
+		SetIpv4Config(c.netif, address, netmask, router)
+	}
+	c.state = DHCP_STATE_BOUND
+	if lease == 0xffffffff {
+		c.leaseEnd = 0
+		CancelHrTimer(&c.timer)
+		return
+	}
+	c.leaseEnd = now + uint64(lease)*NS_PER_SECOND
+	StartHrTimer(&c.timer, now+uint64(lease)*NS_PER_SECOND/2)
+}
+
+func dhcpReceive(e *udpEndpoint, pkt *ipv4Packet, srcPort uint16, data []byte) {
+	c := dhcpFindClient(pkt.netif)
+	if c == nil || c.state == DHCP_STATE_OFF || srcPort != DHCP_SERVER_PORT {
+		return
+	}
+	if len(data) < DHCP_OFFSET_OPTIONS || data[0] != DHCP_OP_REPLY || getUint32(data[DHCP_OFFSET_XID:]) != c.xid ||
+		getUint32(data[DHCP_OFFSET_MAGIC:]) != DHCP_MAGIC {
+		return
+	}
+	var yiaddr, netmask, router, server Ipv4Address
+	copy(yiaddr[:], data[DHCP_OFFSET_YIADDR:])
+	msgType := uint8(0)
+	lease := uint32(DHCP_DEFAULT_LEASE)
+	for o := data[DHCP_OFFSET_OPTIONS:]; len(o) > 0 && o[0] != DHCP_OPT_END; {
+		if o[0] == DHCP_OPT_PAD {
+			o = o[1:]
+			continue
+		}
+		if len(o) < 2 || len(o) < 2+int(o[1]) {
+			return
+		}
+		value := o[2 : 2+o[1]]
+		switch o[0] {
+		case DHCP_OPT_MESSAGE_TYPE:
+			if len(value) == 1 {
+				msgType = value[0]
+			}
+		case DHCP_OPT_NETMASK:
+			copy(netmask[:], value)
+		case DHCP_OPT_ROUTER:
+			copy(router[:], value) // The first one
+		case DHCP_OPT_SERVER_ID:
+			copy(server[:], value)
+		case DHCP_OPT_LEASE_TIME:
+			if len(value) == 4 {
+				lease = getUint32(value)
+			}
+		}
+		o = o[2+len(value):]
+	}
+
+	switch {
+	case msgType == DHCP_OFFER && c.state == DHCP_STATE_SELECTING:
+		c.offered = yiaddr
+		c.server = server
+		dhcpRequest(c, DHCP_STATE_REQUESTING)
+	case msgType == DHCP_ACK && (c.state == DHCP_STATE_REQUESTING || c.state == DHCP_STATE_RENEWING):
+		if netmask.IsAny() {
+			netmask = Ipv4Address{255, 255, 255, 0}
+		}
+		dhcpBound(c, yiaddr, netmask, router, lease)
+	case msgType == DHCP_NAK && (c.state == DHCP_STATE_REQUESTING || c.state == DHCP_STATE_RENEWING):
+		log.KDebugLn("[DHCP] ", c.netif.Name, ": Refused")
+		ClearIpv4Config(c.netif)
+		dhcpDiscover(c)
+	}
+}
@@ -0,0 +1,34 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Memory for device rings and tables that has to be physically contiguous.
+// AllocPage only hands out single pages, so this comes from a region in the
+// kernel image instead. The image is identity mapped, the returned address is
+// both the virtual and the physical one. Nothing is ever freed.
+
+const (
+	DMA_REGION_SIZE = 128 * PAGE_SIZE
+)
+
+var (
+	dmaRegion [DMA_REGION_SIZE]byte
+	dmaUsed   uintptr
+)
+
+// Zeroed memory aligned to align (a power of two) or 0 if the region is used up
+func dmaAlloc(size uintptr, align uintptr) uintptr {
+	base := uintptr(unsafe.Pointer(&dmaRegion))
+	start := (base + dmaUsed + align - 1) &^ (align - 1)
+	if start+size > base+DMA_REGION_SIZE {
+		log.KErrorLn("[DMA] Out of memory for ", size, " bytes")
+		return 0
+	}
+	dmaUsed = start + size - base
+	clear(unsafe.Slice((*byte)(unsafe.Pointer(start)), size))
+	return start
+}
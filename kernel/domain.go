@@ -8,16 +8,26 @@ type Domain struct {
 	next *Domain
 
 	Pid        uint32
+	ParentPid  uint32 // NO_PARENT for programs started by the kernel
 	numThreads uint32
 	nextTid    uint32
 
 	Segments    SegmentList
 	MemorySpace mm.MemSpace
+	Files       FileTable
 
 	runningThreads threadList
 	blockedThreads threadList
 
 	ProgramName string
+
+	// Set while the domain is torn down, its threads are not scheduled anymore
+	exiting bool
+
+	// Usage of all threads, including the ones that exited
+	Usage Rusage
+	// Usage of exited child processes that were waited for
+	ChildUsage Rusage
 }
 
 func (d *Domain) AddThread(t *Thread) {
@@ -28,6 +38,8 @@ func (d *Domain) AddThread(t *Thread) {
 	t.Tid = d.nextTid
 	d.nextTid++
 	d.numThreads++
+	t.accountStamp = MonotonicTime()
+	schedNewThread(t)
 }
 
 func (d *Domain) RemoveThread(t *Thread) {
@@ -38,14 +50,65 @@ func (d *Domain) RemoveThread(t *Thread) {
 		d.blockedThreads.Dequeue(t)
 	} else {
 		d.runningThreads.Dequeue(t)
+		rqDequeue(t)
 	}
 	t.isRemoved = true
 	d.numThreads--
 }
 
+func (d *Domain) FindThread(tid uint32) *Thread {
+	var found *Thread
+	d.ForEachThread(func(t *Thread) bool {
+		if t.Tid == tid {
+			found = t
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func forEachInList(l *threadList, f func(t *Thread) bool) bool {
+	start := l.thread
+	if start == nil {
+		return true
+	}
+	cur := start
+	for {
+		next := cur.Next
+		if !f(cur) {
+			return false
+		}
+		cur = next
+		if cur == start {
+			return true
+		}
+	}
+}
+
+// Calls f for every running and blocked thread of the domain until f returns false
+func (d *Domain) ForEachThread(f func(t *Thread) bool) bool {
+	return forEachInList(&d.runningThreads, f) && forEachInList(&d.blockedThreads, f)
+}
+
+// Calls f for every domain until f returns false
+func ForEachDomain(f func(d *Domain) bool) {
+	d := allDomains.head
+	if d == nil {
+		return
+	}
+	for f(d) {
+		d = d.next
+		if d == allDomains.head {
+			return
+		}
+	}
+}
+
 type domainList struct {
-	head *Domain
-	tail *Domain
+	head  *Domain
+	tail  *Domain
+	count int
 }
 
 func (l *domainList) Append(domain *Domain) {
@@ -63,9 +126,11 @@ func (l *domainList) Append(domain *Domain) {
 	}
 	domain.Pid = largestPid
 	largestPid++
+	l.count++
 }
 
 func (l *domainList) Remove(d *Domain) {
+	l.count--
 	if d == l.head {
 		if d == l.tail {
 			l.head = nil
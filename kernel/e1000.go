@@ -0,0 +1,330 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Intel 8254x gigabit ethernet (e1000), the default network card of QEMU.
+// Received frames are passed to the network interface from the interrupt,
+// transmitting only queues the frame and never waits.
+
+const (
+	E1000_PCI_VENDOR = 0x8086
+	E1000_82540EM    = 0x100e
+	E1000_82545EM    = 0x100f
+	E1000_82545EM_F  = 0x1011
+	E1000_82543GC    = 0x1004
+
+	E1000_CTRL   = 0x0000
+	E1000_STATUS = 0x0008
+	E1000_EERD   = 0x0014
+	E1000_ICR    = 0x00c0
+	E1000_IMS    = 0x00d0
+	E1000_IMC    = 0x00d8
+	E1000_RCTL   = 0x0100
+	E1000_TCTL   = 0x0400
+	E1000_TIPG   = 0x0410
+	E1000_RDBAL  = 0x2800
+	E1000_RDBAH  = 0x2804
+	E1000_RDLEN  = 0x2808
+	E1000_RDH    = 0x2810
+	E1000_RDT    = 0x2818
+	E1000_TDBAL  = 0x3800
+	E1000_TDBAH  = 0x3804
+	E1000_TDLEN  = 0x3808
+	E1000_TDH    = 0x3810
+	E1000_TDT    = 0x3818
+	E1000_MTA    = 0x5200
+	E1000_RAL0   = 0x5400
+	E1000_RAH0   = 0x5404
+
+	E1000_MTA_SIZE = 128
+
+	E1000_CTRL_ASDE = 1 << 5
+	E1000_CTRL_SLU  = 1 << 6
+	E1000_CTRL_RST  = 1 << 26
+
+	E1000_STATUS_LU = 1 << 1
+
+	E1000_EERD_START      = 1 << 0
+	E1000_EERD_DONE       = 1 << 4
+	E1000_EERD_ADDR_SHIFT = 8
+	E1000_EERD_DATA_SHIFT = 16
+
+	E1000_RAH_AV = 1 << 31
+
+	E1000_ICR_LSC    = 1 << 2
+	E1000_ICR_RXSEQ  = 1 << 3
+	E1000_ICR_RXDMT0 = 1 << 4
+	E1000_ICR_RXO    = 1 << 6
+	E1000_ICR_RXT0   = 1 << 7
+
+	E1000_RCTL_EN         = 1 << 1
+	E1000_RCTL_BAM        = 1 << 15
+	E1000_RCTL_BSIZE_2048 = 0 << 16
+	E1000_RCTL_SECRC      = 1 << 26
+
+	E1000_TCTL_EN         = 1 << 1
+	E1000_TCTL_PSP        = 1 << 3
+	E1000_TCTL_CT_SHIFT   = 4
+	E1000_TCTL_COLD_SHIFT = 12
+	E1000_TIPG_DEFAULT    = 10 | 8<<10 | 6<<20
+
+	E1000_RXD_STAT_DD  = 1 << 0
+	E1000_RXD_STAT_EOP = 1 << 1
+
+	E1000_TXD_CMD_EOP  = 1 << 0
+	E1000_TXD_CMD_IFCS = 1 << 1
+	E1000_TXD_CMD_RS   = 1 << 3
+	E1000_TXD_STAT_DD  = 1 << 0
+
+	E1000_NUM_RX_DESC = 32
+	E1000_NUM_TX_DESC = 16
+	E1000_BUF_SIZE    = 2048
+
+	E1000_RESET_TIMEOUT  = 10000000 // ns
+	E1000_EEPROM_TIMEOUT = 10000000
+)
+
+type e1000RxDesc struct {
+	addr     uint64
+	length   uint16
+	checksum uint16
+	status   uint8
+	errors   uint8
+	special  uint16
+}
+
+type e1000TxDesc struct {
+	addr    uint64
+	length  uint16
+	cso     uint8
+	cmd     uint8
+	status  uint8
+	css     uint8
+	special uint16
+}
+
+type e1000Device struct {
+	regs   uintptr
+	netif  *NetInterface
+	rxRing *[E1000_NUM_RX_DESC]e1000RxDesc
+	txRing *[E1000_NUM_TX_DESC]e1000TxDesc
+	rxNext int
+	txNext int
+	// The kernel image is identity mapped, so these can be used for DMA
+	rxBufs [E1000_NUM_RX_DESC][E1000_BUF_SIZE]byte
+	txBufs [E1000_NUM_TX_DESC][E1000_BUF_SIZE]byte
+}
+
+var (
+	e1000Driver = PciDriver{
+		Name: "e1000",
+		Matches: []PciMatch{
+			{Vendor: E1000_PCI_VENDOR, Device: E1000_82540EM, Class: PCI_ANY_CLASS},
+			{Vendor: E1000_PCI_VENDOR, Device: E1000_82545EM, Class: PCI_ANY_CLASS},
+			{Vendor: E1000_PCI_VENDOR, Device: E1000_82545EM_F, Class: PCI_ANY_CLASS},
+			{Vendor: E1000_PCI_VENDOR, Device: E1000_82543GC, Class: PCI_ANY_CLASS},
+		},
+		Probe: e1000Probe,
+	}
+
+	// One card is enough
+	e1000 e1000Device
+)
+
+func (e *e1000Device) read(reg uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(e.regs + reg))
+}
+
+func (e *e1000Device) write(reg uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(e.regs + reg)) = value
+}
+
+func (e *e1000Device) readEeprom(word uint8) (uint16, bool) {
+	e.write(E1000_EERD, uint32(word)<<E1000_EERD_ADDR_SHIFT|E1000_EERD_START)
+	deadline := MonotonicTime() + E1000_EEPROM_TIMEOUT
+	for {
+		value := e.read(E1000_EERD)
+		if value&E1000_EERD_DONE != 0 {
+			return uint16(value >> E1000_EERD_DATA_SHIFT), true
+		}
+		if MonotonicTime() > deadline {
+			return 0, false
+		}
+		Pause()
+	}
+}
+
+// The firmware may already have put the address into receive address 0,
+// otherwise it comes from the EEPROM
+func (e *e1000Device) readMac() (MacAddress, bool) {
+	var mac MacAddress
+	if high := e.read(E1000_RAH0); high&E1000_RAH_AV != 0 {
+		low := e.read(E1000_RAL0)
+		mac = MacAddress{uint8(low), uint8(low >> 8), uint8(low >> 16), uint8(low >> 24), uint8(high), uint8(high >> 8)}
+		return mac, true
+	}
+	for i := uint8(0); i < 3; i++ {
+		word, ok := e.readEeprom(i)
+		if !ok {
+			return mac, false
+		}
+		mac[i*2] = uint8(word)
+		mac[i*2+1] = uint8(word >> 8)
+	}
+	return mac, true
+}
+
+func (e *e1000Device) Transmit(frame []byte) bool {
+	if len(frame) > E1000_BUF_SIZE {
+		return false
+	}
+	desc := &e.txRing[e.txNext]
+	// Descriptors start out done, one that is not is still owned by the card
+	if desc.status&E1000_TXD_STAT_DD == 0 {
+		return false
+	}
+	copy(e.txBufs[e.txNext][:], frame)
+	desc.addr = uint64(uintptr(unsafe.Pointer(&e.txBufs[e.txNext])))
+	desc.length = uint16(len(frame))
+	desc.cmd = E1000_TXD_CMD_EOP | E1000_TXD_CMD_IFCS | E1000_TXD_CMD_RS
+	desc.status = 0
+	e.txNext = (e.txNext + 1) % E1000_NUM_TX_DESC
+	e.write(E1000_TDT, uint32(e.txNext))
+	return true
+}
+
+func (e *e1000Device) receive() {
+	for {
+		desc := &e.rxRing[e.rxNext]
+		if desc.status&E1000_RXD_STAT_DD == 0 {
+			return
+		}
+		// Frames are never split since the buffers are bigger than the MTU
+		if desc.status&E1000_RXD_STAT_EOP != 0 && desc.errors == 0 {
+			e.netif.Receive(e.rxBufs[e.rxNext][:min(desc.length, E1000_BUF_SIZE)])
+		} else {
+			e.netif.RxDropped++
+		}
+		desc.status = 0
+		// Give the descriptor back to the card
+		e.write(E1000_RDT, uint32(e.rxNext))
+		e.rxNext = (e.rxNext + 1) % E1000_NUM_RX_DESC
+	}
+}
+
+func e1000Interrupt() {
+	e := &e1000
+	// Reading acknowledges, 0 means the interrupt was for another device on the line
+	cause := e.read(E1000_ICR)
+	if cause == 0 || e.netif == nil {
+		return
+	}
+	if cause&E1000_ICR_LSC != 0 {
+		e.netif.SetLink(e.read(E1000_STATUS)&E1000_STATUS_LU != 0)
+	}
+	if cause&(E1000_ICR_RXT0|E1000_ICR_RXDMT0|E1000_ICR_RXO|E1000_ICR_RXSEQ) != 0 {
+		e.receive()
+	}
+}
+
+func (e *e1000Device) setupRx() bool {
+	ring := dmaAlloc(unsafe.Sizeof(*e.rxRing), 16)
+	if ring == 0 {
+		return false
+	}
+	e.rxRing = (*[E1000_NUM_RX_DESC]e1000RxDesc)(unsafe.Pointer(ring))
+	for i := range e.rxRing {
+		e.rxRing[i].addr = uint64(uintptr(unsafe.Pointer(&e.rxBufs[i])))
+	}
+	e.write(E1000_RDBAL, uint32(ring))
+	e.write(E1000_RDBAH, 0)
+	e.write(E1000_RDLEN, uint32(unsafe.Sizeof(*e.rxRing)))
+	e.write(E1000_RDH, 0)
+	e.write(E1000_RDT, E1000_NUM_RX_DESC-1)
+	e.rxNext = 0
+	e.write(E1000_RCTL, E1000_RCTL_EN|E1000_RCTL_BAM|E1000_RCTL_BSIZE_2048|E1000_RCTL_SECRC)
+	return true
+}
+
+func (e *e1000Device) setupTx() bool {
+	ring := dmaAlloc(unsafe.Sizeof(*e.txRing), 16)
+	if ring == 0 {
+		return false
+	}
+	e.txRing = (*[E1000_NUM_TX_DESC]e1000TxDesc)(unsafe.Pointer(ring))
+	for i := range e.txRing {
+		e.txRing[i].status = E1000_TXD_STAT_DD
+	}
+	e.write(E1000_TDBAL, uint32(ring))
+	e.write(E1000_TDBAH, 0)
+	e.write(E1000_TDLEN, uint32(unsafe.Sizeof(*e.txRing)))
+	e.write(E1000_TDH, 0)
+	e.write(E1000_TDT, 0)
+	e.txNext = 0
+	e.write(E1000_TIPG, E1000_TIPG_DEFAULT)
+	e.write(E1000_TCTL, E1000_TCTL_EN|E1000_TCTL_PSP|0x10<<E1000_TCTL_CT_SHIFT|0x40<<E1000_TCTL_COLD_SHIFT)
+	return true
+}
+
+func e1000Probe(pci *PciDevice) bool {
+	e := &e1000
+	if e.netif != nil {
+		return false
+	}
+	pci.Enable()
+	pci.setCommand(0, PCI_COMMAND_INTX_DISABLE)
+	e.regs = pci.MapBar(0)
+	if e.regs == 0 {
+		log.KErrorLn("[E1000] No register BAR")
+		return false
+	}
+
+	e.write(E1000_IMC, 0xffffffff)
+	e.write(E1000_CTRL, e.read(E1000_CTRL)|E1000_CTRL_RST)
+	if !mmioWait(e.regs+E1000_CTRL, E1000_CTRL_RST, 0, E1000_RESET_TIMEOUT) {
+		log.KErrorLn("[E1000] Reset timed out")
+		return false
+	}
+	e.write(E1000_IMC, 0xffffffff)
+	e.read(E1000_ICR)
+	e.write(E1000_CTRL, e.read(E1000_CTRL)|E1000_CTRL_SLU|E1000_CTRL_ASDE)
+
+	mac, ok := e.readMac()
+	if !ok {
+		log.KErrorLn("[E1000] Could not read the MAC address")
+		return false
+	}
+	e.write(E1000_RAL0, uint32(mac[0])|uint32(mac[1])<<8|uint32(mac[2])<<16|uint32(mac[3])<<24)
+	e.write(E1000_RAH0, uint32(mac[4])|uint32(mac[5])<<8|E1000_RAH_AV)
+	for i := uintptr(0); i < E1000_MTA_SIZE; i++ {
+		e.write(E1000_MTA+i*4, 0)
+	}
+	if !e.setupRx() || !e.setupTx() {
+		return false
+	}
+
+	e.netif = RegisterNetInterface("eth0", mac, e)
+	if e.netif == nil {
+		return false
+	}
+	e.netif.SetLink(e.read(E1000_STATUS)&E1000_STATUS_LU != 0)
+
+	if irq := pci.IrqLine; irq < IRQ_COUNT {
+		AddIRQHandler(irq, e1000Interrupt)
+		EnableIRQ(irq)
+		e.write(E1000_IMS, E1000_ICR_LSC|E1000_ICR_RXSEQ|E1000_ICR_RXDMT0|E1000_ICR_RXO|E1000_ICR_RXT0)
+	} else {
+		log.KErrorLn("[E1000] No interrupt line, nothing will be received")
+	}
+	pci.DriverData = uintptr(unsafe.Pointer(e))
+	return true
+}
+
+// Has to run before InitPci
+func InitE1000() {
+	RegisterPciDriver(&e1000Driver)
+}
@@ -0,0 +1,235 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/utils"
+)
+
+// epoll. Every watched file is an item with poll entries on the wait queues
+// of the file. When one of them is woken the item is marked ready and
+// epoll_wait checks its events again. Level triggered items stay ready as
+// long as the file is, edge triggered ones until they were reported once.
+
+const (
+	EPOLL_MAX       = 16
+	EPOLL_MAX_ITEMS = 128
+
+	EPOLLEXCLUSIVE = 1 << 28 // Accepted, every waiter is woken anyway
+	EPOLLWAKEUP    = 1 << 29
+	EPOLLONESHOT   = 1 << 30
+	EPOLLET        = 1 << 31
+	// Flags of an item that are not events
+	EPOLL_PRIVATE_BITS = EPOLLEXCLUSIVE | EPOLLWAKEUP | EPOLLONESHOT | EPOLLET
+)
+
+// struct epoll_event, which is packed on i386
+type EpollEvent struct {
+	Events uint32
+	Data   uint64
+}
+
+type Epoll struct {
+	FileBase
+	used    bool
+	waiters WaitQueue // Threads in epoll_wait and pollers of the epoll file
+}
+
+// Items are identified by the file and the file descriptor like on Linux
+type epollItem struct {
+	epoll  *Epoll // nil if the item is free
+	file   File
+	fd     int
+	events uint32
+	data   uint64
+	ready  bool
+}
+
+var (
+	epolls     [EPOLL_MAX]Epoll
+	epollItems [EPOLL_MAX_ITEMS]epollItem
+	epollTable PollTable // Used to add the poll entries of new items
+)
+
+func NewEpoll() (*Epoll, syscall.Errno) {
+	for i := range epolls {
+		e := &epolls[i]
+		if !e.used {
+			*e = Epoll{used: true}
+			return e, ESUCCESS
+		}
+	}
+	return nil, syscall.ENFILE
+}
+
+func epollWake(arg uintptr) {
+	item := utils.UIntToPointer[epollItem](arg)
+	if item.events&^EPOLL_PRIVATE_BITS == 0 {
+		// One shot item that fired already
+		return
+	}
+	item.ready = true
+	item.epoll.waiters.WakeAll()
+}
+
+func epollRemove(item *epollItem) {
+	PollRemove(uintptr(unsafe.Pointer(item)))
+	*item = epollItem{}
+}
+
+// The last reference of f is gone, stop watching it
+func epollForget(f File) {
+	for i := range epollItems {
+		item := &epollItems[i]
+		if item.epoll != nil && item.file == f {
+			epollRemove(item)
+		}
+	}
+}
+
+func (e *Epoll) find(f File, fd int) *epollItem {
+	for i := range epollItems {
+		item := &epollItems[i]
+		if item.epoll == e && item.file == f && item.fd == fd {
+			return item
+		}
+	}
+	return nil
+}
+
+// Nesting is limited to one level, which also rules out loops
+func (e *Epoll) canWatch(f File) syscall.Errno {
+	inner, ok := f.(*Epoll)
+	if !ok {
+		return ESUCCESS
+	}
+	if inner == e {
+		return syscall.EINVAL
+	}
+	for i := range epollItems {
+		item := &epollItems[i]
+		if item.epoll == nil {
+			continue
+		}
+		if _, ok := item.file.(*Epoll); ok && item.epoll == inner || item.file == File(e) {
+			return syscall.ELOOP
+		}
+	}
+	return ESUCCESS
+}
+
+// epoll_ctl for the file f at file descriptor fd
+func (e *Epoll) Ctl(op int, fd int, f File, event *EpollEvent) syscall.Errno {
+	item := e.find(f, fd)
+	switch op {
+	case syscall.EPOLL_CTL_ADD:
+		if item != nil {
+			return syscall.EEXIST
+		}
+		if err := e.canWatch(f); err != ESUCCESS {
+			return err
+		}
+		for i := range epollItems {
+			if epollItems[i].epoll == nil {
+				item = &epollItems[i]
+				break
+			}
+		}
+		if item == nil {
+			return syscall.ENOSPC
+		}
+		// Errors and hangups are always reported
+		*item = epollItem{epoll: e, file: f, fd: fd, events: event.Events | POLLERR | POLLHUP, data: event.Data}
+		epollTable = PollTable{callback: epollWake, arg: uintptr(unsafe.Pointer(item))}
+		events := f.Poll(&epollTable)
+		if epollTable.err != ESUCCESS {
+			epollRemove(item)
+			return syscall.ENOMEM
+		}
+		item.ready = events&item.events != 0
+	case syscall.EPOLL_CTL_MOD:
+		if item == nil {
+			return syscall.ENOENT
+		}
+		item.events = event.Events | POLLERR | POLLHUP
+		item.data = event.Data
+		item.ready = f.Poll(nil)&item.events != 0
+	case syscall.EPOLL_CTL_DEL:
+		if item == nil {
+			return syscall.ENOENT
+		}
+		epollRemove(item)
+		return ESUCCESS
+	default:
+		return syscall.EINVAL
+	}
+	if item.ready {
+		e.waiters.WakeAll()
+	}
+	return ESUCCESS
+}
+
+// Fill events with the ready items
+func (e *Epoll) collect(events []EpollEvent) int {
+	n := 0
+	for i := range epollItems {
+		if n == len(events) {
+			break
+		}
+		item := &epollItems[i]
+		if item.epoll != e || !item.ready {
+			continue
+		}
+		ready := item.file.Poll(nil) & item.events &^ EPOLL_PRIVATE_BITS
+		if ready == 0 {
+			item.ready = false
+			continue
+		}
+		events[n] = EpollEvent{Events: ready, Data: item.data}
+		n++
+		if item.events&EPOLLONESHOT != 0 {
+			// Disabled until EPOLL_CTL_MOD
+			item.events &= EPOLL_PRIVATE_BITS
+		}
+		if item.events&(EPOLLET|EPOLLONESHOT) != 0 {
+			item.ready = false
+		}
+	}
+	return n
+}
+
+// Wait for ready items until the deadline (monotonic ns, 0 waits forever)
+func (e *Epoll) Wait(events []EpollEvent, deadline uint64) (int, syscall.Errno) {
+	for {
+		if n := e.collect(events); n > 0 {
+			return n, ESUCCESS
+		}
+		if err := pollSleep(&e.waiters, deadline); err == syscall.ETIMEDOUT {
+			return 0, ESUCCESS
+		} else if err != ESUCCESS {
+			return 0, err
+		}
+	}
+}
+
+// Readable if an item is ready, without consuming edge triggered events
+func (e *Epoll) Poll(pt *PollTable) uint32 {
+	pt.Wait(&e.waiters)
+	for i := range epollItems {
+		item := &epollItems[i]
+		if item.epoll == e && item.ready && item.file.Poll(nil)&item.events&^EPOLL_PRIVATE_BITS != 0 {
+			return POLLIN | POLLRDNORM
+		}
+	}
+	return 0
+}
+
+func (e *Epoll) Close() {
+	for i := range epollItems {
+		if epollItems[i].epoll == e {
+			epollRemove(&epollItems[i])
+		}
+	}
+	e.used = false
+}
@@ -0,0 +1,119 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// Event counters that threads signal each other with, like eventfd on Linux.
+// Reads take the counter and writes add to it, both with 8 byte values.
+
+const (
+	EVENTFD_MAX       = 32
+	EVENTFD_MAX_COUNT = 0xfffffffffffffffe
+	EFD_SEMAPHORE     = 0x1
+	EFD_NONBLOCK      = syscall.O_NONBLOCK
+	EFD_CLOEXEC       = syscall.O_CLOEXEC
+)
+
+type Eventfd struct {
+	FileBase
+	used      bool
+	semaphore bool // Reads take 1 instead of the whole count
+	nonblock  bool
+	count     uint64
+	wait      WaitQueue // Readers and writers
+}
+
+var eventfds [EVENTFD_MAX]Eventfd
+
+func NewEventfd(count uint32, flags int) (*Eventfd, syscall.Errno) {
+	if flags&^(EFD_SEMAPHORE|EFD_NONBLOCK|EFD_CLOEXEC) != 0 {
+		return nil, syscall.EINVAL
+	}
+	for i := range eventfds {
+		e := &eventfds[i]
+		if !e.used {
+			*e = Eventfd{
+				used:      true,
+				semaphore: flags&EFD_SEMAPHORE != 0,
+				nonblock:  flags&EFD_NONBLOCK != 0,
+				count:     uint64(count),
+			}
+			return e, ESUCCESS
+		}
+	}
+	return nil, syscall.ENFILE
+}
+
+func (e *Eventfd) SetNonblock(nonblock bool) {
+	e.nonblock = nonblock
+}
+
+func (e *Eventfd) Nonblock() bool {
+	return e.nonblock
+}
+
+func (e *Eventfd) Read(buf []byte) (int, syscall.Errno) {
+	if len(buf) < 8 {
+		return 0, syscall.EINVAL
+	}
+	for e.count == 0 {
+		if e.nonblock {
+			return 0, syscall.EAGAIN
+		}
+		if err := e.wait.WaitInterruptible(); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	value := e.count
+	if e.semaphore {
+		value = 1
+	}
+	e.count -= value
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(value >> (8 * i))
+	}
+	e.wait.WakeAll()
+	return 8, ESUCCESS
+}
+
+func (e *Eventfd) Write(buf []byte) (int, syscall.Errno) {
+	if len(buf) < 8 {
+		return 0, syscall.EINVAL
+	}
+	value := uint64(0)
+	for i := 0; i < 8; i++ {
+		value |= uint64(buf[i]) << (8 * i)
+	}
+	if value > EVENTFD_MAX_COUNT {
+		return 0, syscall.EINVAL
+	}
+	// Writers wait until the counter can take the value
+	for EVENTFD_MAX_COUNT-e.count < value {
+		if e.nonblock {
+			return 0, syscall.EAGAIN
+		}
+		if err := e.wait.WaitInterruptible(); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	e.count += value
+	e.wait.WakeAll()
+	return 8, ESUCCESS
+}
+
+func (e *Eventfd) Poll(pt *PollTable) uint32 {
+	pt.Wait(&e.wait)
+	events := uint32(0)
+	if e.count > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	if e.count < EVENTFD_MAX_COUNT {
+		events |= POLLOUT | POLLWRNORM
+	}
+	return events
+}
+
+func (e *Eventfd) Close() {
+	e.used = false
+}
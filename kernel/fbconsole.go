@@ -0,0 +1,141 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/utils"
+)
+
+// Draws the text console onto the framebuffer. The text mode functions keep
+// working on a cell buffer like in VGA text mode and every changed cell is drawn
+// with the font that the BIOS loaded into the VGA.
+
+const (
+	fontWidth  = 8
+	fontHeight = 16
+
+	vgaFontAddr       uintptr = 0xA0000
+	vgaFontCharOffset         = 32 // Every character uses 32 bytes in plane 2
+
+	fbConsoleMaxCells = 160 * 64
+)
+
+var (
+	consoleFont       [256][fontHeight]byte
+	consoleFontLoaded = false
+
+	fbConsoleEnabled = false
+	fbConsoleCells   [fbConsoleMaxCells]uint16
+
+	// Default VGA text mode palette
+	vgaPalette = [16]uint32{
+		0x000000, 0x0000aa, 0x00aa00, 0x00aaaa, 0xaa0000, 0xaa00aa, 0xaa5500, 0xaaaaaa,
+		0x555555, 0x5555ff, 0x55ff55, 0x55ffff, 0xff5555, 0xff55ff, 0xffff55, 0xffffff,
+	}
+)
+
+// Copy the font out of plane 2 of the VGA memory. This only works as long as the VGA is in text mode.
+func LoadVGAFont() {
+	// Make plane 2 accessible at 0xA0000
+	Outw(0x3C4, 0x0402) // Sequencer map mask: write plane 2
+	Outw(0x3C4, 0x0704) // Sequencer memory mode: sequential access
+	Outw(0x3CE, 0x0204) // Graphics read map select: plane 2
+	Outw(0x3CE, 0x0005) // Graphics mode: disable odd/even
+	Outw(0x3CE, 0x0406) // Graphics misc: map 0xA0000 - 0xAFFFF
+
+	vgaMem := utils.UIntToSlice[byte](vgaFontAddr, len(consoleFont)*vgaFontCharOffset)
+	for c := range consoleFont {
+		copy(consoleFont[c][:], vgaMem[c*vgaFontCharOffset:])
+	}
+
+	// Restore text mode access
+	Outw(0x3C4, 0x0302) // Sequencer map mask: planes 0 and 1
+	Outw(0x3C4, 0x0304) // Sequencer memory mode: odd/even access
+	Outw(0x3CE, 0x0004) // Graphics read map select: plane 0
+	Outw(0x3CE, 0x1005) // Graphics mode: enable odd/even
+	Outw(0x3CE, 0x0E06) // Graphics misc: map 0xB8000 - 0xBFFFF, text mode
+	consoleFontLoaded = true
+}
+
+func fbConsoleColor(index uint8) uint32 {
+	rgb := vgaPalette[index&0xf]
+	return fbChannel(rgb>>16, fbDevice.red) | fbChannel(rgb>>8, fbDevice.green) | fbChannel(rgb, fbDevice.blue)
+}
+
+// Scale 8 bit color value to the bitfield
+func fbChannel(value uint32, field fbBitfield) uint32 {
+	return ((value & 0xff) >> (8 - field.length)) << field.offset
+}
+
+func fbConsoleDrawCell(index int) {
+	col := index % fbWidth
+	row := index / fbWidth
+	char := uint8(fb[index])
+	attr := uint8(fb[index] >> 8)
+	fg := fbConsoleColor(attr & 0xf)
+	bg := fbConsoleColor(attr >> 4)
+
+	pitch := uintptr(fbDevice.Pitch)
+	base := fbDevice.PhysAddr + uintptr(row*fontHeight)*pitch + uintptr(col*fontWidth*4)
+	for y, bits := range consoleFont[char] {
+		line := unsafe.Slice((*uint32)(unsafe.Pointer(base+uintptr(y)*pitch)), fontWidth)
+		for x := range line {
+			if bits&(0x80>>x) != 0 {
+				line[x] = fg
+			} else {
+				line[x] = bg
+			}
+		}
+	}
+}
+
+func fbConsoleRedraw() {
+	for i := range fb {
+		fbConsoleDrawCell(i)
+	}
+}
+
+// Called when the framebuffer mode changed. Moves the text console to the framebuffer
+// if it can be drawn there and keeps the text currently on screen.
+func fbConsoleModeChanged() {
+	if !consoleFontLoaded || fbDevice.Bpp != 32 {
+		// Only 32 bit colors are supported. Keep writing to the cells in the background
+		fbConsoleEnabled = false
+		return
+	}
+	cols := int(fbDevice.Width / fontWidth)
+	rows := int(fbDevice.Height / fontHeight)
+	if cols > fbConsoleMaxCells {
+		cols = fbConsoleMaxCells
+	}
+	if cols*rows > fbConsoleMaxCells {
+		rows = fbConsoleMaxCells / cols
+	}
+
+	if len(fb) == 0 || &fb[0] == &fbConsoleCells[0] {
+		// Cells are already used by the console, so they cannot be copied in place
+		for i := range fbConsoleCells {
+			fbConsoleCells[i] = 0xf00
+		}
+		fbCurLine = 0
+		fbCurCol = 0
+	} else {
+		for r := 0; r < rows; r++ {
+			for c := 0; c < cols; c++ {
+				cell := uint16(0xf00)
+				if r < fbHeight && c < fbWidth {
+					cell = fb[r*fbWidth+c]
+				}
+				fbConsoleCells[r*cols+c] = cell
+			}
+		}
+	}
+
+	fb = fbConsoleCells[:cols*rows]
+	fbWidth = cols
+	fbHeight = rows
+	fbCurLine = min(fbCurLine, rows-1)
+	fbCurCol = min(fbCurCol, cols)
+	fbConsoleEnabled = true
+	fbConsoleRedraw()
+}
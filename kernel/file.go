@@ -0,0 +1,164 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+const (
+	MAX_FILES     = 64
+	MAX_FILE_REFS = 64
+)
+
+// An open file that a file descriptor refers to.
+// File implementations must not be allocated on the go heap, as there is none.
+// Use global variables or allocate a page for them.
+type File interface {
+	Read(buf []byte) (int, syscall.Errno)
+	Write(buf []byte) (int, syscall.Errno)
+	Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno)
+	// Map length bytes of the file starting at offset to addr in space.
+	// addr and length are page aligned
+	Mmap(space *mm.MemSpace, addr uintptr, length uintptr, offset uintptr, flags uint8) syscall.Errno
+	// Returns the POLL* events of the file. Unless pt is nil, the file adds the
+	// wait queues that are woken when its events change to pt, see poll.go.
+	Poll(pt *PollTable) uint32
+	Close()
+}
+
+// Files that support O_NONBLOCK
+type NonblockFile interface {
+	SetNonblock(nonblock bool)
+	Nonblock() bool
+}
+
+// Embed FileBase to only implement the file operations that make sense for a file.
+type FileBase struct{}
+
+func (f *FileBase) Read(buf []byte) (int, syscall.Errno) {
+	return 0, syscall.EINVAL
+}
+
+func (f *FileBase) Write(buf []byte) (int, syscall.Errno) {
+	return 0, syscall.EINVAL
+}
+
+func (f *FileBase) Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno) {
+	return 0, syscall.ENOTTY
+}
+
+func (f *FileBase) Mmap(space *mm.MemSpace, addr uintptr, length uintptr, offset uintptr, flags uint8) syscall.Errno {
+	return syscall.ENODEV
+}
+
+// Files without wait queues are always ready
+func (f *FileBase) Poll(pt *PollTable) uint32 {
+	return POLLIN | POLLOUT | POLLRDNORM | POLLWRNORM
+}
+
+func (f *FileBase) Close() {}
+
+// Files with more than one reference, from several file descriptors or from
+// messages in flight. A file without an entry has a single reference.
+type fileRef struct {
+	file  File
+	extra int
+}
+
+var fileRefs [MAX_FILE_REFS]fileRef
+
+// Take another reference to f
+func AcquireFile(f File) syscall.Errno {
+	free := -1
+	for i := range fileRefs {
+		if fileRefs[i].file == f {
+			fileRefs[i].extra++
+			return ESUCCESS
+		}
+		if fileRefs[i].file == nil && free < 0 {
+			free = i
+		}
+	}
+	if free < 0 {
+		return syscall.ENFILE
+	}
+	fileRefs[free] = fileRef{file: f, extra: 1}
+	return ESUCCESS
+}
+
+// Drop a reference to f, the last one closes it
+func ReleaseFile(f File) {
+	for i := range fileRefs {
+		if fileRefs[i].file == f {
+			fileRefs[i].extra--
+			if fileRefs[i].extra == 0 {
+				fileRefs[i].file = nil
+			}
+			return
+		}
+	}
+	epollForget(f)
+	f.Close()
+}
+
+// Per domain table of open files
+type FileTable struct {
+	files [MAX_FILES]File
+}
+
+// Install the file at the lowest free file descriptor
+func (t *FileTable) Install(f File) (uint32, syscall.Errno) {
+	for fd := range t.files {
+		if t.files[fd] == nil {
+			t.files[fd] = f
+			return uint32(fd), ESUCCESS
+		}
+	}
+	return 0, syscall.EMFILE
+}
+
+// Install the file at fd, a file that was there is closed
+func (t *FileTable) InstallAt(fd uint32, f File) syscall.Errno {
+	if fd >= MAX_FILES {
+		return syscall.EBADF
+	}
+	old := t.files[fd]
+	t.files[fd] = f
+	if old != nil {
+		ReleaseFile(old)
+	}
+	return ESUCCESS
+}
+
+func (t *FileTable) Get(fd uint32) (File, syscall.Errno) {
+	if fd >= MAX_FILES || t.files[fd] == nil {
+		return nil, syscall.EBADF
+	}
+	return t.files[fd], ESUCCESS
+}
+
+func (t *FileTable) Close(fd uint32) syscall.Errno {
+	f, err := t.Get(fd)
+	if err != ESUCCESS {
+		return err
+	}
+	t.files[fd] = nil
+	ReleaseFile(f)
+	return ESUCCESS
+}
+
+func (t *FileTable) CloseAll() {
+	for fd := range t.files {
+		if t.files[fd] != nil {
+			t.Close(uint32(fd))
+		}
+	}
+}
+
+// Set up stdin, stdout and stderr
+func (t *FileTable) InitStdio() {
+	t.files[0] = &consoleIn
+	t.files[1] = &consoleOut
+	t.files[2] = &consoleErr
+}
@@ -0,0 +1,208 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+	"github.com/sanserogames/letsgo-os/kernel/multiboot"
+)
+
+// Linux fbdev ABI (linux/fb.h)
+const (
+	FBIOGET_VSCREENINFO = 0x4600
+	FBIOPUT_VSCREENINFO = 0x4601
+	FBIOGET_FSCREENINFO = 0x4602
+
+	FB_TYPE_PACKED_PIXELS = 0
+	FB_VISUAL_TRUECOLOR   = 2
+)
+
+type fbBitfield struct {
+	offset   uint32
+	length   uint32
+	msbRight uint32
+}
+
+type fbVarScreeninfo struct {
+	xres         uint32 // visible resolution
+	yres         uint32
+	xresVirtual  uint32 // virtual resolution
+	yresVirtual  uint32
+	xoffset      uint32 // offset from virtual to visible
+	yoffset      uint32
+	bitsPerPixel uint32
+	grayscale    uint32
+
+	red    fbBitfield
+	green  fbBitfield
+	blue   fbBitfield
+	transp fbBitfield
+
+	nonstd      uint32
+	activate    uint32
+	height      uint32 // height of picture in mm
+	width       uint32 // width of picture in mm
+	accelFlags  uint32
+	pixclock    uint32 // Timing. All values in pixclocks, except pixclock
+	leftMargin  uint32
+	rightMargin uint32
+	upperMargin uint32
+	lowerMargin uint32
+	hsyncLen    uint32
+	vsyncLen    uint32
+	sync        uint32
+	vmode       uint32
+	rotate      uint32
+	colorspace  uint32
+	reserved    [4]uint32
+}
+
+type fbFixScreeninfo struct {
+	id           [16]byte
+	smemStart    uintptr // physical address of framebuffer memory
+	smemLen      uint32
+	fbType       uint32
+	typeAux      uint32
+	visual       uint32
+	xpanstep     uint16
+	ypanstep     uint16
+	ywrapstep    uint16
+	lineLength   uint32
+	mmioStart    uintptr
+	mmioLen      uint32
+	accel        uint32
+	capabilities uint16
+	reserved     [2]uint16
+}
+
+// A linear framebuffer that can be mapped by user programs
+type FramebufferDevice struct {
+	FileBase
+	PhysAddr uintptr
+	Width    uint32
+	Height   uint32
+	Pitch    uint32 // Bytes per line
+	Bpp      uint32
+	red      fbBitfield
+	green    fbBitfield
+	blue     fbBitfield
+	id       [16]byte
+
+	// Change the video mode. nil if the driver cannot change the mode
+	setMode    func(width uint32, height uint32, bpp uint32) syscall.Errno
+	registered bool
+}
+
+var fbDevice FramebufferDevice
+
+func (d *FramebufferDevice) Size() uintptr {
+	return uintptr(d.Pitch) * uintptr(d.Height)
+}
+
+func (d *FramebufferDevice) register() {
+	if !d.registered {
+		RegisterDevice("/dev/fb0", openFramebuffer)
+		d.registered = true
+	}
+}
+
+func (d *FramebufferDevice) varScreeninfo(info *fbVarScreeninfo) {
+	info.xres = d.Width
+	info.yres = d.Height
+	info.xresVirtual = d.Width
+	info.yresVirtual = d.Height
+	info.bitsPerPixel = d.Bpp
+	info.red = d.red
+	info.green = d.green
+	info.blue = d.blue
+	// Size of the screen is unknown
+	info.height = 0xffffffff
+	info.width = 0xffffffff
+}
+
+func (d *FramebufferDevice) fixScreeninfo(info *fbFixScreeninfo) {
+	info.id = d.id
+	info.smemStart = d.PhysAddr
+	info.smemLen = uint32(d.Size())
+	info.fbType = FB_TYPE_PACKED_PIXELS
+	info.visual = FB_VISUAL_TRUECOLOR
+	info.lineLength = d.Pitch
+}
+
+func (d *FramebufferDevice) Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno) {
+	switch cmd {
+	case FBIOGET_VSCREENINFO:
+		var info fbVarScreeninfo
+		d.varScreeninfo(&info)
+		return 0, space.WriteBytesToUserSpace(arg, unsafe.Slice((*byte)(unsafe.Pointer(&info)), unsafe.Sizeof(info)))
+	case FBIOPUT_VSCREENINFO:
+		var info fbVarScreeninfo
+		buf := unsafe.Slice((*byte)(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+		if err := space.ReadBytesFromUserSpace(arg, buf); err != ESUCCESS {
+			return 0, err
+		}
+		if info.xres != d.Width || info.yres != d.Height || info.bitsPerPixel != d.Bpp {
+			if d.setMode == nil {
+				return 0, syscall.EINVAL
+			}
+			if err := d.setMode(info.xres, info.yres, info.bitsPerPixel); err != ESUCCESS {
+				return 0, err
+			}
+		}
+		// Report back the mode that is actually used
+		d.varScreeninfo(&info)
+		return 0, space.WriteBytesToUserSpace(arg, buf)
+	case FBIOGET_FSCREENINFO:
+		var info fbFixScreeninfo
+		d.fixScreeninfo(&info)
+		return 0, space.WriteBytesToUserSpace(arg, unsafe.Slice((*byte)(unsafe.Pointer(&info)), unsafe.Sizeof(info)))
+	default:
+		return 0, syscall.ENOTTY
+	}
+}
+
+func (d *FramebufferDevice) Mmap(space *mm.MemSpace, addr uintptr, length uintptr, offset uintptr, flags uint8) syscall.Errno {
+	size := (d.Size() + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	if offset >= size || length > size-offset {
+		return syscall.EINVAL
+	}
+	// Write-through so that writes show up on the screen without having to flush caches
+	for i := uintptr(0); i < length; i += PAGE_SIZE {
+		space.MapPage(d.PhysAddr+offset+i, addr+i, flags|PAGE_WRITETHROUGH)
+	}
+	return ESUCCESS
+}
+
+func openFramebuffer() (File, syscall.Errno) {
+	return &fbDevice, ESUCCESS
+}
+
+func newFbBitfield(offset uint8, length uint8) fbBitfield {
+	return fbBitfield{offset: uint32(offset), length: uint32(length)}
+}
+
+func InitFramebuffer() {
+	info := &BootFramebuffer
+	if info.MultibootTag.Type != 8 {
+		log.KDebugLn("No framebuffer provided by bootloader")
+		return
+	}
+	if info.FramebufferType != multiboot.FRAMEBUFFER_TYPE_RGB {
+		log.KDebugLn("Bootloader framebuffer is not a linear RGB framebuffer")
+		return
+	}
+	fbDevice.PhysAddr = uintptr(info.Addr)
+	fbDevice.Width = info.Width
+	fbDevice.Height = info.Height
+	fbDevice.Pitch = info.Pitch
+	fbDevice.Bpp = uint32(info.Bpp)
+	fbDevice.red = newFbBitfield(info.RedFieldPosition, info.RedMaskSize)
+	fbDevice.green = newFbBitfield(info.GreenFieldPosition, info.GreenMaskSize)
+	fbDevice.blue = newFbBitfield(info.BlueFieldPosition, info.BlueMaskSize)
+	copy(fbDevice.id[:], "multibootfb")
+	// The kernel accesses it too, e.g. when a syscall buffer is in the user mapping
+	mapPhysical(fbDevice.PhysAddr, fbDevice.Size(), mm.PAGE_RW|mm.PAGE_WRITETHROUGH)
+	fbDevice.register()
+}
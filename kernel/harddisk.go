@@ -222,23 +222,34 @@ func (d *AtaDrive) Reset() bool {
 	return true
 }
 
-// TODO: Explicit length?
-func (d *AtaDrive) WriteSectors(address int, buffer []byte) {
+// Number of LBA28 sectors from identify words 60 and 61
+func (d *AtaDrive) Sectors() uint64 {
+	if !d.Initialized {
+		return 0
+	}
+	data := d.IdentifyData[120:124]
+	return uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24
+}
+
+func (d *AtaDrive) WriteSectors(address int, count uint8, buffer []byte) syscall.Errno {
 	log.KErrorLn("Write does not work :(")
-	return
+	return syscall.EROFS
 	if !d.Initialized {
-		return
+		return syscall.EINVAL
 	}
 	// TODO: Padd with zeros
-	if len(buffer) < 512 {
-		return
+	if int(count)*512 > len(buffer) {
+		return syscall.EINVAL
 	}
-	count := len(buffer) / 512
 	// TODO: This is dangerous
 	log.KDebug("Writing ", uintptr(count), " sectors")
-	for i := 0; i < count; i++ {
-		d.workSectors(address+i, 1, buffer, true)
+	for i := 0; i < int(count); i++ {
+		err := d.workSectors(address+i, 1, buffer[i*512:(i+1)*512], true)
+		if err != ESUCCESS {
+			return err
+		}
 	}
+	return ESUCCESS
 }
 
 func (d *AtaDrive) ReadSectors(address int, count uint8, buffer []byte) syscall.Errno {
@@ -249,7 +260,7 @@ func (d *AtaDrive) ReadSectors(address int, count uint8, buffer []byte) syscall.
 		return syscall.EINVAL
 	}
 	for i := 0; i < int(count); i++ {
-		err := d.workSectors(address, 1, buffer[i*512:(i+1)*512], false)
+		err := d.workSectors(address+i, 1, buffer[i*512:(i+1)*512], false)
 		if err != ESUCCESS {
 			return err
 		}
@@ -345,6 +356,9 @@ var firstDrive AtaDrive = AtaDrive{
 
 func InitATA() {
 	firstDrive.Initialize()
+	if firstDrive.Initialized {
+		RegisterBlockDevice("hda", &firstDrive)
+	}
 	//firstDrive.IdentifyStruct.printInfos()
 	//for i:=0; i < 8; i++ {
 	//    testReadAndWrite()
@@ -0,0 +1,118 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// High Precision Event Timer. Timer 0 in legacy replacement mode takes over
+// IRQ 0 from the PIT and is used as clock event device if there is no local APIC.
+
+const (
+	HPET_CAPABILITIES   = 0x00
+	HPET_PERIOD         = 0x04 // Upper half of the capabilities, counter period in fs
+	HPET_CONFIG         = 0x10
+	HPET_COUNTER        = 0xf0
+	HPET_TIMER0_CONFIG  = 0x100
+	HPET_TIMER0_COMPARE = 0x108
+
+	HPET_CAP_LEGACY_ROUTE = 1 << 15
+	HPET_ENABLE           = 1 << 0
+	HPET_LEGACY_ROUTE     = 1 << 1
+	HPET_TIMER_INT_ENABLE = 1 << 2
+	HPET_TIMER_32BIT      = 1 << 8
+
+	HPET_MAX_PERIOD = 100000000 // fs
+	FS_PER_NS       = 1000000
+	// The comparator is 32 bits wide, the counter must not wrap before it is reached
+	HPET_MAX_TICKS = 0x7fffffff
+)
+
+type hpetTable struct {
+	header     acpiHeader
+	hardwareId uint32
+	base       acpiGas
+}
+
+type hpetClockEvent struct{}
+
+var (
+	hpetBase   uintptr
+	hpetPeriod uint64 // fs per counter tick
+	hpetTimer  hpetClockEvent
+)
+
+func hpetRead(reg uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(hpetBase + reg))
+}
+
+func hpetWrite(reg uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(hpetBase + reg)) = value
+}
+
+func (h *hpetClockEvent) Name() string {
+	return "HPET"
+}
+
+func (h *hpetClockEvent) MaxDelta() uint64 {
+	return HPET_MAX_TICKS * hpetPeriod / FS_PER_NS
+}
+
+func (h *hpetClockEvent) SetNextEvent(delta uint64) {
+	ticks := uint32(max(delta*FS_PER_NS/hpetPeriod, 1))
+	// Stop turns the interrupt off. Enable it first so that the check below covers it.
+	hpetWrite(HPET_TIMER0_CONFIG, HPET_TIMER_32BIT|HPET_TIMER_INT_ENABLE)
+	for {
+		compare := hpetRead(HPET_COUNTER) + ticks
+		hpetWrite(HPET_TIMER0_COMPARE, compare)
+		// The interrupt only fires when the counter reaches the comparator, so it must not have passed already
+		if int32(compare-hpetRead(HPET_COUNTER)) > 0 {
+			return
+		}
+		ticks *= 2
+	}
+}
+
+func (h *hpetClockEvent) Stop() {
+	hpetWrite(HPET_TIMER0_CONFIG, HPET_TIMER_32BIT)
+}
+
+func handleHpet() {
+	hrtimerInterrupt()
+}
+
+// Route timer 0 to IRQ 0. Returns false if there is no usable HPET.
+func hpetStartClockEvent() bool {
+	if hpetBase == 0 || hpetRead(HPET_CAPABILITIES)&HPET_CAP_LEGACY_ROUTE == 0 {
+		return false
+	}
+	hpetWrite(HPET_CONFIG, hpetRead(HPET_CONFIG)|HPET_LEGACY_ROUTE)
+	// One shot and edge triggered
+	hpetWrite(HPET_TIMER0_CONFIG, HPET_TIMER_32BIT|HPET_TIMER_INT_ENABLE)
+	RegisterIRQHandler(0, handleHpet)
+	EnableIRQ(0)
+	return true
+}
+
+// Needs the ACPI tables. The main counter runs from here on.
+func InitHpet() {
+	table := (*hpetTable)(unsafe.Pointer(acpiFindTable([4]byte{'H', 'P', 'E', 'T'})))
+	if table == nil || table.base.addressSpace != ACPI_ADDRESS_MEMORY || table.base.address == 0 || table.base.address >= 1<<32 {
+		log.KDebugLn("[HPET] No HPET found")
+		return
+	}
+	base := uintptr(table.base.address)
+	mapPhysical(base, PAGE_SIZE, mm.PAGE_RW|mm.PAGE_DISABLE_CACHE)
+	hpetBase = base
+	hpetPeriod = uint64(hpetRead(HPET_PERIOD))
+	if hpetPeriod == 0 || hpetPeriod > HPET_MAX_PERIOD {
+		log.KErrorLn("[HPET] Invalid counter period ", hpetPeriod)
+		hpetBase = 0
+		return
+	}
+	hpetWrite(HPET_TIMER0_CONFIG, HPET_TIMER_32BIT)
+	hpetWrite(HPET_CONFIG, hpetRead(HPET_CONFIG)|HPET_ENABLE)
+	log.KDebugLn("[HPET] Counter runs at ", NS_PER_SECOND*FS_PER_NS/hpetPeriod/1000, " kHz")
+}
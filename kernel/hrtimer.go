@@ -0,0 +1,85 @@
+package kernel
+
+// High resolution timers. Every CPU has its own queue sorted by deadline and
+// programs its clock event device for the first one, so timers fire at their
+// deadline instead of on the next tick.
+
+type HrTimer struct {
+	Deadline uint64 // Monotonic time in ns
+	Callback func(timer *HrTimer)
+	Arg      uintptr
+
+	next *HrTimer
+	cpu  *Cpu // Queue the timer is in, nil if not active
+}
+
+func (t *HrTimer) IsActive() bool {
+	return t.cpu != nil
+}
+
+// Queue the timer on the current CPU. An active timer is moved to the new deadline.
+func StartHrTimer(t *HrTimer, deadline uint64) {
+	CancelHrTimer(t)
+	cpu := thisCpu
+	t.Deadline = deadline
+	t.cpu = cpu
+	prev := &cpu.timers
+	for *prev != nil && (*prev).Deadline <= deadline {
+		prev = &(*prev).next
+	}
+	t.next = *prev
+	*prev = t
+	if cpu.timers == t {
+		hrtimerReprogram(cpu)
+	}
+}
+
+// The timer can be on the queue of another CPU. That CPU is not reprogrammed,
+// its device fires anyway and finds nothing to do.
+func CancelHrTimer(t *HrTimer) {
+	cpu := t.cpu
+	if cpu == nil {
+		return
+	}
+	for prev := &cpu.timers; *prev != nil; prev = &(*prev).next {
+		if *prev == t {
+			*prev = t.next
+			break
+		}
+	}
+	t.next = nil
+	t.cpu = nil
+}
+
+// Program the device of the current CPU for the first timer
+func hrtimerReprogram(cpu *Cpu) {
+	dev := cpu.clockEvent
+	if dev == nil {
+		// Timers are only queued until the device is set up
+		return
+	}
+	if cpu.timers == nil {
+		dev.Stop()
+		return
+	}
+	now := MonotonicTime()
+	delta := uint64(CLOCKEVENT_MIN_DELTA)
+	if cpu.timers.Deadline > now+CLOCKEVENT_MIN_DELTA {
+		delta = cpu.timers.Deadline - now
+	}
+	// Too long deltas fire early and are programmed again
+	dev.SetNextEvent(min(delta, dev.MaxDelta()))
+}
+
+// Called by the clock event device of the current CPU
+func hrtimerInterrupt() {
+	cpu := thisCpu
+	now := MonotonicTime()
+	updateCoarseTime(now)
+	for cpu.timers != nil && cpu.timers.Deadline <= now {
+		t := cpu.timers
+		CancelHrTimer(t)
+		t.Callback(t)
+	}
+	hrtimerReprogram(cpu)
+}
@@ -0,0 +1,65 @@
+package kernel
+
+// ICMP. We answer echo requests and report unreachable ports and protocols.
+
+const (
+	ICMP_HEADER_SIZE = 8
+
+	ICMP_ECHO_REPLY       = 0
+	ICMP_DEST_UNREACHABLE = 3
+	ICMP_ECHO_REQUEST     = 8
+
+	ICMP_PROTOCOL_UNREACHABLE = 2
+	ICMP_PORT_UNREACHABLE     = 3
+)
+
+var icmpTxBuf [IPV4_MAX_DATAGRAM]byte
+
+func icmpInput(pkt *ipv4Packet, data []byte) {
+	if len(data) < ICMP_HEADER_SIZE || inetChecksum(data) != 0 {
+		return
+	}
+	switch data[0] {
+	case ICMP_ECHO_REQUEST:
+		if pkt.dst == IPV4_BROADCAST || pkt.dst.IsMulticast() {
+			return
+		}
+		reply := icmpTxBuf[:len(data)]
+		copy(reply, data)
+		reply[0] = ICMP_ECHO_REPLY
+		reply[1] = 0
+		putUint16(reply[2:], 0)
+		putUint16(reply[2:], inetChecksum(reply))
+		icmpSend(pkt.dst, pkt.src, reply)
+	}
+}
+
+// Reply from the address the datagram was sent to
+func icmpSend(src, dst Ipv4Address, msg []byte) {
+	var r ipv4Route
+	if ipv4FindRoute(dst, &r) != ESUCCESS {
+		return
+	}
+	if ipv4IsLocal(src) || src.IsLoopback() {
+		r.src = src
+	}
+	ipv4Output(&r, dst, IPV4_PROTO_ICMP, msg)
+}
+
+// Report a problem with a received datagram. Quotes its header and the
+// first 8 bytes of the payload.
+func icmpSendError(pkt *ipv4Packet, typ, code uint8, payload []byte) {
+	if pkt.header == nil || pkt.src.IsAny() || pkt.dst.IsMulticast() {
+		return
+	}
+	quoted := min(len(payload), 8)
+	msg := icmpTxBuf[:ICMP_HEADER_SIZE+len(pkt.header)+quoted]
+	msg[0] = typ
+	msg[1] = code
+	putUint16(msg[2:], 0)
+	putUint32(msg[4:], 0)
+	copy(msg[ICMP_HEADER_SIZE:], pkt.header)
+	copy(msg[ICMP_HEADER_SIZE+len(pkt.header):], payload[:quoted])
+	putUint16(msg[2:], inetChecksum(msg))
+	icmpSend(pkt.dst, pkt.src, msg)
+}
@@ -0,0 +1,33 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Thread that runs when every other thread is blocked. Every CPU has its own,
+// they do not belong to any domain and only halt until the next interrupt.
+// The tick is stopped while idle, only timers and devices wake the CPU up.
+var idleThread *Thread = &cpus[0].idle
+
+func idleLoop() {
+	for {
+		tickStop()
+		waitForInterrupt()
+	}
+}
+
+func initIdleThread(t *Thread) {
+	stack := mm.AllocPage()
+	stack.Clear()
+	t.fpOffset = 0xffffffff
+	t.kernelStack.lo = stack.Address()
+	t.kernelStack.hi = stack.Address() + PAGE_SIZE
+	// The scheduler continues kernel threads at the stored kernel info
+	t.kernelInfo.ESP = uint32(t.kernelStack.hi)
+	t.kernelInfo.EIP = hackyGetFuncAddr(idleLoop)
+}
+
+// Needs paging to be set up
+func InitIdleThread() {
+	initIdleThread(idleThread)
+}
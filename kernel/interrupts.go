@@ -115,6 +115,7 @@ func do_isr(regs RegisterState, info InterruptInfo) {
 	setDS(KDS_SELECTOR)
 
 	mm.SwitchPageDir(mm.KernelMemSpace.PageDirectory)
+	enterKernel()
 	SetInterruptStack(scheduleThread.kernelStack.hi)
 
 	//printRegisters(defaultLogWriter, &info, &regs)
@@ -127,6 +128,8 @@ func do_isr(regs RegisterState, info InterruptInfo) {
 		kernelPanic("Stack underflow")
 	}
 
+	accountInterruptEntry(info.CS != KCS_SELECTOR)
+
 	if info.CS == KCS_SELECTOR {
 		// We were interrupting the kernel
 		CurrentThread.kernelInfo = info
@@ -142,7 +145,7 @@ func do_isr(regs RegisterState, info InterruptInfo) {
 			regs.KernelESP < uint32(CurrentThread.kernelStack.lo) {
 			log.KErrorLn("kernel stack for process is out of range")
 			log.KPrintLn("KernelESP: ", uintptr(regs.KernelESP), " Stack Hi: ", CurrentThread.kernelStack.hi, " Stack Low: ", CurrentThread.kernelStack.lo)
-			log.KPrintLn(" TSS ESP0: ", tss.esp0)
+			log.KPrintLn(" TSS ESP0: ", thisCpu.tss.esp0)
 			kernelPanic("Fix pls")
 		}
 		CurrentThread.Info = info
@@ -181,6 +184,7 @@ func do_isr(regs RegisterState, info InterruptInfo) {
 		printThreadRegisters(CurrentThread)
 	}
 
+	var pageDir *mm.PageTable
 	if CurrentThread.IsKernelInterrupt {
 		// We were interrupting the kernel
 		info = CurrentThread.kernelInfo
@@ -193,12 +197,18 @@ func do_isr(regs RegisterState, info InterruptInfo) {
 		info = CurrentThread.Info
 		regs = CurrentThread.Regs
 		CurrentThread.IsKernelInterrupt = false
+		accountInterruptExit()
 		SetInterruptStack(CurrentThread.kernelStack.hi)
-		mm.SwitchPageDir(CurrentThread.Domain.MemorySpace.PageDirectory)
+		pageDir = CurrentThread.Domain.MemorySpace.PageDirectory
 		interrupt_debug("User return")
 	}
 	interrupt_debug("[INTERRUPT-OUT] Returning to ", info.EIP, " with stack ", uintptr(info.ESP))
 
+	leaveKernel()
+	if pageDir != nil {
+		mm.SwitchPageDir(pageDir)
+	}
+
 }
 
 func printTid(t *Thread) {
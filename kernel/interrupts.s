@@ -73,6 +73,13 @@ already_in_schedule_stack:
     CALL ·scheduleStackFail(SB)
     HLT
 
+TEXT ·runCurrentThread(SB),NOSPLIT,$0
+    MOVL ·CurrentThread(SB), AX
+    MOVL (Thread_kernelInfo+InterruptInfo_ESP)(AX), SP
+    MOVL (Thread_kernelInfo+InterruptInfo_EIP)(AX), DI
+    MOVL $·doubleStackReturn(SB), (Thread_kernelInfo+InterruptInfo_EIP)(AX)
+    JMP DI
+
 TEXT ·setDS(SB),NOSPLIT,$0
     MOVL ·ds_segment+0(FP), AX
     MOVW AX, DS
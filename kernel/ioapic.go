@@ -0,0 +1,152 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// IO-APIC. Replaces the PIC if the MADT lists one. All device interrupts are
+// delivered to the boot CPU.
+
+const (
+	MAX_IOAPICS = 4
+
+	// Registers are accessed indirectly through these two
+	IOAPIC_REGSEL = 0x00
+	IOAPIC_WINDOW = 0x10
+
+	IOAPIC_REG_VERSION     = 0x01
+	IOAPIC_REG_REDIRECTION = 0x10
+
+	IOAPIC_MAX_REDIRECTION_SHIFT = 16
+
+	IOAPIC_ACTIVE_LOW      = 1 << 13
+	IOAPIC_LEVEL_TRIGGERED = 1 << 15
+	IOAPIC_MASKED          = 1 << 16
+	IOAPIC_DESTINATION     = 24 // Shift in the high register
+)
+
+type ioApic struct {
+	id       uint8
+	base     uintptr
+	gsiBase  uint32
+	gsiCount uint32
+}
+
+type ioApicController struct{}
+
+var (
+	ioApics    [MAX_IOAPICS]ioApic
+	numIoApics = 0
+	ioApicIrqs ioApicController
+)
+
+func (a *ioApic) read(reg uint32) uint32 {
+	*(*uint32)(unsafe.Pointer(a.base + IOAPIC_REGSEL)) = reg
+	return *(*uint32)(unsafe.Pointer(a.base + IOAPIC_WINDOW))
+}
+
+func (a *ioApic) write(reg uint32, value uint32) {
+	*(*uint32)(unsafe.Pointer(a.base + IOAPIC_REGSEL)) = reg
+	*(*uint32)(unsafe.Pointer(a.base + IOAPIC_WINDOW)) = value
+}
+
+func (a *ioApic) setRedirection(pin uint32, low uint32, high uint32) {
+	// Mask first so the entry is never half written while enabled
+	a.write(IOAPIC_REG_REDIRECTION+pin*2, IOAPIC_MASKED)
+	a.write(IOAPIC_REG_REDIRECTION+pin*2+1, high)
+	a.write(IOAPIC_REG_REDIRECTION+pin*2, low)
+}
+
+func addIoApic(id uint8, base uintptr, gsiBase uint32) {
+	if numIoApics == MAX_IOAPICS {
+		log.KErrorLn("[IOAPIC] Ignoring IO-APIC ", id)
+		return
+	}
+	mapPhysical(base, PAGE_SIZE, mm.PAGE_RW|mm.PAGE_DISABLE_CACHE)
+	a := &ioApics[numIoApics]
+	a.id = id
+	a.base = base
+	a.gsiBase = gsiBase
+	a.gsiCount = (a.read(IOAPIC_REG_VERSION)>>IOAPIC_MAX_REDIRECTION_SHIFT)&0xff + 1
+	for pin := uint32(0); pin < a.gsiCount; pin++ {
+		a.setRedirection(pin, IOAPIC_MASKED, 0)
+	}
+	numIoApics++
+	log.KDebugLn("[IOAPIC] IO-APIC ", id, " at ", base, " with GSIs ", gsiBase, "-", gsiBase+a.gsiCount-1)
+}
+
+func ioApicForGsi(gsi uint32) *ioApic {
+	for i := 0; i < numIoApics; i++ {
+		a := &ioApics[i]
+		if gsi >= a.gsiBase && gsi < a.gsiBase+a.gsiCount {
+			return a
+		}
+	}
+	return nil
+}
+
+// ISA IRQs can be remapped by the MADT, everything else is a GSI
+func irqToGsi(irq uint8) (uint32, uint16) {
+	if irq < ISA_IRQ_COUNT {
+		return isaRoutes[irq].gsi, isaRoutes[irq].flags
+	}
+	return uint32(irq), MADT_FLAGS_CONFORMS
+}
+
+func (c *ioApicController) Name() string {
+	return "IO-APIC"
+}
+
+func (c *ioApicController) Enable(irq uint8) {
+	gsi, flags := irqToGsi(irq)
+	a := ioApicForGsi(gsi)
+	if a == nil {
+		log.KErrorLn("[IOAPIC] No IO-APIC for GSI ", gsi)
+		return
+	}
+	low := uint32(IRQ_BASE_VECTOR + irq)
+	// ISA interrupts conform to edge/high, PCI ones to level/low
+	isIsa := irq < ISA_IRQ_COUNT
+	polarity := flags & MADT_POLARITY_MASK
+	if polarity == MADT_POLARITY_LOW || (polarity == MADT_FLAGS_CONFORMS && !isIsa) {
+		low |= IOAPIC_ACTIVE_LOW
+	}
+	trigger := flags & MADT_TRIGGER_MASK
+	if trigger == MADT_TRIGGER_LEVEL || (trigger == MADT_FLAGS_CONFORMS && !isIsa) {
+		low |= IOAPIC_LEVEL_TRIGGERED
+	}
+	a.setRedirection(gsi-a.gsiBase, low, cpus[0].ApicId<<IOAPIC_DESTINATION)
+}
+
+func (c *ioApicController) Disable(irq uint8) {
+	gsi, _ := irqToGsi(irq)
+	if a := ioApicForGsi(gsi); a != nil {
+		a.setRedirection(gsi-a.gsiBase, IOAPIC_MASKED, 0)
+	}
+}
+
+func (c *ioApicController) IsSpurious(irq uint8) bool {
+	// Spurious interrupts arrive on LAPIC_SPURIOUS_VECTOR
+	return false
+}
+
+func (c *ioApicController) EOI(irq uint8) {
+	lapicEOI()
+}
+
+// Needs the MADT and the local APIC. Keeps the PIC if there is no IO-APIC.
+func InitIoApic() {
+	if numIoApics == 0 || lapicBase == 0 {
+		log.KDebugLn("[IOAPIC] No IO-APIC, keeping the PIC")
+		return
+	}
+	// Interrupts from the PIC arrive through LINT0 in virtual wire mode
+	lapicWrite(LAPIC_LVT_LINT0, LAPIC_LVT_MASKED)
+	setIrqController(&ioApicIrqs)
+	if madt.flags&MADT_PCAT_COMPAT != 0 {
+		picMaskAll()
+	}
+}
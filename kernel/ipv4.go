@@ -0,0 +1,471 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// IPv4 input and output. There is no forwarding, packets for other hosts are
+// dropped. Fragments are reassembled before they reach the protocols and
+// datagrams larger than the MTU are fragmented on output.
+
+const (
+	ETH_P_IP = 0x0800
+
+	IPV4_HEADER_SIZE = 20
+	IPV4_DEFAULT_TTL = 64
+
+	IPV4_PROTO_ICMP = 1
+	IPV4_PROTO_TCP  = 6
+	IPV4_PROTO_UDP  = 17
+
+	IPV4_FLAG_MF          = 0x2000
+	IPV4_FLAG_DF          = 0x4000
+	IPV4_FRAG_OFFSET_MASK = 0x1fff
+
+	// Largest datagram that is reassembled, also the largest one we send
+	IPV4_MAX_DATAGRAM  = 16 * 1024
+	IPV4_REASM_SLOTS   = 4
+	IPV4_REASM_TIMEOUT = 30 * NS_PER_SECOND
+)
+
+type Ipv4Address [4]byte
+
+type Ipv4Config struct {
+	Address    Ipv4Address
+	Netmask    Ipv4Address
+	Gateway    Ipv4Address
+	Configured bool
+}
+
+var (
+	IPV4_ANY       = Ipv4Address{0, 0, 0, 0}
+	IPV4_BROADCAST = Ipv4Address{255, 255, 255, 255}
+	IPV4_LOOPBACK  = Ipv4Address{127, 0, 0, 1}
+)
+
+// Header fields of a received datagram
+type ipv4Packet struct {
+	netif    *NetInterface
+	src      Ipv4Address
+	dst      Ipv4Address
+	protocol uint8
+	// Header of the first fragment, for ICMP errors. Nil for reassembled datagrams.
+	header []byte
+}
+
+type ipv4Route struct {
+	netif   *NetInterface
+	src     Ipv4Address
+	nextHop Ipv4Address
+}
+
+type ipv4Reassembly struct {
+	used     bool
+	src      Ipv4Address
+	dst      Ipv4Address
+	id       uint16
+	protocol uint8
+	expires  uint64
+	length   int // Payload length, 0 until the last fragment arrived
+	blocks   [IPV4_MAX_DATAGRAM / 8 / 32]uint32
+	data     [IPV4_MAX_DATAGRAM]byte
+}
+
+var (
+	ipv4TxBuf   [ETH_MTU]byte
+	ipv4NextId  uint16
+	ipv4Reasm   [IPV4_REASM_SLOTS]ipv4Reassembly
+	ipv4Dropped uint64
+	// The packet being received, a local would escape through the UDP callbacks
+	ipv4RxPacket ipv4Packet
+)
+
+func (a Ipv4Address) Uint32() uint32 {
+	return uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+}
+
+func ipv4FromUint32(v uint32) Ipv4Address {
+	return Ipv4Address{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}
+}
+
+func (a Ipv4Address) IsAny() bool {
+	return a == IPV4_ANY
+}
+
+func (a Ipv4Address) IsLoopback() bool {
+	return a[0] == 127
+}
+
+func (a Ipv4Address) IsMulticast() bool {
+	return a[0]&0xf0 == 0xe0
+}
+
+// Parse a dotted address like 10.0.2.15
+func ParseIpv4(s string) (Ipv4Address, bool) {
+	var a Ipv4Address
+	part := 0
+	digits := 0
+	value := 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == '.' {
+			if digits == 0 || part == 4 {
+				return a, false
+			}
+			a[part] = uint8(value)
+			part++
+			digits = 0
+			value = 0
+			continue
+		}
+		if s[i] < '0' || s[i] > '9' {
+			return a, false
+		}
+		value = value*10 + int(s[i]-'0')
+		digits++
+		if value > 255 {
+			return a, false
+		}
+	}
+	return a, part == 4
+}
+
+func logIpv4(a Ipv4Address) {
+	log.KDebug(a[0], ".", a[1], ".", a[2], ".", a[3])
+}
+
+// One's complement sum of data added to sum, for the internet checksum
+func inetChecksumAdd(sum uint32, data []byte) uint32 {
+	i := 0
+	for ; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if i < len(data) {
+		sum += uint32(data[i]) << 8
+	}
+	return sum
+}
+
+func inetChecksumFinish(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func inetChecksum(data []byte) uint16 {
+	return inetChecksumFinish(inetChecksumAdd(0, data))
+}
+
+// Checksum of a TCP or UDP segment including the pseudo header
+func inetPseudoChecksum(src, dst Ipv4Address, protocol uint8, segment []byte) uint16 {
+	sum := inetChecksumAdd(0, src[:])
+	sum = inetChecksumAdd(sum, dst[:])
+	sum += uint32(protocol) + uint32(len(segment))
+	sum = inetChecksumAdd(sum, segment)
+	return inetChecksumFinish(sum)
+}
+
+func putUint16(b []byte, v uint16) {
+	b[0] = uint8(v >> 8)
+	b[1] = uint8(v)
+}
+
+func getUint16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = uint8(v >> 24)
+	b[1] = uint8(v >> 16)
+	b[2] = uint8(v >> 8)
+	b[3] = uint8(v)
+}
+
+func getUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func (c *Ipv4Config) onLink(a Ipv4Address) bool {
+	mask := c.Netmask.Uint32()
+	return c.Configured && a.Uint32()&mask == c.Address.Uint32()&mask
+}
+
+func (c *Ipv4Config) broadcast() Ipv4Address {
+	return ipv4FromUint32(c.Address.Uint32() | ^c.Netmask.Uint32())
+}
+
+func SetIpv4Config(n *NetInterface, address, netmask, gateway Ipv4Address) {
+	n.Ipv4 = Ipv4Config{Address: address, Netmask: netmask, Gateway: gateway, Configured: true}
+	log.KDebug("[NET] ", n.Name, ": ")
+	logIpv4(address)
+	log.KDebug(" netmask ")
+	logIpv4(netmask)
+	if !gateway.IsAny() {
+		log.KDebug(" gateway ")
+		logIpv4(gateway)
+	}
+	log.KDebugLn("")
+}
+
+func ClearIpv4Config(n *NetInterface) {
+	n.Ipv4 = Ipv4Config{}
+}
+
+// Is a the address of one of our interfaces
+func ipv4IsLocal(a Ipv4Address) bool {
+	for i := 0; i < numNetInterfaces; i++ {
+		n := &netInterfaces[i]
+		if n.Ipv4.Configured && n.Ipv4.Address == a {
+			return true
+		}
+	}
+	return false
+}
+
+func ipv4LoopbackInterface() *NetInterface {
+	for i := 0; i < numNetInterfaces; i++ {
+		if netInterfaces[i].Loopback {
+			return &netInterfaces[i]
+		}
+	}
+	return nil
+}
+
+// Pick the interface and next hop for dst. Our own addresses go over the
+// loopback, then directly connected subnets, then the first gateway.
+func ipv4FindRoute(dst Ipv4Address, r *ipv4Route) syscall.Errno {
+	if dst.IsLoopback() || ipv4IsLocal(dst) {
+		lo := ipv4LoopbackInterface()
+		if lo == nil || !lo.Ipv4.Configured {
+			return syscall.ENETUNREACH
+		}
+		r.netif = lo
+		r.nextHop = dst
+		r.src = dst
+		if !ipv4IsLocal(dst) {
+			r.src = lo.Ipv4.Address
+		}
+		return ESUCCESS
+	}
+	for i := 0; i < numNetInterfaces; i++ {
+		n := &netInterfaces[i]
+		if n.Loopback || !n.Ipv4.Configured {
+			continue
+		}
+		if dst == IPV4_BROADCAST || n.Ipv4.onLink(dst) {
+			r.netif = n
+			r.nextHop = dst
+			r.src = n.Ipv4.Address
+			return ESUCCESS
+		}
+	}
+	for i := 0; i < numNetInterfaces; i++ {
+		n := &netInterfaces[i]
+		if n.Loopback || !n.Ipv4.Configured || n.Ipv4.Gateway.IsAny() {
+			continue
+		}
+		r.netif = n
+		r.nextHop = n.Ipv4.Gateway
+		r.src = n.Ipv4.Address
+		return ESUCCESS
+	}
+	return syscall.ENETUNREACH
+}
+
+// Hand a finished packet to the link layer
+func ipv4Transmit(r *ipv4Route, packet []byte) syscall.Errno {
+	n := r.netif
+	if n.Loopback {
+		return n.SendFrame(n.Mac, ETH_P_IP, packet)
+	}
+	if r.nextHop == IPV4_BROADCAST || (n.Ipv4.Configured && r.nextHop == n.Ipv4.broadcast()) {
+		return n.SendFrame(MAC_BROADCAST, ETH_P_IP, packet)
+	}
+	return arpOutput(n, r.nextHop, packet)
+}
+
+// Send payload to dst along route r, fragmenting it if it does not fit the MTU
+func ipv4Output(r *ipv4Route, dst Ipv4Address, protocol uint8, payload []byte) syscall.Errno {
+	if len(payload) > IPV4_MAX_DATAGRAM {
+		return syscall.EMSGSIZE
+	}
+	mtu := min(r.netif.Mtu, len(ipv4TxBuf))
+	// Every fragment but the last carries a multiple of 8 bytes
+	maxFragment := (mtu - IPV4_HEADER_SIZE) &^ 7
+	id := ipv4NextId
+	ipv4NextId++
+	offset := 0
+	for {
+		size := len(payload) - offset
+		flags := uint16(0)
+		if size > mtu-IPV4_HEADER_SIZE {
+			size = maxFragment
+			flags = IPV4_FLAG_MF
+		}
+		packet := ipv4TxBuf[:IPV4_HEADER_SIZE+size]
+		packet[0] = 0x45 // Version 4, 5 words of header
+		packet[1] = 0
+		putUint16(packet[2:], uint16(len(packet)))
+		putUint16(packet[4:], id)
+		putUint16(packet[6:], flags|uint16(offset/8))
+		packet[8] = IPV4_DEFAULT_TTL
+		packet[9] = protocol
+		putUint16(packet[10:], 0)
+		copy(packet[12:16], r.src[:])
+		copy(packet[16:20], dst[:])
+		putUint16(packet[10:], inetChecksum(packet[:IPV4_HEADER_SIZE]))
+		copy(packet[IPV4_HEADER_SIZE:], payload[offset:offset+size])
+		if err := ipv4Transmit(r, packet); err != ESUCCESS {
+			return err
+		}
+		offset += size
+		if offset == len(payload) {
+			return ESUCCESS
+		}
+	}
+}
+
+// Route and send a datagram from the address of the outgoing interface
+func Ipv4Send(dst Ipv4Address, protocol uint8, payload []byte) syscall.Errno {
+	var r ipv4Route
+	if err := ipv4FindRoute(dst, &r); err != ESUCCESS {
+		return err
+	}
+	return ipv4Output(&r, dst, protocol, payload)
+}
+
+// Is the datagram for us. Interfaces without an address take everything,
+// the DHCP replies are sent to the address that is being offered.
+func ipv4Accept(n *NetInterface, dst Ipv4Address) bool {
+	if !n.Ipv4.Configured || dst == IPV4_BROADCAST {
+		return true
+	}
+	if n.Loopback {
+		return dst.IsLoopback() || ipv4IsLocal(dst)
+	}
+	return dst == n.Ipv4.Address || dst == n.Ipv4.broadcast()
+}
+
+// Protocol handler for ETH_P_IP
+func ipv4Input(n *NetInterface, src MacAddress, data []byte) {
+	if len(data) < IPV4_HEADER_SIZE || data[0]>>4 != 4 {
+		ipv4Dropped++
+		return
+	}
+	headerLen := int(data[0]&0xf) * 4
+	totalLen := int(getUint16(data[2:]))
+	if headerLen < IPV4_HEADER_SIZE || totalLen < headerLen || totalLen > len(data) {
+		ipv4Dropped++
+		return
+	}
+	if inetChecksum(data[:headerLen]) != 0 {
+		ipv4Dropped++
+		return
+	}
+	pkt := &ipv4RxPacket
+	*pkt = ipv4Packet{}
+	pkt.netif = n
+	copy(pkt.src[:], data[12:16])
+	copy(pkt.dst[:], data[16:20])
+	pkt.protocol = data[9]
+	if !ipv4Accept(n, pkt.dst) {
+		ipv4Dropped++
+		return
+	}
+	payload := data[headerLen:totalLen]
+	fragment := getUint16(data[6:])
+	if fragment&(IPV4_FLAG_MF|IPV4_FRAG_OFFSET_MASK) != 0 {
+		slot := ipv4Reassemble(pkt, getUint16(data[4:]), fragment, payload)
+		if slot == nil {
+			return
+		}
+		ipv4Deliver(pkt, slot.data[:slot.length])
+		slot.used = false
+		return
+	}
+	pkt.header = data[:headerLen]
+	ipv4Deliver(pkt, payload)
+}
+
+func ipv4Deliver(pkt *ipv4Packet, payload []byte) {
+	switch pkt.protocol {
+	case IPV4_PROTO_ICMP:
+		icmpInput(pkt, payload)
+	case IPV4_PROTO_UDP:
+		udpInput(pkt, payload)
+	case IPV4_PROTO_TCP:
+		tcpInput(pkt, payload)
+	default:
+		if pkt.header != nil && pkt.dst != IPV4_BROADCAST {
+			icmpSendError(pkt, ICMP_DEST_UNREACHABLE, ICMP_PROTOCOL_UNREACHABLE, payload)
+		}
+	}
+}
+
+func ipv4FindReassembly(pkt *ipv4Packet, id uint16) *ipv4Reassembly {
+	now := MonotonicTime()
+	var free *ipv4Reassembly
+	for i := range ipv4Reasm {
+		slot := &ipv4Reasm[i]
+		if slot.used && slot.expires < now {
+			slot.used = false
+		}
+		if !slot.used {
+			if free == nil {
+				free = slot
+			}
+			continue
+		}
+		if slot.id == id && slot.src == pkt.src && slot.dst == pkt.dst && slot.protocol == pkt.protocol {
+			return slot
+		}
+	}
+	if free == nil {
+		// Give up on the oldest datagram
+		free = &ipv4Reasm[0]
+		for i := range ipv4Reasm {
+			if ipv4Reasm[i].expires < free.expires {
+				free = &ipv4Reasm[i]
+			}
+		}
+	}
+	free.used = true
+	free.src = pkt.src
+	free.dst = pkt.dst
+	free.id = id
+	free.protocol = pkt.protocol
+	free.expires = now + IPV4_REASM_TIMEOUT
+	free.length = 0
+	free.blocks = [len(free.blocks)]uint32{}
+	return free
+}
+
+// Store a fragment. Returns the slot once the datagram is complete, the caller
+// frees it after delivering.
+func ipv4Reassemble(pkt *ipv4Packet, id uint16, fragment uint16, payload []byte) *ipv4Reassembly {
+	offset := int(fragment&IPV4_FRAG_OFFSET_MASK) * 8
+	last := fragment&IPV4_FLAG_MF == 0
+	if offset+len(payload) > IPV4_MAX_DATAGRAM || (!last && len(payload)%8 != 0) {
+		ipv4Dropped++
+		return nil
+	}
+	slot := ipv4FindReassembly(pkt, id)
+	copy(slot.data[offset:], payload)
+	for b := offset / 8; b < (offset+len(payload)+7)/8; b++ {
+		slot.blocks[b/32] |= 1 << (b % 32)
+	}
+	if last {
+		slot.length = offset + len(payload)
+	}
+	if slot.length == 0 {
+		return nil
+	}
+	for b := 0; b < (slot.length+7)/8; b++ {
+		if slot.blocks[b/32]&(1<<(b%32)) == 0 {
+			return nil
+		}
+	}
+	return slot
+}
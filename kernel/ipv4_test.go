@@ -0,0 +1,155 @@
+package kernel
+
+import (
+	"testing"
+)
+
+func TestParseIpv4(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Ipv4Address
+		ok   bool
+	}{
+		{"10.0.2.15", Ipv4Address{10, 0, 2, 15}, true},
+		{"0.0.0.0", IPV4_ANY, true},
+		{"255.255.255.255", IPV4_BROADCAST, true},
+		{"", Ipv4Address{}, false},
+		{"10.0.2", Ipv4Address{}, false},
+		{"10.0.2.15.1", Ipv4Address{}, false},
+		{"10..2.15", Ipv4Address{}, false},
+		{"10.0.2.256", Ipv4Address{}, false},
+		{"10.0.2.x", Ipv4Address{}, false},
+		{"10.0.2.15.", Ipv4Address{}, false},
+	}
+	for _, test := range tests {
+		got, ok := ParseIpv4(test.s)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("ParseIpv4(%q) = %v, %v, want %v, %v", test.s, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestInetChecksum(t *testing.T) {
+	// Commonly used example header, its checksum is 0xb861
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	if sum := inetChecksum(header); sum != 0xb861 {
+		t.Errorf("Checksum is %#x, want 0xb861", sum)
+	}
+	putUint16(header[10:], 0xb861)
+	if sum := inetChecksum(header); sum != 0 {
+		t.Errorf("Checksum over a valid header is %#x", sum)
+	}
+}
+
+// Valid header of a datagram from the peer to us
+func testIpv4Header(protocol uint8, payloadLen int) []byte {
+	h := make([]byte, IPV4_HEADER_SIZE)
+	h[0] = 0x45
+	putUint16(h[2:], uint16(IPV4_HEADER_SIZE+payloadLen))
+	h[8] = IPV4_DEFAULT_TTL
+	h[9] = protocol
+	copy(h[12:16], testPeerIp[:])
+	copy(h[16:20], testIp[:])
+	putUint16(h[10:], inetChecksum(h))
+	return h
+}
+
+func TestIpv4InputDropsBadHeaders(t *testing.T) {
+	n := netTestSetup(t)
+	payload := []byte{1, 2, 3, 4}
+	good := append(testIpv4Header(200, len(payload)), payload...)
+
+	badVersion := append([]byte{}, good...)
+	badVersion[0] = 0x65
+	badHeaderLen := append([]byte{}, good...)
+	badHeaderLen[0] = 0x44
+	badChecksum := append([]byte{}, good...)
+	badChecksum[10] ^= 0xff
+	tooLong := append([]byte{}, good...)
+	putUint16(tooLong[2:], uint16(len(good)+1))
+	putUint16(tooLong[10:], 0)
+	putUint16(tooLong[10:], inetChecksum(tooLong[:IPV4_HEADER_SIZE]))
+	notForUs := append([]byte{}, good...)
+	copy(notForUs[16:20], []byte{10, 0, 2, 99})
+	putUint16(notForUs[10:], 0)
+	putUint16(notForUs[10:], inetChecksum(notForUs[:IPV4_HEADER_SIZE]))
+
+	bad := [][]byte{good[:IPV4_HEADER_SIZE-1], badVersion, badHeaderLen, badChecksum, tooLong, notForUs}
+	for i, p := range bad {
+		before := ipv4Dropped
+		ipv4Input(n, testPeerMac, p)
+		if ipv4Dropped != before+1 {
+			t.Errorf("Packet %d was not dropped", i)
+		}
+	}
+
+	// The good one is accepted and answered with protocol unreachable
+	before := ipv4Dropped
+	ipv4Input(n, testPeerMac, good)
+	if ipv4Dropped != before {
+		t.Errorf("Good packet was dropped")
+	}
+	if testEth.count != 1 {
+		t.Fatalf("Sent %d frames, want an ARP request for the ICMP error", testEth.count)
+	}
+}
+
+func TestIpv4Header(t *testing.T) {
+	netTestSetup(t)
+	var r ipv4Route
+	if err := ipv4FindRoute(IPV4_LOOPBACK, &r); err != ESUCCESS {
+		t.Fatalf("No route to the loopback: %v", err)
+	}
+	payload := []byte("hello")
+	if err := ipv4Output(&r, IPV4_LOOPBACK, 200, payload); err != ESUCCESS {
+		t.Fatalf("ipv4Output returned %v", err)
+	}
+	i := loopback.ring.Pop()
+	if i == -1 {
+		t.Fatal("Nothing was sent on the loopback")
+	}
+	packet := loopback.frames[i][ETH_HEADER_SIZE:loopback.lengths[i]]
+	if len(packet) != IPV4_HEADER_SIZE+len(payload) {
+		t.Fatalf("Packet has %d bytes", len(packet))
+	}
+	if packet[0] != 0x45 || int(getUint16(packet[2:])) != len(packet) || packet[8] != IPV4_DEFAULT_TTL || packet[9] != 200 {
+		t.Errorf("Bad header % x", packet[:IPV4_HEADER_SIZE])
+	}
+	if getUint16(packet[6:]) != 0 {
+		t.Errorf("Unfragmented packet has flags %#x", getUint16(packet[6:]))
+	}
+	if Ipv4Address(packet[12:16]) != IPV4_LOOPBACK || Ipv4Address(packet[16:20]) != IPV4_LOOPBACK {
+		t.Errorf("Bad addresses % x", packet[12:20])
+	}
+	if inetChecksum(packet[:IPV4_HEADER_SIZE]) != 0 {
+		t.Errorf("Bad header checksum")
+	}
+	if string(packet[IPV4_HEADER_SIZE:]) != string(payload) {
+		t.Errorf("Bad payload %q", packet[IPV4_HEADER_SIZE:])
+	}
+}
+
+func TestIpv4FindRoute(t *testing.T) {
+	netTestSetup(t)
+	tests := []struct {
+		dst     Ipv4Address
+		netif   string
+		nextHop Ipv4Address
+		src     Ipv4Address
+	}{
+		{IPV4_LOOPBACK, "lo", IPV4_LOOPBACK, IPV4_LOOPBACK},
+		{testIp, "lo", testIp, testIp},
+		{Ipv4Address{10, 0, 2, 3}, "eth0", Ipv4Address{10, 0, 2, 3}, testIp},
+		{Ipv4Address{8, 8, 8, 8}, "eth0", testPeerIp, testIp},
+	}
+	for _, test := range tests {
+		var r ipv4Route
+		if err := ipv4FindRoute(test.dst, &r); err != ESUCCESS {
+			t.Errorf("No route to %v: %v", test.dst, err)
+			continue
+		}
+		if r.netif.Name != test.netif || r.nextHop != test.nextHop || r.src != test.src {
+			t.Errorf("Route to %v is %s via %v from %v", test.dst, r.netif.Name, r.nextHop, r.src)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Device interrupts. Drivers register a handler for their IRQ number and don't
+// care if the PIC or the IO-APIC delivers it. IRQ n always arrives on vector
+// IRQ_BASE_VECTOR + n. IRQs 0-15 are the ISA ones, the IO-APIC may remap them
+// to other global system interrupts (GSI) but the number stays the same.
+// PCI devices share their interrupt lines, their drivers add a handler instead
+// and check if their device raised the interrupt.
+
+const (
+	IRQ_PRINT_DEBUG = ENABLE_DEBUG
+
+	IRQ_COUNT       = 24
+	ISA_IRQ_COUNT   = 16
+	IRQ_BASE_VECTOR = 0x20
+	// Handlers per shared IRQ
+	IRQ_MAX_HANDLERS = 4
+)
+
+type IrqController interface {
+	Name() string
+	Enable(irq uint8)
+	Disable(irq uint8)
+	// Called before the handler. Spurious interrupts are not passed to the handler.
+	IsSpurious(irq uint8) bool
+	EOI(irq uint8)
+}
+
+var (
+	irqHandlers   [IRQ_COUNT][IRQ_MAX_HANDLERS]func()
+	irqNumHandler [IRQ_COUNT]uint8
+	irqEnabled    uint32
+	irqController IrqController = &legacyPic
+)
+
+func irqInterruptHandler() {
+	info := &CurrentThread.Info
+	if CurrentThread.IsKernelInterrupt {
+		info = &CurrentThread.kernelInfo
+	}
+	irq := uint8(info.InterruptNumber - IRQ_BASE_VECTOR)
+	if irqController.IsSpurious(irq) {
+		return
+	}
+
+	if IRQ_PRINT_DEBUG && irq != 0 {
+		log.KDebugLn("[IRQ] Handler nr ", irq)
+	}
+	if irqNumHandler[irq] == 0 {
+		defaultIrqHandler()
+	}
+	for i := uint8(0); i < irqNumHandler[irq]; i++ {
+		irqHandlers[irq][i]()
+	}
+
+	irqController.EOI(irq)
+}
+
+func defaultIrqHandler() {
+	log.KErrorLn("Unhandled IRQ")
+}
+
+// Replaces all handlers of the IRQ
+func RegisterIRQHandler(irq uint8, f func()) {
+	if irq >= IRQ_COUNT {
+		kernelPanic("[IRQ] The requested irq does not exist")
+	}
+	irqHandlers[irq][0] = f
+	irqNumHandler[irq] = 1
+}
+
+// Share the IRQ with the handlers that are already there
+func AddIRQHandler(irq uint8, f func()) {
+	if irq >= IRQ_COUNT {
+		kernelPanic("[IRQ] The requested irq does not exist")
+	}
+	if irqNumHandler[irq] == IRQ_MAX_HANDLERS {
+		kernelPanic("[IRQ] Too many handlers for one irq")
+	}
+	irqHandlers[irq][irqNumHandler[irq]] = f
+	irqNumHandler[irq]++
+}
+
+func EnableIRQ(irq uint8) {
+	irqEnabled |= 1 << irq
+	irqController.Enable(irq)
+}
+
+func DisableIRQ(irq uint8) {
+	irqEnabled &^= 1 << irq
+	irqController.Disable(irq)
+}
+
+// Move all enabled IRQs over to another interrupt controller
+func setIrqController(c IrqController) {
+	for irq := uint8(0); irq < IRQ_COUNT; irq++ {
+		if irqEnabled&(1<<irq) != 0 {
+			irqController.Disable(irq)
+		}
+	}
+	irqController = c
+	for irq := uint8(0); irq < IRQ_COUNT; irq++ {
+		if irqEnabled&(1<<irq) != 0 {
+			c.Enable(irq)
+		}
+	}
+	log.KDebugLn("[IRQ] Using the ", c.Name())
+}
+
+func InitIrq() {
+	for i := range irqHandlers {
+		SetInterruptHandler(IRQ_BASE_VECTOR+uint8(i), irqInterruptHandler, KCS_SELECTOR, PRIV_USER)
+	}
+}
@@ -60,7 +60,7 @@ func handleKeyboard() {
 }
 
 func InitKeyboard() {
-	RegisterPICHandler(1, handleKeyboard)
+	RegisterIRQHandler(1, handleKeyboard)
 	EnableIRQ(1)
 	buffer.Init()
 }
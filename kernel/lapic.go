@@ -0,0 +1,164 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Local APIC of each CPU. It is used for inter processor interrupts and as
+// the clock event device of every CPU. Device interrupts come from the
+// IO-APIC or, without one, from the PIC through LINT0 of the boot CPU.
+
+const (
+	IA32_APIC_BASE_MSR    = 0x1b
+	APIC_BASE_ADDR_MASK   = 0xfffff000
+	LAPIC_DEFAULT_BASE    = 0xfee00000
+	LAPIC_SPURIOUS_VECTOR = 0xff
+	LAPIC_TIMER_VECTOR    = 0x40
+	RESCHED_VECTOR        = 0x41
+	LAPIC_SVR_ENABLE      = 1 << 8
+	LAPIC_LVT_MASKED      = 1 << 16
+	LAPIC_LVT_EXTINT      = 0x700
+	LAPIC_LVT_NMI         = 0x400
+	LAPIC_TIMER_DIV_16    = 0x3
+	LAPIC_ICR_PENDING     = 1 << 12
+	LAPIC_ICR_INIT        = 0x4500 // INIT, level assert
+	LAPIC_ICR_STARTUP     = 0x4600 // Startup IPI, vector is the page of the entry code
+	LAPIC_ICR_FIXED       = 0x4000
+	LAPIC_CALIBRATION_US  = 10000
+	LAPIC_MAX_TIMER_COUNT = 0xffffffff
+	LAPIC_ID_SHIFT        = 24
+
+	// Register offsets
+	LAPIC_ID            = 0x20
+	LAPIC_EOI           = 0xb0
+	LAPIC_SVR           = 0xf0
+	LAPIC_ICR_LOW       = 0x300
+	LAPIC_ICR_HIGH      = 0x310
+	LAPIC_LVT_TIMER     = 0x320
+	LAPIC_LVT_LINT0     = 0x350
+	LAPIC_LVT_LINT1     = 0x360
+	LAPIC_LVT_ERROR     = 0x370
+	LAPIC_TIMER_INITIAL = 0x380
+	LAPIC_TIMER_CURRENT = 0x390
+	LAPIC_TIMER_DIVIDE  = 0x3e0
+)
+
+var (
+	lapicBase uintptr
+	// 0 if the timer is not calibrated
+	lapicTimerPerSecond uint64
+)
+
+// One shot timer of the current CPU
+type lapicClockEvent struct{}
+
+var lapicTimer lapicClockEvent
+
+func lapicRead(reg uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(lapicBase + reg))
+}
+
+func lapicWrite(reg uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(lapicBase + reg)) = value
+}
+
+func LapicId() uint32 {
+	return lapicRead(LAPIC_ID) >> LAPIC_ID_SHIFT
+}
+
+func lapicEOI() {
+	lapicWrite(LAPIC_EOI, 0)
+}
+
+func lapicSendIpi(apicId uint32, command uint32) {
+	lapicWrite(LAPIC_ICR_HIGH, apicId<<LAPIC_ID_SHIFT)
+	lapicWrite(LAPIC_ICR_LOW, command)
+	for lapicRead(LAPIC_ICR_LOW)&LAPIC_ICR_PENDING != 0 {
+		Pause()
+	}
+}
+
+// Enable the local APIC of the calling CPU. Only the boot CPU receives PIC interrupts.
+func lapicEnable(isBoot bool) {
+	lapicWrite(LAPIC_SVR, LAPIC_SVR_ENABLE|LAPIC_SPURIOUS_VECTOR)
+	if isBoot {
+		// Virtual wire mode, the PIC is connected to LINT0
+		lapicWrite(LAPIC_LVT_LINT0, LAPIC_LVT_EXTINT)
+		lapicWrite(LAPIC_LVT_LINT1, LAPIC_LVT_NMI)
+	} else {
+		lapicWrite(LAPIC_LVT_LINT0, LAPIC_LVT_MASKED)
+		lapicWrite(LAPIC_LVT_LINT1, LAPIC_LVT_MASKED)
+	}
+	lapicWrite(LAPIC_LVT_TIMER, LAPIC_LVT_MASKED)
+	lapicWrite(LAPIC_LVT_ERROR, LAPIC_LVT_MASKED)
+	lapicEOI()
+}
+
+// Measure how fast the timer runs with the PIT as reference
+func lapicCalibrateTimer() {
+	lapicWrite(LAPIC_TIMER_DIVIDE, LAPIC_TIMER_DIV_16)
+	lapicWrite(LAPIC_LVT_TIMER, LAPIC_LVT_MASKED|LAPIC_TIMER_VECTOR)
+	lapicWrite(LAPIC_TIMER_INITIAL, LAPIC_MAX_TIMER_COUNT)
+	pitDelay(LAPIC_CALIBRATION_US)
+	elapsed := uint64(LAPIC_MAX_TIMER_COUNT - lapicRead(LAPIC_TIMER_CURRENT))
+	lapicWrite(LAPIC_TIMER_INITIAL, 0)
+	lapicTimerPerSecond = elapsed * 1000000 / LAPIC_CALIBRATION_US
+	log.KDebugLn("[LAPIC] Timer runs at ", lapicTimerPerSecond/1000, " kHz")
+}
+
+func (l *lapicClockEvent) Name() string {
+	return "local APIC timer"
+}
+
+func (l *lapicClockEvent) MaxDelta() uint64 {
+	return LAPIC_MAX_TIMER_COUNT * NS_PER_SECOND / lapicTimerPerSecond
+}
+
+func (l *lapicClockEvent) SetNextEvent(delta uint64) {
+	count := max(delta*lapicTimerPerSecond/NS_PER_SECOND, 1)
+	lapicWrite(LAPIC_TIMER_DIVIDE, LAPIC_TIMER_DIV_16)
+	lapicWrite(LAPIC_LVT_TIMER, LAPIC_TIMER_VECTOR)
+	lapicWrite(LAPIC_TIMER_INITIAL, uint32(min(count, LAPIC_MAX_TIMER_COUNT)))
+}
+
+func (l *lapicClockEvent) Stop() {
+	lapicWrite(LAPIC_TIMER_INITIAL, 0)
+}
+
+func handleLapicTimer() {
+	hrtimerInterrupt()
+	lapicEOI()
+}
+
+func handleReschedIpi() {
+	PerformSchedule = true
+	lapicEOI()
+}
+
+func handleLapicSpurious() {
+	// No EOI for spurious interrupts
+}
+
+// Needs paging. Leaves lapicBase at 0 if the CPU has no local APIC.
+func InitLapic() {
+	if !hasCpuFeature(CPUID_FEATURE_APIC) {
+		log.KDebugLn("[LAPIC] No local APIC")
+		return
+	}
+	lapicBase = uintptr(Rdmsr(IA32_APIC_BASE_MSR) & APIC_BASE_ADDR_MASK)
+	if lapicBase == 0 {
+		lapicBase = LAPIC_DEFAULT_BASE
+	}
+	mapPhysical(lapicBase, PAGE_SIZE, mm.PAGE_RW|mm.PAGE_DISABLE_CACHE)
+	thisCpu.ApicId = LapicId()
+
+	SetInterruptHandler(LAPIC_TIMER_VECTOR, handleLapicTimer, KCS_SELECTOR, PRIV_KERNEL)
+	SetInterruptHandler(RESCHED_VECTOR, handleReschedIpi, KCS_SELECTOR, PRIV_KERNEL)
+	SetInterruptHandler(LAPIC_SPURIOUS_VECTOR, handleLapicSpurious, KCS_SELECTOR, PRIV_KERNEL)
+
+	lapicEnable(true)
+	lapicCalibrateTimer()
+}
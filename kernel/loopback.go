@@ -0,0 +1,54 @@
+package kernel
+
+// Loopback interface. Sent frames are queued and delivered from a timer, so
+// protocols never see their own packets while they are still sending.
+
+const (
+	LOOPBACK_QUEUE_SIZE = 16
+)
+
+type loopbackDevice struct {
+	netif   *NetInterface
+	frames  [LOOPBACK_QUEUE_SIZE][ETH_FRAME_MAX]byte
+	lengths [LOOPBACK_QUEUE_SIZE]int
+	ring    GenericRing
+	timer   HrTimer
+	// A queued frame can be overwritten while it is delivered, so it is copied here first
+	rxFrame [ETH_FRAME_MAX]byte
+}
+
+var loopback = loopbackDevice{
+	ring: GenericRing{Cap: LOOPBACK_QUEUE_SIZE},
+}
+
+func (l *loopbackDevice) Transmit(frame []byte) bool {
+	i := l.ring.Push()
+	if i == -1 {
+		return false
+	}
+	l.lengths[i] = copy(l.frames[i][:], frame)
+	if !l.timer.IsActive() {
+		StartHrTimer(&l.timer, MonotonicTime())
+	}
+	return true
+}
+
+func loopbackDeliver(t *HrTimer) {
+	l := &loopback
+	for i := l.ring.Pop(); i != -1; i = l.ring.Pop() {
+		size := copy(l.rxFrame[:], l.frames[i][:l.lengths[i]])
+		l.netif.Receive(l.rxFrame[:size])
+	}
+}
+
+func InitLoopback() {
+	n := RegisterNetInterface("lo", MacAddress{}, &loopback)
+	if n == nil {
+		return
+	}
+	loopback.netif = n
+	loopback.timer.Callback = loopbackDeliver
+	n.Loopback = true
+	SetIpv4Config(n, IPV4_LOOPBACK, Ipv4Address{255, 0, 0, 0}, IPV4_ANY)
+	n.SetLink(true)
+}
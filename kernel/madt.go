@@ -0,0 +1,135 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Multiple APIC Description Table. Lists the CPUs, the IO-APICs and how the
+// ISA IRQs are wired to them.
+
+const (
+	MADT_HEADER_SIZE = ACPI_HEADER_SIZE + 8
+
+	MADT_PCAT_COMPAT = 1 << 0 // There are 8259 PICs that have to be masked
+
+	MADT_ENTRY_LAPIC    = 0
+	MADT_ENTRY_IOAPIC   = 1
+	MADT_ENTRY_OVERRIDE = 2
+
+	MADT_LAPIC_ENABLED = 1 << 0
+
+	// Interrupt flags of overrides
+	MADT_POLARITY_MASK  = 0x3
+	MADT_POLARITY_HIGH  = 0x1
+	MADT_POLARITY_LOW   = 0x3
+	MADT_TRIGGER_MASK   = 0xc
+	MADT_TRIGGER_EDGE   = 0x4
+	MADT_TRIGGER_LEVEL  = 0xc
+	MADT_FLAGS_CONFORMS = 0
+)
+
+type madtTable struct {
+	header    acpiHeader
+	lapicAddr uint32
+	flags     uint32
+}
+
+type madtEntryHeader struct {
+	entryType uint8
+	length    uint8
+}
+
+type madtLapic struct {
+	entryHeader madtEntryHeader
+	acpiId      uint8
+	apicId      uint8
+	flags       uint32
+}
+
+type madtIoApic struct {
+	entryHeader madtEntryHeader
+	id          uint8
+	reserved    uint8
+	addr        uint32
+	gsiBase     uint32
+}
+
+type madtOverride struct {
+	entryHeader madtEntryHeader
+	bus         uint8
+	source      uint8
+	gsi         uint32
+	flags       uint16
+}
+
+// Where an ISA IRQ ends up on the IO-APIC
+type isaRoute struct {
+	gsi   uint32
+	flags uint16
+}
+
+var (
+	madt *madtTable
+	// Identity mapped unless there is an override
+	isaRoutes [ISA_IRQ_COUNT]isaRoute
+)
+
+func madtEntries(f func(entry *madtEntryHeader)) {
+	start := uintptr(unsafe.Pointer(madt))
+	for p := start + MADT_HEADER_SIZE; p+2 <= start+uintptr(madt.header.length); {
+		entry := (*madtEntryHeader)(unsafe.Pointer(p))
+		if entry.length < 2 {
+			break
+		}
+		f(entry)
+		p += uintptr(entry.length)
+	}
+}
+
+// Add every enabled AP of the MADT to cpus. Returns false if there is no MADT.
+func madtReadProcessors() bool {
+	if madt == nil {
+		return false
+	}
+	madtEntries(func(entry *madtEntryHeader) {
+		if entry.entryType != MADT_ENTRY_LAPIC {
+			return
+		}
+		lapic := (*madtLapic)(unsafe.Pointer(entry))
+		if lapic.flags&MADT_LAPIC_ENABLED != 0 {
+			addCpu(uint32(lapic.apicId))
+		}
+	})
+	return true
+}
+
+func madtReadIoApics() {
+	madtEntries(func(entry *madtEntryHeader) {
+		switch entry.entryType {
+		case MADT_ENTRY_IOAPIC:
+			ioApicEntry := (*madtIoApic)(unsafe.Pointer(entry))
+			addIoApic(ioApicEntry.id, uintptr(ioApicEntry.addr), ioApicEntry.gsiBase)
+		case MADT_ENTRY_OVERRIDE:
+			override := (*madtOverride)(unsafe.Pointer(entry))
+			if override.bus != 0 || override.source >= ISA_IRQ_COUNT {
+				return
+			}
+			isaRoutes[override.source] = isaRoute{gsi: override.gsi, flags: override.flags}
+			log.KDebugLn("[MADT] IRQ ", override.source, " -> GSI ", override.gsi, " flags ", override.flags)
+		}
+	})
+}
+
+func InitMadt() {
+	for i := range isaRoutes {
+		isaRoutes[i] = isaRoute{gsi: uint32(i), flags: MADT_FLAGS_CONFORMS}
+	}
+	madt = (*madtTable)(unsafe.Pointer(acpiFindTable([4]byte{'A', 'P', 'I', 'C'})))
+	if madt == nil {
+		log.KDebugLn("[MADT] No MADT found")
+		return
+	}
+	madtReadIoApics()
+}
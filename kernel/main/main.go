@@ -32,7 +32,7 @@ var progs = [...]string{
 	// "/usr/syscall-test",
 }
 
-var debugWriters = []io.Writer{&kernel.SerialDevice}
+var debugWriters = []io.Writer{&kernel.SerialDevice, &kernel.VirtioConsole}
 var errorWriters = []io.Writer{&kernel.SerialDevice, kernel.TextModeErrorWriter{}}
 var logWriters = []io.Writer{&kernel.SerialDevice, kernel.TextModeWriter{}}
 
@@ -72,12 +72,18 @@ func kmain(info *multiboot.MultibootInfo, stackstart uintptr, stackend uintptr)
 	kernel.InitPIC()
 	log.KDebugLn("InitPIC complete")
 
+	kernel.InitTime()
+	log.KDebugLn("InitTime complete")
+
 	kernel.InitPit()
 	log.KDebugLn("InitPit complete")
 
 	kernel.InitKeyboard()
 	log.KDebugLn("InitKeyboard complete")
 
+	kernel.InitMouse()
+	log.KDebugLn("InitMouse complete")
+
 	kernel.InitATA()
 	log.KDebugLn("InitATA complete")
 	kernel.InitSerialDeviceInterrupt()
@@ -85,6 +91,12 @@ func kmain(info *multiboot.MultibootInfo, stackstart uintptr, stackend uintptr)
 	log.KDebugLn("InitSerialDeviceInterrupt complete")
 	kernel.InitMultiboot(info)
 	log.KDebugLn("InitMultiboot complete")
+
+	kernel.InitDevices()
+	log.KDebugLn("InitDevices complete")
+
+	kernel.InitFramebuffer()
+	log.KDebugLn("InitFramebuffer complete")
 	kernel.SetInterruptHandler(0xE, pageFaultWrapper, kernel.KCS_SELECTOR, kernel.PRIV_USER)
 	log.KDebugLn("SetInterruptHandler complete")
 
@@ -93,9 +105,54 @@ func kmain(info *multiboot.MultibootInfo, stackstart uintptr, stackend uintptr)
 	mm.InitPaging(kernel.MemoryMaps[:])
 	log.KDebugLn("InitPaging complete")
 
+	kernel.InitBGA()
+	log.KDebugLn("InitBGA complete")
+
+	kernel.InitVirtioBlk()
+	log.KDebugLn("InitVirtioBlk complete")
+
+	kernel.InitVirtioConsole()
+	log.KDebugLn("InitVirtioConsole complete")
+
+	kernel.InitAhci()
+	log.KDebugLn("InitAhci complete")
+
+	kernel.InitE1000()
+	log.KDebugLn("InitE1000 complete")
+
+	kernel.InitPci()
+	log.KDebugLn("InitPci complete")
+
+	kernel.InitAcpiTables()
+	log.KDebugLn("InitAcpiTables complete")
+
+	kernel.InitMadt()
+	log.KDebugLn("InitMadt complete")
+
+	kernel.InitLapic()
+	log.KDebugLn("InitLapic complete")
+
+	kernel.InitIoApic()
+	log.KDebugLn("InitIoApic complete")
+
+	kernel.InitHpet()
+	log.KDebugLn("InitHpet complete")
+
+	kernel.InitClockEvents()
+	log.KDebugLn("InitClockEvents complete")
+
+	kernel.InitNet()
+	log.KDebugLn("InitNet complete")
+
 	kernel.InitUserMode(stackstart, stackend)
 	log.KDebugLn("InitUserMode complete")
 
+	kernel.InitIdleThread()
+	log.KDebugLn("InitIdleThread complete")
+
+	kernel.InitSmp()
+	log.KDebugLn("InitSmp complete")
+
 	kernel.TextModePrintLnCol("Initilaization complete", 0x2)
 	log.KDebugLn("Initialization complete")
 	//HdReadSector()
@@ -113,6 +170,7 @@ func kmain(info *multiboot.MultibootInfo, stackstart uintptr, stackend uintptr)
 			panic.KernelPanic("Could not start program")
 		}
 		newDomain.MemorySpace.MapPage(newThreadMem.Address(), newThreadMem.Address(), mm.PAGE_RW|mm.PAGE_PERM_KERNEL)
+		newDomain.ParentPid = kernel.NO_PARENT
 		kernel.AddDomain(newDomain)
 	}
 
@@ -125,5 +183,6 @@ func kmain(info *multiboot.MultibootInfo, stackstart uintptr, stackend uintptr)
 
 func pageFaultWrapper() {
 	// TODO: Replace
+	kernel.AccountPageFault()
 	mm.PageFaultHandler(uintptr(kernel.CurrentThread.Info.ExceptionCode))
 }
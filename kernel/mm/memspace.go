@@ -74,7 +74,10 @@ func (m *MemSpace) UnmapPage(virtAddr uintptr) {
 	e := pt.GetEntry(virtAddr)
 	if e.IsPresent() {
 		e.UnsetPresent()
-		FreePage(e.GetPhysicalAddress())
+		if isManagedPage(e.GetPhysicalAddress()) {
+			// Pages outside of the managed memory (e.g. device memory) are not ours to free
+			FreePage(e.GetPhysicalAddress())
+		}
 		if PAGE_DEBUG {
 			log.KDebugLn("(phys-addr: ", e.GetPhysicalAddress(), ")")
 		}
@@ -201,6 +204,33 @@ func (m *MemSpace) ReadBytesFromUserSpace(startAddr uintptr, buffer []byte) sysc
 	return 0
 }
 
+// Returns the part of the user buffer at startAddr that is contiguous in physical memory,
+// i.e. at most until the end of the page. The returned slice can be accessed by the kernel.
+func (m *MemSpace) GetUserSpaceSlice(startAddr uintptr, length int) ([]byte, syscall.Errno) {
+	physAddr, ok := m.GetPhysicalAddress(startAddr)
+	if !ok {
+		return nil, syscall.EFAULT
+	}
+	pageLeft := PAGE_SIZE - int(startAddr&(PAGE_SIZE-1))
+	if length > pageLeft {
+		length = pageLeft
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(physAddr)), length), 0
+}
+
+func (m *MemSpace) WriteBytesToUserSpace(startAddr uintptr, data []byte) syscall.Errno {
+	for len(data) > 0 {
+		target, err := m.GetUserSpaceSlice(startAddr, len(data))
+		if err != 0 {
+			return err
+		}
+		n := copy(target, data)
+		data = data[n:]
+		startAddr += uintptr(n)
+	}
+	return 0
+}
+
 func (m *MemSpace) IterateUserSpace(startAt uintptr) iter.Seq2[byte, syscall.Errno] {
 	return func(yield func(byte, syscall.Errno) bool) {
 		if !m.IsAddressAccessible(startAt) {
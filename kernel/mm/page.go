@@ -29,6 +29,13 @@ func (page Page) Pointer() unsafe.Pointer {
 var freePagesList *pageList
 var AllocatedPages int = 0
 
+// Highest address of the memory that is handed out by AllocPage
+var managedMemoryTop uintptr = 0
+
+func isManagedPage(pageAddr unsafe.Pointer) bool {
+	return uintptr(pageAddr) >= KERNEL_RESERVED && uintptr(pageAddr) < managedMemoryTop
+}
+
 func FreePage(pageAddr unsafe.Pointer) {
 	if uintptr(pageAddr)%PAGE_SIZE != 0 {
 		log.KDebugLn("[PAGE] WARNING: freeing Page but is not page aligned: ", pageAddr)
@@ -118,6 +118,9 @@ func InitPaging(memoryMaps []multiboot.MemoryMap) {
 		for i := startAddr; i < uintptr(p.BaseAddr+p.Length); i += PAGE_SIZE {
 			FreePage(unsafe.Pointer(i))
 		}
+		if end := p.BaseAddr + p.Length; end < 1<<32 && uintptr(end) > managedMemoryTop {
+			managedMemoryTop = uintptr(end)
+		}
 	}
 
 	maxPages = -AllocatedPages
@@ -0,0 +1,346 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// PS/2 mouse on the auxiliary port of the 8042 controller. Movement is collected
+// in the interrupt and handed out in the format of Linux' /dev/input/mice.
+
+const (
+	PS2_DATA_PORT    uint16 = 0x60
+	PS2_STATUS_PORT  uint16 = 0x64
+	PS2_COMMAND_PORT uint16 = 0x64
+
+	PS2_STATUS_OUTPUT_FULL = 1 << 0
+	PS2_STATUS_INPUT_FULL  = 1 << 1
+	PS2_STATUS_AUX_DATA    = 1 << 5
+
+	PS2_CMD_READ_CONFIG  = 0x20
+	PS2_CMD_WRITE_CONFIG = 0x60
+	PS2_CMD_ENABLE_AUX   = 0xA8
+	PS2_CMD_WRITE_AUX    = 0xD4
+
+	PS2_CONFIG_AUX_IRQ   = 1 << 1
+	PS2_CONFIG_AUX_CLOCK = 1 << 5 // Set to disable the clock
+
+	MOUSE_IRQ = 12
+
+	MOUSE_CMD_SET_SAMPLE_RATE = 0xF3
+	MOUSE_CMD_GET_ID          = 0xF2
+	MOUSE_CMD_ENABLE          = 0xF4
+	MOUSE_CMD_SET_DEFAULTS    = 0xF6
+	MOUSE_CMD_RESET           = 0xFF
+
+	MOUSE_ACK       = 0xFA
+	MOUSE_SELF_TEST = 0xAA
+
+	MOUSE_ID_INTELLIMOUSE = 3
+
+	MOUSE_BUTTON_LEFT   = 1 << 0
+	MOUSE_BUTTON_RIGHT  = 1 << 1
+	MOUSE_BUTTON_MIDDLE = 1 << 2
+	MOUSE_ALWAYS_ONE    = 1 << 3
+	MOUSE_X_SIGN        = 1 << 4
+	MOUSE_Y_SIGN        = 1 << 5
+	MOUSE_X_OVERFLOW    = 1 << 6
+	MOUSE_Y_OVERFLOW    = 1 << 7
+
+	ps2Timeout = 100000
+)
+
+type MouseDevice struct {
+	FileBase
+	hasWheel bool
+
+	// Packet that is currently received from the mouse
+	packet     [4]byte
+	packetPos  int
+	packetSize int
+
+	// Accumulated state that was not read yet
+	dx      int
+	dy      int
+	dz      int
+	buttons uint8
+	changed bool
+
+	// Emulated mouse protocol of the device file. Programs switch to the
+	// wheel protocol with the same magic sample rate sequence as on the hardware.
+	imps        bool
+	rateHistory [3]byte
+	expectRate  bool
+	reply       [4]byte
+	replyLen    int
+
+	waitQueue WaitQueue
+}
+
+var mouseDevice MouseDevice
+
+func ps2WaitWrite() bool {
+	for i := 0; i < ps2Timeout; i++ {
+		if Inb(PS2_STATUS_PORT)&PS2_STATUS_INPUT_FULL == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func ps2WaitRead() bool {
+	for i := 0; i < ps2Timeout; i++ {
+		if Inb(PS2_STATUS_PORT)&PS2_STATUS_OUTPUT_FULL != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func ps2Command(cmd uint8) {
+	ps2WaitWrite()
+	Outb(PS2_COMMAND_PORT, cmd)
+}
+
+func ps2ReadData() (uint8, bool) {
+	if !ps2WaitRead() {
+		return 0, false
+	}
+	return Inb(PS2_DATA_PORT), true
+}
+
+func ps2WriteData(value uint8) {
+	ps2WaitWrite()
+	Outb(PS2_DATA_PORT, value)
+}
+
+// Send a byte to the mouse and wait for the acknowledgement
+func mouseWrite(value uint8) bool {
+	ps2Command(PS2_CMD_WRITE_AUX)
+	ps2WriteData(value)
+	ack, ok := ps2ReadData()
+	return ok && ack == MOUSE_ACK
+}
+
+func mouseSetSampleRate(rate uint8) bool {
+	return mouseWrite(MOUSE_CMD_SET_SAMPLE_RATE) && mouseWrite(rate)
+}
+
+func mouseGetId() uint8 {
+	if !mouseWrite(MOUSE_CMD_GET_ID) {
+		return 0
+	}
+	id, _ := ps2ReadData()
+	return id
+}
+
+func clampDelta(value int, limit int) int {
+	if value > limit {
+		return limit
+	}
+	if value < -limit {
+		return -limit
+	}
+	return value
+}
+
+func (m *MouseDevice) handlePacket() {
+	flags := m.packet[0]
+	if flags&(MOUSE_X_OVERFLOW|MOUSE_Y_OVERFLOW) != 0 {
+		return
+	}
+	// Movement is 9 bit two's complement with the sign bit in the first byte
+	dx := int(m.packet[1])
+	if flags&MOUSE_X_SIGN != 0 {
+		dx -= 0x100
+	}
+	dy := int(m.packet[2])
+	if flags&MOUSE_Y_SIGN != 0 {
+		dy -= 0x100
+	}
+	m.dx += dx
+	m.dy += dy
+	if m.hasWheel {
+		// Lower 4 bits are the signed wheel movement
+		m.dz += int(int8(m.packet[3]<<4) >> 4)
+	}
+	m.buttons = flags & (MOUSE_BUTTON_LEFT | MOUSE_BUTTON_RIGHT | MOUSE_BUTTON_MIDDLE)
+	m.changed = true
+}
+
+func handleMouse() {
+	m := &mouseDevice
+	status := Inb(PS2_STATUS_PORT)
+	if status&PS2_STATUS_OUTPUT_FULL == 0 || status&PS2_STATUS_AUX_DATA == 0 {
+		return
+	}
+	data := Inb(PS2_DATA_PORT)
+	if m.packetPos == 0 && data&MOUSE_ALWAYS_ONE == 0 {
+		// Out of sync, wait for the start of the next packet
+		return
+	}
+	m.packet[m.packetPos] = data
+	m.packetPos++
+	if m.packetPos == m.packetSize {
+		m.packetPos = 0
+		m.handlePacket()
+		m.waitQueue.WakeAll()
+	}
+}
+
+func (m *MouseDevice) queueReply(data ...byte) {
+	// Replies to commands replace anything that was not read yet
+	m.replyLen = copy(m.reply[:], data)
+}
+
+// Commands written to the device file. Only the ones needed for switching protocols do something.
+func (m *MouseDevice) Write(buf []byte) (int, syscall.Errno) {
+	for _, c := range buf {
+		if m.expectRate {
+			m.expectRate = false
+			m.rateHistory[0] = m.rateHistory[1]
+			m.rateHistory[1] = m.rateHistory[2]
+			m.rateHistory[2] = c
+			if m.rateHistory == [3]byte{200, 100, 80} {
+				m.imps = true
+			}
+			m.queueReply(MOUSE_ACK)
+			continue
+		}
+		switch c {
+		case MOUSE_CMD_SET_SAMPLE_RATE:
+			m.expectRate = true
+			m.queueReply(MOUSE_ACK)
+		case MOUSE_CMD_GET_ID:
+			if m.imps {
+				m.queueReply(MOUSE_ACK, MOUSE_ID_INTELLIMOUSE)
+			} else {
+				m.queueReply(MOUSE_ACK, 0)
+			}
+		case MOUSE_CMD_RESET:
+			m.imps = false
+			m.queueReply(MOUSE_ACK, MOUSE_SELF_TEST, 0)
+		default:
+			m.queueReply(MOUSE_ACK)
+		}
+	}
+	return len(buf), ESUCCESS
+}
+
+// Build the next packet from the accumulated movement. Movement that does
+// not fit into one packet is kept for the next one.
+func (m *MouseDevice) nextPacket(packet *[4]byte) int {
+	dx := clampDelta(m.dx, 127)
+	dy := clampDelta(m.dy, 127)
+	packet[0] = MOUSE_ALWAYS_ONE | m.buttons
+	if dx < 0 {
+		packet[0] |= MOUSE_X_SIGN
+	}
+	if dy < 0 {
+		packet[0] |= MOUSE_Y_SIGN
+	}
+	packet[1] = byte(dx)
+	packet[2] = byte(dy)
+	m.dx -= dx
+	m.dy -= dy
+
+	size := 3
+	if m.imps {
+		dz := clampDelta(m.dz, 7)
+		packet[3] = byte(dz)
+		m.dz -= dz
+		size = 4
+	} else {
+		m.dz = 0
+	}
+	m.changed = m.dx != 0 || m.dy != 0 || m.dz != 0
+	return size
+}
+
+func (m *MouseDevice) Read(buf []byte) (int, syscall.Errno) {
+	if len(buf) == 0 {
+		return 0, ESUCCESS
+	}
+	packetSize := 3
+	if m.imps {
+		packetSize = 4
+	}
+	for !m.changed && m.replyLen == 0 {
+		m.waitQueue.Wait()
+	}
+	if m.replyLen > 0 {
+		n := copy(buf, m.reply[:m.replyLen])
+		copy(m.reply[:], m.reply[n:m.replyLen])
+		m.replyLen -= n
+		return n, ESUCCESS
+	}
+	// Only whole packets, a part of one would break the stream for later reads
+	if len(buf) < packetSize {
+		return 0, syscall.EINVAL
+	}
+	num := 0
+	for m.changed && len(buf)-num >= packetSize {
+		var packet [4]byte
+		size := m.nextPacket(&packet)
+		num += copy(buf[num:], packet[:size])
+	}
+	return num, ESUCCESS
+}
+
+// Commands are answered right away, so writing never blocks
+func (m *MouseDevice) Poll(pt *PollTable) uint32 {
+	pt.Wait(&m.waitQueue)
+	events := uint32(POLLOUT | POLLWRNORM)
+	if m.changed || m.replyLen > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	return events
+}
+
+func openMouse() (File, syscall.Errno) {
+	return &mouseDevice, ESUCCESS
+}
+
+// Has to run with interrupts disabled, since the answers of the mouse are polled
+func InitMouse() {
+	m := &mouseDevice
+
+	ps2Command(PS2_CMD_ENABLE_AUX)
+	ps2Command(PS2_CMD_READ_CONFIG)
+	config, ok := ps2ReadData()
+	if !ok {
+		log.KDebugLn("[MOUSE] No PS/2 controller found")
+		return
+	}
+	config |= PS2_CONFIG_AUX_IRQ
+	config &^= PS2_CONFIG_AUX_CLOCK
+	ps2Command(PS2_CMD_WRITE_CONFIG)
+	ps2WriteData(config)
+
+	if !mouseWrite(MOUSE_CMD_SET_DEFAULTS) {
+		log.KDebugLn("[MOUSE] No mouse found")
+		return
+	}
+
+	// IntelliMouse detection: the mouse reports ID 3 after this sample rate sequence
+	mouseSetSampleRate(200)
+	mouseSetSampleRate(100)
+	mouseSetSampleRate(80)
+	m.hasWheel = mouseGetId() == MOUSE_ID_INTELLIMOUSE
+	m.packetSize = 3
+	if m.hasWheel {
+		m.packetSize = 4
+	}
+	mouseSetSampleRate(100)
+
+	if !mouseWrite(MOUSE_CMD_ENABLE) {
+		log.KErrorLn("[MOUSE] Could not enable data reporting")
+		return
+	}
+	log.KDebugLn("[MOUSE] PS/2 mouse found. Wheel: ", m.hasWheel)
+
+	RegisterIRQHandler(MOUSE_IRQ, handleMouse)
+	EnableIRQ(MOUSE_IRQ)
+	RegisterDevice("/dev/input/mice", openMouse)
+}
@@ -13,6 +13,13 @@ var (
 	loadedModules [30]multiboot.MultibootModule
 
 	MemoryMaps [6]multiboot.MemoryMap
+
+	// Framebuffer set up by the bootloader. The tag type is 0 if there was none
+	BootFramebuffer multiboot.MultibootFramebuffer
+
+	// Kernel command line, copied since the boot information is not kept
+	bootCmdline    [256]byte
+	bootCmdlineLen = 0
 )
 
 func InitMultiboot(info *multiboot.MultibootInfo) {
@@ -29,6 +36,15 @@ func InitMultiboot(info *multiboot.MultibootInfo) {
 		if mbTag.Type == 0 && mbTag.Size == 8 {
 			break
 		}
+		if mbTag.Type == 1 && mbTag.Size > 8 {
+			// Zero terminated string after the tag header
+			cmdline := mbI[i+8 : i+mbTag.Size]
+			for bootCmdlineLen < len(bootCmdline) && bootCmdlineLen < len(cmdline) && cmdline[bootCmdlineLen] != 0 {
+				bootCmdline[bootCmdlineLen] = cmdline[bootCmdlineLen]
+				bootCmdlineLen++
+			}
+			log.KDebugLn("Command line: ", unsafe.String(&bootCmdline[0], bootCmdlineLen))
+		}
 		if mbTag.Type == 3 {
 			if foundModules < len(loadedModuleSlice) {
 				mbMod := (*multiboot.MultibootModule)(unsafe.Pointer(mbTag))
@@ -54,6 +70,10 @@ func InitMultiboot(info *multiboot.MultibootInfo) {
 				MemoryMaps[i] = v
 			}
 		}
+		if mbTag.Type == 8 {
+			BootFramebuffer = *(*multiboot.MultibootFramebuffer)(unsafe.Pointer(mbTag))
+			log.KDebugLn("Framebuffer ", BootFramebuffer.Width, "x", BootFramebuffer.Height, "x", BootFramebuffer.Bpp, " type ", BootFramebuffer.FramebufferType)
+		}
 		oldi := i
 		size := max(mbTag.Size, 8)
 		i = (i + size + 7) & 0xfffffff8
@@ -65,3 +85,20 @@ func InitMultiboot(info *multiboot.MultibootInfo) {
 	log.KDebugLn("Done")
 	//printMemMaps()
 }
+
+// Value of name=value on the kernel command line
+func BootCmdlineOption(name string) (string, bool) {
+	cmdline := bootCmdline[:bootCmdlineLen]
+	for start := 0; start < len(cmdline); {
+		end := start
+		for end < len(cmdline) && cmdline[end] != ' ' {
+			end++
+		}
+		option := unsafe.String(unsafe.SliceData(cmdline[start:]), end-start)
+		if len(option) > len(name) && option[:len(name)] == name && option[len(name)] == '=' {
+			return option[len(name)+1:], true
+		}
+		start = end + 1
+	}
+	return "", false
+}
@@ -4,6 +4,10 @@ import "unsafe"
 
 const (
 	MEM_MAP_AVAILABLE = 1
+
+	FRAMEBUFFER_TYPE_INDEXED  = 0
+	FRAMEBUFFER_TYPE_RGB      = 1
+	FRAMEBUFFER_TYPE_EGA_TEXT = 2
 )
 
 type MultibootInfo struct {
@@ -25,6 +29,25 @@ type MultibootMemoryMap struct {
 	Entries      MemoryMap // Take pointer of it and use it as slice with
 }
 
+type MultibootFramebuffer struct {
+	MultibootTag    // Type is 8
+	Addr            uint64
+	Pitch           uint32 // Bytes per line
+	Width           uint32
+	Height          uint32
+	Bpp             uint8
+	FramebufferType uint8
+	reserved        uint16
+
+	// Color info. Only valid if FramebufferType is FRAMEBUFFER_TYPE_RGB
+	RedFieldPosition   uint8
+	RedMaskSize        uint8
+	GreenFieldPosition uint8
+	GreenMaskSize      uint8
+	BlueFieldPosition  uint8
+	BlueMaskSize       uint8
+}
+
 // A module represents a module to be loaded along with the kernel.
 type MultibootModule struct {
 	MultibootTag
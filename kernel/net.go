@@ -0,0 +1,78 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Brings up the protocols and configures the interfaces from the ip= option
+// on the kernel command line. Like Linux it takes
+//   ip=dhcp
+//   ip=off
+//   ip=<client>:<server>:<gateway>:<netmask>[:<hostname>[:<device>]]
+// The server and hostname are ignored. Without the option every ethernet
+// interface uses DHCP.
+
+// Split s at the n-th colon, missing fields are empty
+func netCmdlineField(s string, n int) string {
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == ':' {
+			if n == 0 {
+				return s[start:i]
+			}
+			n--
+			start = i + 1
+		}
+	}
+	return ""
+}
+
+func netConfigureStatic(option string) {
+	var n *NetInterface
+	if device := netCmdlineField(option, 5); device != "" {
+		n = FindNetInterface(device)
+	} else {
+		for i := 0; i < numNetInterfaces && n == nil; i++ {
+			if !netInterfaces[i].Loopback {
+				n = &netInterfaces[i]
+			}
+		}
+	}
+	if n == nil || n.Loopback {
+		log.KErrorLn("[NET] No interface for ip=", option)
+		return
+	}
+	address, ok1 := ParseIpv4(netCmdlineField(option, 0))
+	netmask, ok2 := ParseIpv4(netCmdlineField(option, 3))
+	gateway, ok3 := ParseIpv4(netCmdlineField(option, 2))
+	if !ok1 {
+		log.KErrorLn("[NET] Bad ip=", option)
+		return
+	}
+	if !ok2 {
+		netmask = Ipv4Address{255, 255, 255, 0}
+	}
+	if !ok3 {
+		gateway = IPV4_ANY
+	}
+	SetIpv4Config(n, address, netmask, gateway)
+}
+
+func InitNet() {
+	RegisterNetProtocol(ETH_P_ARP, arpInput)
+	RegisterNetProtocol(ETH_P_IP, ipv4Input)
+	InitLoopback()
+
+	option, ok := BootCmdlineOption("ip")
+	switch {
+	case ok && option == "off":
+	case ok && option != "dhcp":
+		netConfigureStatic(option)
+	default:
+		for i := 0; i < numNetInterfaces; i++ {
+			if !netInterfaces[i].Loopback {
+				StartDhcp(&netInterfaces[i])
+			}
+		}
+	}
+}
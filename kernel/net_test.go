@@ -0,0 +1,96 @@
+package kernel
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Helpers for the network tests. They run the protocols on the host, so
+// there is no clock event device and the loopback is flushed by hand.
+
+const TEST_NET_FRAMES = 8
+
+var (
+	testMac     = MacAddress{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	testPeerMac = MacAddress{0x52, 0x55, 0x0a, 0x00, 0x02, 0x02}
+	testIp      = Ipv4Address{10, 0, 2, 15}
+	testPeerIp  = Ipv4Address{10, 0, 2, 2}
+	testNetmask = Ipv4Address{255, 255, 255, 0}
+)
+
+// Ethernet card that keeps the frames it was given
+type testNetDriver struct {
+	frames  [TEST_NET_FRAMES][ETH_FRAME_MAX]byte
+	lengths [TEST_NET_FRAMES]int
+	count   int
+}
+
+func (d *testNetDriver) Transmit(frame []byte) bool {
+	if d.count == TEST_NET_FRAMES {
+		return false
+	}
+	d.lengths[d.count] = copy(d.frames[d.count][:], frame)
+	d.count++
+	return true
+}
+
+func (d *testNetDriver) frame(i int) []byte {
+	return d.frames[i][:d.lengths[i]]
+}
+
+var testEth testNetDriver
+
+// Start from a fresh stack with the loopback and one ethernet interface
+func netTestSetup(t *testing.T) *NetInterface {
+	t.Helper()
+	// MonotonicTime needs a TSC frequency
+	tscPerSecond = NS_PER_SECOND
+	netInterfaces = [NETIF_MAX]NetInterface{}
+	numNetInterfaces = 0
+	netProtocols = [NETIF_MAX_PROTOCOLS]netProtocol{}
+	numNetProtocols = 0
+	arpCache = [ARP_CACHE_SIZE]arpEntry{}
+	udpEndpoints = [UDP_MAX_ENDPOINTS]*udpEndpoint{}
+	ipv4Reasm = [IPV4_REASM_SLOTS]ipv4Reassembly{}
+	ipv4Dropped = 0
+	CancelHrTimer(&loopback.timer)
+	loopback.ring = GenericRing{Cap: LOOPBACK_QUEUE_SIZE}
+	testEth = testNetDriver{}
+
+	RegisterNetProtocol(ETH_P_ARP, arpInput)
+	RegisterNetProtocol(ETH_P_IP, ipv4Input)
+	InitLoopback()
+	n := RegisterNetInterface("eth0", testMac, &testEth)
+	if n == nil {
+		t.Fatal("Could not register eth0")
+	}
+	SetIpv4Config(n, testIp, testNetmask, testPeerIp)
+	n.SetLink(true)
+	return n
+}
+
+// Deliver the frames queued on the loopback, like its timer does
+func loopbackFlush() {
+	CancelHrTimer(&loopback.timer)
+	loopbackDeliver(&loopback.timer)
+}
+
+// Put payload in an ethernet frame from the peer
+func testFrame(buf []byte, dst MacAddress, etherType uint16, payload []byte) []byte {
+	copy(buf[0:6], dst[:])
+	copy(buf[6:12], testPeerMac[:])
+	putUint16(buf[12:], etherType)
+	n := copy(buf[ETH_HEADER_SIZE:], payload)
+	return buf[:ETH_HEADER_SIZE+n]
+}
+
+func TestNetSendFrameNeedsLink(t *testing.T) {
+	n := netTestSetup(t)
+	n.SetLink(false)
+	if err := n.SendFrame(testPeerMac, ETH_P_IP, []byte{1, 2, 3}); err != syscall.ENETDOWN {
+		t.Errorf("SendFrame without link returned %v", err)
+	}
+	if testEth.count != 0 || n.TxDropped != 1 {
+		t.Errorf("Frame was not dropped, sent %d, dropped %d", testEth.count, n.TxDropped)
+	}
+}
@@ -0,0 +1,190 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Network interfaces. Drivers register one per card and pass received
+// ethernet frames to Receive, which hands the payload to the protocol
+// registered for its ether type. Protocols send with SendFrame.
+
+const (
+	ETH_ALEN        = 6
+	ETH_HEADER_SIZE = 14
+	ETH_MTU         = 1500
+	ETH_FRAME_MAX   = ETH_HEADER_SIZE + ETH_MTU // Without the CRC, the cards add it
+
+	NETIF_MAX           = 4
+	NETIF_MAX_PROTOCOLS = 8
+)
+
+type MacAddress [ETH_ALEN]byte
+
+var MAC_BROADCAST = MacAddress{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type NetDriver interface {
+	// Queue one frame for sending. Returns false if the card has no room for it.
+	// The frame is copied, the caller may reuse the buffer.
+	Transmit(frame []byte) bool
+}
+
+// Called with the payload of a received frame, which is only valid during the call
+type NetProtocolHandler func(n *NetInterface, src MacAddress, payload []byte)
+
+type netProtocol struct {
+	etherType uint16
+	handler   NetProtocolHandler
+}
+
+type NetInterface struct {
+	Name   string
+	Mac    MacAddress
+	Mtu    int
+	LinkUp bool
+	// Frames come straight back, there are no other hosts to find with ARP
+	Loopback bool
+	Ipv4     Ipv4Config
+	driver   NetDriver
+
+	RxPackets uint64
+	RxBytes   uint64
+	RxDropped uint64
+	TxPackets uint64
+	TxBytes   uint64
+	TxDropped uint64
+
+	txFrame [ETH_FRAME_MAX]byte
+}
+
+var (
+	netInterfaces    [NETIF_MAX]NetInterface
+	numNetInterfaces = 0
+
+	netProtocols    [NETIF_MAX_PROTOCOLS]netProtocol
+	numNetProtocols = 0
+)
+
+func (m MacAddress) IsBroadcast() bool {
+	return m == MAC_BROADCAST
+}
+
+func (m MacAddress) IsMulticast() bool {
+	return m[0]&1 != 0
+}
+
+const hexDigits = "0123456789abcdef"
+
+func logMac(m MacAddress) {
+	for i, b := range m {
+		if i > 0 {
+			log.KDebug(":")
+		}
+		log.KDebug(hexDigits[b>>4:(b>>4)+1], hexDigits[b&0xf:(b&0xf)+1])
+	}
+}
+
+// Returns nil if there are too many interfaces
+func RegisterNetInterface(name string, mac MacAddress, driver NetDriver) *NetInterface {
+	if numNetInterfaces == NETIF_MAX {
+		log.KErrorLn("[NET] Too many interfaces, ignoring ", name)
+		return nil
+	}
+	n := &netInterfaces[numNetInterfaces]
+	numNetInterfaces++
+	n.Name = name
+	n.Mac = mac
+	n.Mtu = ETH_MTU
+	n.driver = driver
+	log.KDebug("[NET] ", name, ": ")
+	logMac(mac)
+	log.KDebugLn("")
+	return n
+}
+
+func FindNetInterface(name string) *NetInterface {
+	for i := 0; i < numNetInterfaces; i++ {
+		if netInterfaces[i].Name == name {
+			return &netInterfaces[i]
+		}
+	}
+	return nil
+}
+
+func NetInterfaceCount() int {
+	return numNetInterfaces
+}
+
+func NetInterfaceAt(i int) *NetInterface {
+	return &netInterfaces[i]
+}
+
+// Protocols register before the interfaces receive anything
+func RegisterNetProtocol(etherType uint16, handler NetProtocolHandler) {
+	if numNetProtocols == NETIF_MAX_PROTOCOLS {
+		kernelPanic("[NET] Too many protocols")
+	}
+	netProtocols[numNetProtocols] = netProtocol{etherType: etherType, handler: handler}
+	numNetProtocols++
+}
+
+// Called by the driver when the link changes
+func (n *NetInterface) SetLink(up bool) {
+	if up != n.LinkUp {
+		if up {
+			log.KDebugLn("[NET] ", n.Name, ": Link up")
+		} else {
+			log.KDebugLn("[NET] ", n.Name, ": Link down")
+		}
+	}
+	n.LinkUp = up
+}
+
+// Called by the driver for every received frame
+func (n *NetInterface) Receive(frame []byte) {
+	if len(frame) < ETH_HEADER_SIZE {
+		n.RxDropped++
+		return
+	}
+	var dst, src MacAddress
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+	etherType := uint16(frame[12])<<8 | uint16(frame[13])
+	if dst != n.Mac && !dst.IsBroadcast() && !dst.IsMulticast() {
+		n.RxDropped++
+		return
+	}
+	n.RxPackets++
+	n.RxBytes += uint64(len(frame))
+	for i := 0; i < numNetProtocols; i++ {
+		if netProtocols[i].etherType == etherType {
+			netProtocols[i].handler(n, src, frame[ETH_HEADER_SIZE:])
+			return
+		}
+	}
+}
+
+// Send payload in an ethernet frame. Never sleeps, a full transmit ring drops the frame.
+func (n *NetInterface) SendFrame(dst MacAddress, etherType uint16, payload []byte) syscall.Errno {
+	if len(payload) > n.Mtu {
+		return syscall.EMSGSIZE
+	}
+	if !n.LinkUp {
+		n.TxDropped++
+		return syscall.ENETDOWN
+	}
+	frame := n.txFrame[:ETH_HEADER_SIZE+len(payload)]
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], n.Mac[:])
+	frame[12] = uint8(etherType >> 8)
+	frame[13] = uint8(etherType)
+	copy(frame[ETH_HEADER_SIZE:], payload)
+	if !n.driver.Transmit(frame) {
+		n.TxDropped++
+		return syscall.ENOBUFS
+	}
+	n.TxPackets++
+	n.TxBytes += uint64(len(frame))
+	return ESUCCESS
+}
@@ -0,0 +1,394 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// PCI devices are found by scanning bus 0 and every bus behind a bridge.
+// Drivers register which devices they handle and are probed for every match.
+
+const (
+	PCI_CONFIG_ADDRESS uint16 = 0xCF8
+	PCI_CONFIG_DATA    uint16 = 0xCFC
+
+	PCI_MAX_DEVICES   = 64
+	PCI_MAX_DRIVERS   = 16
+	PCI_MAX_BARS      = 6
+	PCI_MAX_SLOTS     = 32
+	PCI_MAX_FUNCTIONS = 8
+
+	// Configuration space
+	PCI_VENDOR_ID          = 0x00
+	PCI_DEVICE_ID          = 0x02
+	PCI_COMMAND            = 0x04
+	PCI_STATUS             = 0x06
+	PCI_REVISION           = 0x08
+	PCI_PROG_IF            = 0x09
+	PCI_SUBCLASS           = 0x0a
+	PCI_CLASS              = 0x0b
+	PCI_HEADER_TYPE        = 0x0e
+	PCI_BAR0               = 0x10
+	PCI_SECONDARY_BUS      = 0x19
+	PCI_SUBSYSTEM_VENDOR   = 0x2c
+	PCI_SUBSYSTEM_ID       = 0x2e
+	PCI_CAPABILITY_POINTER = 0x34
+	PCI_INTERRUPT_LINE     = 0x3c
+	PCI_INTERRUPT_PIN      = 0x3d
+
+	PCI_COMMAND_IO           = 1 << 0
+	PCI_COMMAND_MEMORY       = 1 << 1
+	PCI_COMMAND_BUS_MASTER   = 1 << 2
+	PCI_COMMAND_INTX_DISABLE = 1 << 10
+
+	PCI_STATUS_CAPABILITIES = 1 << 4
+
+	PCI_CAP_VENDOR = 0x09
+
+	PCI_HEADER_MULTIFUNCTION = 1 << 7
+	PCI_HEADER_TYPE_MASK     = 0x7f
+	PCI_HEADER_DEVICE        = 0
+	PCI_HEADER_BRIDGE        = 1
+
+	PCI_CLASS_BRIDGE        = 0x06
+	PCI_SUBCLASS_HOST       = 0x00
+	PCI_SUBCLASS_PCI_BRIDGE = 0x04
+
+	PCI_BAR_IO          = 1 << 0
+	PCI_BAR_TYPE_MASK   = 0x6
+	PCI_BAR_TYPE_64     = 0x4
+	PCI_BAR_PREFETCH    = 1 << 3
+	PCI_BAR_IO_MASK     = 0xfffffffc
+	PCI_BAR_MEMORY_MASK = 0xfffffff0
+
+	PCI_INTERRUPT_NONE = 0xff
+
+	PCI_VENDOR_NONE = 0xffff
+	PCI_ANY_ID      = 0xffff
+	PCI_ANY_CLASS   = 0xffff
+)
+
+type PciAddress struct {
+	Bus      uint8
+	Slot     uint8
+	Function uint8
+}
+
+type PciBar struct {
+	Base         uintptr // Physical address or IO port
+	Size         uintptr
+	IsIo         bool
+	Prefetchable bool
+	mapped       bool
+}
+
+type PciDevice struct {
+	Addr            PciAddress
+	VendorId        uint16
+	DeviceId        uint16
+	SubsystemVendor uint16
+	SubsystemId     uint16
+	Class           uint8
+	Subclass        uint8
+	ProgIf          uint8
+	Revision        uint8
+	Bars            [PCI_MAX_BARS]PciBar
+	// Legacy interrupt, PCI_INTERRUPT_NONE if the device has none
+	IrqLine uint8
+	IrqPin  uint8
+
+	Driver *PciDriver
+	// For the driver
+	DriverData uintptr
+}
+
+// A field set to PCI_ANY_ID or PCI_ANY_CLASS matches everything
+type PciMatch struct {
+	Vendor uint16
+	Device uint16
+	Class  uint16 // Class << 8 | subclass
+}
+
+type PciDriver struct {
+	Name    string
+	Matches []PciMatch
+	// Returns false if the driver does not handle the device after all
+	Probe func(dev *PciDevice) bool
+}
+
+var (
+	pciDevices    [PCI_MAX_DEVICES]PciDevice
+	numPciDevices = 0
+	pciDrivers    [PCI_MAX_DRIVERS]*PciDriver
+	numPciDrivers = 0
+	pciScanned    = false
+)
+
+// Configuration space access mechanism #1
+func (a PciAddress) configAddress(offset uint8) uint32 {
+	return 1<<31 | uint32(a.Bus)<<16 | uint32(a.Slot)<<11 | uint32(a.Function)<<8 | uint32(offset&0xfc)
+}
+
+func (a PciAddress) ReadConfig32(offset uint8) uint32 {
+	Outl(PCI_CONFIG_ADDRESS, a.configAddress(offset))
+	return Inl(PCI_CONFIG_DATA)
+}
+
+func (a PciAddress) ReadConfig16(offset uint8) uint16 {
+	return uint16(a.ReadConfig32(offset) >> ((offset & 2) * 8))
+}
+
+func (a PciAddress) ReadConfig8(offset uint8) uint8 {
+	return uint8(a.ReadConfig32(offset) >> ((offset & 3) * 8))
+}
+
+func (a PciAddress) WriteConfig32(offset uint8, value uint32) {
+	Outl(PCI_CONFIG_ADDRESS, a.configAddress(offset))
+	Outl(PCI_CONFIG_DATA, value)
+}
+
+func (a PciAddress) WriteConfig16(offset uint8, value uint16) {
+	shift := (offset & 2) * 8
+	old := a.ReadConfig32(offset) &^ (0xffff << shift)
+	a.WriteConfig32(offset, old|uint32(value)<<shift)
+}
+
+func (a PciAddress) WriteConfig8(offset uint8, value uint8) {
+	shift := (offset & 3) * 8
+	old := a.ReadConfig32(offset) &^ (0xff << shift)
+	a.WriteConfig32(offset, old|uint32(value)<<shift)
+}
+
+func (d *PciDevice) setCommand(set uint16, clear uint16) {
+	command := d.Addr.ReadConfig16(PCI_COMMAND)
+	d.Addr.WriteConfig16(PCI_COMMAND, command&^clear|set)
+}
+
+// Let the device decode its BARs and do DMA
+func (d *PciDevice) Enable() {
+	d.setCommand(PCI_COMMAND_IO|PCI_COMMAND_MEMORY|PCI_COMMAND_BUS_MASTER, 0)
+}
+
+// Offset of the capability in the configuration space or 0
+func (d *PciDevice) FindCapability(id uint8) uint8 {
+	if d.Addr.ReadConfig16(PCI_STATUS)&PCI_STATUS_CAPABILITIES == 0 {
+		return 0
+	}
+	return d.findCapabilityFrom(d.Addr.ReadConfig8(PCI_CAPABILITY_POINTER), id)
+}
+
+// The next capability with the same id after offset, for devices that have several
+func (d *PciDevice) FindNextCapability(offset uint8, id uint8) uint8 {
+	return d.findCapabilityFrom(d.Addr.ReadConfig8(offset+1), id)
+}
+
+func (d *PciDevice) findCapabilityFrom(offset uint8, id uint8) uint8 {
+	offset &^= 3
+	// Bounded in case the list loops
+	for i := 0; i < 48 && offset != 0; i++ {
+		if d.Addr.ReadConfig8(offset) == id {
+			return offset
+		}
+		offset = d.Addr.ReadConfig8(offset+1) &^ 3
+	}
+	return 0
+}
+
+// Map a memory BAR uncached into the kernel address space. Returns 0 for IO BARs.
+func (d *PciDevice) MapBar(i int) uintptr {
+	bar := &d.Bars[i]
+	if bar.IsIo || bar.Base == 0 {
+		return 0
+	}
+	if !bar.mapped {
+		mapPhysical(bar.Base, bar.Size, mm.PAGE_RW|mm.PAGE_DISABLE_CACHE)
+		bar.mapped = true
+	}
+	return bar.Base
+}
+
+// Wait until the bits in mask of a memory mapped register equal value. Returns false on timeout.
+func mmioWait(addr uintptr, mask uint32, value uint32, timeout uint64) bool {
+	deadline := MonotonicTime() + timeout
+	for *(*uint32)(unsafe.Pointer(addr))&mask != value {
+		if MonotonicTime() > deadline {
+			return false
+		}
+		Pause()
+	}
+	return true
+}
+
+// Returns how many BAR registers the BAR takes
+func (d *PciDevice) readBar(i int) int {
+	offset := uint8(PCI_BAR0 + i*4)
+	bar := &d.Bars[i]
+	value := d.Addr.ReadConfig32(offset)
+	// The BAR must not decode while it holds the size mask
+	command := d.Addr.ReadConfig16(PCI_COMMAND)
+	d.Addr.WriteConfig16(PCI_COMMAND, command&^(PCI_COMMAND_IO|PCI_COMMAND_MEMORY))
+	d.Addr.WriteConfig32(offset, 0xffffffff)
+	sizeMask := d.Addr.ReadConfig32(offset)
+	d.Addr.WriteConfig32(offset, value)
+	d.Addr.WriteConfig16(PCI_COMMAND, command)
+
+	if value&PCI_BAR_IO != 0 {
+		bar.IsIo = true
+		bar.Base = uintptr(value & PCI_BAR_IO_MASK)
+		bar.Size = uintptr(^(sizeMask&PCI_BAR_IO_MASK)&0xffff) + 1
+		return 1
+	}
+	bar.Prefetchable = value&PCI_BAR_PREFETCH != 0
+	bar.Base = uintptr(value & PCI_BAR_MEMORY_MASK)
+	if sizeMask&PCI_BAR_MEMORY_MASK != 0 {
+		bar.Size = uintptr(^(sizeMask & PCI_BAR_MEMORY_MASK)) + 1
+	}
+	if value&PCI_BAR_TYPE_MASK != PCI_BAR_TYPE_64 {
+		return 1
+	}
+	if high := d.Addr.ReadConfig32(offset + 4); high != 0 {
+		// Not reachable without PAE
+		log.KErrorLn("[PCI] Ignoring BAR above 4G of ", d.Addr.Bus, ":", d.Addr.Slot, ".", d.Addr.Function)
+		bar.Base = 0
+		bar.Size = 0
+	}
+	return 2
+}
+
+func pciAddDevice(addr PciAddress) *PciDevice {
+	if numPciDevices == PCI_MAX_DEVICES {
+		log.KErrorLn("[PCI] Too many devices")
+		return nil
+	}
+	d := &pciDevices[numPciDevices]
+	numPciDevices++
+	d.Addr = addr
+	d.VendorId = addr.ReadConfig16(PCI_VENDOR_ID)
+	d.DeviceId = addr.ReadConfig16(PCI_DEVICE_ID)
+	d.Revision = addr.ReadConfig8(PCI_REVISION)
+	d.ProgIf = addr.ReadConfig8(PCI_PROG_IF)
+	d.Subclass = addr.ReadConfig8(PCI_SUBCLASS)
+	d.Class = addr.ReadConfig8(PCI_CLASS)
+	d.IrqLine = PCI_INTERRUPT_NONE
+	d.IrqPin = addr.ReadConfig8(PCI_INTERRUPT_PIN)
+	if d.IrqPin != 0 {
+		d.IrqLine = addr.ReadConfig8(PCI_INTERRUPT_LINE)
+	}
+	if addr.ReadConfig8(PCI_HEADER_TYPE)&PCI_HEADER_TYPE_MASK == PCI_HEADER_DEVICE {
+		d.SubsystemVendor = addr.ReadConfig16(PCI_SUBSYSTEM_VENDOR)
+		d.SubsystemId = addr.ReadConfig16(PCI_SUBSYSTEM_ID)
+		for i := 0; i < PCI_MAX_BARS; {
+			i += d.readBar(i)
+		}
+	}
+	log.KDebugLn("[PCI] ", addr.Bus, ":", addr.Slot, ".", addr.Function, " ", uintptr(d.VendorId), ":", uintptr(d.DeviceId),
+		" class ", uintptr(d.Class), ":", uintptr(d.Subclass), " irq ", d.IrqLine)
+	return d
+}
+
+func pciScanFunction(addr PciAddress) {
+	d := pciAddDevice(addr)
+	if d == nil || d.Class != PCI_CLASS_BRIDGE || d.Subclass != PCI_SUBCLASS_PCI_BRIDGE {
+		return
+	}
+	secondary := addr.ReadConfig8(PCI_SECONDARY_BUS)
+	// A bridge pointing back would make the scan loop forever
+	if secondary > addr.Bus {
+		pciScanBus(secondary)
+	}
+}
+
+func pciScanSlot(bus uint8, slot uint8) {
+	addr := PciAddress{Bus: bus, Slot: slot}
+	if addr.ReadConfig16(PCI_VENDOR_ID) == PCI_VENDOR_NONE {
+		return
+	}
+	pciScanFunction(addr)
+	if addr.ReadConfig8(PCI_HEADER_TYPE)&PCI_HEADER_MULTIFUNCTION == 0 {
+		return
+	}
+	for addr.Function = 1; addr.Function < PCI_MAX_FUNCTIONS; addr.Function++ {
+		if addr.ReadConfig16(PCI_VENDOR_ID) != PCI_VENDOR_NONE {
+			pciScanFunction(addr)
+		}
+	}
+}
+
+func pciScanBus(bus uint8) {
+	for slot := uint8(0); slot < PCI_MAX_SLOTS; slot++ {
+		pciScanSlot(bus, slot)
+	}
+}
+
+func pciMatches(d *PciDevice, m *PciMatch) bool {
+	class := uint16(d.Class)<<8 | uint16(d.Subclass)
+	return (m.Vendor == PCI_ANY_ID || m.Vendor == d.VendorId) &&
+		(m.Device == PCI_ANY_ID || m.Device == d.DeviceId) &&
+		(m.Class == PCI_ANY_CLASS || m.Class == class)
+}
+
+func pciProbe(d *PciDevice, drv *PciDriver) {
+	if d.Driver != nil {
+		return
+	}
+	for i := range drv.Matches {
+		if !pciMatches(d, &drv.Matches[i]) {
+			continue
+		}
+		d.Driver = drv
+		if drv.Probe(d) {
+			log.KDebugLn("[PCI] ", drv.Name, " bound to ", d.Addr.Bus, ":", d.Addr.Slot, ".", d.Addr.Function)
+			return
+		}
+		d.Driver = nil
+	}
+}
+
+// Probe the driver for every matching device. Drivers registered before the scan are probed by InitPci.
+func RegisterPciDriver(drv *PciDriver) {
+	if numPciDrivers == PCI_MAX_DRIVERS {
+		kernelPanic("Too many PCI drivers registered")
+	}
+	pciDrivers[numPciDrivers] = drv
+	numPciDrivers++
+	if !pciScanned {
+		return
+	}
+	for i := 0; i < numPciDevices; i++ {
+		pciProbe(&pciDevices[i], drv)
+	}
+}
+
+// Returns the first device with the ids or nil
+func FindPciDevice(vendor uint16, device uint16) *PciDevice {
+	for i := 0; i < numPciDevices; i++ {
+		if pciDevices[i].VendorId == vendor && pciDevices[i].DeviceId == device {
+			return &pciDevices[i]
+		}
+	}
+	return nil
+}
+
+// Needs paging, BARs are mapped into the kernel space by the drivers
+func InitPci() {
+	host := PciAddress{}
+	if host.ReadConfig8(PCI_HEADER_TYPE)&PCI_HEADER_MULTIFUNCTION == 0 {
+		pciScanBus(0)
+	} else {
+		// Every function of the host bridge is responsible for one bus
+		for host.Function = 0; host.Function < PCI_MAX_FUNCTIONS; host.Function++ {
+			if host.ReadConfig16(PCI_VENDOR_ID) != PCI_VENDOR_NONE {
+				pciScanBus(host.Function)
+			}
+		}
+	}
+	pciScanned = true
+	log.KDebugLn("[PCI] Found ", numPciDevices, " devices")
+	for i := 0; i < numPciDevices; i++ {
+		for j := 0; j < numPciDrivers; j++ {
+			pciProbe(&pciDevices[i], pciDrivers[j])
+		}
+	}
+}
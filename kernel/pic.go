@@ -5,8 +5,6 @@ import (
 )
 
 const (
-	PIC_PRINT_DEBUG = ENABLE_DEBUG
-
 	PIC1Port uint16 = 0x20
 	PIC1Data uint16 = PIC1Port + 1
 	PIC2Port uint16 = 0xA0
@@ -24,78 +22,48 @@ const (
 	PIC_ReadISR byte = 0xb
 )
 
-var picHandlers [16]func()
+// The legacy 8259 pair. Used until the IO-APIC takes over or if there is none.
+type pic8259 struct{}
 
-func PICInterruptHandler() {
-	info := &CurrentThread.Info
-	if CurrentThread.IsKernelInterrupt {
-		info = &CurrentThread.kernelInfo
-	}
-	irq := info.InterruptNumber - uint32(PIC1Offset)
+var legacyPic pic8259
+
+func (p *pic8259) Name() string {
+	return "8259 PIC"
+}
+
+func (p *pic8259) IsSpurious(irq uint8) bool {
 	if irq == 7 {
 		Outb(PIC1Port, PIC_ReadISR)
 		res := Inb(PIC1Port)
 		if res&(1<<7) == 0 {
 			// Spurious IRQ
-			return
+			return true
 		}
 	}
 	if irq == 15 {
-		Outb(PIC1Port, PIC_ReadISR)
-		res := Inb(PIC1Port)
+		Outb(PIC2Port, PIC_ReadISR)
+		res := Inb(PIC2Port)
 		if res&(1<<7) == 0 {
 			// Spurious IRQ
 			// PIC1 does not know it is spurious
 			Outb(PIC1Port, PIC_EOI)
-			return
+			return true
 		}
 	}
+	return false
+}
 
-	if PIC_PRINT_DEBUG && irq != 0 {
-		log.KDebugLn("[PIC] Handler nr ", irq)
-	}
-	picHandlers[irq]()
-
+func (p *pic8259) EOI(irq uint8) {
 	if irq >= 8 {
 		Outb(PIC2Port, PIC_EOI)
 	}
 	Outb(PIC1Port, PIC_EOI)
 }
 
-func defaultPicHandler() {
-	log.KErrorLn("Unhandled IRQ")
-}
-
-func InitPIC() {
-
-	picHandlerSlice := picHandlers[:]
-
-	Outb(PIC1Port, PIC_ICW1_Init|PIC_ICW1_ICW4)
-	Outb(PIC2Port, PIC_ICW1_Init|PIC_ICW1_ICW4)
-
-	Outb(PIC1Data, PIC1Offset)
-	Outb(PIC2Data, PIC2Offset)
-
-	Outb(PIC1Data, 0b0100) // Tells PIC1 that there is slave PIC at IRQ2
-	Outb(PIC2Data, 2)      // Tells slave PIC what IRQ it is on master PIC (binary form)
-	Outb(PIC1Data, PIC_ICW4_8086)
-	Outb(PIC2Data, PIC_ICW4_8086)
-
-	Outb(PIC1Data, 0xff)
-	Outb(PIC2Data, 0xff)
-
-	for i := 0; i < 8; i++ {
-		SetInterruptHandler(PIC1Offset+byte(i), PICInterruptHandler, KCS_SELECTOR, PRIV_USER)
-	}
-	for i := 0; i < 8; i++ {
-		SetInterruptHandler(PIC2Offset+byte(i), PICInterruptHandler, KCS_SELECTOR, PRIV_USER)
+func (p *pic8259) Disable(irq uint8) {
+	if irq >= ISA_IRQ_COUNT {
+		return
 	}
-	for i := range picHandlerSlice {
-		RegisterPICHandler(uint8(i), defaultPicHandler)
-	}
-}
-
-func DisableIRQ(irq uint8) {
 	port := PIC1Data
 	if irq > 7 {
 		port = PIC2Data
@@ -105,9 +73,15 @@ func DisableIRQ(irq uint8) {
 	Outb(port, value)
 }
 
-func EnableIRQ(irq uint8) {
+func (p *pic8259) Enable(irq uint8) {
+	if irq >= ISA_IRQ_COUNT {
+		log.KErrorLn("[PIC] IRQ ", irq, " is not connected to the PIC")
+		return
+	}
 	port := PIC1Data
 	if irq > 7 {
+		// IRQs of the slave PIC are delivered through IRQ2
+		Outb(PIC1Data, Inb(PIC1Data)&^(1<<2))
 		port = PIC2Data
 		irq -= 8
 	}
@@ -115,9 +89,25 @@ func EnableIRQ(irq uint8) {
 	Outb(port, value)
 }
 
-func RegisterPICHandler(irq uint8, f func()) {
-	if irq > 15 {
-		kernelPanic("[PIC] The requested irq does not exist")
-	}
-	picHandlers[irq] = f
+// Mask everything, used when the IO-APIC takes over
+func picMaskAll() {
+	Outb(PIC1Data, 0xff)
+	Outb(PIC2Data, 0xff)
+}
+
+func InitPIC() {
+	Outb(PIC1Port, PIC_ICW1_Init|PIC_ICW1_ICW4)
+	Outb(PIC2Port, PIC_ICW1_Init|PIC_ICW1_ICW4)
+
+	Outb(PIC1Data, PIC1Offset)
+	Outb(PIC2Data, PIC2Offset)
+
+	Outb(PIC1Data, 0b0100) // Tells PIC1 that there is slave PIC at IRQ2
+	Outb(PIC2Data, 2)      // Tells slave PIC what IRQ it is on master PIC (binary form)
+	Outb(PIC1Data, PIC_ICW4_8086)
+	Outb(PIC2Data, PIC_ICW4_8086)
+
+	picMaskAll()
+
+	InitIrq()
 }
@@ -0,0 +1,326 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Pipes and FIFOs. A pipe is a ring buffer, every open of it is an end that
+// reads, writes or both and has its own flags. Ends are files, file
+// descriptors that share an open share its end. A FIFO is a pipe with a name
+// that anyone can open. There is no filesystem, so FIFOs stay in the pipe
+// table until they are unlinked.
+// There are no signals either, writers without readers only get EPIPE.
+
+const (
+	PIPE_MAX         = 32
+	PIPE_MAX_ENDS    = 2 * PIPE_MAX
+	PIPE_BUFFER_SIZE = 8192
+	PIPE_BUF         = 4096 // Writes up to this size are not split
+	FIFO_NAME_MAX    = 64
+)
+
+// One open of a pipe
+type PipeEnd struct {
+	FileBase
+	pipe     *Pipe // nil if the end is free
+	read     bool
+	write    bool
+	nonblock bool
+}
+
+type Pipe struct {
+	used    bool
+	buf     [PIPE_BUFFER_SIZE]byte
+	head    int
+	len     int
+	readers int // Open ends that read
+	writers int
+	// Count the opens of each side, FIFO opens wait for the other one
+	readerOpens uint32
+	writerOpens uint32
+	readWait    WaitQueue
+	writeWait   WaitQueue
+	openWait    WaitQueue
+	name        [FIFO_NAME_MAX]byte
+	nameLen     int // 0 for anonymous pipes
+}
+
+var (
+	pipes    [PIPE_MAX]Pipe
+	pipeEnds [PIPE_MAX_ENDS]PipeEnd
+)
+
+func pipeAlloc() *Pipe {
+	for i := range pipes {
+		p := &pipes[i]
+		if !p.used {
+			*p = Pipe{}
+			p.used = true
+			return p
+		}
+	}
+	return nil
+}
+
+// Open another end of p. Returns nil if there is no free end.
+func pipeOpen(p *Pipe, read bool, write bool) *PipeEnd {
+	for i := range pipeEnds {
+		e := &pipeEnds[i]
+		if e.pipe != nil {
+			continue
+		}
+		*e = PipeEnd{pipe: p, read: read, write: write}
+		if read {
+			p.readers++
+			p.readerOpens++
+		}
+		if write {
+			p.writers++
+			p.writerOpens++
+		}
+		p.openWait.WakeAll()
+		return e
+	}
+	return nil
+}
+
+// An anonymous pipe. Returns the read and the write end.
+func NewPipe() (*PipeEnd, *PipeEnd, syscall.Errno) {
+	p := pipeAlloc()
+	if p == nil {
+		return nil, nil, syscall.ENFILE
+	}
+	r := pipeOpen(p, true, false)
+	if r == nil {
+		p.used = false
+		return nil, nil, syscall.ENFILE
+	}
+	w := pipeOpen(p, false, true)
+	if w == nil {
+		// Frees the pipe as well
+		r.Close()
+		return nil, nil, syscall.ENFILE
+	}
+	return r, w, ESUCCESS
+}
+
+func pipeFindFifo(path string) *Pipe {
+	for i := range pipes {
+		p := &pipes[i]
+		if p.used && p.nameLen != 0 && string(p.name[:p.nameLen]) == path {
+			return p
+		}
+	}
+	return nil
+}
+
+func MakeFifo(path string) syscall.Errno {
+	if len(path) == 0 {
+		return syscall.ENOENT
+	}
+	if len(path) > FIFO_NAME_MAX {
+		return syscall.ENAMETOOLONG
+	}
+	if pipeFindFifo(path) != nil {
+		return syscall.EEXIST
+	}
+	for i := 0; i < numDevices; i++ {
+		if devices[i].path == path {
+			return syscall.EEXIST
+		}
+	}
+	p := pipeAlloc()
+	if p == nil {
+		return syscall.ENOSPC
+	}
+	p.nameLen = copy(p.name[:], path)
+	return ESUCCESS
+}
+
+// The FIFO lives on as an anonymous pipe while it is open
+func UnlinkFifo(path string) syscall.Errno {
+	p := pipeFindFifo(path)
+	if p == nil {
+		return syscall.ENOENT
+	}
+	p.nameLen = 0
+	if p.readers == 0 && p.writers == 0 {
+		p.used = false
+	}
+	return ESUCCESS
+}
+
+// Open the FIFO at path, ENOENT if there is none. Like on Linux, readers wait
+// for a writer and writers for a reader unless O_NONBLOCK is given.
+func OpenFifo(path string, flags int) (File, syscall.Errno) {
+	p := pipeFindFifo(path)
+	if p == nil {
+		return nil, syscall.ENOENT
+	}
+	nonblock := flags&syscall.O_NONBLOCK != 0
+	var read, write bool
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		read = true
+	case syscall.O_WRONLY:
+		if nonblock && p.readers == 0 {
+			return nil, syscall.ENXIO
+		}
+		write = true
+	case syscall.O_RDWR:
+		read = true
+		write = true
+	default:
+		return nil, syscall.EINVAL
+	}
+	readerOpens, writerOpens := p.readerOpens, p.writerOpens
+	e := pipeOpen(p, read, write)
+	if e == nil {
+		return nil, syscall.ENFILE
+	}
+	if nonblock {
+		e.nonblock = true
+		return e, ESUCCESS
+	}
+	for !write && p.writers == 0 && p.writerOpens == writerOpens ||
+		!read && p.readers == 0 && p.readerOpens == readerOpens {
+		if err := p.openWait.WaitInterruptible(); err != ESUCCESS {
+			ReleaseFile(e)
+			return nil, err
+		}
+	}
+	return e, ESUCCESS
+}
+
+func (e *PipeEnd) SetNonblock(nonblock bool) {
+	e.nonblock = nonblock
+}
+
+func (e *PipeEnd) Nonblock() bool {
+	return e.nonblock
+}
+
+func (e *PipeEnd) Read(buf []byte) (int, syscall.Errno) {
+	if !e.read {
+		return 0, syscall.EBADF
+	}
+	p := e.pipe
+	for p.len == 0 {
+		if p.writers == 0 || len(buf) == 0 {
+			return 0, ESUCCESS
+		}
+		if e.nonblock {
+			return 0, syscall.EAGAIN
+		}
+		if err := p.readWait.WaitInterruptible(); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	n := min(len(buf), p.len)
+	for done := 0; done < n; {
+		done += copy(buf[done:n], p.buf[(p.head+done)%PIPE_BUFFER_SIZE:])
+	}
+	p.head = (p.head + n) % PIPE_BUFFER_SIZE
+	p.len -= n
+	p.writeWait.WakeAll()
+	return n, ESUCCESS
+}
+
+func (e *PipeEnd) Write(buf []byte) (int, syscall.Errno) {
+	if !e.write {
+		return 0, syscall.EBADF
+	}
+	p := e.pipe
+	written := 0
+	err := ESUCCESS
+	for written < len(buf) && err == ESUCCESS {
+		space := PIPE_BUFFER_SIZE - p.len
+		switch {
+		case p.readers == 0:
+			err = syscall.EPIPE
+		case space == 0 || len(buf) <= PIPE_BUF && space < len(buf):
+			if e.nonblock {
+				err = syscall.EAGAIN
+			} else {
+				err = p.writeWait.WaitInterruptible()
+			}
+		default:
+			n := min(space, len(buf)-written)
+			for done := 0; done < n; {
+				done += copy(p.buf[(p.head+p.len+done)%PIPE_BUFFER_SIZE:], buf[written+done:written+n])
+			}
+			p.len += n
+			written += n
+			p.readWait.WakeAll()
+		}
+	}
+	if written > 0 {
+		return written, ESUCCESS
+	}
+	return 0, err
+}
+
+func (e *PipeEnd) Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno) {
+	var value [4]byte
+	switch cmd {
+	case FIONBIO:
+		if err := space.ReadBytesFromUserSpace(arg, value[:]); err != ESUCCESS {
+			return 0, err
+		}
+		v, _ := optionInt(value[:])
+		e.nonblock = v != 0
+		return 0, ESUCCESS
+	case FIONREAD:
+		putOptionInt(value[:], e.pipe.len)
+		return 0, space.WriteBytesToUserSpace(arg, value[:])
+	}
+	return 0, syscall.ENOTTY
+}
+
+func (e *PipeEnd) Poll(pt *PollTable) uint32 {
+	p := e.pipe
+	events := uint32(0)
+	if e.read {
+		pt.Wait(&p.readWait)
+		if p.len > 0 {
+			events |= POLLIN | POLLRDNORM
+		}
+		if p.writers == 0 {
+			events |= POLLHUP
+		}
+	}
+	if e.write {
+		pt.Wait(&p.writeWait)
+		if PIPE_BUFFER_SIZE-p.len >= PIPE_BUF {
+			events |= POLLOUT | POLLWRNORM
+		}
+		if p.readers == 0 {
+			events |= POLLERR
+		}
+	}
+	return events
+}
+
+func (e *PipeEnd) Close() {
+	p := e.pipe
+	e.pipe = nil
+	if e.read {
+		p.readers--
+	}
+	if e.write {
+		p.writers--
+	}
+	// Readers see EOF, writers get EPIPE
+	p.readWait.WakeAll()
+	p.writeWait.WakeAll()
+	if p.readers == 0 && p.writers == 0 {
+		// Like on Linux the data of a FIFO is gone once nobody has it open
+		p.head = 0
+		p.len = 0
+		if p.nameLen == 0 {
+			p.used = false
+		}
+	}
+}
@@ -1,17 +1,74 @@
 package kernel
 
 const (
-	PIT_PORT_DATA    = 0x40
-	PIT_PORT_COMMAND = 0x43
+	PIT_PORT_DATA     = 0x40
+	PIT_PORT_CHANNEL2 = 0x42
+	PIT_PORT_COMMAND  = 0x43
+	PIT_PORT_GATE     = 0x61 // Channel 2 gate and output
+
+	PIT_CHANNEL0_ONESHOT = 0x30 // Channel 0, low and high byte, interrupt on terminal count
+	PIT_CHANNEL2_ONESHOT = 0xb0 // Channel 2, low and high byte, interrupt on terminal count
+	PIT_GATE_ENABLE      = 1 << 0
+	PIT_SPEAKER_ENABLE   = 1 << 1
+	PIT_CHANNEL2_OUT     = 1 << 5
+
+	PIT_FREQUENCY = 1193182 // Hz
+	PIT_MAX_COUNT = 0xffff
 )
 
+// Channel 0 in one shot mode. Only used as clock event device if there is
+// neither a local APIC nor an HPET.
+type pitClockEvent struct{}
+
+var pitTimer pitClockEvent
+
+func (p *pitClockEvent) Name() string {
+	return "PIT"
+}
+
+func (p *pitClockEvent) MaxDelta() uint64 {
+	return PIT_MAX_COUNT * NS_PER_SECOND / PIT_FREQUENCY
+}
+
+func (p *pitClockEvent) SetNextEvent(delta uint64) {
+	count := min(max(delta*PIT_FREQUENCY/NS_PER_SECOND, 1), PIT_MAX_COUNT)
+	Outb(PIT_PORT_COMMAND, PIT_CHANNEL0_ONESHOT)
+	Outb(PIT_PORT_DATA, uint8(count))
+	Outb(PIT_PORT_DATA, uint8(count>>8))
+}
+
+func (p *pitClockEvent) Stop() {
+	// The counter waits for a new count after the mode is set
+	Outb(PIT_PORT_COMMAND, PIT_CHANNEL0_ONESHOT)
+}
+
 func handlePit() {
-	PerformSchedule = true
+	hrtimerInterrupt()
 }
 
-func InitPit() {
-	Outb(PIT_PORT_DATA, 0x00) // Low byte
-	Outb(PIT_PORT_DATA, 0x02) // High byte
-	RegisterPICHandler(0, handlePit)
+// Busy wait with PIT channel 2. Works without interrupts.
+func pitDelay(us uint32) {
+	count := uint64(us) * PIT_FREQUENCY / 1000000
+	for count > 0 {
+		chunk := min(count, 0xffff)
+		gate := Inb(PIT_PORT_GATE) &^ (PIT_GATE_ENABLE | PIT_SPEAKER_ENABLE)
+		Outb(PIT_PORT_GATE, gate)
+		Outb(PIT_PORT_COMMAND, PIT_CHANNEL2_ONESHOT)
+		Outb(PIT_PORT_CHANNEL2, uint8(chunk))
+		Outb(PIT_PORT_CHANNEL2, uint8(chunk>>8))
+		Outb(PIT_PORT_GATE, gate|PIT_GATE_ENABLE)
+		for Inb(PIT_PORT_GATE)&PIT_CHANNEL2_OUT == 0 {
+		}
+		count -= chunk
+	}
+}
+
+func pitStartClockEvent() {
+	RegisterIRQHandler(0, handlePit)
 	EnableIRQ(0)
 }
+
+// Stop the periodic interrupt the BIOS has set up
+func InitPit() {
+	pitTimer.Stop()
+}
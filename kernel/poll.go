@@ -0,0 +1,122 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/utils"
+)
+
+// Readiness of files for poll, select and epoll. A file reports its events
+// and adds poll entries to the wait queues that get woken when they change.
+// Waking such a queue calls the callbacks of its entries. Threads in poll
+// use a callback that wakes them from their own wait queue, epoll items use
+// one that marks them ready.
+
+const (
+	POLLIN     = 0x1
+	POLLPRI    = 0x2
+	POLLOUT    = 0x4
+	POLLERR    = 0x8
+	POLLHUP    = 0x10
+	POLLNVAL   = 0x20
+	POLLRDNORM = 0x40
+	POLLRDBAND = 0x80
+	POLLWRNORM = 0x100
+	POLLRDHUP  = 0x2000
+
+	POLL_MAX_ENTRIES = 256
+)
+
+type PollTable struct {
+	callback func(arg uintptr)
+	arg      uintptr
+	err      syscall.Errno // ENOMEM if an entry did not fit
+}
+
+type pollEntry struct {
+	queue    *WaitQueue // nil if the entry is free
+	callback func(arg uintptr)
+	arg      uintptr
+}
+
+var pollEntries [POLL_MAX_ENTRIES]pollEntry
+
+// Call the callback of pt when q is woken. pt may be nil.
+func (pt *PollTable) Wait(q *WaitQueue) {
+	if pt == nil {
+		return
+	}
+	for i := range pollEntries {
+		e := &pollEntries[i]
+		if e.queue == nil {
+			*e = pollEntry{queue: q, callback: pt.callback, arg: pt.arg}
+			q.pollers++
+			return
+		}
+	}
+	pt.err = syscall.ENOMEM
+}
+
+// Remove the entries that were added with arg
+func PollRemove(arg uintptr) {
+	for i := range pollEntries {
+		e := &pollEntries[i]
+		if e.queue != nil && e.arg == arg {
+			e.queue.pollers--
+			*e = pollEntry{}
+		}
+	}
+}
+
+func pollWake(q *WaitQueue) {
+	for i := range pollEntries {
+		e := &pollEntries[i]
+		if e.queue == q {
+			e.callback(e.arg)
+		}
+	}
+}
+
+// Sleep on q until it is woken. Returns ETIMEDOUT at the deadline (monotonic
+// ns, 0 waits forever) and EINTR if a signal arrived.
+func pollSleep(q *WaitQueue, deadline uint64) syscall.Errno {
+	if deadline != 0 && deadline <= MonotonicTime() {
+		return syscall.ETIMEDOUT
+	}
+	if q.WaitUntil(deadline) {
+		return ESUCCESS
+	}
+	if CurrentThread.interrupted {
+		return syscall.EINTR
+	}
+	return syscall.ETIMEDOUT
+}
+
+func pollWakeThread(arg uintptr) {
+	t := utils.UIntToPointer[Thread](arg)
+	if t.waitQueue == &t.pollQueue {
+		t.pollQueue.Wake(t)
+	}
+}
+
+// Start polling files with the current thread. Pass the table to the first
+// round of Poll calls, then PollSleep until one is ready and call PollEnd.
+func PollBegin() *PollTable {
+	t := CurrentThread
+	t.pollTable = PollTable{callback: pollWakeThread, arg: uintptr(unsafe.Pointer(t))}
+	return &t.pollTable
+}
+
+// Sleep until a polled file might be ready, see pollSleep
+func PollSleep(deadline uint64) syscall.Errno {
+	t := CurrentThread
+	if t.pollTable.err != ESUCCESS {
+		return t.pollTable.err
+	}
+	return pollSleep(&t.pollQueue, deadline)
+}
+
+func PollEnd() {
+	PollRemove(uintptr(unsafe.Pointer(CurrentThread)))
+}
@@ -0,0 +1,31 @@
+package kernel
+
+import (
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+const (
+	PS2_CMD_PULSE_RESET = 0xfe
+)
+
+func Shutdown() {
+	log.KDebugLn("Shutting down...")
+	AcpiPowerOff()
+	qemuShutdown()
+	kernelPanic("Shutdown did not work :(")
+}
+
+// Pulse the reset line of the CPU through the keyboard controller
+func ps2Reset() {
+	for i := 0; i < ps2Timeout && Inb(PS2_STATUS_PORT)&PS2_STATUS_INPUT_FULL != 0; i++ {
+	}
+	Outb(PS2_COMMAND_PORT, PS2_CMD_PULSE_RESET)
+	pitDelay(ACPI_ENABLE_DELAY_US)
+}
+
+func Reboot() {
+	log.KDebugLn("Rebooting...")
+	AcpiReset()
+	ps2Reset()
+	kernelPanic("Reboot did not work :(")
+}
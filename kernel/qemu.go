@@ -1,11 +1,11 @@
 package kernel
 
-import (
-	"github.com/sanserogames/letsgo-os/kernel/log"
+const (
+	QEMU_PM1A_CONTROL = 0x604
+	QEMU_SHUTDOWN     = 0x2000
 )
 
-func Shutdown() {
-	log.KDebugLn("Shutting down...")
-	Outw(0x604, 0x2000)
-	kernelPanic("Qemu shutdown did not work :(")
+// Only works on QEMU, used if ACPI did not work
+func qemuShutdown() {
+	Outw(QEMU_PM1A_CONTROL, QEMU_SHUTDOWN)
 }
@@ -0,0 +1,108 @@
+package kernel
+
+// CMOS real time clock. Only read once at boot to seed the wall clock.
+
+const (
+	CMOS_ADDRESS uint16 = 0x70
+	CMOS_DATA    uint16 = 0x71
+
+	RTC_SECONDS  = 0x00
+	RTC_MINUTES  = 0x02
+	RTC_HOURS    = 0x04
+	RTC_DAY      = 0x07
+	RTC_MONTH    = 0x08
+	RTC_YEAR     = 0x09
+	RTC_CENTURY  = 0x32 // Not guaranteed to exist, ACPI FADT would know
+	RTC_STATUS_A = 0x0A
+	RTC_STATUS_B = 0x0B
+
+	RTC_UPDATE_IN_PROGRESS = 1 << 7
+	RTC_24_HOUR            = 1 << 1
+	RTC_BINARY             = 1 << 2
+	RTC_HOUR_PM            = 1 << 7
+)
+
+type rtcTime struct {
+	second  uint8
+	minute  uint8
+	hour    uint8
+	day     uint8
+	month   uint8
+	year    uint8
+	century uint8
+}
+
+func cmosRead(reg uint8) uint8 {
+	Outb(CMOS_ADDRESS, reg)
+	return Inb(CMOS_DATA)
+}
+
+func rtcReadRaw(t *rtcTime) {
+	for cmosRead(RTC_STATUS_A)&RTC_UPDATE_IN_PROGRESS != 0 {
+	}
+	t.second = cmosRead(RTC_SECONDS)
+	t.minute = cmosRead(RTC_MINUTES)
+	t.hour = cmosRead(RTC_HOURS)
+	t.day = cmosRead(RTC_DAY)
+	t.month = cmosRead(RTC_MONTH)
+	t.year = cmosRead(RTC_YEAR)
+	t.century = cmosRead(RTC_CENTURY)
+}
+
+func bcdToBinary(value uint8) uint8 {
+	return (value>>4)*10 + value&0xf
+}
+
+// Days since 1970-01-01 of a date in the gregorian calendar
+func daysSinceEpoch(year int64, month int64, day int64) int64 {
+	if month <= 2 {
+		year--
+	}
+	era := year / 400
+	yearOfEra := year - era*400
+	shiftedMonth := (month + 9) % 12 // March is 0
+	dayOfYear := (153*shiftedMonth+2)/5 + day - 1
+	dayOfEra := yearOfEra*365 + yearOfEra/4 - yearOfEra/100 + dayOfYear
+	return era*146097 + dayOfEra - 719468
+}
+
+// Read the RTC and return the seconds since the unix epoch. The RTC is assumed to run in UTC.
+func ReadRtcSeconds() int64 {
+	var t, last rtcTime
+	rtcReadRaw(&t)
+	// Read until two reads match so that an update in between does not produce garbage
+	for {
+		last = t
+		rtcReadRaw(&t)
+		if t == last {
+			break
+		}
+	}
+
+	statusB := cmosRead(RTC_STATUS_B)
+	pm := t.hour&RTC_HOUR_PM != 0
+	t.hour &^= RTC_HOUR_PM
+	if statusB&RTC_BINARY == 0 {
+		t.second = bcdToBinary(t.second)
+		t.minute = bcdToBinary(t.minute)
+		t.hour = bcdToBinary(t.hour)
+		t.day = bcdToBinary(t.day)
+		t.month = bcdToBinary(t.month)
+		t.year = bcdToBinary(t.year)
+		t.century = bcdToBinary(t.century)
+	}
+	if statusB&RTC_24_HOUR == 0 {
+		// 12 hour clock: 12 am is 0 and 12 pm is 12
+		t.hour %= 12
+		if pm {
+			t.hour += 12
+		}
+	}
+	century := int64(t.century)
+	if century < 19 || century > 30 {
+		century = 20
+	}
+
+	days := daysSinceEpoch(century*100+int64(t.year), int64(t.month), int64(t.day))
+	return days*86400 + int64(t.hour)*3600 + int64(t.minute)*60 + int64(t.second)
+}
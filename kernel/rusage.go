@@ -0,0 +1,159 @@
+package kernel
+
+// Resource usage accounting. Time is charged to the current thread whenever
+// it crosses the user/kernel boundary (do_isr) and when it is switched out.
+
+const (
+	// Processes that run or exited and were not waited for yet, like zombies
+	MAX_DOMAINS = 64
+	WAIT_ANY    = 0xffffffff // -1
+	NO_PARENT   = 0xffffffff // Started by the kernel, nobody waits for it
+)
+
+type Rusage struct {
+	UserTime            uint64 // ns
+	SystemTime          uint64 // ns
+	VoluntarySwitches   uint64
+	InvoluntarySwitches uint64
+	// Pages are never read in from disk, so there are no major faults
+	MinorFaults uint64
+}
+
+func (r *Rusage) Add(o *Rusage) {
+	r.UserTime += o.UserTime
+	r.SystemTime += o.SystemTime
+	r.VoluntarySwitches += o.VoluntarySwitches
+	r.InvoluntarySwitches += o.InvoluntarySwitches
+	r.MinorFaults += o.MinorFaults
+}
+
+// Usage of exited domains that was not collected by wait4 yet.
+// The domain itself is freed on exit, so its usage is kept here.
+type exitedUsage struct {
+	pid    uint32
+	parent uint32
+	used   bool
+	usage  Rusage
+}
+
+var exitedUsages [MAX_DOMAINS]exitedUsage
+
+func isAccountedThread(t *Thread) bool {
+	return t != nil && t != idleThread && t.Domain != nil
+}
+
+// Charge the time since the last charge to the thread
+func chargeTime(t *Thread, user bool) {
+	now := MonotonicTime()
+	if isAccountedThread(t) && now > t.accountStamp {
+		delta := now - t.accountStamp
+		if user {
+			t.Usage.UserTime += delta
+			t.Domain.Usage.UserTime += delta
+		} else {
+			t.Usage.SystemTime += delta
+			t.Domain.Usage.SystemTime += delta
+		}
+	}
+	if t != nil {
+		t.accountStamp = now
+	}
+}
+
+// Called when an interrupt arrives. Everything before it ran in the mode that was interrupted.
+func accountInterruptEntry(fromUser bool) {
+	chargeTime(CurrentThread, fromUser)
+}
+
+// Called before returning to user space
+func accountInterruptExit() {
+	chargeTime(CurrentThread, false)
+}
+
+func accountSwitch(prev *Thread, next *Thread) {
+	if isAccountedThread(prev) && !prev.isRemoved {
+		chargeTime(prev, false)
+		// Blocked threads gave up the CPU by themselves
+		if prev.IsBlocked {
+			prev.Usage.VoluntarySwitches++
+			prev.Domain.Usage.VoluntarySwitches++
+		} else {
+			prev.Usage.InvoluntarySwitches++
+			prev.Domain.Usage.InvoluntarySwitches++
+		}
+	}
+	next.accountStamp = MonotonicTime()
+}
+
+// Called for every page fault and every page that mmap and brk map. They are
+// mapped right away, where Linux would take a fault on the first access.
+func AccountPageFault() {
+	t := CurrentThread
+	if !isAccountedThread(t) {
+		return
+	}
+	t.Usage.MinorFaults++
+	t.Domain.Usage.MinorFaults++
+}
+
+// False if MAX_DOMAINS processes run or wait to be collected
+func CanAddDomain() bool {
+	n := allDomains.count
+	for i := range exitedUsages {
+		if exitedUsages[i].used {
+			n++
+		}
+	}
+	return n < MAX_DOMAINS
+}
+
+// Remember the usage of a domain that exits until its parent waits for it.
+// There is always a slot as the domain counted against MAX_DOMAINS.
+func recordExitedUsage(d *Domain) {
+	if CurrentThread != nil && CurrentThread.Domain == d {
+		chargeTime(CurrentThread, false)
+	}
+	// Nobody collects the children of d anymore
+	for i := range exitedUsages {
+		if exitedUsages[i].parent == d.Pid {
+			exitedUsages[i].used = false
+		}
+	}
+	if d.ParentPid == NO_PARENT || FindDomainByPid(d.ParentPid) == nil {
+		return
+	}
+	for i := range exitedUsages {
+		e := &exitedUsages[i]
+		if !e.used {
+			*e = exitedUsage{pid: d.Pid, parent: d.ParentPid, used: true, usage: d.Usage}
+			e.usage.Add(&d.ChildUsage)
+			return
+		}
+	}
+}
+
+// Collect the usage of an exited child of waiter with the pid, any child for
+// WAIT_ANY, and add it to the children of waiter. Returns the pid of the
+// child and false if no such child exited.
+func ReapExitedUsage(pid uint32, waiter *Domain, out *Rusage) (uint32, bool) {
+	for i := range exitedUsages {
+		e := &exitedUsages[i]
+		if e.used && e.parent == waiter.Pid && (pid == WAIT_ANY || e.pid == pid) {
+			e.used = false
+			*out = e.usage
+			waiter.ChildUsage.Add(&e.usage)
+			return e.pid, true
+		}
+	}
+	return 0, false
+}
+
+// Whether a child of d with the pid, any child for WAIT_ANY, is still running
+func HasRunningChild(d *Domain, pid uint32) bool {
+	found := false
+	ForEachDomain(func(c *Domain) bool {
+		found = c.ParentPid == d.Pid && (pid == WAIT_ANY || c.Pid == pid)
+		return !found
+	})
+	return found
+}
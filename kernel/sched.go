@@ -0,0 +1,389 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// Scheduling policy. Normal threads share the CPU by virtual runtime like CFS:
+// the runnable thread that ran the least (weighted by its nice value) is picked.
+// Real time threads (FIFO and RR) always run before normal ones.
+// Every runnable thread is in the run queue of one CPU. Idle CPUs pull threads
+// from the others and the queues are balanced periodically.
+
+const (
+	SCHED_OTHER = 0
+	SCHED_FIFO  = 1
+	SCHED_RR    = 2
+	SCHED_BATCH = 3
+	SCHED_IDLE  = 5
+
+	MIN_NICE = -20
+	MAX_NICE = 19
+
+	MIN_RT_PRIORITY = 1
+	MAX_RT_PRIORITY = 99
+
+	NICE_0_WEIGHT     = 1024
+	SCHED_IDLE_WEIGHT = 3
+
+	SCHED_LATENCY          = 6000000 // ns
+	SCHED_MIN_GRANULARITY  = 1000000 // ns
+	SCHED_RR_TIMESLICE     = 100000000
+	SCHED_BALANCE_INTERVAL = 50000000
+	SCHED_TICK_NS          = 1000000 // Preemption tick while a thread runs
+
+	ALL_CPUS_MASK = 0xffffffff
+)
+
+// Weight of every nice value from -20 to 19. Each step is about 10% CPU time.
+var niceToWeight = [40]uint32{
+	88761, 71755, 56483, 46273, 36291,
+	29154, 23254, 18705, 14949, 11916,
+	9548, 7620, 6100, 4904, 3906,
+	3121, 2501, 1991, 1586, 1277,
+	1024, 820, 655, 526, 423,
+	335, 272, 215, 172, 137,
+	110, 87, 70, 56, 45,
+	36, 29, 23, 18, 15,
+}
+
+var (
+	// Smallest virtual runtime of the runnable threads, only moves forward
+	minVruntime uint64
+	// Orders real time threads of the same priority
+	rtSequence uint64
+)
+
+func isRealTime(t *Thread) bool {
+	return t.policy == SCHED_FIFO || t.policy == SCHED_RR
+}
+
+func threadWeight(t *Thread) uint64 {
+	if t.policy == SCHED_IDLE {
+		return SCHED_IDLE_WEIGHT
+	}
+	return uint64(niceToWeight[t.nice-MIN_NICE])
+}
+
+// Put real time threads at the end of their priority
+func rtRequeue(t *Thread) {
+	rtSequence++
+	t.rtSequence = rtSequence
+	t.rrTimeLeft = SCHED_RR_TIMESLICE
+}
+
+// Called on every scheduler tick for the running thread
+func schedTick(t *Thread) {
+	if t == idleThread || t.Domain == nil {
+		return
+	}
+	if isRealTime(t) {
+		if t.policy == SCHED_RR {
+			if t.rrTimeLeft <= SCHED_TICK_NS {
+				rtRequeue(t)
+			} else {
+				t.rrTimeLeft -= SCHED_TICK_NS
+			}
+		}
+		return
+	}
+	t.vruntime += SCHED_TICK_NS * NICE_0_WEIGHT / threadWeight(t)
+}
+
+// Called when a thread becomes runnable again
+func schedWakeup(t *Thread) {
+	// Don't let a thread that slept for a long time monopolize the CPU
+	if minVruntime > SCHED_LATENCY/2 && t.vruntime < minVruntime-SCHED_LATENCY/2 {
+		t.vruntime = minVruntime - SCHED_LATENCY/2
+	}
+	rtRequeue(t)
+}
+
+func schedNewThread(t *Thread) {
+	t.vruntime = minVruntime
+	if t.affinity == 0 {
+		t.affinity = ALL_CPUS_MASK
+	}
+	t.cpu = uint8(leastLoadedCpu(t))
+	rqEnqueue(t)
+	rtRequeue(t)
+}
+
+// Make the CPU of a thread that became runnable notice it
+func schedKick(t *Thread) {
+	cpu := &cpus[t.cpu]
+	if cpu != thisCpu {
+		cur := cpu.currentThread
+		// A thread that is still on the CPU is halting in Block
+		if t.onCpu || cur == nil || cur == &cpu.idle || schedBefore(t, cur) {
+			sendReschedIpi(cpu)
+		} else {
+			kickIdleCpu(t)
+		}
+		return
+	}
+	if CurrentThread == nil || CurrentThread == idleThread || schedBefore(t, CurrentThread) {
+		// Don't wait for the next timer tick
+		PerformSchedule = true
+	} else {
+		kickIdleCpu(t)
+	}
+}
+
+// Idle CPUs have no tick and would not look for work by themselves. Wake one
+// up so that it steals the thread.
+func kickIdleCpu(t *Thread) {
+	for i := range numCpus {
+		cpu := &cpus[i]
+		if cpu != thisCpu && canRunOn(t, i) && cpu.currentThread == &cpu.idle {
+			sendReschedIpi(cpu)
+			return
+		}
+	}
+}
+
+func canRunOn(t *Thread, cpu int) bool {
+	return t.affinity&(1<<cpu) != 0 && cpus[cpu].online
+}
+
+// Threads running on another CPU or of a domain that is torn down cannot be picked
+func canRunHere(t *Thread) bool {
+	return canRunOn(t, thisCpu.Index) && !t.Domain.exiting && (!t.onCpu || t == CurrentThread)
+}
+
+// Runnable threads of a CPU, including the one it runs. Other CPUs take the
+// lock to steal from it.
+type runQueue struct {
+	lock  SpinLock
+	head  *Thread
+	count int
+}
+
+func (rq *runQueue) add(t *Thread) {
+	rq.lock.Lock()
+	if rq.head == nil {
+		rq.head = t
+		t.rqNext = t
+		t.rqPrev = t
+	} else {
+		t.rqNext = rq.head
+		t.rqPrev = rq.head.rqPrev
+		rq.head.rqPrev.rqNext = t
+		rq.head.rqPrev = t
+	}
+	rq.count++
+	t.onRq = true
+	rq.lock.Unlock()
+}
+
+func (rq *runQueue) remove(t *Thread) {
+	rq.lock.Lock()
+	if t == rq.head && t.rqNext == t {
+		rq.head = nil
+	} else if t == rq.head {
+		rq.head = t.rqNext
+	}
+	t.rqPrev.rqNext = t.rqNext
+	t.rqNext.rqPrev = t.rqPrev
+	t.rqNext = nil
+	t.rqPrev = nil
+	rq.count--
+	t.onRq = false
+	rq.lock.Unlock()
+}
+
+// Best thread of the queue this CPU can run
+func (rq *runQueue) pick() *Thread {
+	var best *Thread
+	rq.lock.Lock()
+	t := rq.head
+	for i := 0; i < rq.count; i++ {
+		if canRunHere(t) && (best == nil || schedBefore(t, best)) {
+			best = t
+		}
+		t = t.rqNext
+	}
+	rq.lock.Unlock()
+	return best
+}
+
+func rqEnqueue(t *Thread) {
+	if !t.onRq {
+		cpus[t.cpu].rq.add(t)
+	}
+}
+
+func rqDequeue(t *Thread) {
+	if t.onRq {
+		cpus[t.cpu].rq.remove(t)
+	}
+}
+
+// Move a thread to the run queue of another CPU. The queues are never locked
+// both at once.
+func rqMigrate(t *Thread, cpu int) {
+	if !t.onRq {
+		t.cpu = uint8(cpu)
+		return
+	}
+	rqDequeue(t)
+	t.cpu = uint8(cpu)
+	rqEnqueue(t)
+}
+
+func leastLoadedCpu(t *Thread) int {
+	best := NO_CPU
+	bestLoad := 0
+	for i := range numCpus {
+		load := cpus[i].rq.count
+		if t.onRq && int(t.cpu) == i {
+			load--
+		}
+		if canRunOn(t, i) && (best == NO_CPU || load < bestLoad) {
+			best = i
+			bestLoad = load
+		}
+	}
+	if best == NO_CPU {
+		return thisCpu.Index
+	}
+	return best
+}
+
+// Pull a waiting thread from the busiest CPU if it has at least two more than this one
+func balanceLoad() {
+	me := thisCpu.Index
+	busiest := me
+	for i := range numCpus {
+		if cpus[i].rq.count > cpus[busiest].rq.count {
+			busiest = i
+		}
+	}
+	if cpus[busiest].rq.count-cpus[me].rq.count < 2 {
+		return
+	}
+	rq := &cpus[busiest].rq
+	var pulled *Thread
+	rq.lock.Lock()
+	t := rq.head
+	for i := 0; i < rq.count; i++ {
+		if canRunHere(t) && !t.onCpu {
+			pulled = t
+			break
+		}
+		t = t.rqNext
+	}
+	rq.lock.Unlock()
+	if pulled != nil {
+		rqMigrate(pulled, me)
+	}
+}
+
+// Returns true if a should run before b
+func schedBefore(a *Thread, b *Thread) bool {
+	if isRealTime(a) != isRealTime(b) {
+		return isRealTime(a)
+	}
+	if isRealTime(a) {
+		if a.rtPriority != b.rtPriority {
+			return a.rtPriority > b.rtPriority
+		}
+		return a.rtSequence < b.rtSequence
+	}
+	return a.vruntime < b.vruntime
+}
+
+// Pick the thread this CPU should run next. Returns nil if no thread is runnable.
+func pickNextThread() *Thread {
+	me := thisCpu.Index
+	best := thisCpu.rq.pick()
+	if best == nil {
+		// Nothing to do here, take a thread that waits on another CPU instead of idling
+		for i := range numCpus {
+			if i == me {
+				continue
+			}
+			if t := cpus[i].rq.pick(); t != nil && (best == nil || schedBefore(t, best)) {
+				best = t
+			}
+		}
+		if best != nil {
+			rqMigrate(best, me)
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	// Don't switch for tiny differences in runtime, every switch costs time as well
+	cur := CurrentThread
+	if cur != nil && cur != best && cur != idleThread && !cur.IsBlocked && !cur.isRemoved &&
+		int(cur.cpu) == me && canRunHere(cur) &&
+		!isRealTime(cur) && !isRealTime(best) && cur.vruntime < best.vruntime+SCHED_MIN_GRANULARITY {
+		best = cur
+	}
+
+	if !isRealTime(best) && best.vruntime > minVruntime {
+		minVruntime = best.vruntime
+	}
+	return best
+}
+
+func SetNice(t *Thread, nice int) {
+	t.nice = int8(max(MIN_NICE, min(MAX_NICE, nice)))
+}
+
+func Nice(t *Thread) int {
+	return int(t.nice)
+}
+
+func SetScheduler(t *Thread, policy int, priority int) syscall.Errno {
+	switch policy {
+	case SCHED_FIFO, SCHED_RR:
+		if priority < MIN_RT_PRIORITY || priority > MAX_RT_PRIORITY {
+			return syscall.EINVAL
+		}
+	case SCHED_OTHER, SCHED_BATCH, SCHED_IDLE:
+		if priority != 0 {
+			return syscall.EINVAL
+		}
+	default:
+		return syscall.EINVAL
+	}
+	wasRealTime := isRealTime(t)
+	t.policy = uint8(policy)
+	t.rtPriority = uint8(priority)
+	if wasRealTime && !isRealTime(t) {
+		// Start where the other threads are instead of the old runtime
+		t.vruntime = minVruntime
+	}
+	rtRequeue(t)
+	PerformSchedule = true
+	return ESUCCESS
+}
+
+func Scheduler(t *Thread) (policy int, priority int) {
+	return int(t.policy), int(t.rtPriority)
+}
+
+func SetAffinity(t *Thread, mask uint32) syscall.Errno {
+	if mask&onlineCpuMask() == 0 {
+		return syscall.EINVAL
+	}
+	t.affinity = mask
+	if canRunOn(t, int(t.cpu)) {
+		return ESUCCESS
+	}
+	oldCpu := &cpus[t.cpu]
+	rqMigrate(t, leastLoadedCpu(t))
+	if t == CurrentThread {
+		PerformSchedule = true
+	} else if t.onCpu {
+		sendReschedIpi(oldCpu)
+	}
+	return ESUCCESS
+}
+
+func Affinity(t *Thread) uint32 {
+	return t.affinity & onlineCpuMask()
+}
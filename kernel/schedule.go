@@ -22,8 +22,9 @@ var (
 	CurrentDomain  *Domain    = nil
 	allDomains     domainList = domainList{head: nil, tail: nil}
 	largestPid     uint32     = 0x0
-	kernelHlt      bool       = false
 	scheduleThread Thread     = Thread{}
+	// Set when the first thread runs. Before that nobody can sleep and drivers poll.
+	schedulerStarted bool
 )
 
 func backupFpRegs(buffer uintptr)
@@ -41,7 +42,17 @@ func AddDomain(d *Domain) {
 }
 
 func ExitDomain(d *Domain) {
+	if d.exiting {
+		// Another thread is already tearing down the domain and waits for us to be switched out
+		for {
+			waitForInterrupt()
+		}
+	}
+	d.exiting = true
+	stopDomainOnOtherCpus(d)
+
 	allDomains.Remove(d)
+	recordExitedUsage(d)
 
 	if allDomains.head == nil {
 		CurrentDomain = nil
@@ -64,9 +75,11 @@ func cleanUpDomain(d *Domain) {
 		cleanUpThread(cur)
 	}
 	for cur := d.blockedThreads.thread; d.blockedThreads.thread != nil; cur = d.blockedThreads.thread {
-		cleanUpThread(cur)
 		d.blockedThreads.Dequeue(cur)
+		cleanUpThread(cur)
 	}
+	d.Files.CloseAll()
+
 	// Clean allocated memory
 	d.MemorySpace.FreeAllPages()
 
@@ -80,6 +93,16 @@ func cleanUpThread(t *Thread) {
 	// TODO; Adjust when thread control block is no longer a single page
 	threadPtr := (uintptr)(unsafe.Pointer(t))
 	threadDomain := t.Domain
+	CancelHrTimer(&t.sleepTimer)
+	rqDequeue(t)
+	if thisCpu.prevThread == t {
+		thisCpu.prevThread = nil
+	}
+	if t.waitQueue != nil {
+		t.waitQueue.Remove(t)
+	}
+	// A thread killed during poll or select leaves its entries behind
+	PollRemove(threadPtr)
 	threadDomain.MemorySpace.UnmapPage(t.kernelStack.lo)
 	threadDomain.MemorySpace.UnmapPage(threadPtr)
 	if CurrentThread == t {
@@ -103,7 +126,14 @@ func ExitThread(t *Thread) {
 	}, (uintptr)(unsafe.Pointer(t)))
 }
 
-func waitForInterrupt()
+func haltForInterrupt()
+
+// Halt until the next interrupt. Other CPUs can enter the kernel in the meantime.
+func waitForInterrupt() {
+	leaveKernel()
+	haltForInterrupt()
+	enterKernel()
+}
 
 /*
  * Yield execution but allow thread to be scheduled again.
@@ -113,36 +143,33 @@ func Yield() {
 }
 
 /*
- * Yield execution and prevent thread from being scheduled
+ * Yield execution and prevent thread from being scheduled until ResumeThread is called
  */
 func Block() {
-	CurrentThread.IsBlocked = true
-	for CurrentThread.IsBlocked {
+	t := CurrentThread
+	t.IsBlocked = true
+	t.Domain.runningThreads.Dequeue(t)
+	t.Domain.blockedThreads.Enqueue(t)
+	rqDequeue(t)
+	for t.IsBlocked {
 		waitForInterrupt()
 	}
 }
 
 func ResumeThread(t *Thread) {
+	if !t.IsBlocked {
+		return
+	}
 	t.IsBlocked = false
 	t.Domain.blockedThreads.Dequeue(t)
 	t.Domain.runningThreads.Enqueue(t)
-}
-
-func getNextUnblockedThread(domain *Domain) *Thread {
-	newThread := domain.runningThreads.Next()
-	if newThread == nil || !newThread.IsBlocked {
-		return newThread
-	}
-	for cur := domain.runningThreads.Next(); cur != newThread; cur = domain.runningThreads.Next() {
-		if !cur.IsBlocked {
-			return cur
-		}
-	}
-	return nil
+	rqEnqueue(t)
+	schedWakeup(t)
+	schedKick(t)
 }
 
 func Schedule() {
-	if CurrentDomain == nil {
+	if allDomains.head == nil {
 		log.KErrorLn("No Domains to schedule")
 		Shutdown()
 		// DisableInterrupts()
@@ -150,46 +177,28 @@ func Schedule() {
 	}
 	//log.KDebug("Scheduling in ")
 	//printTid(defaultLogWriter, currentThread)
-	nextDomain := CurrentDomain.next
-	newThread := getNextUnblockedThread(nextDomain)
 
-	if newThread == nil {
-		for newDomain := nextDomain.next; newDomain != nextDomain; newDomain = newDomain.next {
-			newThread = getNextUnblockedThread(newDomain)
-			if newThread != nil {
-				break
-			}
-		}
+	if now := MonotonicTime(); now >= thisCpu.nextBalance {
+		balanceLoad()
+		thisCpu.nextBalance = now + SCHED_BALANCE_INTERVAL
 	}
-	//if currentThread.next == currentThread && currentThread.tid != 0{
-	//    kernelPanic("Why no next?")
-	//}
-	//if newThread.tid == currentThread.tid && currentThread.tid != 0 {
-	//    kernelPanic("Why only one thread?")
-	//}
+	newThread := pickNextThread()
 	//log.KPrintln("next domain: ", nextDomain.pid)
 	//log.KPrintln("next thread: ", newThread.tid)
 	//log.KPrintln("domain threads: ", nextDomain.numThreads)
 
 	if newThread == nil {
-		if kernelHlt {
-			// We are already stalling the kernel
-			return
-		}
-		// All threads blocked or no threads exist anymore.
-		kernelHlt = true
-		PerformSchedule = false
-		//currentThread = nil
-		kernelPanic("test")
-		return
+		// All threads are blocked. Wait for an interrupt to wake one up.
+		newThread = idleThread
+	} else {
+		CurrentDomain = newThread.Domain
+		tickStart()
 	}
-
-	kernelHlt = false
-	CurrentDomain = nextDomain
 	if newThread == CurrentThread {
 		return
 	}
 
+	accountSwitch(CurrentThread, newThread)
 	switchToThread(newThread)
 
 	//log.KDebug("Now executing: ")
@@ -198,7 +207,10 @@ func Schedule() {
 
 func switchToThread(t *Thread) {
 	// Save state of current thread
+	finishSwitch()
 	if CurrentThread != nil {
+		// Still marked as on the CPU until we are off its stack
+		thisCpu.prevThread = CurrentThread
 		addr := uintptr(unsafe.Pointer(&(CurrentThread.fpState)))
 		offset := 16 - (addr % 16)
 		CurrentThread.fpOffset = offset
@@ -209,6 +221,7 @@ func switchToThread(t *Thread) {
 	// Load next thread
 	//log.KDebugln("Switching to domain pid", currentDomain.pid, " and thread ", t.tid)
 	CurrentThread = t
+	t.onCpu = true
 
 	addr := uintptr(unsafe.Pointer(&(CurrentThread.fpState)))
 	offset := CurrentThread.fpOffset
@@ -224,6 +237,15 @@ func switchToThread(t *Thread) {
 	FlushTlsTable(t.tlsSegments[:])
 }
 
+// The previous thread can run on other CPUs again. Called when this CPU is
+// done with its stack, at the latest before the kernel lock is released.
+func finishSwitch() {
+	if prev := thisCpu.prevThread; prev != nil {
+		prev.onCpu = false
+		thisCpu.prevThread = nil
+	}
+}
+
 func InitScheduling() {
 
 }
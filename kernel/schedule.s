@@ -14,7 +14,7 @@ TEXT ·getESP(SB),NOSPLIT,$4
     MOVL SP, ret+0(FP)
     RET
 
-TEXT ·waitForInterrupt(SB),NOSPLIT,$0
+TEXT ·haltForInterrupt(SB),NOSPLIT,$0
     // When an interrunt in kernel space happens it does not push stack info on the stack
     // We do this here so it is found in the interrupt
     MOVL SP, AX
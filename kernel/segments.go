@@ -149,6 +149,7 @@ func InitSegments() {
 	gdtDescriptor.GdtSize = GDT_ENTRIES - 1
 	gdtTableLen += oldGdtLen
 	installGDT(&gdtDescriptor)
+	thisCpu.gdt = &gdtTable
 	//printGdt(gdtTable[:gdtTableLen])
 }
 
@@ -245,8 +246,9 @@ func FindFreeTlsSlot() uint32 {
 	return uint32(0xffffffff)
 }
 
+// Copies the TLS entries into the GDT of the current CPU
 func FlushTlsTable(table []GdtEntry) {
-	copy(gdtTable[TLS_START:], table[TLS_START:])
+	copy(thisCpu.gdt[TLS_START:], table[TLS_START:])
 }
 
 func printGdt(gdt []GdtEntry) {
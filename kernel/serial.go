@@ -11,6 +11,9 @@ const (
 
 var (
 	SerialDevice UARTSerialDevice
+
+	// Threads waiting for serial input
+	serialInputQueue WaitQueue
 )
 
 type UARTSerialDevice struct {
@@ -92,7 +95,22 @@ func InitSerialDevice() {
 	}
 }
 
+func handleSerial() {
+	// Reading the interrupt identification acknowledges it. The data stays in the FIFO for the readers.
+	Inb(SerialDevice.BasePort + 2)
+	serialInputQueue.WakeAll()
+}
+
+// Wait until data was received
+func (d UARTSerialDevice) WaitForData() {
+	for !d.HasReceivedData() {
+		serialInputQueue.Wait()
+	}
+}
+
 func InitSerialDeviceInterrupt() {
-	// RegisterPICHandler(COM1_IRQ, testInterrupt4)
-	// EnableIRQ(COM1_IRQ)
+	RegisterIRQHandler(COM1_IRQ, handleSerial)
+	Outb(SerialDevice.BasePort+1, 0x01) // Interrupt when data is available
+	Outb(SerialDevice.BasePort+4, 0x0B) // RTS/DSR set, OUT2 connects the interrupt line
+	EnableIRQ(COM1_IRQ)
 }
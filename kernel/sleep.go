@@ -0,0 +1,46 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/utils"
+)
+
+// Threads that sleep until a deadline. Every sleeping thread has a high
+// resolution timer that resumes it.
+
+func wakeSleeper(timer *HrTimer) {
+	t := utils.UIntToPointer[Thread](timer.Arg)
+	t.isSleeping = false
+	ResumeThread(t)
+}
+
+// Block the current thread until the monotonic time reaches the deadline (in ns).
+// Returns false if the sleep was interrupted by a signal.
+func SleepUntil(deadline uint64) bool {
+	t := CurrentThread
+	if deadline <= MonotonicTime() {
+		return true
+	}
+	t.interrupted = false
+	t.isSleeping = true
+	t.sleepTimer.Callback = wakeSleeper
+	t.sleepTimer.Arg = uintptr(unsafe.Pointer(t))
+	StartHrTimer(&t.sleepTimer, deadline)
+	Block()
+	// Still queued if something else woke us up
+	CancelHrTimer(&t.sleepTimer)
+	t.isSleeping = false
+	return !t.interrupted
+}
+
+// Wake a thread that is sleeping because a signal arrived
+func InterruptThread(t *Thread) {
+	if !t.isSleeping {
+		return
+	}
+	CancelHrTimer(&t.sleepTimer)
+	t.isSleeping = false
+	t.interrupted = true
+	ResumeThread(t)
+}
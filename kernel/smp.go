@@ -0,0 +1,418 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Symmetric multiprocessing. The application processors (APs) are found in the
+// MADT or the MP table and started with INIT-SIPI-SIPI.
+//
+// The kernel itself is protected by a single kernel lock. A CPU takes it when it
+// enters the kernel through an interrupt and releases it when returning to user
+// space or when halting. Globals like CurrentThread belong to the CPU holding the
+// lock, they are stored in the Cpu struct while the CPU is outside of the kernel.
+
+const (
+	MAX_CPUS = 8
+	NO_CPU   = -1
+
+	AP_TRAMPOLINE_ADDR  = 0x8000
+	AP_TRAMPOLINE_ENTRY = 0x17 // Offset of the far jump target
+	AP_TRAMPOLINE_GDT   = 0x20 // Offset of the GDT descriptor
+
+	AP_INIT_DELAY_US    = 10000
+	AP_STARTUP_DELAY_US = 200
+	AP_BOOT_TIMEOUT_MS  = 100
+
+	MP_CONFIG_HEADER_SIZE = 44
+	MP_ENTRY_PROCESSOR    = 0
+	MP_PROCESSOR_SIZE     = 20
+	MP_ENTRY_SIZE         = 8
+	MP_CPU_ENABLED        = 1 << 0
+	MP_CPU_BSP            = 1 << 1
+
+	BDA_EBDA_SEGMENT = 0x40e
+	BDA_BASE_MEMORY  = 0x413 // In KiB
+	BIOS_ROM_START   = 0xf0000
+	BIOS_ROM_SIZE    = 0x10000
+)
+
+type Cpu struct {
+	Index   int
+	ApicId  uint32
+	started bool // The AP runs kernel code, set before it takes the kernel lock
+	online  bool
+
+	tss           tssEntry
+	tssSelector   uint32
+	gdt           *[GDT_ENTRIES]GdtEntry
+	gdtDescriptor GdtDescriptor
+	schedStack    stack
+	idle          Thread
+	rq            runQueue
+
+	// Kernel globals of this CPU while another CPU holds the kernel lock
+	currentThread   *Thread
+	currentDomain   *Domain
+	performSchedule bool
+
+	// Thread that was switched out but whose stack is still in use until we leave the kernel
+	prevThread *Thread
+
+	nextBalance uint64
+
+	// Timers of this CPU
+	clockEvent ClockEventDevice
+	timers     *HrTimer
+	tickTimer  HrTimer
+}
+
+type mpFloatingPointer struct {
+	signature  [4]byte
+	configAddr uint32
+	length     uint8 // In 16 byte units
+	revision   uint8
+	checksum   uint8
+	features   [5]uint8
+}
+
+type mpConfigHeader struct {
+	signature    [4]byte
+	length       uint16
+	revision     uint8
+	checksum     uint8
+	oemId        [8]byte
+	productId    [12]byte
+	oemTable     uint32
+	oemTableSize uint16
+	entryCount   uint16
+	lapicAddr    uint32
+	extLength    uint16
+	extChecksum  uint8
+	reserved     uint8
+}
+
+type mpProcessorEntry struct {
+	entryType   uint8
+	apicId      uint8
+	apicVersion uint8
+	flags       uint8
+	signature   uint32
+	features    uint32
+	reserved    [2]uint32
+}
+
+// Real mode code the APs start in. It loads the kernel GDT, enables protected
+// mode and jumps to apEntry. The jump target and the GDT are patched in.
+var apTrampoline = [...]byte{
+	0xfa,       // cli
+	0x31, 0xc0, // xor ax, ax
+	0x8e, 0xd8, // mov ds, ax
+	0x66, 0x0f, 0x01, 0x16, AP_TRAMPOLINE_GDT, AP_TRAMPOLINE_ADDR >> 8, // lgdtl [AP_TRAMPOLINE_ADDR + AP_TRAMPOLINE_GDT]
+	0x0f, 0x20, 0xc0, // mov eax, cr0
+	0x66, 0x83, 0xc8, 0x01, // or eax, 1
+	0x0f, 0x22, 0xc0, // mov cr0, eax
+	0x66, 0xea, 0, 0, 0, 0, KCS_SELECTOR, 0, // ljmpl KCS_SELECTOR:apEntry
+}
+
+var (
+	cpus    [MAX_CPUS]Cpu
+	numCpus = 1
+	thisCpu = &cpus[0]
+
+	// The boot CPU starts out in the kernel
+	kernelLock      = SpinLock{state: 1}
+	kernelLockOwner = 0
+	kernelLockDepth = 0
+
+	// Passed to the AP that is currently booting
+	apBootCpu     *Cpu
+	apBootStack   uintptr
+	apBootPageDir uintptr
+)
+
+// 32 bit entry of the APs, sets up paging and the stack and calls apMain
+func apEntry()
+
+// Continue the current thread where it was switched out
+func runCurrentThread()
+
+func getTaskRegister() uint32
+
+// Every CPU has its own TSS, so the task register tells us where we are
+func currentCpu() *Cpu {
+	tr := getTaskRegister()
+	for i := 1; i < numCpus; i++ {
+		if cpus[i].tssSelector == tr {
+			return &cpus[i]
+		}
+	}
+	return &cpus[0]
+}
+
+func CurrentCpuIndex() int {
+	return thisCpu.Index
+}
+
+func enterKernel() {
+	cpu := currentCpu()
+	if kernelLock.IsLocked() && kernelLockOwner == cpu.Index {
+		// Exception while in the kernel
+		kernelLockDepth++
+		return
+	}
+	kernelLock.Lock()
+	kernelLockOwner = cpu.Index
+	thisCpu = cpu
+	CurrentThread = cpu.currentThread
+	CurrentDomain = cpu.currentDomain
+	PerformSchedule = cpu.performSchedule
+	idleThread = &cpu.idle
+	scheduleThread.kernelStack = cpu.schedStack
+}
+
+// Nothing shared may be touched after this until enterKernel is called again
+func leaveKernel() {
+	if kernelLockDepth > 0 {
+		kernelLockDepth--
+		return
+	}
+	cpu := thisCpu
+	finishSwitch()
+	cpu.currentThread = CurrentThread
+	cpu.currentDomain = CurrentDomain
+	cpu.performSchedule = PerformSchedule
+	kernelLockOwner = NO_CPU
+	kernelLock.Unlock()
+}
+
+func onlineCpuMask() uint32 {
+	var mask uint32
+	for i := range numCpus {
+		if cpus[i].online {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+func sendReschedIpi(cpu *Cpu) {
+	if cpu == thisCpu || !cpu.online {
+		return
+	}
+	lapicSendIpi(cpu.ApicId, LAPIC_ICR_FIXED|RESCHED_VECTOR)
+}
+
+// Other CPUs still running threads of the domain might use the old mappings.
+// Every interrupt reloads the page directory before returning to user space.
+func FlushTlbOtherCpus(d *Domain) {
+	for i := range numCpus {
+		cpu := &cpus[i]
+		if cpu != thisCpu && cpu.currentThread != nil && cpu.currentThread.Domain == d {
+			sendReschedIpi(cpu)
+		}
+	}
+}
+
+// Wait until no other CPU runs a thread of the domain. The domain has to be marked as exiting.
+func stopDomainOnOtherCpus(d *Domain) {
+	for {
+		running := false
+		for i := range numCpus {
+			cpu := &cpus[i]
+			if cpu != thisCpu && cpu.currentThread != nil && cpu.currentThread.Domain == d {
+				running = true
+				sendReschedIpi(cpu)
+			}
+		}
+		if !running {
+			return
+		}
+		// Let the other CPUs in so that they can switch away
+		leaveKernel()
+		Pause()
+		enterKernel()
+	}
+}
+
+func mpChecksum(addr uintptr, length uintptr) uint8 {
+	var sum uint8
+	for _, b := range unsafe.Slice((*byte)(unsafe.Pointer(addr)), length) {
+		sum += b
+	}
+	return sum
+}
+
+func mpScan(addr uintptr, length uintptr) *mpFloatingPointer {
+	if addr == 0 {
+		return nil
+	}
+	for p := addr; p+16 <= addr+length; p += 16 {
+		fp := (*mpFloatingPointer)(unsafe.Pointer(p))
+		if fp.signature == [4]byte{'_', 'M', 'P', '_'} && mpChecksum(p, uintptr(fp.length)*16) == 0 {
+			return fp
+		}
+	}
+	return nil
+}
+
+func mpFindFloatingPointer() *mpFloatingPointer {
+	ebda := uintptr(*(*uint16)(unsafe.Pointer(uintptr(BDA_EBDA_SEGMENT)))) << 4
+	if fp := mpScan(ebda, 1024); fp != nil {
+		return fp
+	}
+	baseMemory := uintptr(*(*uint16)(unsafe.Pointer(uintptr(BDA_BASE_MEMORY)))) * 1024
+	if fp := mpScan(baseMemory-1024, 1024); fp != nil {
+		return fp
+	}
+	return mpScan(BIOS_ROM_START, BIOS_ROM_SIZE)
+}
+
+// Add an AP to cpus
+func addCpu(apicId uint32) {
+	if apicId == thisCpu.ApicId {
+		return
+	}
+	if numCpus == MAX_CPUS {
+		log.KErrorLn("[SMP] Ignoring CPU with APIC id ", apicId)
+		return
+	}
+	cpus[numCpus].Index = numCpus
+	cpus[numCpus].ApicId = apicId
+	numCpus++
+}
+
+// Add every enabled AP of the MP configuration table to cpus
+func mpReadProcessors(fp *mpFloatingPointer) {
+	header := (*mpConfigHeader)(unsafe.Pointer(uintptr(fp.configAddr)))
+	if header.signature != [4]byte{'P', 'C', 'M', 'P'} || mpChecksum(uintptr(fp.configAddr), uintptr(header.length)) != 0 {
+		log.KErrorLn("[SMP] Invalid MP configuration table")
+		return
+	}
+	entry := uintptr(fp.configAddr) + MP_CONFIG_HEADER_SIZE
+	for i := 0; i < int(header.entryCount); i++ {
+		if *(*uint8)(unsafe.Pointer(entry)) != MP_ENTRY_PROCESSOR {
+			entry += MP_ENTRY_SIZE
+			continue
+		}
+		cpu := (*mpProcessorEntry)(unsafe.Pointer(entry))
+		entry += MP_PROCESSOR_SIZE
+		if cpu.flags&MP_CPU_ENABLED == 0 || cpu.flags&MP_CPU_BSP != 0 {
+			continue
+		}
+		addCpu(uint32(cpu.apicId))
+	}
+}
+
+// Every CPU needs its own GDT for its TSS and the TLS entries of its thread
+func prepareCpu(cpu *Cpu) bool {
+	tssIndex := AddSegment(uintptr(unsafe.Pointer(&cpu.tss)), unsafe.Sizeof(cpu.tss), PRIV_KERNEL|SEG_NORW|TSS_32MODE|SEG_SYSTEM|TSS_IS_TSS, SEG_GRAN_BYTE)
+	if tssIndex < 0 {
+		log.KErrorLn("[SMP] No GDT entry left for CPU ", cpu.Index)
+		return false
+	}
+	gdtPage := mm.AllocPage()
+	cpu.gdt = (*[GDT_ENTRIES]GdtEntry)(gdtPage.Pointer())
+	*cpu.gdt = gdtTable
+	gdtAddr := gdtPage.Address()
+	cpu.gdtDescriptor.GdtAddressLow = uint16(gdtAddr)
+	cpu.gdtDescriptor.GdtAddressHigh = uint16(gdtAddr >> 16)
+	cpu.gdtDescriptor.GdtSize = gdtDescriptor.GdtSize
+	cpu.tssSelector = uint32(tssIndex * 8)
+
+	stack := mm.AllocPage()
+	stack.Clear()
+	cpu.schedStack.lo = stack.Address()
+	cpu.schedStack.hi = stack.Address() + PAGE_SIZE
+	cpu.tss.ss0 = KDS_SELECTOR
+	cpu.tss.esp0 = uint32(cpu.schedStack.hi)
+	initIdleThread(&cpu.idle)
+	return true
+}
+
+func startCpu(cpu *Cpu) {
+	if !prepareCpu(cpu) {
+		return
+	}
+	apBootCpu = cpu
+	apBootStack = cpu.schedStack.hi
+	lapicSendIpi(cpu.ApicId, LAPIC_ICR_INIT)
+	pitDelay(AP_INIT_DELAY_US)
+	for i := 0; i < 2 && !cpu.started; i++ {
+		lapicSendIpi(cpu.ApicId, LAPIC_ICR_STARTUP|AP_TRAMPOLINE_ADDR>>12)
+		pitDelay(AP_STARTUP_DELAY_US)
+	}
+	for i := 0; i < AP_BOOT_TIMEOUT_MS && !cpu.started; i++ {
+		pitDelay(1000)
+	}
+	if !cpu.started {
+		log.KErrorLn("[SMP] CPU ", cpu.Index, " did not start")
+	}
+}
+
+func apMain() {
+	cpu := apBootCpu
+	installIDT(&idtDescriptor)
+	installGDT(&cpu.gdtDescriptor)
+	flushTss(int(cpu.tssSelector))
+	cpu.started = true
+
+	// Waits until the boot CPU is done with the initialization. Everything
+	// after this may touch shared state.
+	enterKernel()
+	lapicEnable(false)
+	cpu.online = true
+	setClockEvent(&lapicTimer)
+	Schedule()
+	runCurrentThread()
+}
+
+// Needs paging, the idle thread and user mode segments
+func InitSmp() {
+	thisCpu.started = true
+	thisCpu.online = true
+	if lapicBase == 0 {
+		log.KDebugLn("[SMP] No local APIC, running on a single CPU")
+		return
+	}
+	// Prefer the MADT, the MP table is the fallback for old machines
+	if !madtReadProcessors() {
+		fp := mpFindFloatingPointer()
+		if fp == nil || fp.configAddr == 0 {
+			log.KDebugLn("[SMP] No MADT or MP configuration table, running on a single CPU")
+			return
+		}
+		mpReadProcessors(fp)
+	}
+	if numCpus == 1 {
+		return
+	}
+
+	// The trampoline has to be below 1M. Keep whatever was there before.
+	lowMemory := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(AP_TRAMPOLINE_ADDR))), PAGE_SIZE)
+	backup := mm.AllocPage()
+	copy(backup, lowMemory)
+	copy(lowMemory, apTrampoline[:])
+	*(*uint32)(unsafe.Pointer(uintptr(AP_TRAMPOLINE_ADDR + AP_TRAMPOLINE_ENTRY))) = uint32(hackyGetFuncAddr(apEntry))
+	*(*GdtDescriptor)(unsafe.Pointer(uintptr(AP_TRAMPOLINE_ADDR + AP_TRAMPOLINE_GDT))) = gdtDescriptor
+	apBootPageDir = uintptr(unsafe.Pointer(mm.KernelMemSpace.PageDirectory))
+
+	for i := 1; i < numCpus; i++ {
+		startCpu(&cpus[i])
+	}
+
+	copy(lowMemory, backup)
+	mm.FreePage(backup.Pointer())
+
+	// The APs go online once the boot CPU leaves the kernel
+	started := 0
+	for i := range numCpus {
+		if cpus[i].started {
+			started++
+		}
+	}
+	log.KDebugLn("[SMP] ", started, " of ", numCpus, " CPUs started")
+}
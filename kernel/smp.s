@@ -0,0 +1,30 @@
+#include "textflag.h"
+
+// The trampoline jumps here in protected mode with paging disabled
+TEXT ·apEntry(SB),NOSPLIT,$0
+    MOVL $0x10, AX // KDS_SELECTOR
+    MOVW AX, DS
+    MOVW AX, ES
+    MOVW AX, FS
+    MOVW AX, SS
+    MOVL $0x18, AX // KGS_SELECTOR
+    MOVW AX, GS
+
+    // Enable SSE like rt0 does on the boot CPU
+    MOVL CR0, AX
+    ANDL $~4, AX
+    ORL $2, AX
+    MOVL AX, CR0
+    MOVL CR4, AX
+    ORL $0x600, AX
+    MOVL AX, CR4
+
+    MOVL ·apBootPageDir(SB), AX
+    MOVL AX, CR3
+    MOVL CR0, AX
+    ORL $0x80000000, AX
+    MOVL AX, CR0
+
+    MOVL ·apBootStack(SB), SP
+    CALL ·apMain(SB)
+    HLT
@@ -0,0 +1,618 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// BSD sockets. A socket is a file that wraps a TCP connection, a UDP endpoint
+// or a unix socket. They come from a static table, there is no heap for them.
+
+const (
+	SOCKET_MAX         = 32
+	SOCKET_BUFFER_SIZE = 8192 // Queued datagrams of a UDP socket, data of a unix socket
+	// Length, port and source address in front of every queued datagram
+	SOCKET_DGRAM_HEADER = 8
+
+	SOCKADDR_IN_SIZE = 16
+
+	SO_REUSEPORT  = 15
+	TCP_KEEPIDLE  = 4
+	TCP_KEEPINTVL = 5
+	TCP_KEEPCNT   = 6
+
+	FIONREAD = 0x541b
+	FIONBIO  = 0x5421
+)
+
+// Ancillary data of a message. Received files belong to the caller, which
+// installs or releases them.
+type SocketControl struct {
+	Fds     [UNIX_MAX_FDS]File
+	NumFds  int
+	Cred    syscall.Ucred
+	HasCred bool
+}
+
+// Socket address in the layout of struct sockaddr. Data is big enough for sockaddr_un.
+type Sockaddr struct {
+	Family uint16
+	Data   [108]byte
+}
+
+type Socket struct {
+	FileBase
+	used      bool
+	family    int
+	typ       int
+	nonblock  bool
+	keepAlive bool // Stored for getsockopt, no probes are sent
+
+	tcp *tcpConn
+
+	udp       udpEndpoint
+	connected bool // Datagram socket with a default destination or connected unix socket
+	peerAddr  Ipv4Address
+	peerPort  uint16
+	broadcast bool
+	rxBuf     [SOCKET_BUFFER_SIZE]byte
+	rxHead    int
+	rxLen     int
+	rxCount   int // Queued datagrams or unix records
+	readers   WaitQueue
+
+	// Unix sockets
+	name        Sockaddr
+	nameLen     int  // 0 if unbound
+	named       bool // Others find it by name
+	peer        *Socket
+	cred        syscall.Ucred // Passed to connecting peers
+	peerCred    syscall.Ucred
+	passCred    bool
+	rxShut      bool // Nothing more arrives
+	txShut      bool
+	listening   bool
+	backlog     int
+	acceptQueue [UNIX_MAX_BACKLOG]*Socket
+	acceptHead  int
+	acceptCount int
+	writers     WaitQueue // Wait for room in rxBuf or the accept queue
+}
+
+var sockets [SOCKET_MAX]Socket
+
+func (sa *Sockaddr) inet(length int) (Ipv4Address, uint16, syscall.Errno) {
+	var addr Ipv4Address
+	if length < SOCKADDR_IN_SIZE {
+		return addr, 0, syscall.EINVAL
+	}
+	if sa.Family != syscall.AF_INET {
+		return addr, 0, syscall.EAFNOSUPPORT
+	}
+	copy(addr[:], sa.Data[2:6])
+	return addr, getUint16(sa.Data[0:]), ESUCCESS
+}
+
+// Returns the length of the address
+func (sa *Sockaddr) setInet(addr Ipv4Address, port uint16) int {
+	*sa = Sockaddr{Family: syscall.AF_INET}
+	putUint16(sa.Data[0:], port)
+	copy(sa.Data[2:6], addr[:])
+	return SOCKADDR_IN_SIZE
+}
+
+func socketAlloc() *Socket {
+	for i := range sockets {
+		s := &sockets[i]
+		if !s.used {
+			*s = Socket{}
+			s.used = true
+			return s
+		}
+	}
+	return nil
+}
+
+func socketFromUdp(e *udpEndpoint) *Socket {
+	for i := range sockets {
+		if &sockets[i].udp == e {
+			return &sockets[i]
+		}
+	}
+	return nil
+}
+
+// typ without the SOCK_NONBLOCK and SOCK_CLOEXEC flags
+func NewSocket(family, typ, protocol int) (*Socket, syscall.Errno) {
+	switch {
+	case family == syscall.AF_UNIX:
+		if typ != syscall.SOCK_STREAM && typ != syscall.SOCK_DGRAM {
+			return nil, syscall.ESOCKTNOSUPPORT
+		}
+		if protocol != 0 && protocol != syscall.AF_UNIX { // PF_UNIX
+			return nil, syscall.EPROTONOSUPPORT
+		}
+	case family != syscall.AF_INET:
+		return nil, syscall.EAFNOSUPPORT
+	case typ == syscall.SOCK_STREAM:
+		if protocol != 0 && protocol != syscall.IPPROTO_TCP {
+			return nil, syscall.EPROTONOSUPPORT
+		}
+	case typ == syscall.SOCK_DGRAM:
+		if protocol != 0 && protocol != syscall.IPPROTO_UDP {
+			return nil, syscall.EPROTONOSUPPORT
+		}
+	default:
+		return nil, syscall.ESOCKTNOSUPPORT
+	}
+	s := socketAlloc()
+	if s == nil {
+		return nil, syscall.ENFILE
+	}
+	s.family = family
+	s.typ = typ
+	if family == syscall.AF_UNIX {
+		return s, ESUCCESS
+	}
+	if typ == syscall.SOCK_STREAM {
+		s.tcp = tcpNew()
+		if s.tcp == nil {
+			s.used = false
+			return nil, syscall.ENOBUFS
+		}
+	} else {
+		s.udp.receive = socketUdpReceive
+	}
+	return s, ESUCCESS
+}
+
+func (s *Socket) IsStream() bool {
+	return s.typ == syscall.SOCK_STREAM
+}
+
+func (s *Socket) SetNonblock(nonblock bool) {
+	s.nonblock = nonblock
+}
+
+func (s *Socket) Nonblock() bool {
+	return s.nonblock
+}
+
+func (s *Socket) Bind(sa *Sockaddr, length int) syscall.Errno {
+	if s.family == syscall.AF_UNIX {
+		return unixBind(s, sa, length)
+	}
+	addr, port, err := sa.inet(length)
+	if err != ESUCCESS {
+		return err
+	}
+	if s.IsStream() {
+		return tcpBind(s.tcp, addr, port)
+	}
+	return udpBind(&s.udp, addr, port)
+}
+
+func (s *Socket) Connect(sa *Sockaddr, length int) syscall.Errno {
+	if !s.IsStream() && length >= 2 && sa.Family == syscall.AF_UNSPEC {
+		s.connected = false
+		s.peer = nil
+		return ESUCCESS
+	}
+	if s.family == syscall.AF_UNIX {
+		return unixConnect(s, sa, length)
+	}
+	addr, port, err := sa.inet(length)
+	if err != ESUCCESS {
+		return err
+	}
+	if addr.IsAny() {
+		// Like Linux, the any address means this host
+		addr = IPV4_LOOPBACK
+	}
+	if s.IsStream() {
+		return tcpConnect(s.tcp, addr, port, s.nonblock)
+	}
+	if !s.udp.bound {
+		if err := udpBind(&s.udp, IPV4_ANY, 0); err != ESUCCESS {
+			return err
+		}
+	}
+	s.peerAddr = addr
+	s.peerPort = port
+	s.connected = true
+	return ESUCCESS
+}
+
+func (s *Socket) Listen(backlog int) syscall.Errno {
+	if s.family == syscall.AF_UNIX {
+		return unixListen(s, backlog)
+	}
+	if !s.IsStream() {
+		return syscall.EOPNOTSUPP
+	}
+	return tcpListen(s.tcp, backlog)
+}
+
+func (s *Socket) Accept() (*Socket, syscall.Errno) {
+	if !s.IsStream() {
+		return nil, syscall.EOPNOTSUPP
+	}
+	if s.family == syscall.AF_UNIX {
+		return unixAccept(s)
+	}
+	n := socketAlloc()
+	if n == nil {
+		return nil, syscall.ENFILE
+	}
+	c, err := tcpAccept(s.tcp, s.nonblock)
+	if err != ESUCCESS {
+		n.used = false
+		return nil, err
+	}
+	n.family = s.family
+	n.typ = s.typ
+	n.tcp = c
+	return n, ESUCCESS
+}
+
+// sa is nil if no address was given
+func (s *Socket) SendTo(data []byte, flags int, sa *Sockaddr, length int) (int, syscall.Errno) {
+	return s.SendMsg(data, flags, sa, length, nil)
+}
+
+// Sleep until a datagram with length bytes can be sent without sleeping.
+// Syscalls call this before they copy the data to a buffer that other
+// senders use as well. Sends on other sockets never sleep for datagrams.
+func (s *Socket) WaitSendDgram(length int, flags int, sa *Sockaddr, saLength int) syscall.Errno {
+	if s.family != syscall.AF_UNIX || s.IsStream() {
+		return ESUCCESS
+	}
+	return unixWaitDgram(s, length, s.nonblock || flags&syscall.MSG_DONTWAIT != 0, sa, saLength)
+}
+
+// Like SendTo with ancillary data, which only unix sockets take
+func (s *Socket) SendMsg(data []byte, flags int, sa *Sockaddr, length int, ctrl *SocketControl) (int, syscall.Errno) {
+	nonblock := s.nonblock || flags&syscall.MSG_DONTWAIT != 0
+	if s.family == syscall.AF_UNIX {
+		return unixSendMsg(s, data, nonblock, sa, length, ctrl)
+	}
+	if ctrl != nil && (ctrl.NumFds > 0 || ctrl.HasCred) {
+		return 0, syscall.EINVAL
+	}
+	if s.IsStream() {
+		// The address is ignored for connected sockets like on Linux
+		return tcpWrite(s.tcp, data, nonblock)
+	}
+	dst, port := s.peerAddr, s.peerPort
+	if sa != nil {
+		var err syscall.Errno
+		dst, port, err = sa.inet(length)
+		if err != ESUCCESS {
+			return 0, err
+		}
+	} else if !s.connected {
+		return 0, syscall.EDESTADDRREQ
+	}
+	if dst.IsAny() {
+		dst = IPV4_LOOPBACK
+	}
+	if dst == IPV4_BROADCAST && !s.broadcast {
+		return 0, syscall.EACCES
+	}
+	if err := udpSendTo(&s.udp, dst, port, data); err != ESUCCESS {
+		return 0, err
+	}
+	return len(data), ESUCCESS
+}
+
+// Copy the queued bytes starting offset bytes after the head
+func (s *Socket) rxCopyOut(offset int, buf []byte) {
+	for done := 0; done < len(buf); {
+		done += copy(buf[done:], s.rxBuf[(s.rxHead+offset+done)%SOCKET_BUFFER_SIZE:])
+	}
+}
+
+// Overwrite the bytes starting offset bytes after the head
+func (s *Socket) rxWriteAt(offset int, data []byte) {
+	for done := 0; done < len(data); {
+		done += copy(s.rxBuf[(s.rxHead+offset+done)%SOCKET_BUFFER_SIZE:], data[done:])
+	}
+}
+
+func (s *Socket) rxCopyIn(data []byte) {
+	s.rxWriteAt(s.rxLen, data)
+	s.rxLen += len(data)
+}
+
+func (s *Socket) rxConsume(n int) {
+	s.rxHead = (s.rxHead + n) % SOCKET_BUFFER_SIZE
+	s.rxLen -= n
+}
+
+func socketUdpReceive(e *udpEndpoint, pkt *ipv4Packet, srcPort uint16, data []byte) {
+	s := socketFromUdp(e)
+	if s == nil {
+		return
+	}
+	if s.connected && (pkt.src != s.peerAddr || srcPort != s.peerPort) {
+		return
+	}
+	if SOCKET_DGRAM_HEADER+len(data) > SOCKET_BUFFER_SIZE-s.rxLen {
+		// Queue full
+		return
+	}
+	var header [SOCKET_DGRAM_HEADER]byte
+	putUint16(header[0:], uint16(len(data)))
+	putUint16(header[2:], srcPort)
+	copy(header[4:], pkt.src[:])
+	s.rxCopyIn(header[:])
+	s.rxCopyIn(data)
+	s.rxCount++
+	s.readers.WakeAll()
+}
+
+// Returns the bytes copied to buf, the length of the message, which is larger
+// for truncated datagrams, and the length of the source address stored in sa.
+func (s *Socket) RecvFrom(buf []byte, flags int, sa *Sockaddr) (int, int, int, syscall.Errno) {
+	return s.RecvMsg(buf, flags, sa, nil)
+}
+
+// Like RecvFrom, ancillary data goes to ctrl. Passed files are dropped if it is nil.
+func (s *Socket) RecvMsg(buf []byte, flags int, sa *Sockaddr, ctrl *SocketControl) (int, int, int, syscall.Errno) {
+	nonblock := s.nonblock || flags&syscall.MSG_DONTWAIT != 0
+	peek := flags&syscall.MSG_PEEK != 0
+	if s.family == syscall.AF_UNIX {
+		return unixRecvMsg(s, buf, nonblock, peek, sa, ctrl)
+	}
+	if s.IsStream() {
+		n, err := tcpRead(s.tcp, buf, nonblock, peek)
+		return n, n, 0, err
+	}
+	for s.rxCount == 0 {
+		if nonblock {
+			return 0, 0, 0, syscall.EAGAIN
+		}
+		if err := s.readers.WaitInterruptible(); err != ESUCCESS {
+			return 0, 0, 0, err
+		}
+	}
+	var header [SOCKET_DGRAM_HEADER]byte
+	s.rxCopyOut(0, header[:])
+	length := int(getUint16(header[0:]))
+	n := min(length, len(buf))
+	s.rxCopyOut(SOCKET_DGRAM_HEADER, buf[:n])
+	addrLen := 0
+	if sa != nil {
+		var src Ipv4Address
+		copy(src[:], header[4:])
+		addrLen = sa.setInet(src, getUint16(header[2:]))
+	}
+	if !peek {
+		s.rxConsume(SOCKET_DGRAM_HEADER + length)
+		s.rxCount--
+	}
+	return n, length, addrLen, ESUCCESS
+}
+
+func (s *Socket) GetSockName(sa *Sockaddr) int {
+	if s.family == syscall.AF_UNIX {
+		return sa.setUnix(s)
+	}
+	if s.IsStream() {
+		return sa.setInet(s.tcp.localAddr, s.tcp.localPort)
+	}
+	return sa.setInet(s.udp.localAddr, s.udp.localPort)
+}
+
+func (s *Socket) GetPeerName(sa *Sockaddr) (int, syscall.Errno) {
+	if s.family == syscall.AF_UNIX {
+		if s.peer == nil {
+			return 0, syscall.ENOTCONN
+		}
+		return sa.setUnix(s.peer), ESUCCESS
+	}
+	if s.IsStream() {
+		switch s.tcp.state {
+		case TCP_STATE_CLOSED, TCP_STATE_LISTEN, TCP_STATE_SYN_SENT:
+			return 0, syscall.ENOTCONN
+		}
+		return sa.setInet(s.tcp.remoteAddr, s.tcp.remotePort), ESUCCESS
+	}
+	if !s.connected {
+		return 0, syscall.ENOTCONN
+	}
+	return sa.setInet(s.peerAddr, s.peerPort), ESUCCESS
+}
+
+func (s *Socket) Shutdown(how int) syscall.Errno {
+	if how < syscall.SHUT_RD || how > syscall.SHUT_RDWR {
+		return syscall.EINVAL
+	}
+	if s.family == syscall.AF_UNIX {
+		return unixShutdown(s, how)
+	}
+	if s.IsStream() {
+		return tcpShutdown(s.tcp, how)
+	}
+	if !s.connected {
+		return syscall.ENOTCONN
+	}
+	return ESUCCESS
+}
+
+func optionInt(value []byte) (int, syscall.Errno) {
+	if len(value) < 4 {
+		return 0, syscall.EINVAL
+	}
+	return int(int32(uint32(value[0]) | uint32(value[1])<<8 | uint32(value[2])<<16 | uint32(value[3])<<24)), ESUCCESS
+}
+
+func putOptionInt(value []byte, v int) (int, syscall.Errno) {
+	if len(value) < 4 {
+		return 0, syscall.EINVAL
+	}
+	value[0] = uint8(v)
+	value[1] = uint8(v >> 8)
+	value[2] = uint8(v >> 16)
+	value[3] = uint8(v >> 24)
+	return 4, ESUCCESS
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *Socket) SetSockOpt(level, name int, value []byte) syscall.Errno {
+	v, err := optionInt(value)
+	switch {
+	case level == syscall.SOL_SOCKET && name == syscall.SO_LINGER:
+		// Closing always lingers in the background
+		return ESUCCESS
+	case err != ESUCCESS:
+		return err
+	case level == syscall.SOL_SOCKET:
+		switch name {
+		case syscall.SO_REUSEADDR, SO_REUSEPORT:
+			if s.tcp != nil {
+				s.tcp.reuseAddr = v != 0
+			}
+		case syscall.SO_BROADCAST:
+			s.broadcast = v != 0
+		case syscall.SO_KEEPALIVE:
+			s.keepAlive = v != 0
+		case syscall.SO_PASSCRED:
+			s.passCred = v != 0
+		case syscall.SO_RCVBUF, syscall.SO_SNDBUF:
+			// The buffers have a fixed size
+		default:
+			return syscall.ENOPROTOOPT
+		}
+		return ESUCCESS
+	case level == syscall.IPPROTO_TCP && s.tcp != nil:
+		switch name {
+		case syscall.TCP_NODELAY:
+			s.tcp.noDelay = v != 0
+		case TCP_KEEPIDLE, TCP_KEEPINTVL, TCP_KEEPCNT:
+		default:
+			return syscall.ENOPROTOOPT
+		}
+		return ESUCCESS
+	}
+	return syscall.ENOPROTOOPT
+}
+
+// Returns the length of the value
+func (s *Socket) GetSockOpt(level, name int, value []byte) (int, syscall.Errno) {
+	switch level {
+	case syscall.SOL_SOCKET:
+		switch name {
+		case syscall.SO_ERROR:
+			err := ESUCCESS
+			if s.tcp != nil {
+				err = s.tcp.err
+				s.tcp.err = ESUCCESS
+			}
+			return putOptionInt(value, int(err))
+		case syscall.SO_TYPE:
+			return putOptionInt(value, s.typ)
+		case syscall.SO_DOMAIN:
+			return putOptionInt(value, s.family)
+		case syscall.SO_ACCEPTCONN:
+			return putOptionInt(value, boolToInt(s.listening || s.tcp != nil && s.tcp.state == TCP_STATE_LISTEN))
+		case syscall.SO_REUSEADDR, SO_REUSEPORT:
+			return putOptionInt(value, boolToInt(s.tcp != nil && s.tcp.reuseAddr))
+		case syscall.SO_BROADCAST:
+			return putOptionInt(value, boolToInt(s.broadcast))
+		case syscall.SO_KEEPALIVE:
+			return putOptionInt(value, boolToInt(s.keepAlive))
+		case syscall.SO_PASSCRED:
+			return putOptionInt(value, boolToInt(s.passCred))
+		case syscall.SO_PEERCRED:
+			if len(value) < 12 {
+				return 0, syscall.EINVAL
+			}
+			putOptionInt(value[0:], int(s.peerCred.Pid))
+			putOptionInt(value[4:], int(s.peerCred.Uid))
+			putOptionInt(value[8:], int(s.peerCred.Gid))
+			return 12, ESUCCESS
+		case syscall.SO_RCVBUF, syscall.SO_SNDBUF:
+			if s.tcp != nil {
+				return putOptionInt(value, TCP_BUFFER_SIZE)
+			}
+			return putOptionInt(value, SOCKET_BUFFER_SIZE)
+		}
+	case syscall.IPPROTO_TCP:
+		if s.tcp != nil && name == syscall.TCP_NODELAY {
+			return putOptionInt(value, boolToInt(s.tcp.noDelay))
+		}
+	}
+	return 0, syscall.ENOPROTOOPT
+}
+
+func (s *Socket) Read(buf []byte) (int, syscall.Errno) {
+	n, _, _, err := s.RecvFrom(buf, 0, nil)
+	return n, err
+}
+
+func (s *Socket) Write(buf []byte) (int, syscall.Errno) {
+	return s.SendTo(buf, 0, nil, 0)
+}
+
+func (s *Socket) Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno) {
+	var value [4]byte
+	switch cmd {
+	case FIONBIO:
+		if err := space.ReadBytesFromUserSpace(arg, value[:]); err != ESUCCESS {
+			return 0, err
+		}
+		v, _ := optionInt(value[:])
+		s.nonblock = v != 0
+		return 0, ESUCCESS
+	case FIONREAD:
+		available := 0
+		if s.family == syscall.AF_UNIX {
+			available = unixAvailable(s)
+		} else if s.IsStream() {
+			available = s.tcp.rxLen
+		} else if s.rxCount > 0 {
+			// Like Linux, the size of the next datagram
+			var header [SOCKET_DGRAM_HEADER]byte
+			s.rxCopyOut(0, header[:])
+			available = int(getUint16(header[0:]))
+		}
+		putOptionInt(value[:], available)
+		return 0, space.WriteBytesToUserSpace(arg, value[:])
+	}
+	return 0, syscall.ENOTTY
+}
+
+func (s *Socket) Poll(pt *PollTable) uint32 {
+	if s.family == syscall.AF_UNIX {
+		return unixPoll(s, pt)
+	}
+	if s.IsStream() {
+		return tcpPoll(s.tcp, pt)
+	}
+	pt.Wait(&s.readers)
+	// Datagrams are sent right away
+	events := uint32(POLLOUT | POLLWRNORM)
+	if s.rxCount > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	return events
+}
+
+func (s *Socket) Close() {
+	if s.family == syscall.AF_UNIX {
+		unixClose(s)
+	} else if s.IsStream() {
+		tcpClose(s.tcp)
+	} else {
+		udpUnbind(&s.udp)
+	}
+	s.used = false
+}
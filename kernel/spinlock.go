@@ -0,0 +1,28 @@
+package kernel
+
+// Test and set lock. Interrupts have to be disabled while holding it,
+// otherwise an interrupt handler on the same CPU can deadlock.
+type SpinLock struct {
+	state uint32
+}
+
+func (l *SpinLock) Lock() {
+	for xchg(&l.state, 1) != 0 {
+		// Only read while somebody else holds the lock to keep the cache line shared
+		for l.state != 0 {
+			Pause()
+		}
+	}
+}
+
+func (l *SpinLock) TryLock() bool {
+	return xchg(&l.state, 1) == 0
+}
+
+func (l *SpinLock) Unlock() {
+	xchg(&l.state, 0)
+}
+
+func (l *SpinLock) IsLocked() bool {
+	return l.state != 0
+}
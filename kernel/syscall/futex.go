@@ -0,0 +1,331 @@
+package syscall
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+const (
+	FUTEX_CLOCK_REALTIME = 256
+	FUTEX_CMD_MASK       = ^uint32(FUTEX_PRIVATE_FLAG | FUTEX_CLOCK_REALTIME)
+
+	FUTEX_BITSET_MATCH_ANY = 0xffffffff
+
+	FUTEX_HASH_SIZE = 256
+
+	FUTEX_OP_SET  = 0
+	FUTEX_OP_ADD  = 1
+	FUTEX_OP_OR   = 2
+	FUTEX_OP_ANDN = 3
+	FUTEX_OP_XOR  = 4
+
+	FUTEX_OP_OPARG_SHIFT = 8 // Use (1 << oparg) as operand
+
+	FUTEX_OP_CMP_EQ = 0
+	FUTEX_OP_CMP_NE = 1
+	FUTEX_OP_CMP_LT = 2
+	FUTEX_OP_CMP_LE = 3
+	FUTEX_OP_CMP_GT = 4
+	FUTEX_OP_CMP_GE = 5
+)
+
+type futexArgs struct {
+	uaddr  uintptr
+	op     uint32
+	val    uint32
+	val2   uint32 // Either the timeout pointer or a second count
+	uaddr2 uintptr
+	val3   uint32
+
+	// Timeout as monotonic deadline in ns
+	hasTimeout bool
+	deadline   uint64
+}
+
+// Futexes are identified by their physical address. That way shared futexes
+// work across processes and private ones cannot collide. Waiters are kept in
+// a global hash table of wait queues.
+func futexLookup(uaddr uintptr) (*uint32, syscall.Errno) {
+	if uaddr%4 != 0 {
+		return nil, syscall.EINVAL
+	}
+	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uaddr)
+	if !ok {
+		return nil, syscall.EFAULT
+	}
+	return (*uint32)(unsafe.Pointer(addr)), ESUCCESS
+}
+
+var futexQueues [FUTEX_HASH_SIZE]kernel.WaitQueue
+
+func futexQueue(futexAddr *uint32) *kernel.WaitQueue {
+	h := uintptr(unsafe.Pointer(futexAddr)) >> 2
+	h ^= h >> 10
+	return &futexQueues[h%FUTEX_HASH_SIZE]
+}
+
+// Calls f for every thread waiting on the futex until f returns false
+func futexWaiters(futexAddr *uint32, f func(t *kernel.Thread) bool) {
+	futexQueue(futexAddr).ForEach(func(t *kernel.Thread) bool {
+		// Other futexes can end up in the same queue
+		if t.WaitAddress == futexAddr {
+			return f(t)
+		}
+		return true
+	})
+}
+
+func futexWakeThread(t *kernel.Thread) {
+	futexQueue(t.WaitAddress).Wake(t)
+	t.WaitAddress = nil
+}
+
+func futexWait(args *futexArgs, bitset uint32) (uint32, syscall.Errno) {
+	if bitset == 0 {
+		return 0, syscall.EINVAL
+	}
+	futexAddr, err := futexLookup(args.uaddr)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	// Atomic because the other CPUs wait for the kernel lock
+	if args.val != *futexAddr {
+		return 0, syscall.EAGAIN
+	}
+
+	t := kernel.CurrentThread
+	t.WaitAddress = futexAddr
+	t.WaitBitset = bitset
+	futexQueue(futexAddr).Enqueue(t)
+	for t.WaitAddress != nil {
+		if !args.hasTimeout {
+			kernel.Block()
+			continue
+		}
+		err := ESUCCESS
+		if kernel.MonotonicTime() >= args.deadline {
+			err = syscall.ETIMEDOUT
+		} else if !kernel.SleepUntil(args.deadline) {
+			err = syscall.EINTR
+		}
+		if err != ESUCCESS && t.WaitAddress != nil {
+			// Nobody woke us up, so we are still queued. Might be a different queue after a requeue.
+			futexQueue(t.WaitAddress).Remove(t)
+			t.WaitAddress = nil
+			return 0, err
+		}
+	}
+	return 0, ESUCCESS
+}
+
+func futexWake(futexAddr *uint32, count uint32, bitset uint32) uint32 {
+	var woken uint32 = 0
+	if count == 0 {
+		return 0
+	}
+	futexWaiters(futexAddr, func(t *kernel.Thread) bool {
+		if t.WaitBitset&bitset != 0 {
+			futexWakeThread(t)
+			woken++
+		}
+		return woken < count
+	})
+	return woken
+}
+
+func futexRequeue(args *futexArgs, compare bool) (uint32, syscall.Errno) {
+	futexAddr, err := futexLookup(args.uaddr)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	futexAddr2, err := futexLookup(args.uaddr2)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if compare && *futexAddr != args.val3 {
+		return 0, syscall.EAGAIN
+	}
+	var woken, requeued uint32 = 0, 0
+	futexWaiters(futexAddr, func(t *kernel.Thread) bool {
+		if woken < args.val {
+			futexWakeThread(t)
+			woken++
+		} else if requeued < args.val2 {
+			// Requeued threads keep waiting, just on the other futex
+			futexQueue(futexAddr).Remove(t)
+			t.WaitAddress = futexAddr2
+			futexQueue(futexAddr2).Enqueue(t)
+			requeued++
+		}
+		return woken < args.val || requeued < args.val2
+	})
+	return woken + requeued, ESUCCESS
+}
+
+// Sign extend a 12 bit value
+func futexOpArg(value uint32) int32 {
+	return int32(value<<20) >> 20
+}
+
+func futexWakeOp(args *futexArgs) (uint32, syscall.Errno) {
+	futexAddr, err := futexLookup(args.uaddr)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	futexAddr2, err := futexLookup(args.uaddr2)
+	if err != ESUCCESS {
+		return 0, err
+	}
+
+	op := (args.val3 >> 28) & 0xf
+	cmp := (args.val3 >> 24) & 0xf
+	oparg := futexOpArg(args.val3 >> 12)
+	cmparg := futexOpArg(args.val3)
+	if op&FUTEX_OP_OPARG_SHIFT != 0 {
+		if oparg < 0 || oparg > 31 {
+			return 0, syscall.EINVAL
+		}
+		oparg = 1 << oparg
+		op &^= FUTEX_OP_OPARG_SHIFT
+	}
+
+	old := int32(*futexAddr2)
+	switch op {
+	case FUTEX_OP_SET:
+		*futexAddr2 = uint32(oparg)
+	case FUTEX_OP_ADD:
+		*futexAddr2 = uint32(old + oparg)
+	case FUTEX_OP_OR:
+		*futexAddr2 = uint32(old | oparg)
+	case FUTEX_OP_ANDN:
+		*futexAddr2 = uint32(old &^ oparg)
+	case FUTEX_OP_XOR:
+		*futexAddr2 = uint32(old ^ oparg)
+	default:
+		return 0, syscall.ENOSYS
+	}
+
+	var wakeSecond bool
+	switch cmp {
+	case FUTEX_OP_CMP_EQ:
+		wakeSecond = old == cmparg
+	case FUTEX_OP_CMP_NE:
+		wakeSecond = old != cmparg
+	case FUTEX_OP_CMP_LT:
+		wakeSecond = old < cmparg
+	case FUTEX_OP_CMP_LE:
+		wakeSecond = old <= cmparg
+	case FUTEX_OP_CMP_GT:
+		wakeSecond = old > cmparg
+	case FUTEX_OP_CMP_GE:
+		wakeSecond = old >= cmparg
+	default:
+		return 0, syscall.ENOSYS
+	}
+
+	woken := futexWake(futexAddr, args.val, FUTEX_BITSET_MATCH_ANY)
+	if wakeSecond {
+		woken += futexWake(futexAddr2, args.val2, FUTEX_BITSET_MATCH_ANY)
+	}
+	return woken, ESUCCESS
+}
+
+// Turn the timeout into a deadline. FUTEX_WAIT uses a relative timeout, FUTEX_WAIT_BITSET an absolute one.
+func futexTimeout(args *futexArgs, ns int64) {
+	args.hasTimeout = true
+	if args.op&FUTEX_CMD_MASK == FUTEX_WAIT {
+		args.deadline = kernel.MonotonicTime() + uint64(ns)
+		return
+	}
+	clock := uint32(kernel.CLOCK_MONOTONIC)
+	if args.op&FUTEX_CLOCK_REALTIME != 0 {
+		clock = kernel.CLOCK_REALTIME
+	}
+	clockNow, _ := kernel.ClockTime(clock)
+	args.deadline = kernel.MonotonicTime()
+	if ns > clockNow {
+		args.deadline += uint64(ns - clockNow)
+	}
+}
+
+func futex(args *futexArgs) (uint32, syscall.Errno) {
+	switch args.op & FUTEX_CMD_MASK {
+	case FUTEX_WAIT:
+		return futexWait(args, FUTEX_BITSET_MATCH_ANY)
+	case FUTEX_WAIT_BITSET:
+		return futexWait(args, args.val3)
+	case FUTEX_WAKE, FUTEX_WAKE_BITSET:
+		bitset := uint32(FUTEX_BITSET_MATCH_ANY)
+		if args.op&FUTEX_CMD_MASK == FUTEX_WAKE_BITSET {
+			bitset = args.val3
+		}
+		if bitset == 0 {
+			return 0, syscall.EINVAL
+		}
+		futexAddr, err := futexLookup(args.uaddr)
+		if err != ESUCCESS {
+			return 0, err
+		}
+		return futexWake(futexAddr, args.val, bitset), ESUCCESS
+	case FUTEX_REQUEUE:
+		return futexRequeue(args, false)
+	case FUTEX_CMP_REQUEUE:
+		return futexRequeue(args, true)
+	case FUTEX_WAKE_OP:
+		return futexWakeOp(args)
+	default:
+		log.KErrorLn("Unsupported futex op ", args.op)
+		return 0, syscall.ENOSYS
+	}
+}
+
+func newFutexArgs(args syscallArgs) futexArgs {
+	return futexArgs{
+		uaddr:  uintptr(args.arg1),
+		op:     args.arg2,
+		val:    args.arg3,
+		val2:   args.arg4,
+		uaddr2: uintptr(args.arg5),
+		val3:   args.arg6,
+	}
+}
+
+func isFutexWait(op uint32) bool {
+	cmd := op & FUTEX_CMD_MASK
+	return cmd == FUTEX_WAIT || cmd == FUTEX_WAIT_BITSET
+}
+
+func linuxFutexSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	fargs := newFutexArgs(args)
+	if isFutexWait(fargs.op) && fargs.val2 != 0 {
+		var ts timespec32
+		if err := readFromUser(uintptr(fargs.val2), &ts); err != ESUCCESS {
+			return 0, err
+		}
+		ns, err := timespecNs(int64(ts.sec), int64(ts.nsec))
+		if err != ESUCCESS {
+			return 0, err
+		}
+		futexTimeout(&fargs, ns)
+	}
+	return futex(&fargs)
+}
+
+func linuxFutexTime64Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	fargs := newFutexArgs(args)
+	if isFutexWait(fargs.op) && fargs.val2 != 0 {
+		var ts timespec64
+		if err := readFromUser(uintptr(fargs.val2), &ts); err != ESUCCESS {
+			return 0, err
+		}
+		ns, err := timespecNs(ts.sec, ts.nsec)
+		if err != ESUCCESS {
+			return 0, err
+		}
+		futexTimeout(&fargs, ns)
+	}
+	return futex(&fargs)
+}
@@ -0,0 +1,66 @@
+package syscall
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+	"github.com/sanserogames/letsgo-os/kernel/utils"
+)
+
+func linuxPipeSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	return linuxPipe2Syscall(syscallArgs{arg1: args.arg1})
+}
+
+func linuxPipe2Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	fdsAddr := uintptr(args.arg1)
+	flags := args.arg2
+	// There is no exec that keeps files open, so close on exec does not matter
+	if flags&^(syscall.O_NONBLOCK|syscall.O_CLOEXEC) != 0 {
+		return 0, syscall.EINVAL
+	}
+	r, w, err := kernel.NewPipe()
+	if err != ESUCCESS {
+		return 0, err
+	}
+	r.SetNonblock(flags&syscall.O_NONBLOCK != 0)
+	w.SetNonblock(flags&syscall.O_NONBLOCK != 0)
+	files := &kernel.CurrentThread.Domain.Files
+	var fds [2]uint32
+	if fds[0], err = files.Install(r); err != ESUCCESS {
+		r.Close()
+		w.Close()
+		return 0, err
+	}
+	if fds[1], err = files.Install(w); err != ESUCCESS {
+		files.Close(fds[0])
+		w.Close()
+		return 0, err
+	}
+	if err := writeToUser(fdsAddr, &fds); err != ESUCCESS {
+		files.Close(fds[0])
+		files.Close(fds[1])
+		return 0, err
+	}
+	return 0, ESUCCESS
+}
+
+func mknodPath(pathAddr uintptr, mode uint32) (uint32, syscall.Errno) {
+	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(pathAddr)
+	if !ok {
+		return 0, syscall.EFAULT
+	}
+	// Without a filesystem only FIFOs can be made
+	if mode&syscall.S_IFMT != syscall.S_IFIFO {
+		return 0, syscall.EPERM
+	}
+	return 0, kernel.MakeFifo(utils.CString(addr))
+}
+
+func linuxMknodSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	return mknodPath(uintptr(args.arg1), args.arg2)
+}
+
+func linuxMknodAtSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	// dirfd is ignored like in openat
+	return mknodPath(uintptr(args.arg2), args.arg3)
+}
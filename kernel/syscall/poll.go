@@ -0,0 +1,373 @@
+package syscall
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+)
+
+// poll, select and epoll on top of the readiness of files, see kernel/poll.go.
+// Signal masks of the p* variants are ignored, signals always interrupt them.
+
+const (
+	POLL_MAX_FDS     = 1024
+	FD_SET_WORDS     = kernel.MAX_FILES / 32
+	EPOLL_WAIT_BATCH = 8 // Events returned by one epoll_wait, the kernel stack is small
+
+	// Events that make a file descriptor ready for select
+	SELECT_IN  = kernel.POLLIN | kernel.POLLRDNORM | kernel.POLLHUP | kernel.POLLERR
+	SELECT_OUT = kernel.POLLOUT | kernel.POLLWRNORM | kernel.POLLERR
+	SELECT_EX  = kernel.POLLPRI
+)
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// Only the descriptors below kernel.MAX_FILES can be open
+type fdSets struct {
+	in  [FD_SET_WORDS]uint32
+	out [FD_SET_WORDS]uint32
+	ex  [FD_SET_WORDS]uint32
+}
+
+// Deadline for a timeout in ns. Negative timeouts wait forever.
+func pollDeadline(timeout int64) uint64 {
+	if timeout < 0 {
+		return 0
+	}
+	return kernel.MonotonicTime() + uint64(timeout)
+}
+
+// Timeout of a timespec at addr, forever if addr is 0
+func pollTimespec32(addr uintptr) (int64, syscall.Errno) {
+	if addr == 0 {
+		return -1, ESUCCESS
+	}
+	var ts timespec32
+	if err := readFromUser(addr, &ts); err != ESUCCESS {
+		return 0, err
+	}
+	return timespecNs(int64(ts.sec), int64(ts.nsec))
+}
+
+func pollTimespec64(addr uintptr) (int64, syscall.Errno) {
+	if addr == 0 {
+		return -1, ESUCCESS
+	}
+	var ts timespec64
+	if err := readFromUser(addr, &ts); err != ESUCCESS {
+		return 0, err
+	}
+	return timespecNs(ts.sec, ts.nsec)
+}
+
+// Store the events of every pollfd and return how many have some
+func pollScan(addr uintptr, nfds uint32, pt *kernel.PollTable) (uint32, syscall.Errno) {
+	files := &kernel.CurrentThread.Domain.Files
+	ready := uint32(0)
+	for i := uint32(0); i < nfds; i++ {
+		var pfd pollFd
+		entry := addr + uintptr(i)*unsafe.Sizeof(pfd)
+		if err := readFromUser(entry, &pfd); err != ESUCCESS {
+			return 0, err
+		}
+		revents := uint32(0)
+		if pfd.fd >= 0 {
+			if f, err := files.Get(uint32(pfd.fd)); err != ESUCCESS {
+				revents = kernel.POLLNVAL
+			} else {
+				// Errors and hangups are reported even if nobody asked
+				revents = f.Poll(pt) & (uint32(uint16(pfd.events)) | kernel.POLLERR | kernel.POLLHUP)
+			}
+		}
+		if revents != 0 {
+			ready++
+		}
+		pfd.revents = int16(revents)
+		if err := writeToUser(entry, &pfd); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return ready, ESUCCESS
+}
+
+func doPoll(addr uintptr, nfds uint32, deadline uint64) (uint32, syscall.Errno) {
+	if nfds > POLL_MAX_FDS {
+		return 0, syscall.EINVAL
+	}
+	// Only the first scan adds the poll entries
+	ready, err := pollScan(addr, nfds, kernel.PollBegin())
+	for ready == 0 && err == ESUCCESS {
+		if err = kernel.PollSleep(deadline); err == ESUCCESS {
+			ready, err = pollScan(addr, nfds, nil)
+		}
+	}
+	kernel.PollEnd()
+	if err == syscall.ETIMEDOUT {
+		return 0, ESUCCESS
+	}
+	return ready, err
+}
+
+func linuxPollSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	// The timeout is in ms
+	timeout := int64(int32(args.arg3))
+	if timeout > 0 {
+		timeout *= kernel.NS_PER_SECOND / 1000
+	}
+	return doPoll(uintptr(args.arg1), args.arg2, pollDeadline(timeout))
+}
+
+func linuxPpollSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	timeout, err := pollTimespec32(uintptr(args.arg3))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return doPoll(uintptr(args.arg1), args.arg2, pollDeadline(timeout))
+}
+
+func linuxPpollTime64Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	timeout, err := pollTimespec64(uintptr(args.arg3))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return doPoll(uintptr(args.arg1), args.arg2, pollDeadline(timeout))
+}
+
+func readFdSet(addr uintptr, nfds uint32, set *[FD_SET_WORDS]uint32) syscall.Errno {
+	*set = [FD_SET_WORDS]uint32{}
+	if addr == 0 {
+		return ESUCCESS
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(set)), (nfds+31)/32*4)
+	return kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(addr, buf)
+}
+
+func writeFdSet(addr uintptr, nfds uint32, set *[FD_SET_WORDS]uint32) syscall.Errno {
+	if addr == 0 {
+		return ESUCCESS
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(set)), (nfds+31)/32*4)
+	return kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(addr, buf)
+}
+
+// Fill result with the ready descriptors of sets and return how many bits are set
+func selectScan(sets *fdSets, result *fdSets, nfds uint32, pt *kernel.PollTable) (uint32, syscall.Errno) {
+	files := &kernel.CurrentThread.Domain.Files
+	*result = fdSets{}
+	ready := uint32(0)
+	for fd := uint32(0); fd < nfds; fd++ {
+		w, bit := fd/32, uint32(1)<<(fd%32)
+		if (sets.in[w]|sets.out[w]|sets.ex[w])&bit == 0 {
+			continue
+		}
+		f, err := files.Get(fd)
+		if err != ESUCCESS {
+			return 0, err
+		}
+		events := f.Poll(pt)
+		if sets.in[w]&bit != 0 && events&SELECT_IN != 0 {
+			result.in[w] |= bit
+			ready++
+		}
+		if sets.out[w]&bit != 0 && events&SELECT_OUT != 0 {
+			result.out[w] |= bit
+			ready++
+		}
+		if sets.ex[w]&bit != 0 && events&SELECT_EX != 0 {
+			result.ex[w] |= bit
+			ready++
+		}
+	}
+	return ready, ESUCCESS
+}
+
+func doSelect(nfds int32, inAddr, outAddr, exAddr uintptr, deadline uint64) (uint32, syscall.Errno) {
+	if nfds < 0 {
+		return 0, syscall.EINVAL
+	}
+	// Like Linux, descriptors past the end of the file table are ignored
+	n := min(uint32(nfds), kernel.MAX_FILES)
+	var sets, result fdSets
+	if err := readFdSet(inAddr, n, &sets.in); err != ESUCCESS {
+		return 0, err
+	}
+	if err := readFdSet(outAddr, n, &sets.out); err != ESUCCESS {
+		return 0, err
+	}
+	if err := readFdSet(exAddr, n, &sets.ex); err != ESUCCESS {
+		return 0, err
+	}
+	ready, err := selectScan(&sets, &result, n, kernel.PollBegin())
+	for ready == 0 && err == ESUCCESS {
+		if err = kernel.PollSleep(deadline); err == ESUCCESS {
+			ready, err = selectScan(&sets, &result, n, nil)
+		}
+	}
+	kernel.PollEnd()
+	if err == syscall.ETIMEDOUT {
+		err = ESUCCESS
+	}
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if err := writeFdSet(inAddr, n, &result.in); err != ESUCCESS {
+		return 0, err
+	}
+	if err := writeFdSet(outAddr, n, &result.out); err != ESUCCESS {
+		return 0, err
+	}
+	return ready, writeFdSet(exAddr, n, &result.ex)
+}
+
+func linuxSelectSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	tvAddr := uintptr(args.arg5)
+	timeout := int64(-1)
+	if tvAddr != 0 {
+		var tv timeval32
+		if err := readFromUser(tvAddr, &tv); err != ESUCCESS {
+			return 0, err
+		}
+		var err syscall.Errno
+		if timeout, err = timespecNs(int64(tv.sec), int64(tv.usec)*1000); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	deadline := pollDeadline(timeout)
+	ready, err := doSelect(int32(args.arg1), uintptr(args.arg2), uintptr(args.arg3), uintptr(args.arg4), deadline)
+	if tvAddr != 0 && err == ESUCCESS {
+		// Like Linux, select tells how much time is left
+		left := int64(0)
+		if now := kernel.MonotonicTime(); now < deadline {
+			left = int64(deadline - now)
+		}
+		tv := newTimeval32(left)
+		writeToUser(tvAddr, &tv)
+	}
+	return ready, err
+}
+
+func linuxPselect6Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	timeout, err := pollTimespec32(uintptr(args.arg5))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return doSelect(int32(args.arg1), uintptr(args.arg2), uintptr(args.arg3), uintptr(args.arg4), pollDeadline(timeout))
+}
+
+func linuxPselect6Time64Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	timeout, err := pollTimespec64(uintptr(args.arg5))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return doSelect(int32(args.arg1), uintptr(args.arg2), uintptr(args.arg3), uintptr(args.arg4), pollDeadline(timeout))
+}
+
+func epollCreate() (uint32, syscall.Errno) {
+	e, err := kernel.NewEpoll()
+	if err != ESUCCESS {
+		return 0, err
+	}
+	fd, err := kernel.CurrentThread.Domain.Files.Install(e)
+	if err != ESUCCESS {
+		e.Close()
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
+
+func linuxEpollCreateSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	// The size is only a hint
+	if int32(args.arg1) <= 0 {
+		return 0, syscall.EINVAL
+	}
+	return epollCreate()
+}
+
+func linuxEpollCreate1Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	// There is no exec that keeps files open, so close on exec does not matter
+	if args.arg1&^syscall.O_CLOEXEC != 0 {
+		return 0, syscall.EINVAL
+	}
+	return epollCreate()
+}
+
+func getEpoll(fd uint32) (*kernel.Epoll, syscall.Errno) {
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return nil, err
+	}
+	e, ok := file.(*kernel.Epoll)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return e, ESUCCESS
+}
+
+func linuxEpollCtlSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	op := int(args.arg2)
+	fd := args.arg3
+	e, err := getEpoll(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	f, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	var event kernel.EpollEvent
+	if op != syscall.EPOLL_CTL_DEL {
+		if err := readFromUser(uintptr(args.arg4), &event); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return 0, e.Ctl(op, int(fd), f, &event)
+}
+
+func linuxEpollWaitSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	eventsAddr := uintptr(args.arg2)
+	maxEvents := int32(args.arg3)
+	timeout := int64(int32(args.arg4))
+	if maxEvents <= 0 {
+		return 0, syscall.EINVAL
+	}
+	e, err := getEpoll(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if timeout > 0 {
+		timeout *= kernel.NS_PER_SECOND / 1000
+	}
+	var events [EPOLL_WAIT_BATCH]kernel.EpollEvent
+	n, err := e.Wait(events[:min(int(maxEvents), len(events))], pollDeadline(timeout))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		if err := writeToUser(eventsAddr+uintptr(i)*unsafe.Sizeof(events[i]), &events[i]); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return uint32(n), ESUCCESS
+}
+
+func linuxEventfdSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	return linuxEventfd2Syscall(syscallArgs{arg1: args.arg1})
+}
+
+func linuxEventfd2Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	e, err := kernel.NewEventfd(args.arg1, int(args.arg2))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	fd, err := kernel.CurrentThread.Domain.Files.Install(e)
+	if err != ESUCCESS {
+		e.Close()
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
@@ -0,0 +1,89 @@
+package syscall
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+)
+
+const (
+	RUSAGE_SELF     = 0
+	RUSAGE_THREAD   = 1
+	RUSAGE_CHILDREN = 0xffffffff // -1
+
+	// clock_t ticks per second (USER_HZ)
+	CLOCK_TICKS_PER_SECOND = 100
+)
+
+type tms struct {
+	utime  int32
+	stime  int32
+	cutime int32
+	cstime int32
+}
+
+type rusage32 struct {
+	utime    timeval32
+	stime    timeval32
+	maxrss   int32
+	ixrss    int32
+	idrss    int32
+	isrss    int32
+	minflt   int32
+	majflt   int32
+	nswap    int32
+	inblock  int32
+	oublock  int32
+	msgsnd   int32
+	msgrcv   int32
+	nsignals int32
+	nvcsw    int32
+	nivcsw   int32
+}
+
+func nsToClockTicks(ns uint64) int32 {
+	return int32(ns / (kernel.NS_PER_SECOND / CLOCK_TICKS_PER_SECOND))
+}
+
+func newRusage32(usage *kernel.Rusage) rusage32 {
+	return rusage32{
+		utime:  newTimeval32(int64(usage.UserTime)),
+		stime:  newTimeval32(int64(usage.SystemTime)),
+		minflt: int32(usage.MinorFaults),
+		nvcsw:  int32(usage.VoluntarySwitches),
+		nivcsw: int32(usage.InvoluntarySwitches),
+	}
+}
+
+func linuxTimesSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	domain := kernel.CurrentThread.Domain
+	if args.arg1 != 0 {
+		buf := tms{
+			utime:  nsToClockTicks(domain.Usage.UserTime),
+			stime:  nsToClockTicks(domain.Usage.SystemTime),
+			cutime: nsToClockTicks(domain.ChildUsage.UserTime),
+			cstime: nsToClockTicks(domain.ChildUsage.SystemTime),
+		}
+		if err := writeToUser(uintptr(args.arg1), &buf); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	// Ticks since boot
+	return uint32(nsToClockTicks(kernel.MonotonicTime())), ESUCCESS
+}
+
+func linuxGetRusageSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	var usage *kernel.Rusage
+	switch args.arg1 {
+	case RUSAGE_SELF:
+		usage = &kernel.CurrentThread.Domain.Usage
+	case RUSAGE_THREAD:
+		usage = &kernel.CurrentThread.Usage
+	case RUSAGE_CHILDREN:
+		usage = &kernel.CurrentThread.Domain.ChildUsage
+	default:
+		return 0, syscall.EINVAL
+	}
+	buf := newRusage32(usage)
+	return 0, writeToUser(uintptr(args.arg2), &buf)
+}
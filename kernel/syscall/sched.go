@@ -0,0 +1,232 @@
+package syscall
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+)
+
+const (
+	PRIO_PROCESS = 0
+	PRIO_PGRP    = 1
+	PRIO_USER    = 2
+)
+
+type schedParam struct {
+	priority int32
+}
+
+// Thread that the pid argument of the sched_* syscalls and of setpriority
+// selects. 0 is the calling thread. Linux takes thread ids here, but tids
+// are only unique within a process. An id is first looked up as a tid of
+// the calling process, otherwise it is a pid and selects the main thread of
+// that process, the one with the lowest tid. A pid that is also a tid of the
+// caller selects that thread.
+func findSchedTarget(pid uint32) *kernel.Thread {
+	if pid == 0 {
+		return kernel.CurrentThread
+	}
+	if t := kernel.CurrentThread.Domain.FindThread(pid); t != nil {
+		return t
+	}
+	domain := kernel.FindDomainByPid(pid)
+	if domain == nil {
+		return nil
+	}
+	var mainThread *kernel.Thread
+	domain.ForEachThread(func(t *kernel.Thread) bool {
+		if mainThread == nil || t.Tid < mainThread.Tid {
+			mainThread = t
+		}
+		return true
+	})
+	return mainThread
+}
+
+// Calls f for every thread selected by which and who of get/setpriority
+func forEachPrioTarget(which uint32, who uint32, f func(t *kernel.Thread)) syscall.Errno {
+	found := false
+	apply := func(t *kernel.Thread) bool {
+		found = true
+		f(t)
+		return true
+	}
+	switch which {
+	case PRIO_PROCESS:
+		// Like on Linux a single thread
+		if t := findSchedTarget(who); t != nil {
+			apply(t)
+		}
+	case PRIO_PGRP:
+		// There are no process groups, a group is a single process
+		domain := kernel.CurrentThread.Domain
+		if who != 0 {
+			domain = kernel.FindDomainByPid(who)
+		}
+		if domain == nil {
+			return syscall.ESRCH
+		}
+		domain.ForEachThread(apply)
+	case PRIO_USER:
+		// Everything runs as root
+		if who != 0 {
+			return syscall.ESRCH
+		}
+		kernel.ForEachDomain(func(d *kernel.Domain) bool {
+			return d.ForEachThread(apply)
+		})
+	default:
+		return syscall.EINVAL
+	}
+	if !found {
+		return syscall.ESRCH
+	}
+	return ESUCCESS
+}
+
+func linuxGetPrioritySyscall(args syscallArgs) (uint32, syscall.Errno) {
+	// Returns 20 - nice so that the value is never negative. The highest priority wins.
+	var prio uint32 = 0
+	err := forEachPrioTarget(args.arg1, args.arg2, func(t *kernel.Thread) {
+		prio = max(prio, uint32(20-kernel.Nice(t)))
+	})
+	return prio, err
+}
+
+func linuxSetPrioritySyscall(args syscallArgs) (uint32, syscall.Errno) {
+	nice := int(int32(args.arg3))
+	return 0, forEachPrioTarget(args.arg1, args.arg2, func(t *kernel.Thread) {
+		kernel.SetNice(t, nice)
+	})
+}
+
+func linuxNiceSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	inc := int(int32(args.arg1))
+	kernel.SetNice(kernel.CurrentThread, kernel.Nice(kernel.CurrentThread)+inc)
+	return 0, ESUCCESS
+}
+
+func linuxSchedSetSchedulerSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	var param schedParam
+	if err := readFromUser(uintptr(args.arg3), &param); err != ESUCCESS {
+		return 0, err
+	}
+	return 0, kernel.SetScheduler(t, int(args.arg2), int(param.priority))
+}
+
+func linuxSchedGetSchedulerSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	policy, _ := kernel.Scheduler(t)
+	return uint32(policy), ESUCCESS
+}
+
+func linuxSchedSetParamSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	var param schedParam
+	if err := readFromUser(uintptr(args.arg2), &param); err != ESUCCESS {
+		return 0, err
+	}
+	policy, _ := kernel.Scheduler(t)
+	return 0, kernel.SetScheduler(t, policy, int(param.priority))
+}
+
+func linuxSchedGetParamSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	_, priority := kernel.Scheduler(t)
+	param := schedParam{priority: int32(priority)}
+	return 0, writeToUser(uintptr(args.arg2), &param)
+}
+
+func linuxSchedGetPriorityMaxSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	switch args.arg1 {
+	case kernel.SCHED_FIFO, kernel.SCHED_RR:
+		return kernel.MAX_RT_PRIORITY, ESUCCESS
+	case kernel.SCHED_OTHER, kernel.SCHED_BATCH, kernel.SCHED_IDLE:
+		return 0, ESUCCESS
+	}
+	return 0, syscall.EINVAL
+}
+
+func linuxSchedGetPriorityMinSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	switch args.arg1 {
+	case kernel.SCHED_FIFO, kernel.SCHED_RR:
+		return kernel.MIN_RT_PRIORITY, ESUCCESS
+	case kernel.SCHED_OTHER, kernel.SCHED_BATCH, kernel.SCHED_IDLE:
+		return 0, ESUCCESS
+	}
+	return 0, syscall.EINVAL
+}
+
+func linuxSchedRrGetIntervalSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	var ts timespec32
+	if policy, _ := kernel.Scheduler(t); policy == kernel.SCHED_RR {
+		ts = newTimespec32(kernel.SCHED_RR_TIMESLICE)
+	}
+	return 0, writeToUser(uintptr(args.arg2), &ts)
+}
+
+func linuxSchedSetAffinitySyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	if args.arg2 < 4 {
+		return 0, syscall.EINVAL
+	}
+	// CPUs beyond the first 32 don't exist anyway
+	var mask uint32
+	if err := readFromUser(uintptr(args.arg3), &mask); err != ESUCCESS {
+		return 0, err
+	}
+	return 0, kernel.SetAffinity(t, mask)
+}
+
+func linuxGetCpuSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	if args.arg1 != 0 {
+		cpu := uint32(kernel.CurrentCpuIndex())
+		if err := writeToUser(uintptr(args.arg1), &cpu); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	if args.arg2 != 0 {
+		// Only a single NUMA node
+		var node uint32 = 0
+		if err := writeToUser(uintptr(args.arg2), &node); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return 0, ESUCCESS
+}
+
+func linuxSchedGetAffinitySyscall(args syscallArgs) (uint32, syscall.Errno) {
+	t := findSchedTarget(args.arg1)
+	if t == nil {
+		return 0, syscall.ESRCH
+	}
+	if args.arg2 < 4 {
+		return 0, syscall.EINVAL
+	}
+	mask := kernel.Affinity(t)
+	if err := writeToUser(uintptr(args.arg3), &mask); err != ESUCCESS {
+		return 0, err
+	}
+	// Size of the mask that was written
+	return 4, ESUCCESS
+}
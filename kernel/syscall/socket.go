@@ -0,0 +1,770 @@
+package syscall
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Socket syscalls. i386 programs call them through socketcall or, since
+// Linux 4.3, with their own numbers.
+
+const (
+	SYS_SOCKET      = 0x167
+	SYS_SOCKETPAIR  = 0x168
+	SYS_BIND        = 0x169
+	SYS_CONNECT     = 0x16a
+	SYS_LISTEN      = 0x16b
+	SYS_ACCEPT4     = 0x16c
+	SYS_GETSOCKOPT  = 0x16d
+	SYS_SETSOCKOPT  = 0x16e
+	SYS_GETSOCKNAME = 0x16f
+	SYS_GETPEERNAME = 0x170
+	SYS_SENDTO      = 0x171
+	SYS_SENDMSG     = 0x172
+	SYS_RECVFROM    = 0x173
+	SYS_RECVMSG     = 0x174
+	SYS_SHUTDOWN    = 0x175
+
+	// Calls of socketcall, see linux/net.h
+	SOCKETCALL_SOCKET      = 1
+	SOCKETCALL_BIND        = 2
+	SOCKETCALL_CONNECT     = 3
+	SOCKETCALL_LISTEN      = 4
+	SOCKETCALL_ACCEPT      = 5
+	SOCKETCALL_GETSOCKNAME = 6
+	SOCKETCALL_GETPEERNAME = 7
+	SOCKETCALL_SOCKETPAIR  = 8
+	SOCKETCALL_SEND        = 9
+	SOCKETCALL_RECV        = 10
+	SOCKETCALL_SENDTO      = 11
+	SOCKETCALL_RECVFROM    = 12
+	SOCKETCALL_SHUTDOWN    = 13
+	SOCKETCALL_SETSOCKOPT  = 14
+	SOCKETCALL_GETSOCKOPT  = 15
+	SOCKETCALL_SENDMSG     = 16
+	SOCKETCALL_RECVMSG     = 17
+	SOCKETCALL_ACCEPT4     = 18
+
+	SOCKOPT_MAX_SIZE = 16
+
+	SOCKET_CONTROL_SIZE = 256
+	CMSG_HEADER_SIZE    = 12
+)
+
+type msghdr struct {
+	name       uint32
+	namelen    uint32
+	iov        uint32
+	iovlen     uint32
+	control    uint32
+	controllen uint32
+	flags      int32
+}
+
+type cmsghdr struct {
+	len   uint32
+	level int32
+	typ   int32
+}
+
+var (
+	// Number of arguments of every socketcall
+	socketcallArgs = [...]uint8{0, 3, 3, 3, 2, 3, 3, 3, 4, 4, 4, 6, 6, 2, 5, 5, 3, 3, 4}
+
+	// Datagrams are sent and received in one piece, so they go through these
+	// buffers. Nothing blocks between filling and emptying them, senders wait
+	// for room with WaitSendDgram before they fill socketSendBuf.
+	socketSendBuf [kernel.UDP_MAX_PAYLOAD]byte
+	socketRecvBuf [kernel.UDP_MAX_PAYLOAD]byte
+	// Control messages of sendmsg and recvmsg
+	socketControlBuf [SOCKET_CONTROL_SIZE]byte
+	// Files recvmsg installed, they are closed again if the message can't be written out
+	socketRecvFds    [kernel.UNIX_MAX_FDS]uint32
+	socketRecvNumFds int
+)
+
+func registerSocketSyscalls() {
+	RegisterSyscall(syscall.SYS_SOCKETCALL, "socketcall syscall", linuxSocketcallSyscall)
+	RegisterSyscall(SYS_SOCKET, "socket syscall", linuxSocketSyscall)
+	RegisterSyscall(SYS_SOCKETPAIR, "socketpair syscall", linuxSocketPairSyscall)
+	RegisterSyscall(SYS_BIND, "bind syscall", linuxBindSyscall)
+	RegisterSyscall(SYS_CONNECT, "connect syscall", linuxConnectSyscall)
+	RegisterSyscall(SYS_LISTEN, "listen syscall", linuxListenSyscall)
+	RegisterSyscall(SYS_ACCEPT4, "accept4 syscall", linuxAccept4Syscall)
+	RegisterSyscall(SYS_GETSOCKOPT, "getsockopt syscall", linuxGetSockOptSyscall)
+	RegisterSyscall(SYS_SETSOCKOPT, "setsockopt syscall", linuxSetSockOptSyscall)
+	RegisterSyscall(SYS_GETSOCKNAME, "getsockname syscall", linuxGetSockNameSyscall)
+	RegisterSyscall(SYS_GETPEERNAME, "getpeername syscall", linuxGetPeerNameSyscall)
+	RegisterSyscall(SYS_SENDTO, "sendto syscall", linuxSendToSyscall)
+	RegisterSyscall(SYS_SENDMSG, "sendmsg syscall", linuxSendMsgSyscall)
+	RegisterSyscall(SYS_RECVFROM, "recvfrom syscall", linuxRecvFromSyscall)
+	RegisterSyscall(SYS_RECVMSG, "recvmsg syscall", linuxRecvMsgSyscall)
+	RegisterSyscall(SYS_SHUTDOWN, "shutdown syscall", linuxShutdownSyscall)
+}
+
+func getSocket(fd uint32) (*kernel.Socket, syscall.Errno) {
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return nil, err
+	}
+	s, ok := file.(*kernel.Socket)
+	if !ok {
+		return nil, syscall.ENOTSOCK
+	}
+	return s, ESUCCESS
+}
+
+func readSockaddr(addr uintptr, length uint32, sa *kernel.Sockaddr) syscall.Errno {
+	if length > uint32(unsafe.Sizeof(*sa)) {
+		return syscall.EINVAL
+	}
+	*sa = kernel.Sockaddr{}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(sa)), length)
+	return kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(addr, buf)
+}
+
+// Copy the address to user space. Like Linux it is truncated to the size of
+// the user buffer and the full length is stored in *lengthAddr.
+func writeSockaddr(addr uintptr, lengthAddr uintptr, sa *kernel.Sockaddr, length int) syscall.Errno {
+	if addr == 0 {
+		return ESUCCESS
+	}
+	var userLength uint32
+	if err := readFromUser(lengthAddr, &userLength); err != ESUCCESS {
+		return err
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(sa)), min(int(userLength), length))
+	if err := kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(addr, buf); err != ESUCCESS {
+		return err
+	}
+	userLength = uint32(length)
+	return writeToUser(lengthAddr, &userLength)
+}
+
+func linuxSocketcallSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	call := args.arg1
+	if call == 0 || call >= uint32(len(socketcallArgs)) {
+		return 0, syscall.EINVAL
+	}
+	var a [6]uint32
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&a)), int(socketcallArgs[call])*4)
+	if err := kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(uintptr(args.arg2), buf); err != ESUCCESS {
+		return 0, err
+	}
+	callArgs := syscallArgs{arg1: a[0], arg2: a[1], arg3: a[2], arg4: a[3], arg5: a[4], arg6: a[5]}
+	switch call {
+	case SOCKETCALL_SOCKET:
+		return linuxSocketSyscall(callArgs)
+	case SOCKETCALL_BIND:
+		return linuxBindSyscall(callArgs)
+	case SOCKETCALL_CONNECT:
+		return linuxConnectSyscall(callArgs)
+	case SOCKETCALL_LISTEN:
+		return linuxListenSyscall(callArgs)
+	case SOCKETCALL_ACCEPT:
+		callArgs.arg4 = 0
+		return linuxAccept4Syscall(callArgs)
+	case SOCKETCALL_ACCEPT4:
+		return linuxAccept4Syscall(callArgs)
+	case SOCKETCALL_GETSOCKNAME:
+		return linuxGetSockNameSyscall(callArgs)
+	case SOCKETCALL_GETPEERNAME:
+		return linuxGetPeerNameSyscall(callArgs)
+	case SOCKETCALL_SOCKETPAIR:
+		return linuxSocketPairSyscall(callArgs)
+	case SOCKETCALL_SEND:
+		callArgs.arg5 = 0
+		callArgs.arg6 = 0
+		return linuxSendToSyscall(callArgs)
+	case SOCKETCALL_RECV:
+		callArgs.arg5 = 0
+		callArgs.arg6 = 0
+		return linuxRecvFromSyscall(callArgs)
+	case SOCKETCALL_SENDTO:
+		return linuxSendToSyscall(callArgs)
+	case SOCKETCALL_RECVFROM:
+		return linuxRecvFromSyscall(callArgs)
+	case SOCKETCALL_SHUTDOWN:
+		return linuxShutdownSyscall(callArgs)
+	case SOCKETCALL_SETSOCKOPT:
+		return linuxSetSockOptSyscall(callArgs)
+	case SOCKETCALL_GETSOCKOPT:
+		return linuxGetSockOptSyscall(callArgs)
+	case SOCKETCALL_SENDMSG:
+		return linuxSendMsgSyscall(callArgs)
+	case SOCKETCALL_RECVMSG:
+		return linuxRecvMsgSyscall(callArgs)
+	}
+	return 0, syscall.EOPNOTSUPP
+}
+
+func linuxSocketSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	family := int(args.arg1)
+	typ := int(args.arg2)
+	protocol := int(args.arg3)
+	flags := typ & (syscall.SOCK_NONBLOCK | syscall.SOCK_CLOEXEC)
+	s, err := kernel.NewSocket(family, typ&^flags, protocol)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	// There is no exec that keeps files open, so close on exec does not matter
+	s.SetNonblock(flags&syscall.SOCK_NONBLOCK != 0)
+	fd, err := kernel.CurrentThread.Domain.Files.Install(s)
+	if err != ESUCCESS {
+		s.Close()
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
+
+func linuxSocketPairSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	family := int(args.arg1)
+	typ := int(args.arg2)
+	protocol := int(args.arg3)
+	svAddr := uintptr(args.arg4)
+	flags := typ & (syscall.SOCK_NONBLOCK | syscall.SOCK_CLOEXEC)
+	a, b, err := kernel.NewSocketPair(family, typ&^flags, protocol)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	a.SetNonblock(flags&syscall.SOCK_NONBLOCK != 0)
+	b.SetNonblock(flags&syscall.SOCK_NONBLOCK != 0)
+	files := &kernel.CurrentThread.Domain.Files
+	var sv [2]uint32
+	if sv[0], err = files.Install(a); err != ESUCCESS {
+		a.Close()
+		b.Close()
+		return 0, err
+	}
+	if sv[1], err = files.Install(b); err != ESUCCESS {
+		files.Close(sv[0])
+		b.Close()
+		return 0, err
+	}
+	if err := writeToUser(svAddr, &sv); err != ESUCCESS {
+		files.Close(sv[0])
+		files.Close(sv[1])
+		return 0, err
+	}
+	return 0, ESUCCESS
+}
+
+func linuxBindSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	if err := readSockaddr(uintptr(args.arg2), args.arg3, &sa); err != ESUCCESS {
+		return 0, err
+	}
+	return 0, s.Bind(&sa, int(args.arg3))
+}
+
+func linuxConnectSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	if err := readSockaddr(uintptr(args.arg2), args.arg3, &sa); err != ESUCCESS {
+		return 0, err
+	}
+	return 0, s.Connect(&sa, int(args.arg3))
+}
+
+func linuxListenSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return 0, s.Listen(int(int32(args.arg2)))
+}
+
+func linuxAccept4Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	addr := uintptr(args.arg2)
+	lengthAddr := uintptr(args.arg3)
+	flags := args.arg4
+	if flags&^(syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC) != 0 {
+		return 0, syscall.EINVAL
+	}
+	n, err := s.Accept()
+	if err != ESUCCESS {
+		return 0, err
+	}
+	n.SetNonblock(flags&syscall.SOCK_NONBLOCK != 0)
+	fd, err := kernel.CurrentThread.Domain.Files.Install(n)
+	if err != ESUCCESS {
+		n.Close()
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	length, _ := n.GetPeerName(&sa)
+	if err := writeSockaddr(addr, lengthAddr, &sa, length); err != ESUCCESS {
+		kernel.CurrentThread.Domain.Files.Close(fd)
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
+
+func linuxGetSockNameSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	length := s.GetSockName(&sa)
+	return 0, writeSockaddr(uintptr(args.arg2), uintptr(args.arg3), &sa, length)
+}
+
+func linuxGetPeerNameSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	length, err := s.GetPeerName(&sa)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return 0, writeSockaddr(uintptr(args.arg2), uintptr(args.arg3), &sa, length)
+}
+
+func linuxShutdownSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return 0, s.Shutdown(int(args.arg2))
+}
+
+func linuxSetSockOptSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	level := int(args.arg2)
+	name := int(args.arg3)
+	length := min(args.arg5, SOCKOPT_MAX_SIZE)
+	var value [SOCKOPT_MAX_SIZE]byte
+	if err := kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(uintptr(args.arg4), value[:length]); err != ESUCCESS {
+		return 0, err
+	}
+	return 0, s.SetSockOpt(level, name, value[:length])
+}
+
+func linuxGetSockOptSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	level := int(args.arg2)
+	name := int(args.arg3)
+	valueAddr := uintptr(args.arg4)
+	lengthAddr := uintptr(args.arg5)
+	var userLength uint32
+	if err := readFromUser(lengthAddr, &userLength); err != ESUCCESS {
+		return 0, err
+	}
+	var value [SOCKOPT_MAX_SIZE]byte
+	length, err := s.GetSockOpt(level, name, value[:])
+	if err != ESUCCESS {
+		return 0, err
+	}
+	length = min(length, int(userLength))
+	if err := kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(valueAddr, value[:length]); err != ESUCCESS {
+		return 0, err
+	}
+	userLength = uint32(length)
+	return 0, writeToUser(lengthAddr, &userLength)
+}
+
+// Streams are sent straight from user memory, page by page like write.
+// ctrl goes with the first bytes and is cleared once they are sent.
+func sendStream(s *kernel.Socket, buf uintptr, length uint32, flags int, ctrl **kernel.SocketControl) (uint32, syscall.Errno) {
+	sent := uint32(0)
+	for sent < length {
+		data, err := kernel.CurrentThread.Domain.MemorySpace.GetUserSpaceSlice(buf+uintptr(sent), int(length-sent))
+		if err == ESUCCESS {
+			var n int
+			n, err = s.SendMsg(data, flags, nil, 0, *ctrl)
+			if n > 0 {
+				*ctrl = nil
+			}
+			sent += uint32(n)
+			if err == ESUCCESS && n < len(data) {
+				break
+			}
+		}
+		if err != ESUCCESS {
+			if sent > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	return sent, ESUCCESS
+}
+
+func linuxSendToSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	buf := uintptr(args.arg2)
+	length := args.arg3
+	flags := int(args.arg4)
+	var sa kernel.Sockaddr
+	var saPtr *kernel.Sockaddr
+	if args.arg5 != 0 {
+		if err := readSockaddr(uintptr(args.arg5), args.arg6, &sa); err != ESUCCESS {
+			return 0, err
+		}
+		saPtr = &sa
+	}
+	if s.IsStream() {
+		var ctrl *kernel.SocketControl
+		return sendStream(s, buf, length, flags, &ctrl)
+	}
+	if length > uint32(len(socketSendBuf)) {
+		return 0, syscall.EMSGSIZE
+	}
+	if err := s.WaitSendDgram(int(length), flags, saPtr, int(args.arg6)); err != ESUCCESS {
+		return 0, err
+	}
+	data := socketSendBuf[:length]
+	if err := kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(buf, data); err != ESUCCESS {
+		return 0, err
+	}
+	n, err := s.SendTo(data, flags, saPtr, int(args.arg6))
+	return uint32(n), err
+}
+
+func linuxRecvFromSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	buf := uintptr(args.arg2)
+	length := min(args.arg3, uint32(len(socketRecvBuf)))
+	flags := int(args.arg4)
+	var sa kernel.Sockaddr
+	n, full, addrLength, err := s.RecvFrom(socketRecvBuf[:length], flags, &sa)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if err := kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(buf, socketRecvBuf[:n]); err != ESUCCESS {
+		return 0, err
+	}
+	if addrLength > 0 {
+		if err := writeSockaddr(uintptr(args.arg5), uintptr(args.arg6), &sa, addrLength); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	if flags&syscall.MSG_TRUNC != 0 {
+		return uint32(full), ESUCCESS
+	}
+	return uint32(n), ESUCCESS
+}
+
+// Length of the datagram in the iovecs of msg. EMSGSIZE if it does not fit socketSendBuf.
+func datagramLength(msg *msghdr) (uint32, syscall.Errno) {
+	total := uint32(0)
+	var item ioVec
+	for i := uint32(0); i < msg.iovlen; i++ {
+		if err := readFromUser(uintptr(msg.iov)+uintptr(i)*unsafe.Sizeof(item), &item); err != ESUCCESS {
+			return 0, err
+		}
+		if item.iovLen > uint32(len(socketSendBuf))-total {
+			return 0, syscall.EMSGSIZE
+		}
+		total += item.iovLen
+	}
+	return total, ESUCCESS
+}
+
+func linuxSendMsgSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	flags := int(args.arg3)
+	var msg msghdr
+	if err := readFromUser(uintptr(args.arg2), &msg); err != ESUCCESS {
+		return 0, err
+	}
+	var sa kernel.Sockaddr
+	var saPtr *kernel.Sockaddr
+	if msg.name != 0 {
+		if err := readSockaddr(uintptr(msg.name), msg.namelen, &sa); err != ESUCCESS {
+			return 0, err
+		}
+		saPtr = &sa
+	}
+	if !s.IsStream() {
+		// Before the files are looked up, they could be closed while we sleep
+		length, err := datagramLength(&msg)
+		if err != ESUCCESS {
+			return 0, err
+		}
+		if err := s.WaitSendDgram(int(length), flags, saPtr, int(msg.namelen)); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	var ctrl kernel.SocketControl
+	if err := readControl(&msg, &ctrl); err != ESUCCESS {
+		return 0, err
+	}
+	ctrlPtr := &ctrl
+
+	total := uint32(0)
+	processed := uint32(0)
+	for item, err := range mm.IterateUserSpaceType[ioVec](uintptr(msg.iov), &kernel.CurrentThread.Domain.MemorySpace) {
+		if processed == msg.iovlen {
+			break
+		}
+		if err != ESUCCESS {
+			return 0, err
+		}
+		processed++
+		if s.IsStream() {
+			sent, err := sendStream(s, item.iovBase, item.iovLen, flags, &ctrlPtr)
+			if err != ESUCCESS {
+				if total > 0 {
+					break
+				}
+				return 0, err
+			}
+			total += sent
+			if sent < item.iovLen {
+				break
+			}
+			continue
+		}
+		// Gather the datagram
+		if total+item.iovLen > uint32(len(socketSendBuf)) {
+			return 0, syscall.EMSGSIZE
+		}
+		if err := kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(item.iovBase, socketSendBuf[total:total+item.iovLen]); err != ESUCCESS {
+			return 0, err
+		}
+		total += item.iovLen
+	}
+	if s.IsStream() {
+		return total, ESUCCESS
+	}
+	n, err := s.SendMsg(socketSendBuf[:total], flags, saPtr, int(msg.namelen), ctrlPtr)
+	return uint32(n), err
+}
+
+func linuxRecvMsgSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	s, err := getSocket(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	msgAddr := uintptr(args.arg2)
+	flags := int(args.arg3)
+	var msg msghdr
+	if err := readFromUser(msgAddr, &msg); err != ESUCCESS {
+		return 0, err
+	}
+
+	capacity := uint32(0)
+	processed := uint32(0)
+	for item, err := range mm.IterateUserSpaceType[ioVec](uintptr(msg.iov), &kernel.CurrentThread.Domain.MemorySpace) {
+		if processed == msg.iovlen {
+			break
+		}
+		if err != ESUCCESS {
+			return 0, err
+		}
+		processed++
+		capacity += item.iovLen
+	}
+	capacity = min(capacity, uint32(len(socketRecvBuf)))
+
+	var sa kernel.Sockaddr
+	var ctrl kernel.SocketControl
+	n, full, addrLength, err := s.RecvMsg(socketRecvBuf[:capacity], flags, &sa, &ctrl)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	// Passed files are installed last, so they don't leak if user memory is bad
+	if err := writeRecvData(&msg, n, &sa, addrLength); err != ESUCCESS {
+		dropControl(&ctrl)
+		return 0, err
+	}
+	controlLength, truncated, err := writeControl(&msg, &ctrl)
+	if err != ESUCCESS {
+		closeReceivedFds()
+		return 0, err
+	}
+	msg.namelen = uint32(addrLength)
+	msg.controllen = controlLength
+	msg.flags = 0
+	if full > n {
+		msg.flags |= syscall.MSG_TRUNC
+	}
+	if truncated {
+		msg.flags |= syscall.MSG_CTRUNC
+	}
+	if err := writeToUser(msgAddr, &msg); err != ESUCCESS {
+		closeReceivedFds()
+		return 0, err
+	}
+	if flags&syscall.MSG_TRUNC != 0 {
+		return uint32(full), ESUCCESS
+	}
+	return uint32(n), ESUCCESS
+}
+
+// Scatter the received data into the buffers of msg and write the source address
+func writeRecvData(msg *msghdr, n int, sa *kernel.Sockaddr, addrLength int) syscall.Errno {
+	done := 0
+	processed := uint32(0)
+	for item, err := range mm.IterateUserSpaceType[ioVec](uintptr(msg.iov), &kernel.CurrentThread.Domain.MemorySpace) {
+		if processed == msg.iovlen || done == n {
+			break
+		}
+		if err != ESUCCESS {
+			return err
+		}
+		processed++
+		size := min(int(item.iovLen), n-done)
+		if err := kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(item.iovBase, socketRecvBuf[done:done+size]); err != ESUCCESS {
+			return err
+		}
+		done += size
+	}
+
+	if msg.name != 0 && addrLength > 0 {
+		length := min(int(msg.namelen), addrLength)
+		buf := unsafe.Slice((*byte)(unsafe.Pointer(sa)), length)
+		return kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(uintptr(msg.name), buf)
+	}
+	return ESUCCESS
+}
+
+// Release the passed files of a message that was not delivered
+func dropControl(ctrl *kernel.SocketControl) {
+	for i := 0; i < ctrl.NumFds; i++ {
+		kernel.ReleaseFile(ctrl.Fds[i])
+	}
+}
+
+func closeReceivedFds() {
+	for i := 0; i < socketRecvNumFds; i++ {
+		kernel.CurrentThread.Domain.Files.Close(socketRecvFds[i])
+	}
+	socketRecvNumFds = 0
+}
+
+func cmsgAlign(length int) int {
+	return (length + 3) &^ 3
+}
+
+// Pick up the files and credentials of the control messages of msg
+func readControl(msg *msghdr, ctrl *kernel.SocketControl) syscall.Errno {
+	if msg.control == 0 || msg.controllen == 0 {
+		return ESUCCESS
+	}
+	if msg.controllen > SOCKET_CONTROL_SIZE {
+		return syscall.ENOBUFS
+	}
+	buf := socketControlBuf[:msg.controllen]
+	if err := kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(uintptr(msg.control), buf); err != ESUCCESS {
+		return err
+	}
+	for offset := 0; offset+CMSG_HEADER_SIZE <= len(buf); {
+		h := (*cmsghdr)(unsafe.Pointer(&buf[offset]))
+		if h.len < CMSG_HEADER_SIZE || offset+int(h.len) > len(buf) {
+			return syscall.EINVAL
+		}
+		data := buf[offset+CMSG_HEADER_SIZE : offset+int(h.len)]
+		offset += cmsgAlign(int(h.len))
+		if h.level != syscall.SOL_SOCKET {
+			continue
+		}
+		switch h.typ {
+		case syscall.SCM_RIGHTS:
+			for i := 0; i+4 <= len(data); i += 4 {
+				if ctrl.NumFds == kernel.UNIX_MAX_FDS {
+					return syscall.EINVAL
+				}
+				f, err := kernel.CurrentThread.Domain.Files.Get(*(*uint32)(unsafe.Pointer(&data[i])))
+				if err != ESUCCESS {
+					return err
+				}
+				ctrl.Fds[ctrl.NumFds] = f
+				ctrl.NumFds++
+			}
+		case syscall.SCM_CREDENTIALS:
+			// Everyone is root, so any credentials may be sent
+			if len(data) != int(unsafe.Sizeof(ctrl.Cred)) {
+				return syscall.EINVAL
+			}
+			ctrl.Cred = *(*syscall.Ucred)(unsafe.Pointer(&data[0]))
+			ctrl.HasCred = true
+		default:
+			return syscall.EINVAL
+		}
+	}
+	return ESUCCESS
+}
+
+// Install the received files and write the control messages for them and the
+// credentials. Files that do not fit are closed like on Linux. Returns the
+// length written and if something was cut off.
+func writeControl(msg *msghdr, ctrl *kernel.SocketControl) (uint32, bool, syscall.Errno) {
+	buf := socketControlBuf[:0]
+	if msg.control != 0 {
+		buf = socketControlBuf[:min(msg.controllen, SOCKET_CONTROL_SIZE)]
+	}
+	length := 0
+	truncated := false
+	if ctrl.HasCred {
+		size := CMSG_HEADER_SIZE + int(unsafe.Sizeof(ctrl.Cred))
+		if size <= len(buf) {
+			*(*cmsghdr)(unsafe.Pointer(&buf[0])) = cmsghdr{len: uint32(size), level: syscall.SOL_SOCKET, typ: syscall.SCM_CREDENTIALS}
+			*(*syscall.Ucred)(unsafe.Pointer(&buf[CMSG_HEADER_SIZE])) = ctrl.Cred
+			length = size
+		} else {
+			truncated = true
+		}
+	}
+	installed := 0
+	socketRecvNumFds = 0
+	for ; installed < ctrl.NumFds; installed++ {
+		offset := length + CMSG_HEADER_SIZE + 4*installed
+		if offset+4 > len(buf) {
+			break
+		}
+		fd, err := kernel.CurrentThread.Domain.Files.Install(ctrl.Fds[installed])
+		if err != ESUCCESS {
+			break
+		}
+		*(*uint32)(unsafe.Pointer(&buf[offset])) = fd
+		socketRecvFds[installed] = fd
+		socketRecvNumFds++
+	}
+	for i := installed; i < ctrl.NumFds; i++ {
+		kernel.ReleaseFile(ctrl.Fds[i])
+		truncated = true
+	}
+	if installed > 0 {
+		size := CMSG_HEADER_SIZE + 4*installed
+		*(*cmsghdr)(unsafe.Pointer(&buf[length])) = cmsghdr{len: uint32(size), level: syscall.SOL_SOCKET, typ: syscall.SCM_RIGHTS}
+		length += size
+	}
+	if length == 0 {
+		return 0, truncated, ESUCCESS
+	}
+	return uint32(length), truncated, kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(uintptr(msg.control), buf[:length])
+}
@@ -160,6 +160,7 @@ const (
 	REBOOT_MAGIC1       = 0xfee1dead
 	REBOOT_MAGIC2       = 0x28121969
 	REBOOT_CMD_POWEROFF = 0x4321fedc
+	REBOOT_CMD_RESTART  = 0x01234567
 )
 
 var (
@@ -175,7 +176,7 @@ var (
 	// As I don't implement the full set of linux syscalls I try to save memory by using a lookup in a pointer table
 	// and not sort them in the list.
 	registeredSyscalls = [0x200](byte){}
-	syscallListRaw     = [64]syscallEntry{}
+	syscallListRaw     = [192]syscallEntry{}
 	syscallList        = []syscallEntry{}
 	okHandler          = func(args syscallArgs) (uint32, syscall.Errno) { return 0, ESUCCESS }
 	invalHandler       = func(args syscallArgs) (uint32, syscall.Errno) { return 0, syscall.EINVAL }
@@ -207,26 +208,49 @@ func InitSyscall() {
 	RegisterSyscall(syscall.SYS_SET_THREAD_AREA, "set thread area syscall", linuxSetThreadAreaSyscall)
 	RegisterSyscall(syscall.SYS_OPEN, "open syscall", linuxOpenSyscall)
 	RegisterSyscall(syscall.SYS_OPENAT, "open at syscall", linuxOpenAtSyscall)
-	RegisterSyscall(syscall.SYS_CLOSE, "close syscall", okHandler)
+	RegisterSyscall(syscall.SYS_CLOSE, "close syscall", linuxCloseSyscall)
 	RegisterSyscall(syscall.SYS_READ, "read syscall", linuxReadSyscall)
 	RegisterSyscall(syscall.SYS_READLINK, "readlink syscall", okHandler)
 	RegisterSyscall(syscall.SYS_READLINKAT, "read link at syscall", invalHandler)
-	RegisterSyscall(syscall.SYS_SCHED_GETAFFINITY, "sched get affinity syscall", func(args syscallArgs) (uint32, syscall.Errno) { return 0xffffffff, ESUCCESS })
-	RegisterSyscall(syscall.SYS_NANOSLEEP, "nano sleep syscall", invalHandler)
+	RegisterSyscall(syscall.SYS_SCHED_GETAFFINITY, "sched get affinity syscall", linuxSchedGetAffinitySyscall)
+	RegisterSyscall(syscall.SYS_SCHED_SETAFFINITY, "sched set affinity syscall", linuxSchedSetAffinitySyscall)
+	RegisterSyscall(syscall.SYS_SCHED_SETSCHEDULER, "sched set scheduler syscall", linuxSchedSetSchedulerSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_GETSCHEDULER, "sched get scheduler syscall", linuxSchedGetSchedulerSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_SETPARAM, "sched set param syscall", linuxSchedSetParamSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_GETPARAM, "sched get param syscall", linuxSchedGetParamSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_GET_PRIORITY_MAX, "sched get priority max syscall", linuxSchedGetPriorityMaxSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_GET_PRIORITY_MIN, "sched get priority min syscall", linuxSchedGetPriorityMinSyscall)
+	RegisterSyscall(syscall.SYS_SCHED_RR_GET_INTERVAL, "sched rr get interval syscall", linuxSchedRrGetIntervalSyscall)
+	RegisterSyscall(syscall.SYS_GETCPU, "getcpu syscall", linuxGetCpuSyscall)
+	RegisterSyscall(syscall.SYS_GETPRIORITY, "get priority syscall", linuxGetPrioritySyscall)
+	RegisterSyscall(syscall.SYS_SETPRIORITY, "set priority syscall", linuxSetPrioritySyscall)
+	RegisterSyscall(syscall.SYS_NICE, "nice syscall", linuxNiceSyscall)
+	RegisterSyscall(syscall.SYS_NANOSLEEP, "nano sleep syscall", linuxNanosleepSyscall)
+	RegisterSyscall(syscall.SYS_CLOCK_NANOSLEEP, "clock nano sleep syscall", linuxClockNanosleepSyscall)
 	RegisterSyscall(syscall.SYS_EXIT_GROUP, "exit group syscall", linuxExitGroupSyscall)
 	RegisterSyscall(syscall.SYS_EXIT, "exit syscall", linuxExitSyscall)
 	RegisterSyscall(syscall.SYS_BRK, "brk syscall", linuxBrkSyscall)
 	RegisterSyscall(syscall.SYS_MMAP2, "mmap2 syscall", linuxMmap2Syscall)
 	RegisterSyscall(syscall.SYS_MINCORE, "mincore syscall", linuxMincoreSyscall)
 	RegisterSyscall(syscall.SYS_MUNMAP, "munmap syscall", linuxMunmapSyscall)
-	RegisterSyscall(syscall.SYS_CLOCK_GETTIME, "clock get time syscall", func(args syscallArgs) (uint32, syscall.Errno) { return 0, syscall.ENOTSUP })
+	RegisterSyscall(syscall.SYS_CLOCK_GETTIME, "clock get time syscall", linuxClockGetTimeSyscall)
+	RegisterSyscall(syscall.SYS_CLOCK_GETRES, "clock get res syscall", linuxClockGetResSyscall)
+	RegisterSyscall(syscall.SYS_GETTIMEOFDAY, "get time of day syscall", linuxGetTimeOfDaySyscall)
+	RegisterSyscall(syscall.SYS_TIME, "time syscall", linuxTimeSyscall)
+	RegisterSyscall(syscall.SYS_TIMES, "times syscall", linuxTimesSyscall)
+	RegisterSyscall(syscall.SYS_GETRUSAGE, "getrusage syscall", linuxGetRusageSyscall)
 	RegisterSyscall(syscall.SYS_RT_SIGPROCMASK, "sig proc mask syscall", okHandler)
 	RegisterSyscall(syscall.SYS_SIGALTSTACK, "sig alt stack syscall", okHandler)
 	RegisterSyscall(syscall.SYS_RT_SIGACTION, "rt sig action syscall", okHandler)
 	RegisterSyscall(syscall.SYS_GETTID, "gettid syscall", getTidSyscall)
 	RegisterSyscall(syscall.SYS_GETPID, "get pid syscall", getPidSyscall)
 	RegisterSyscall(syscall.SYS_SET_TID_ADDRESS, "set tid address syscall", okHandler)
-	RegisterSyscall(syscall.SYS_POLL, "poll syscall", okHandler)
+	RegisterSyscall(syscall.SYS_POLL, "poll syscall", linuxPollSyscall)
+	RegisterSyscall(syscall.SYS_PPOLL, "ppoll syscall", linuxPpollSyscall)
+	RegisterSyscall(0x19e, "ppoll time64 syscall", linuxPpollTime64Syscall)
+	RegisterSyscall(syscall.SYS__NEWSELECT, "select syscall", linuxSelectSyscall)
+	RegisterSyscall(syscall.SYS_PSELECT6, "pselect6 syscall", linuxPselect6Syscall)
+	RegisterSyscall(0x19d, "pselect6 time64 syscall", linuxPselect6Time64Syscall)
 	RegisterSyscall(syscall.SYS_CLONE, "clone syscall", linuxCloneSyscall)
 	RegisterSyscall(syscall.SYS_FUTEX, "futex syscall", linuxFutexSyscall)
 	RegisterSyscall(syscall.SYS_SCHED_YIELD, "sched yield syscall", linuxSchedYieldSyscall)
@@ -235,7 +259,7 @@ func InitSyscall() {
 	RegisterSyscall(syscall.SYS_GETEGID32, "get egid syscall", okHandler)
 	RegisterSyscall(syscall.SYS_GETGID32, "get gid syscall", okHandler)
 	RegisterSyscall(syscall.SYS_UNAME, "uname syscall", linuxUnameSyscall)
-	RegisterSyscall(syscall.SYS_TGKILL, "tgkill syscall", okHandler)
+	RegisterSyscall(syscall.SYS_TGKILL, "tgkill syscall", linuxTgkillSyscall)
 	RegisterSyscall(syscall.SYS_MPROTECT, "mprotect syscall", okHandler)
 	RegisterSyscall(syscall.SYS_SET_ROBUST_LIST, "set robust list sycall", invalHandler)
 	RegisterSyscall(syscall.SYS_UGETRLIMIT, "get upper limit syscall", invalHandler)
@@ -243,18 +267,28 @@ func InitSyscall() {
 	RegisterSyscall(0x17f, "statx syscall", linuxStatxSyscall)
 	RegisterSyscall(0x180, "arch ptrctl syscall", invalHandler)
 	RegisterSyscall(0x182, "rseq syscall", invalHandler)
-	RegisterSyscall(0x193, "clock gettime 64 syscall", invalHandler)
-	RegisterSyscall(syscall.SYS_EPOLL_CREATE1, "epoll_create1 syscall", invalHandler)
-	RegisterSyscall(syscall.SYS_EPOLL_WAIT, "epoll wait syscall", okHandler)
+	RegisterSyscall(0x193, "clock gettime 64 syscall", linuxClockGetTime64Syscall)
+	RegisterSyscall(0x197, "clock nanosleep 64 syscall", linuxClockNanosleepTime64Syscall)
+	RegisterSyscall(0x1a6, "futex time64 syscall", linuxFutexTime64Syscall)
+	RegisterSyscall(syscall.SYS_EPOLL_CREATE1, "epoll_create1 syscall", linuxEpollCreate1Syscall)
+	RegisterSyscall(syscall.SYS_EPOLL_WAIT, "epoll wait syscall", linuxEpollWaitSyscall)
+	RegisterSyscall(syscall.SYS_EPOLL_PWAIT, "epoll pwait syscall", linuxEpollWaitSyscall)
 	RegisterSyscall(syscall.SYS_EPOLL_CREATE, "epoll_create syscall", linuxEpollCreateSyscall)
-	RegisterSyscall(syscall.SYS_FCNTL64, "fcntl64 syscall", okHandler)
-	RegisterSyscall(syscall.SYS_FCNTL, "fctnl syscall", okHandler)
+	RegisterSyscall(syscall.SYS_EVENTFD, "eventfd syscall", linuxEventfdSyscall)
+	RegisterSyscall(syscall.SYS_EVENTFD2, "eventfd2 syscall", linuxEventfd2Syscall)
+	RegisterSyscall(syscall.SYS_FCNTL64, "fcntl64 syscall", linuxFcntlSyscall)
+	RegisterSyscall(syscall.SYS_FCNTL, "fctnl syscall", linuxFcntlSyscall)
 	RegisterSyscall(syscall.SYS_PRCTL, "prctl syscall", invalHandler)
-	RegisterSyscall(syscall.SYS_PIPE2, "pipe2 syscall", okHandler)
-	RegisterSyscall(syscall.SYS_EPOLL_CTL, "epoll_ctl syscall", okHandler)
-	RegisterSyscall(syscall.SYS_DUP3, "dup3 syscall", okHandler)
-	RegisterSyscall(syscall.SYS_DUP2, "dup2 syscall", okHandler)
-	RegisterSyscall(syscall.SYS_DUP, "dup syscall", invalHandler)
+	RegisterSyscall(syscall.SYS_PIPE2, "pipe2 syscall", linuxPipe2Syscall)
+	RegisterSyscall(syscall.SYS_PIPE, "pipe syscall", linuxPipeSyscall)
+	RegisterSyscall(syscall.SYS_MKNOD, "mknod syscall", linuxMknodSyscall)
+	RegisterSyscall(syscall.SYS_MKNODAT, "mknodat syscall", linuxMknodAtSyscall)
+	RegisterSyscall(syscall.SYS_UNLINK, "unlink syscall", linuxUnlinkSyscall)
+	RegisterSyscall(syscall.SYS_UNLINKAT, "unlinkat syscall", linuxUnlinkAtSyscall)
+	RegisterSyscall(syscall.SYS_EPOLL_CTL, "epoll_ctl syscall", linuxEpollCtlSyscall)
+	RegisterSyscall(syscall.SYS_DUP3, "dup3 syscall", linuxDup3Syscall)
+	RegisterSyscall(syscall.SYS_DUP2, "dup2 syscall", linuxDup2Syscall)
+	RegisterSyscall(syscall.SYS_DUP, "dup syscall", linuxDupSyscall)
 	RegisterSyscall(syscall.SYS_EXECVE, "execve syscall", linuxExecveSyscall)
 	RegisterSyscall(syscall.SYS_MADVISE, "madvise syscall", okHandler)
 	RegisterSyscall(syscall.SYS_PRLIMIT64, "prlimit64 syscall", okHandler)
@@ -262,7 +296,8 @@ func InitSyscall() {
 	RegisterSyscall(syscall.SYS_WAIT4, "wait4 syscall", linuxWaitPidSyscall)
 	RegisterSyscall(syscall.SYS_FSTATAT64, "fstatat64 syscall", okHandler)
 	RegisterSyscall(syscall.SYS_GETCWD, "fstatat64 syscall", okHandler)
-	RegisterSyscall(syscall.SYS_IOCTL, "ioctl syscall", invalHandler)
+	RegisterSyscall(syscall.SYS_IOCTL, "ioctl syscall", linuxIoctlSyscall)
+	registerSocketSyscalls()
 }
 
 func getTidSyscall(args syscallArgs) (uint32, syscall.Errno) {
@@ -359,6 +394,9 @@ func linuxExecveSyscall(args syscallArgs) (uint32, syscall.Errno) {
 	argv := args.arg2
 	envp := args.arg3
 
+	if !kernel.CanAddDomain() {
+		return 0, syscall.EAGAIN
+	}
 	// Create new domain
 	newDomainMem := mm.AllocPage()
 	newDomainMem.Clear()
@@ -374,6 +412,7 @@ func linuxExecveSyscall(args syscallArgs) (uint32, syscall.Errno) {
 		return 0, err
 	}
 	newDomain.MemorySpace.MapPage(newThreadMem.Address(), newThreadMem.Address(), kernel.PAGE_RW|kernel.PAGE_PERM_KERNEL)
+	newDomain.ParentPid = kernel.CurrentThread.Domain.Pid
 	kernel.AddDomain(newDomain)
 
 	// if !kernel.CurrentThread.isFork {
@@ -393,22 +432,26 @@ func linuxWaitPidSyscall(args syscallArgs) (uint32, syscall.Errno) {
 	waitPid := args.arg1
 	// status := args.arg2
 	// options := args.arg3
-	// usage := args.arg3
+	usage := args.arg4
 	// log.KDebugln("Wait for ", waitPid)
 
+	domain := kernel.CurrentThread.Domain
+	var childUsage kernel.Rusage
 	for {
-		kernel.Yield()
-		if kernel.FindDomainByPid(waitPid) == nil {
-			break
+		if pid, ok := kernel.ReapExitedUsage(waitPid, domain, &childUsage); ok {
+			if usage != 0 {
+				buf := newRusage32(&childUsage)
+				if err := writeToUser(uintptr(usage), &buf); err != ESUCCESS {
+					return 0, err
+				}
+			}
+			return pid, ESUCCESS
+		}
+		if !kernel.HasRunningChild(domain, waitPid) {
+			return 0, syscall.ECHILD
 		}
+		kernel.Yield()
 	}
-
-	return 0, ESUCCESS
-}
-
-func linuxEpollCreateSyscall(args syscallArgs) (uint32, syscall.Errno) {
-	// TODO
-	return 0, ESUCCESS
 }
 
 func linuxExitGroupSyscall(args syscallArgs) (uint32, syscall.Errno) {
@@ -428,11 +471,14 @@ func rebootHandler(args syscallArgs) (uint32, syscall.Errno) {
 	if magic1 != REBOOT_MAGIC1 && magic2 != REBOOT_MAGIC2 {
 		return 0, syscall.EINVAL
 	}
-	if cmd != REBOOT_CMD_POWEROFF {
+	switch cmd {
+	case REBOOT_CMD_POWEROFF:
+		kernel.Shutdown()
+	case REBOOT_CMD_RESTART:
+		kernel.Reboot()
+	default:
 		log.KErrorLn("invalid reboot command")
-		return 0, syscall.EINVAL
 	}
-	kernel.Shutdown()
 	return 0, syscall.EINVAL
 }
 
@@ -527,6 +573,7 @@ func linuxMunmapSyscall(args syscallArgs) (uint32, syscall.Errno) {
 		}
 		kernel.CurrentThread.Domain.MemorySpace.UnmapPage(addr)
 	}
+	kernel.FlushTlbOtherCpus(kernel.CurrentThread.Domain)
 	return 0, ESUCCESS
 }
 
@@ -547,6 +594,7 @@ func linuxBrkSyscall(args syscallArgs) (uint32, syscall.Errno) {
 		// log.KDebugln("[brk] Map page ", i, " -> ", p)
 
 		kernel.CurrentThread.Domain.MemorySpace.MapPage(p.Address(), i, flags)
+		kernel.AccountPageFault()
 	}
 	kernel.CurrentThread.Domain.MemorySpace.Brk = newBrk
 	// log.KDebugln("BRK: ", newBrk)
@@ -560,7 +608,7 @@ func linuxMmap2Syscall(args syscallArgs) (uint32, syscall.Errno) {
 	flags := args.arg4
 
 	if flags&MMAP_MAP_ANONYMOUS == 0 {
-		return 0, syscall.EINVAL
+		return mmapFile(target, size, prot, flags, args.arg5, args.arg6)
 	}
 
 	if target == 0 {
@@ -599,9 +647,47 @@ func linuxMmap2Syscall(args syscallArgs) (uint32, syscall.Errno) {
 			}
 		} else {
 			kernel.CurrentThread.Domain.MemorySpace.MapPage(p.Address(), i, pageFlags)
+			kernel.AccountPageFault()
+		}
+	}
+
+	return uint32(startAddr), ESUCCESS
+}
+
+func mmapFile(target uintptr, size uintptr, prot uint32, flags uint32, fd uint32, pageOffset uint32) (uint32, syscall.Errno) {
+	memSpace := &kernel.CurrentThread.Domain.MemorySpace
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if target&(kernel.PAGE_SIZE-1) != 0 || size == 0 {
+		return 0, syscall.EINVAL
+	}
+	size = (size + kernel.PAGE_SIZE - 1) &^ (kernel.PAGE_SIZE - 1)
+
+	startAddr := target
+	if flags&MMAP_MAP_FIXED == MMAP_MAP_FIXED {
+		if target < kernel.KERNEL_RESERVED {
+			return 0, syscall.EINVAL
+		}
+		for i := target; i < target+size; i += kernel.PAGE_SIZE {
+			memSpace.UnmapPage(i)
+		}
+	} else {
+		startAddr = memSpace.FindSpaceFor(target, size)
+		if startAddr == 0 {
+			return 0, syscall.ENOMEM
 		}
 	}
 
+	pageFlags := uint8(kernel.PAGE_PERM_USER)
+	if prot&MMAP_PROT_WRITE == MMAP_PROT_WRITE {
+		pageFlags |= kernel.PAGE_RW
+	}
+	err = file.Mmap(memSpace, startAddr, size, uintptr(pageOffset)*kernel.PAGE_SIZE, pageFlags)
+	if err != ESUCCESS {
+		return 0, err
+	}
 	return uint32(startAddr), ESUCCESS
 }
 
@@ -633,20 +719,17 @@ func linuxSetThreadAreaSyscall(args syscallArgs) (uint32, syscall.Errno) {
 }
 
 func linuxOpenSyscall(args syscallArgs) (uint32, syscall.Errno) {
-	//path := args.arg1
+	path := args.arg1
 	flags := args.arg2
-	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(flags))
+	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(path))
 	if !ok {
 		return 0, syscall.EFAULT
 	}
 	s := utils.CString(addr)
 	if PRINT_SYSCALL {
-		log.KDebugLn("[SYS-OPEN] ", s)
+		log.KDebugLn("[SYS-OPEN] ", s, " flags:", flags)
 	}
-	//text_mode_println(s)
-	return 0, syscall.ENOSYS
-	//printRegisters(currentInfo, Regs)
-
+	return openPath(s, flags)
 }
 
 func linuxOpenAtSyscall(args syscallArgs) (uint32, syscall.Errno) {
@@ -663,23 +746,148 @@ func linuxOpenAtSyscall(args syscallArgs) (uint32, syscall.Errno) {
 		log.KDebugLn("[SYS-OPENAT] path:", s1)
 		log.KDebugLn("[SYS-OPENAT] flags:", flags)
 	}
+	// There is no filesystem yet, so all paths are absolute device paths and fd is ignored
+	return openPath(s1, flags)
+}
 
-	if s1 == "/dev/null" {
-		return 42, ESUCCESS
+func openPath(path string, flags uint32) (uint32, syscall.Errno) {
+	file, err := kernel.OpenFifo(path, int(flags))
+	if err == syscall.ENOENT {
+		file, err = kernel.OpenDevice(path)
 	}
+	if err != ESUCCESS {
+		return 0, err
+	}
+	fd, err := kernel.CurrentThread.Domain.Files.Install(file)
+	if err != ESUCCESS {
+		file.Close()
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
 
-	//text_mode_println(s)
-	return 0, syscall.ENOSYS
-	//printRegisters(currentInfo, Regs)
+// There is no filesystem, unlink only removes FIFOs and the paths of unix sockets
+func unlinkPath(path string) syscall.Errno {
+	if err := kernel.UnlinkFifo(path); err != syscall.ENOENT {
+		return err
+	}
+	return kernel.UnlinkSocketName(path)
+}
+
+func linuxUnlinkSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(args.arg1))
+	if !ok {
+		return 0, syscall.EFAULT
+	}
+	return 0, unlinkPath(utils.CString(addr))
+}
+
+func linuxUnlinkAtSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	// All paths are absolute, so dirfd is ignored like in openat
+	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(args.arg2))
+	if !ok {
+		return 0, syscall.EFAULT
+	}
+	return 0, unlinkPath(utils.CString(addr))
+}
 
+func linuxCloseSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	fd := args.arg1
+	return 0, kernel.CurrentThread.Domain.Files.Close(fd)
+}
+
+// The new file descriptor shares the open file, it takes a reference
+func linuxDupSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	files := &kernel.CurrentThread.Domain.Files
+	file, err := files.Get(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if err := kernel.AcquireFile(file); err != ESUCCESS {
+		return 0, err
+	}
+	fd, err := files.Install(file)
+	if err != ESUCCESS {
+		kernel.ReleaseFile(file)
+		return 0, err
+	}
+	return fd, ESUCCESS
+}
+
+func dupTo(oldFd uint32, newFd uint32) (uint32, syscall.Errno) {
+	files := &kernel.CurrentThread.Domain.Files
+	file, err := files.Get(oldFd)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if newFd >= kernel.MAX_FILES {
+		return 0, syscall.EBADF
+	}
+	if err := kernel.AcquireFile(file); err != ESUCCESS {
+		return 0, err
+	}
+	return newFd, files.InstallAt(newFd, file)
+}
+
+func linuxDup2Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	oldFd, newFd := args.arg1, args.arg2
+	if oldFd == newFd {
+		_, err := kernel.CurrentThread.Domain.Files.Get(oldFd)
+		return newFd, err
+	}
+	return dupTo(oldFd, newFd)
+}
+
+// O_CLOEXEC is accepted, execve does not pass file descriptors on anyway
+func linuxDup3Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	oldFd, newFd, flags := args.arg1, args.arg2, args.arg3
+	if flags&^syscall.O_CLOEXEC != 0 || oldFd == newFd {
+		return 0, syscall.EINVAL
+	}
+	return dupTo(oldFd, newFd)
+}
+
+func linuxIoctlSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	fd := args.arg1
+	cmd := args.arg2
+	arg := args.arg3
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	return file.Ioctl(&kernel.CurrentThread.Domain.MemorySpace, cmd, uintptr(arg))
+}
+
+// Only the file status flags do something, everything else is accepted as before
+func linuxFcntlSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	fd := args.arg1
+	cmd := args.arg2
+	arg := args.arg3
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	nb, ok := file.(kernel.NonblockFile)
+	switch cmd {
+	case syscall.F_GETFL:
+		if ok && nb.Nonblock() {
+			return syscall.O_NONBLOCK, ESUCCESS
+		}
+	case syscall.F_SETFL:
+		if ok {
+			nb.SetNonblock(arg&syscall.O_NONBLOCK != 0)
+		}
+	}
+	return 0, ESUCCESS
 }
 
 func linuxWriteVSyscall(args syscallArgs) (uint32, syscall.Errno) {
 	fd := args.arg1
 	arr := uintptr(args.arg2)
 	count := args.arg3
-	if fd < 1 || fd > 2 {
-		return 0, syscall.EBADF
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
 	}
 
 	if count <= 0 {
@@ -692,13 +900,13 @@ func linuxWriteVSyscall(args syscallArgs) (uint32, syscall.Errno) {
 		if err != ESUCCESS {
 			return 0, err
 		}
-		written, err := writeSyscallWriteData(fd, item.iovBase, item.iovLen)
+		written, err := writeToFile(file, item.iovBase, item.iovLen)
 		if err != ESUCCESS {
 			return 0, err
 		}
 		printed += written
 		processed++
-		if processed == int(count) {
+		if processed == int(count) || written < item.iovLen {
 			break
 		}
 	}
@@ -712,145 +920,85 @@ func linuxWriteSyscall(args syscallArgs) (uint32, syscall.Errno) {
 	if PRINT_SYSCALL {
 		log.KDebugLn("FD: ", fd, " text: ", text, " length: ", length)
 	}
-	if fd < 1 || fd > 2 {
-		return 0, syscall.EBADF
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
 	}
-	return writeSyscallWriteData(fd, text, length)
+	return writeToFile(file, text, length)
 }
 
-func writeSyscallWriteData(fd uint32, text uintptr, length uint32) (uint32, syscall.Errno) {
-	var buf [100]byte
-
-	s := unsafe.String(&buf[0], len(buf))
-
-	index := 0
-	writeLen := uint32(0)
-	for value, err := range kernel.CurrentDomain.MemorySpace.IterateUserSpace(text) {
-		if err != ESUCCESS {
-			return 0, err
-		}
-		buf[index] = value
-		index++
-		if index == len(buf) {
-			if fd == 2 {
-				log.KError(s)
-			} else {
-				log.KPrint(s)
+// Write the user buffer to the file page by page until everything is written or
+// the file does not accept more data
+func writeToFile(file kernel.File, buf uintptr, length uint32) (uint32, syscall.Errno) {
+	written := uint32(0)
+	for written < length {
+		data, err := kernel.CurrentThread.Domain.MemorySpace.GetUserSpaceSlice(buf+uintptr(written), int(length-written))
+		if err == ESUCCESS {
+			var n int
+			n, err = file.Write(data)
+			written += uint32(n)
+			if err == ESUCCESS && n < len(data) {
+				break
 			}
-			index = 0
 		}
-		writeLen++
-		if writeLen == length {
-			break
+		if err != ESUCCESS {
+			if written > 0 {
+				break
+			}
+			return 0, err
 		}
 	}
-	rest := unsafe.String(&buf[0], index)
-	if fd == 2 {
-		log.KError(rest)
-	} else {
-		log.KPrint(rest)
-	}
-	return uint32(writeLen), ESUCCESS
+	return written, ESUCCESS
 }
 
 func linuxReadSyscall(args syscallArgs) (uint32, syscall.Errno) {
 	fd := args.arg1
 	buf := args.arg2
 	count := args.arg3
-	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(buf))
-	if !ok {
-		log.KErrorLn("Could not look up read addr")
-		return 0, syscall.EFAULT
+	file, err := kernel.CurrentThread.Domain.Files.Get(fd)
+	if err != ESUCCESS {
+		return 0, err
 	}
-	arr := (*[1 << 30]byte)(unsafe.Pointer(addr))[:count]
-
-	var num uint32 = 0
-
-	if fd == 0 {
-		for num == 0 {
-			for !kernel.SerialDevice.HasReceivedData() {
-				kernel.Yield()
-			}
-
-			for kernel.SerialDevice.HasReceivedData() && num < count {
-				char := kernel.SerialDevice.Read()
-				arr[num] = char
-				num++
-			}
-		}
+	if count == 0 {
+		return 0, ESUCCESS
 	}
-	// I don't use keyboard anymore, since I have serial.
-	// When I implmentf device drivers, I might add this again
-	// else if fd == 42 {
-	// 	for num == 0 {
-	// 		for buffer.Len() == 0 {
-	// 			kernel.Block()
-	// 		}
-
-	// 		for buffer.Len() > 0 && num < count {
-	// 			raw_key := buffer.Pop().Keycode
-	// 			pressed := raw_key&0x80 == 0
-	// 			key := raw_key & 0x7f
-	// 			if pressed {
-	// 				arr[num] = translateKeycode(key)
-	// 				num++
-	// 			}
-	// 		}
-	// 	}
-	// }
-	return num, ESUCCESS
+	// Reads may return less than requested, so only read until the end of the page
+	arr, err := kernel.CurrentThread.Domain.MemorySpace.GetUserSpaceSlice(uintptr(buf), int(count))
+	if err != ESUCCESS {
+		log.KErrorLn("Could not look up read addr")
+		return 0, err
+	}
+	num, err := file.Read(arr)
+	return uint32(num), err
 }
 
-func linuxFutexSyscall(args syscallArgs) (uint32, syscall.Errno) {
-	uaddr := args.arg1
-	futex_op := args.arg2
-	val := args.arg3
-	// timeout := args.arg4
-
-	if futex_op&FUTEX_PRIVATE_FLAG == 0 {
-		log.KErrorLn("Futex on shared futexes is not supported")
-		return 0, syscall.ENOSYS
+// Signals are not delivered yet. They only interrupt sleeping threads.
+func linuxTgkillSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	tgid := args.arg1
+	tid := args.arg2
+	sig := args.arg3
+	domain := kernel.FindDomainByPid(tgid)
+	if domain == nil {
+		return 0, syscall.ESRCH
 	}
-
-	addr, ok := kernel.CurrentThread.Domain.MemorySpace.GetPhysicalAddress(uintptr(uaddr))
-	if !ok {
-		log.KErrorLn("Could not look up read addr")
-		return 0, syscall.EFAULT
+	thread := domain.FindThread(tid)
+	if thread == nil {
+		return 0, syscall.ESRCH
 	}
-	futexAddr := (*uint32)(unsafe.Pointer(addr))
-	switch futex_op & 0xf {
-	case FUTEX_WAIT:
-		// If timeout is not 0 we pretend it is. The standard says that it should guarnatee not to wakeup before the timeout, so not waking up should count I guess
-		// if timeout != 0 {
-		// 	return 0, ESUCCESS //syscall.ENOSYS
-		// }
-
-		// This should be atomically, but we're not multithreaded (as in multicore) yet so it does not matter
-		if val != *futexAddr {
-			return 0, syscall.EAGAIN
-		}
+	if sig != 0 && !signalIgnoredByDefault(sig) {
+		kernel.InterruptThread(thread)
+	}
+	return 0, ESUCCESS
+}
 
-		kernel.CurrentThread.WaitAddress = futexAddr
-		for kernel.CurrentThread.WaitAddress != nil {
-			kernel.Block()
-		}
-		return 0, ESUCCESS
-	case FUTEX_WAKE:
-		var woken uint32 = 0
-		cur := kernel.CurrentThread.Next
-		for cur != kernel.CurrentThread && woken < val {
-			if cur.IsBlocked && cur.WaitAddress == futexAddr {
-				cur.IsBlocked = false
-				cur.WaitAddress = nil
-				woken++
-			}
-			cur = cur.Next
-		}
-		return woken, ESUCCESS
-	default:
-		log.KErrorLn("Unsupported futex op", futex_op)
-		return 0, syscall.ENOSYS
+// Signals are not delivered, so no handler runs for them. Those that are
+// ignored by default must not interrupt sleeps either, Go preempts with SIGURG.
+func signalIgnoredByDefault(sig uint32) bool {
+	switch syscall.Signal(sig) {
+	case syscall.SIGCHLD, syscall.SIGCONT, syscall.SIGURG, syscall.SIGWINCH:
+		return true
 	}
+	return false
 }
 
 func linuxSchedYieldSyscall(rgs syscallArgs) (uint32, syscall.Errno) {
@@ -863,3 +1011,14 @@ func unsupportedSyscall() {
 	log.KPrintLn("Syscall Number: ", uintptr(kernel.CurrentThread.Regs.EAX), " (", uint32(kernel.CurrentThread.Regs.EAX), ")")
 	panic.KernelPanic("Unsupported syscall")
 }
+
+// Copy a struct from or to user space. Works across page boundaries.
+func readFromUser[T any](addr uintptr, value *T) syscall.Errno {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(value)), unsafe.Sizeof(*value))
+	return kernel.CurrentThread.Domain.MemorySpace.ReadBytesFromUserSpace(addr, buf)
+}
+
+func writeToUser[T any](addr uintptr, value *T) syscall.Errno {
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(value)), unsafe.Sizeof(*value))
+	return kernel.CurrentThread.Domain.MemorySpace.WriteBytesToUserSpace(addr, buf)
+}
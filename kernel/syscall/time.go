@@ -0,0 +1,186 @@
+package syscall
+
+import (
+	"math"
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel"
+)
+
+type timespec32 struct {
+	sec  int32
+	nsec int32
+}
+
+type timespec64 struct {
+	sec  int64
+	nsec int64
+}
+
+type timeval32 struct {
+	sec  int32
+	usec int32
+}
+
+type timezone struct {
+	minuteswest int32
+	dsttime     int32
+}
+
+func newTimespec32(ns int64) timespec32 {
+	return timespec32{sec: int32(ns / kernel.NS_PER_SECOND), nsec: int32(ns % kernel.NS_PER_SECOND)}
+}
+
+func newTimespec64(ns int64) timespec64 {
+	return timespec64{sec: ns / kernel.NS_PER_SECOND, nsec: ns % kernel.NS_PER_SECOND}
+}
+
+func newTimeval32(ns int64) timeval32 {
+	return timeval32{sec: int32(ns / kernel.NS_PER_SECOND), usec: int32(ns % kernel.NS_PER_SECOND / 1000)}
+}
+
+func linuxClockGetTimeSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	ns, err := kernel.ClockTime(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	ts := newTimespec32(ns)
+	return 0, writeToUser(uintptr(args.arg2), &ts)
+}
+
+func linuxClockGetTime64Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	ns, err := kernel.ClockTime(args.arg1)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	ts := newTimespec64(ns)
+	return 0, writeToUser(uintptr(args.arg2), &ts)
+}
+
+func linuxClockGetResSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	ns, err := kernel.ClockResolution(args.arg1)
+	if err != ESUCCESS || args.arg2 == 0 {
+		return 0, err
+	}
+	ts := newTimespec32(ns)
+	return 0, writeToUser(uintptr(args.arg2), &ts)
+}
+
+func linuxGetTimeOfDaySyscall(args syscallArgs) (uint32, syscall.Errno) {
+	tv := args.arg1
+	tz := args.arg2
+	if tv != 0 {
+		val := newTimeval32(kernel.RealTime())
+		if err := writeToUser(uintptr(tv), &val); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	if tz != 0 {
+		// Everything is UTC
+		zone := timezone{}
+		if err := writeToUser(uintptr(tz), &zone); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return 0, ESUCCESS
+}
+
+func linuxTimeSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	now := int32(kernel.RealTime() / kernel.NS_PER_SECOND)
+	if args.arg1 != 0 {
+		if err := writeToUser(uintptr(args.arg1), &now); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	return uint32(now), ESUCCESS
+}
+
+const TIMER_ABSTIME = 1
+
+func timespecNs(sec int64, nsec int64) (int64, syscall.Errno) {
+	if sec < 0 || nsec < 0 || nsec >= kernel.NS_PER_SECOND {
+		return 0, syscall.EINVAL
+	}
+	// Like KTIME_MAX of Linux, longer times are forever anyway
+	if sec > (math.MaxInt64-nsec)/kernel.NS_PER_SECOND {
+		return math.MaxInt64, ESUCCESS
+	}
+	return sec*kernel.NS_PER_SECOND + nsec, ESUCCESS
+}
+
+// Sleep on the given clock. Returns the time that is left if the sleep was interrupted.
+func clockNanosleep(clockId uint32, flags uint32, ns int64) (int64, syscall.Errno) {
+	switch clockId {
+	case kernel.CLOCK_REALTIME, kernel.CLOCK_MONOTONIC, kernel.CLOCK_BOOTTIME:
+	default:
+		return 0, syscall.EINVAL
+	}
+	now := kernel.MonotonicTime()
+	if flags&TIMER_ABSTIME != 0 {
+		// Convert to a duration on the clock, the sleep timers run on monotonic time
+		clockNow, _ := kernel.ClockTime(clockId)
+		if ns <= clockNow {
+			return 0, ESUCCESS
+		}
+		ns -= clockNow
+	}
+	deadline := now + uint64(ns)
+	if !kernel.SleepUntil(deadline) {
+		if now = kernel.MonotonicTime(); now >= deadline {
+			return 0, ESUCCESS
+		}
+		return int64(deadline - now), syscall.EINTR
+	}
+	return 0, ESUCCESS
+}
+
+func linuxNanosleepSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	var req timespec32
+	if err := readFromUser(uintptr(args.arg1), &req); err != ESUCCESS {
+		return 0, err
+	}
+	ns, err := timespecNs(int64(req.sec), int64(req.nsec))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	left, err := clockNanosleep(kernel.CLOCK_MONOTONIC, 0, ns)
+	if err == syscall.EINTR && args.arg2 != 0 {
+		rem := newTimespec32(left)
+		writeToUser(uintptr(args.arg2), &rem)
+	}
+	return 0, err
+}
+
+func linuxClockNanosleepSyscall(args syscallArgs) (uint32, syscall.Errno) {
+	var req timespec32
+	if err := readFromUser(uintptr(args.arg3), &req); err != ESUCCESS {
+		return 0, err
+	}
+	ns, err := timespecNs(int64(req.sec), int64(req.nsec))
+	if err != ESUCCESS {
+		return 0, err
+	}
+	left, err := clockNanosleep(args.arg1, args.arg2, ns)
+	if err == syscall.EINTR && args.arg2&TIMER_ABSTIME == 0 && args.arg4 != 0 {
+		rem := newTimespec32(left)
+		writeToUser(uintptr(args.arg4), &rem)
+	}
+	return 0, err
+}
+
+func linuxClockNanosleepTime64Syscall(args syscallArgs) (uint32, syscall.Errno) {
+	var req timespec64
+	if err := readFromUser(uintptr(args.arg3), &req); err != ESUCCESS {
+		return 0, err
+	}
+	ns, err := timespecNs(req.sec, req.nsec)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	left, err := clockNanosleep(args.arg1, args.arg2, ns)
+	if err == syscall.EINTR && args.arg2&TIMER_ABSTIME == 0 && args.arg4 != 0 {
+		rem := newTimespec64(left)
+		writeToUser(uintptr(args.arg4), &rem)
+	}
+	return 0, err
+}
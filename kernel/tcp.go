@@ -0,0 +1,1158 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// TCP. Connections live in a static table, each with a fixed send and receive
+// buffer. Segments that arrive out of order are dropped and answered with a
+// duplicate ACK, the sender retransmits them after three of those or when its
+// retransmission timer fires. Listeners keep their established children in an
+// accept queue until they are accepted.
+
+const (
+	TCP_HEADER_SIZE = 20
+	TCP_MSS_OPTION  = 4
+
+	TCP_FIN = 0x01
+	TCP_SYN = 0x02
+	TCP_RST = 0x04
+	TCP_PSH = 0x08
+	TCP_ACK = 0x10
+
+	TCP_OPT_END = 0
+	TCP_OPT_NOP = 1
+	TCP_OPT_MSS = 2
+
+	TCP_MAX_CONNECTIONS = 32
+	TCP_BUFFER_SIZE     = 8192
+	TCP_MAX_BACKLOG     = 16
+	TCP_DEFAULT_MSS     = 536
+
+	TCP_RTO_INITIAL       = NS_PER_SECOND
+	TCP_RTO_MIN           = NS_PER_SECOND / 5
+	TCP_RTO_MAX           = 60 * NS_PER_SECOND
+	TCP_MAX_RETRIES       = 8
+	TCP_DELAYED_ACK       = NS_PER_SECOND / 25
+	TCP_TIME_WAIT_TIMEOUT = 30 * NS_PER_SECOND
+	// Orphaned connections wait this long for the FIN of the other side
+	TCP_FIN_TIMEOUT = 60 * NS_PER_SECOND
+)
+
+const (
+	TCP_STATE_CLOSED = iota
+	TCP_STATE_LISTEN
+	TCP_STATE_SYN_SENT
+	TCP_STATE_SYN_RECEIVED
+	TCP_STATE_ESTABLISHED
+	TCP_STATE_FIN_WAIT_1
+	TCP_STATE_FIN_WAIT_2
+	TCP_STATE_CLOSE_WAIT
+	TCP_STATE_CLOSING
+	TCP_STATE_LAST_ACK
+	TCP_STATE_TIME_WAIT
+)
+
+type tcpConn struct {
+	used  bool
+	open  bool // Owned by a socket or the accept queue of a listener
+	state int
+	err   syscall.Errno // Reported once by the next read or write
+
+	localAddr  Ipv4Address
+	remoteAddr Ipv4Address
+	localPort  uint16
+	remotePort uint16
+	reuseAddr  bool
+	noDelay    bool
+
+	// Send side. txBuf holds the data from sndUna on, sent or not.
+	iss       uint32
+	sndUna    uint32
+	sndNxt    uint32
+	sndWnd    uint32
+	mss       int
+	txBuf     [TCP_BUFFER_SIZE]byte
+	txHead    int
+	txLen     int
+	finQueued bool // Send a FIN after the data
+	finSent   bool
+	dupAcks   int
+
+	// Receive side
+	irs         uint32
+	rcvNxt      uint32
+	rcvWndSent  int // Window in the last segment we sent
+	rxBuf       [TCP_BUFFER_SIZE]byte
+	rxHead      int
+	rxLen       int
+	finReceived bool
+	readShut    bool
+	ackPending  int // Segments received since our last ACK
+
+	// Round trip time estimation, in ns
+	srtt     uint64
+	rttvar   uint64
+	rto      uint64
+	rttSeq   uint32
+	rttStart uint64 // 0 if no segment is being timed
+	retries  int
+
+	rtxTimer HrTimer // Also the persist, TIME-WAIT and FIN-WAIT-2 timer
+	ackTimer HrTimer
+
+	// Listeners
+	listener    *tcpConn
+	backlog     int
+	acceptQueue [TCP_MAX_BACKLOG]*tcpConn
+	acceptHead  int
+	acceptCount int
+
+	readers WaitQueue // Also waits for connections to accept
+	writers WaitQueue // Also waits for connect
+}
+
+// Fields of a received segment
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   uint8
+	window  uint16
+	options []byte
+	payload []byte
+}
+
+var (
+	tcpConns         [TCP_MAX_CONNECTIONS]tcpConn
+	tcpTxBuf         [TCP_HEADER_SIZE + TCP_MSS_OPTION + ETH_MTU]byte
+	tcpNextEphemeral uint16 = IP_EPHEMERAL_FIRST
+	tcpIssCounter    uint32
+)
+
+func seqLt(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLe(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func tcpAlloc() *tcpConn {
+	for i := range tcpConns {
+		c := &tcpConns[i]
+		if c.used {
+			continue
+		}
+		*c = tcpConn{}
+		c.used = true
+		c.mss = TCP_DEFAULT_MSS
+		c.rto = TCP_RTO_INITIAL
+		c.rtxTimer.Callback = tcpRtxTimeout
+		c.rtxTimer.Arg = uintptr(i)
+		c.ackTimer.Callback = tcpAckTimeout
+		c.ackTimer.Arg = uintptr(i)
+		return c
+	}
+	return nil
+}
+
+func tcpFree(c *tcpConn) {
+	CancelHrTimer(&c.rtxTimer)
+	CancelHrTimer(&c.ackTimer)
+	c.used = false
+}
+
+// The connection is gone. err is reported to the owner, it is freed if there is none.
+func tcpSetClosed(c *tcpConn, err syscall.Errno) {
+	c.state = TCP_STATE_CLOSED
+	if err != ESUCCESS {
+		c.err = err
+	}
+	CancelHrTimer(&c.rtxTimer)
+	CancelHrTimer(&c.ackTimer)
+	c.readers.WakeAll()
+	c.writers.WakeAll()
+	if !c.open {
+		tcpFree(c)
+	}
+}
+
+func tcpNewIss() uint32 {
+	// The clock based ISS of RFC 793, the counter keeps quick reconnects apart
+	tcpIssCounter += 64000
+	return uint32(MonotonicTime()/4000) + tcpIssCounter
+}
+
+func tcpPortInUse(self *tcpConn, addr Ipv4Address, port uint16) bool {
+	for i := range tcpConns {
+		c := &tcpConns[i]
+		if !c.used || c == self || c.localPort != port {
+			continue
+		}
+		if c.localAddr != addr && !c.localAddr.IsAny() && !addr.IsAny() {
+			continue
+		}
+		if self.reuseAddr && c.state != TCP_STATE_LISTEN {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func tcpEphemeralPort(c *tcpConn, addr Ipv4Address) uint16 {
+	for i := 0; i <= IP_EPHEMERAL_LAST-IP_EPHEMERAL_FIRST; i++ {
+		port := tcpNextEphemeral
+		tcpNextEphemeral++
+		if tcpNextEphemeral == 0 {
+			tcpNextEphemeral = IP_EPHEMERAL_FIRST
+		}
+		if !tcpPortInUse(c, addr, port) {
+			return port
+		}
+	}
+	return 0
+}
+
+// Free space in the receive buffer
+func tcpWindow(c *tcpConn) int {
+	return TCP_BUFFER_SIZE - c.rxLen
+}
+
+func tcpRoute(c *tcpConn, r *ipv4Route) syscall.Errno {
+	if err := ipv4FindRoute(c.remoteAddr, r); err != ESUCCESS {
+		return err
+	}
+	if !c.localAddr.IsAny() {
+		r.src = c.localAddr
+	}
+	return ESUCCESS
+}
+
+func tcpLocalMss(r *ipv4Route) int {
+	return r.netif.Mtu - IPV4_HEADER_SIZE - TCP_HEADER_SIZE
+}
+
+func tcpFillHeader(s []byte, srcPort, dstPort uint16, seq, ack uint32, flags uint8, window uint16, headerLen int) {
+	putUint16(s[0:], srcPort)
+	putUint16(s[2:], dstPort)
+	putUint32(s[4:], seq)
+	putUint32(s[8:], ack)
+	s[12] = uint8(headerLen/4) << 4
+	s[13] = flags
+	putUint16(s[14:], window)
+	putUint16(s[16:], 0)
+	putUint16(s[18:], 0)
+}
+
+// Send a segment with size bytes of the send buffer, starting offset bytes after sndUna
+func tcpSendSegment(c *tcpConn, seq uint32, flags uint8, offset, size int) syscall.Errno {
+	var r ipv4Route
+	if err := tcpRoute(c, &r); err != ESUCCESS {
+		return err
+	}
+	headerLen := TCP_HEADER_SIZE
+	if flags&TCP_SYN != 0 {
+		headerLen += TCP_MSS_OPTION
+	}
+	ack := uint32(0)
+	if flags&TCP_ACK != 0 {
+		ack = c.rcvNxt
+	}
+	window := min(tcpWindow(c), 0xffff)
+	s := tcpTxBuf[:headerLen+size]
+	tcpFillHeader(s, c.localPort, c.remotePort, seq, ack, flags, uint16(window), headerLen)
+	if flags&TCP_SYN != 0 {
+		s[20] = TCP_OPT_MSS
+		s[21] = TCP_MSS_OPTION
+		putUint16(s[22:], uint16(tcpLocalMss(&r)))
+	}
+	for done := 0; done < size; {
+		done += copy(s[headerLen+done:], c.txBuf[(c.txHead+offset+done)%TCP_BUFFER_SIZE:])
+	}
+	putUint16(s[16:], inetPseudoChecksum(r.src, c.remoteAddr, IPV4_PROTO_TCP, s))
+	if flags&TCP_ACK != 0 {
+		c.ackPending = 0
+		CancelHrTimer(&c.ackTimer)
+		c.rcvWndSent = window
+	}
+	return ipv4Output(&r, c.remoteAddr, IPV4_PROTO_TCP, s)
+}
+
+func tcpSendAck(c *tcpConn) {
+	tcpSendSegment(c, c.sndNxt, TCP_ACK, 0, 0)
+}
+
+// Answer a segment that has no connection
+func tcpReplyReset(pkt *ipv4Packet, seg *tcpSegment) {
+	if seg.flags&TCP_RST != 0 {
+		return
+	}
+	var r ipv4Route
+	if ipv4FindRoute(pkt.src, &r) != ESUCCESS {
+		return
+	}
+	r.src = pkt.dst
+	s := tcpTxBuf[:TCP_HEADER_SIZE]
+	if seg.flags&TCP_ACK != 0 {
+		tcpFillHeader(s, seg.dstPort, seg.srcPort, seg.ack, 0, TCP_RST, 0, TCP_HEADER_SIZE)
+	} else {
+		length := uint32(len(seg.payload))
+		if seg.flags&TCP_SYN != 0 {
+			length++
+		}
+		if seg.flags&TCP_FIN != 0 {
+			length++
+		}
+		tcpFillHeader(s, seg.dstPort, seg.srcPort, 0, seg.seq+length, TCP_RST|TCP_ACK, 0, TCP_HEADER_SIZE)
+	}
+	putUint16(s[16:], inetPseudoChecksum(r.src, pkt.src, IPV4_PROTO_TCP, s))
+	ipv4Output(&r, pkt.src, IPV4_PROTO_TCP, s)
+}
+
+func tcpStartRtxTimer(c *tcpConn) {
+	if !c.rtxTimer.IsActive() {
+		StartHrTimer(&c.rtxTimer, MonotonicTime()+c.rto)
+	}
+}
+
+// Bytes of the send buffer that are in flight
+func tcpSentData(c *tcpConn) int {
+	n := int(c.sndNxt - c.sndUna)
+	if c.finSent {
+		n--
+	}
+	return n
+}
+
+// Send what the window and Nagle allow, then the FIN once everything is out
+func tcpOutput(c *tcpConn) {
+	switch c.state {
+	case TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT, TCP_STATE_FIN_WAIT_1, TCP_STATE_CLOSING, TCP_STATE_LAST_ACK:
+	default:
+		return
+	}
+	for !c.finSent {
+		sent := tcpSentData(c)
+		unsent := c.txLen - sent
+		if unsent == 0 {
+			if c.finQueued {
+				tcpSendSegment(c, c.sndNxt, TCP_FIN|TCP_ACK, 0, 0)
+				c.sndNxt++
+				c.finSent = true
+				tcpStartRtxTimer(c)
+			}
+			return
+		}
+		room := int(c.sndWnd) - sent
+		if room <= 0 {
+			// The timer probes a closed window
+			tcpStartRtxTimer(c)
+			return
+		}
+		size := min(unsent, room, c.mss)
+		if size < c.mss && sent > 0 && !c.noDelay {
+			// Nagle, wait for the ACK before sending a small segment
+			return
+		}
+		flags := uint8(TCP_ACK)
+		if size == unsent {
+			flags |= TCP_PSH
+		}
+		// A segment the driver dropped is treated as lost
+		tcpSendSegment(c, c.sndNxt, flags, sent, size)
+		if c.rttStart == 0 {
+			c.rttStart = MonotonicTime()
+			c.rttSeq = c.sndNxt
+		}
+		c.sndNxt += uint32(size)
+		tcpStartRtxTimer(c)
+	}
+}
+
+// RFC 6298
+func tcpUpdateRtt(c *tcpConn, rtt uint64) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if rtt > c.srtt {
+			delta = rtt - c.srtt
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, TCP_RTO_MIN), TCP_RTO_MAX)
+}
+
+func tcpRtxTimeout(t *HrTimer) {
+	c := &tcpConns[t.Arg]
+	switch c.state {
+	case TCP_STATE_TIME_WAIT, TCP_STATE_FIN_WAIT_2:
+		tcpSetClosed(c, ESUCCESS)
+		return
+	case TCP_STATE_CLOSED, TCP_STATE_LISTEN:
+		return
+	}
+	if c.sndUna == c.sndNxt {
+		if c.txLen > 0 && c.sndWnd == 0 {
+			// Zero window probe. An old sequence number makes the peer answer with its window.
+			tcpSendSegment(c, c.sndUna-1, TCP_ACK, 0, 0)
+			c.rto = min(c.rto*2, TCP_RTO_MAX)
+			tcpStartRtxTimer(c)
+		}
+		return
+	}
+	c.retries++
+	if c.retries > TCP_MAX_RETRIES {
+		tcpSendSegment(c, c.sndNxt, TCP_RST|TCP_ACK, 0, 0)
+		tcpSetClosed(c, syscall.ETIMEDOUT)
+		return
+	}
+	c.rto = min(c.rto*2, TCP_RTO_MAX)
+	// Karn, retransmitted segments are not timed
+	c.rttStart = 0
+	switch c.state {
+	case TCP_STATE_SYN_SENT:
+		tcpSendSegment(c, c.iss, TCP_SYN, 0, 0)
+	case TCP_STATE_SYN_RECEIVED:
+		tcpSendSegment(c, c.iss, TCP_SYN|TCP_ACK, 0, 0)
+	default:
+		// Go back N
+		c.sndNxt = c.sndUna
+		c.finSent = false
+		c.dupAcks = 0
+		tcpOutput(c)
+	}
+	tcpStartRtxTimer(c)
+}
+
+func tcpAckTimeout(t *HrTimer) {
+	c := &tcpConns[t.Arg]
+	if c.ackPending > 0 {
+		tcpSendAck(c)
+	}
+}
+
+func tcpEnterTimeWait(c *tcpConn) {
+	c.state = TCP_STATE_TIME_WAIT
+	CancelHrTimer(&c.ackTimer)
+	StartHrTimer(&c.rtxTimer, MonotonicTime()+TCP_TIME_WAIT_TIMEOUT)
+	c.readers.WakeAll()
+	c.writers.WakeAll()
+}
+
+// Send a RST and forget the connection
+func tcpAbort(c *tcpConn) {
+	switch c.state {
+	case TCP_STATE_CLOSED, TCP_STATE_LISTEN, TCP_STATE_SYN_SENT, TCP_STATE_TIME_WAIT:
+	default:
+		tcpSendSegment(c, c.sndNxt, TCP_RST|TCP_ACK, 0, 0)
+	}
+	tcpSetClosed(c, syscall.ECONNRESET)
+}
+
+func tcpParseMss(options []byte) int {
+	for len(options) > 0 && options[0] != TCP_OPT_END {
+		if options[0] == TCP_OPT_NOP {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || options[1] < 2 || int(options[1]) > len(options) {
+			break
+		}
+		if options[0] == TCP_OPT_MSS && options[1] == TCP_MSS_OPTION {
+			return int(getUint16(options[2:]))
+		}
+		options = options[options[1]:]
+	}
+	return TCP_DEFAULT_MSS
+}
+
+func tcpSetMss(c *tcpConn, seg *tcpSegment) {
+	c.mss = tcpParseMss(seg.options)
+	var r ipv4Route
+	if tcpRoute(c, &r) == ESUCCESS {
+		c.mss = min(c.mss, tcpLocalMss(&r))
+	}
+}
+
+func tcpLookup(local Ipv4Address, localPort uint16, remote Ipv4Address, remotePort uint16) *tcpConn {
+	var listener *tcpConn
+	for i := range tcpConns {
+		c := &tcpConns[i]
+		if !c.used || c.localPort != localPort || c.state == TCP_STATE_CLOSED {
+			continue
+		}
+		if c.state == TCP_STATE_LISTEN {
+			if c.localAddr == local || (c.localAddr.IsAny() && listener == nil) {
+				listener = c
+			}
+			continue
+		}
+		if c.localAddr == local && c.remoteAddr == remote && c.remotePort == remotePort {
+			return c
+		}
+	}
+	return listener
+}
+
+func tcpInput(pkt *ipv4Packet, data []byte) {
+	if len(data) < TCP_HEADER_SIZE || pkt.dst == IPV4_BROADCAST || pkt.dst.IsMulticast() {
+		return
+	}
+	if inetPseudoChecksum(pkt.src, pkt.dst, IPV4_PROTO_TCP, data) != 0 {
+		return
+	}
+	headerLen := int(data[12]>>4) * 4
+	if headerLen < TCP_HEADER_SIZE || headerLen > len(data) {
+		return
+	}
+	var seg tcpSegment
+	seg.srcPort = getUint16(data[0:])
+	seg.dstPort = getUint16(data[2:])
+	seg.seq = getUint32(data[4:])
+	seg.ack = getUint32(data[8:])
+	seg.flags = data[13]
+	seg.window = getUint16(data[14:])
+	seg.options = data[TCP_HEADER_SIZE:headerLen]
+	seg.payload = data[headerLen:]
+
+	c := tcpLookup(pkt.dst, seg.dstPort, pkt.src, seg.srcPort)
+	if c == nil {
+		tcpReplyReset(pkt, &seg)
+		return
+	}
+	switch c.state {
+	case TCP_STATE_LISTEN:
+		tcpInputListen(c, pkt, &seg)
+	case TCP_STATE_SYN_SENT:
+		tcpInputSynSent(c, pkt, &seg)
+	default:
+		tcpInputSynchronized(c, pkt, &seg)
+	}
+}
+
+// Children in SYN-RECEIVED count against the backlog
+func tcpPendingChildren(l *tcpConn) int {
+	n := 0
+	for i := range tcpConns {
+		if tcpConns[i].used && tcpConns[i].listener == l && tcpConns[i].state == TCP_STATE_SYN_RECEIVED {
+			n++
+		}
+	}
+	return n
+}
+
+func tcpInputListen(l *tcpConn, pkt *ipv4Packet, seg *tcpSegment) {
+	if seg.flags&TCP_RST != 0 {
+		return
+	}
+	if seg.flags&TCP_ACK != 0 {
+		tcpReplyReset(pkt, seg)
+		return
+	}
+	if seg.flags&TCP_SYN == 0 {
+		return
+	}
+	if l.acceptCount+tcpPendingChildren(l) >= l.backlog {
+		// Dropping the SYN makes the client try again later
+		return
+	}
+	c := tcpAlloc()
+	if c == nil {
+		return
+	}
+	c.localAddr = pkt.dst
+	c.localPort = l.localPort
+	c.remoteAddr = pkt.src
+	c.remotePort = seg.srcPort
+	c.listener = l
+	c.noDelay = l.noDelay
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.iss = tcpNewIss()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndWnd = uint32(seg.window)
+	tcpSetMss(c, seg)
+	c.state = TCP_STATE_SYN_RECEIVED
+	c.rttStart = MonotonicTime()
+	c.rttSeq = c.iss
+	tcpSendSegment(c, c.iss, TCP_SYN|TCP_ACK, 0, 0)
+	tcpStartRtxTimer(c)
+}
+
+func tcpInputSynSent(c *tcpConn, pkt *ipv4Packet, seg *tcpSegment) {
+	if seg.flags&TCP_ACK != 0 && seg.ack != c.iss+1 {
+		tcpReplyReset(pkt, seg)
+		return
+	}
+	if seg.flags&TCP_RST != 0 {
+		if seg.flags&TCP_ACK != 0 {
+			tcpSetClosed(c, syscall.ECONNREFUSED)
+		}
+		return
+	}
+	if seg.flags&TCP_SYN == 0 {
+		return
+	}
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = uint32(seg.window)
+	tcpSetMss(c, seg)
+	if seg.flags&TCP_ACK == 0 {
+		// Simultaneous open
+		c.state = TCP_STATE_SYN_RECEIVED
+		tcpSendSegment(c, c.iss, TCP_SYN|TCP_ACK, 0, 0)
+		return
+	}
+	c.sndUna = seg.ack
+	tcpEstablished(c)
+	tcpSendAck(c)
+	// Data that came with the SYN is sent again
+}
+
+func tcpEstablished(c *tcpConn) {
+	c.state = TCP_STATE_ESTABLISHED
+	if c.rttStart != 0 {
+		tcpUpdateRtt(c, MonotonicTime()-c.rttStart)
+		c.rttStart = 0
+	}
+	c.retries = 0
+	CancelHrTimer(&c.rtxTimer)
+	c.writers.WakeAll()
+}
+
+// Does the segment overlap the receive window
+func tcpSeqAcceptable(c *tcpConn, seq uint32, length int) bool {
+	window := uint32(tcpWindow(c))
+	if length == 0 {
+		if window == 0 {
+			return seq == c.rcvNxt
+		}
+		return seqLe(c.rcvNxt, seq) && seqLt(seq, c.rcvNxt+window)
+	}
+	if window == 0 {
+		return false
+	}
+	return seqLt(seq, c.rcvNxt+window) && seqLt(c.rcvNxt, seq+uint32(length))
+}
+
+// Handle the ACK field. Returns false if the segment needs no more processing.
+func tcpProcessAck(c *tcpConn, seg *tcpSegment) bool {
+	if seqLt(c.sndNxt, seg.ack) {
+		// Acknowledges something we did not send
+		tcpSendAck(c)
+		return false
+	}
+	if !seqLt(c.sndUna, seg.ack) {
+		if seg.ack == c.sndUna && len(seg.payload) == 0 && seg.flags&TCP_FIN == 0 &&
+			uint32(seg.window) == c.sndWnd && c.sndUna != c.sndNxt {
+			c.dupAcks++
+			if c.dupAcks == 3 {
+				// Fast retransmit of the first segment
+				if size := min(tcpSentData(c), c.mss); size > 0 {
+					tcpSendSegment(c, c.sndUna, TCP_ACK, 0, size)
+					c.rttStart = 0
+				}
+			}
+		}
+		if seg.ack == c.sndUna {
+			c.sndWnd = uint32(seg.window)
+		}
+		return true
+	}
+
+	acked := int(seg.ack - c.sndUna)
+	finAcked := c.finSent && seg.ack == c.sndNxt
+	if finAcked {
+		acked--
+	}
+	c.txHead = (c.txHead + acked) % TCP_BUFFER_SIZE
+	c.txLen -= acked
+	c.sndUna = seg.ack
+	c.sndWnd = uint32(seg.window)
+	c.dupAcks = 0
+	c.retries = 0
+	if c.rttStart != 0 && seqLt(c.rttSeq, seg.ack) {
+		tcpUpdateRtt(c, MonotonicTime()-c.rttStart)
+		c.rttStart = 0
+	}
+	CancelHrTimer(&c.rtxTimer)
+	if c.sndUna != c.sndNxt {
+		tcpStartRtxTimer(c)
+	}
+	c.writers.WakeAll()
+
+	if finAcked {
+		switch c.state {
+		case TCP_STATE_FIN_WAIT_1:
+			c.state = TCP_STATE_FIN_WAIT_2
+			if !c.open {
+				StartHrTimer(&c.rtxTimer, MonotonicTime()+TCP_FIN_TIMEOUT)
+			}
+		case TCP_STATE_CLOSING:
+			tcpEnterTimeWait(c)
+			return false
+		case TCP_STATE_LAST_ACK:
+			tcpSetClosed(c, ESUCCESS)
+			return false
+		}
+	}
+	return true
+}
+
+// Move an established child to the accept queue of its listener
+func tcpQueueChild(c *tcpConn) {
+	l := c.listener
+	if l.acceptCount == TCP_MAX_BACKLOG {
+		tcpAbort(c)
+		return
+	}
+	c.open = true
+	l.acceptQueue[(l.acceptHead+l.acceptCount)%TCP_MAX_BACKLOG] = c
+	l.acceptCount++
+	l.readers.WakeAll()
+}
+
+func tcpInputSynchronized(c *tcpConn, pkt *ipv4Packet, seg *tcpSegment) {
+	fin := seg.flags&TCP_FIN != 0
+	length := len(seg.payload)
+	if fin {
+		length++
+	}
+	if !tcpSeqAcceptable(c, seg.seq, length) {
+		if seg.flags&TCP_RST == 0 {
+			tcpSendAck(c)
+		}
+		return
+	}
+	if seg.flags&TCP_RST != 0 {
+		switch c.state {
+		case TCP_STATE_SYN_RECEIVED, TCP_STATE_CLOSING, TCP_STATE_LAST_ACK, TCP_STATE_TIME_WAIT:
+			tcpSetClosed(c, ESUCCESS)
+		default:
+			tcpSetClosed(c, syscall.ECONNRESET)
+		}
+		return
+	}
+	if seg.flags&TCP_SYN != 0 {
+		// Challenge ACK, a real peer answers it with a RST
+		tcpSendAck(c)
+		return
+	}
+	if seg.flags&TCP_ACK == 0 {
+		return
+	}
+	if c.state == TCP_STATE_SYN_RECEIVED {
+		if !seqLt(c.sndUna, seg.ack) || seqLt(c.sndNxt, seg.ack) {
+			tcpReplyReset(pkt, seg)
+			return
+		}
+		c.sndUna = seg.ack
+		c.sndWnd = uint32(seg.window)
+		tcpEstablished(c)
+		if c.listener != nil {
+			tcpQueueChild(c)
+			if !c.used {
+				return
+			}
+		}
+	}
+	if !tcpProcessAck(c, seg) {
+		return
+	}
+
+	switch c.state {
+	case TCP_STATE_ESTABLISHED, TCP_STATE_FIN_WAIT_1, TCP_STATE_FIN_WAIT_2:
+		tcpReceiveData(c, seg)
+	}
+	tcpOutput(c)
+	if c.ackPending >= 2 {
+		tcpSendAck(c)
+	} else if c.ackPending > 0 && !c.ackTimer.IsActive() {
+		StartHrTimer(&c.ackTimer, MonotonicTime()+TCP_DELAYED_ACK)
+	}
+}
+
+func tcpReceiveData(c *tcpConn, seg *tcpSegment) {
+	payload := seg.payload
+	fin := seg.flags&TCP_FIN != 0
+	if seqLt(seg.seq, c.rcvNxt) {
+		// Partly old, keep only the new part
+		skip := int(c.rcvNxt - seg.seq)
+		if skip > len(payload) {
+			payload = payload[:0]
+			fin = false
+		} else {
+			payload = payload[skip:]
+		}
+	} else if seg.seq != c.rcvNxt {
+		// Out of order, the duplicate ACK tells the sender where we are
+		tcpSendAck(c)
+		return
+	}
+	if len(payload) > 0 {
+		size := min(len(payload), tcpWindow(c))
+		if size < len(payload) {
+			// The rest comes again
+			fin = false
+		}
+		for done := 0; done < size; {
+			done += copy(c.rxBuf[(c.rxHead+c.rxLen+done)%TCP_BUFFER_SIZE:], payload[done:size])
+		}
+		c.rxLen += size
+		c.rcvNxt += uint32(size)
+		c.ackPending++
+		c.readers.WakeAll()
+	}
+	if !fin {
+		return
+	}
+	c.rcvNxt++
+	c.finReceived = true
+	c.readers.WakeAll()
+	switch c.state {
+	case TCP_STATE_ESTABLISHED:
+		c.state = TCP_STATE_CLOSE_WAIT
+	case TCP_STATE_FIN_WAIT_1:
+		c.state = TCP_STATE_CLOSING
+	case TCP_STATE_FIN_WAIT_2:
+		tcpEnterTimeWait(c)
+	}
+	tcpSendAck(c)
+}
+
+// Calls of the socket layer. They run in thread context and may block.
+
+// A new unconnected connection, nil if the table is full
+func tcpNew() *tcpConn {
+	c := tcpAlloc()
+	if c != nil {
+		c.open = true
+	}
+	return c
+}
+
+func tcpBind(c *tcpConn, addr Ipv4Address, port uint16) syscall.Errno {
+	if c.state != TCP_STATE_CLOSED || c.localPort != 0 {
+		return syscall.EINVAL
+	}
+	if !addr.IsAny() && !ipv4IsLocal(addr) && !addr.IsLoopback() {
+		return syscall.EADDRNOTAVAIL
+	}
+	if port == 0 {
+		port = tcpEphemeralPort(c, addr)
+		if port == 0 {
+			return syscall.EADDRINUSE
+		}
+	} else if tcpPortInUse(c, addr, port) {
+		return syscall.EADDRINUSE
+	}
+	c.localAddr = addr
+	c.localPort = port
+	return ESUCCESS
+}
+
+func tcpListen(c *tcpConn, backlog int) syscall.Errno {
+	backlog = min(max(backlog, 1), TCP_MAX_BACKLOG)
+	if c.state == TCP_STATE_LISTEN {
+		c.backlog = backlog
+		return ESUCCESS
+	}
+	if c.state != TCP_STATE_CLOSED {
+		return syscall.EINVAL
+	}
+	if c.localPort == 0 {
+		if err := tcpBind(c, IPV4_ANY, 0); err != ESUCCESS {
+			return err
+		}
+	} else if tcpPortInUse(c, c.localAddr, c.localPort) {
+		// Another connection got the port since the bind
+		return syscall.EADDRINUSE
+	}
+	c.backlog = backlog
+	c.state = TCP_STATE_LISTEN
+	return ESUCCESS
+}
+
+// Start the handshake. Without nonblock it waits until it is done.
+func tcpConnect(c *tcpConn, addr Ipv4Address, port uint16, nonblock bool) syscall.Errno {
+	switch c.state {
+	case TCP_STATE_CLOSED:
+	case TCP_STATE_SYN_SENT, TCP_STATE_SYN_RECEIVED:
+		return syscall.EALREADY
+	case TCP_STATE_LISTEN:
+		return syscall.EINVAL
+	default:
+		return syscall.EISCONN
+	}
+	if port == 0 {
+		return syscall.ECONNREFUSED
+	}
+	c.remoteAddr = addr
+	c.remotePort = port
+	var r ipv4Route
+	if err := tcpRoute(c, &r); err != ESUCCESS {
+		return err
+	}
+	if c.localPort == 0 {
+		if err := tcpBind(c, r.src, 0); err != ESUCCESS {
+			return err
+		}
+	}
+	if c.localAddr.IsAny() {
+		c.localAddr = r.src
+	}
+	c.mss = min(TCP_DEFAULT_MSS, tcpLocalMss(&r))
+	c.err = ESUCCESS
+	c.iss = tcpNewIss()
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.state = TCP_STATE_SYN_SENT
+	c.rttStart = MonotonicTime()
+	c.rttSeq = c.iss
+	tcpSendSegment(c, c.iss, TCP_SYN, 0, 0)
+	tcpStartRtxTimer(c)
+	if nonblock {
+		return syscall.EINPROGRESS
+	}
+	for c.state == TCP_STATE_SYN_SENT || c.state == TCP_STATE_SYN_RECEIVED {
+		if err := c.writers.WaitInterruptible(); err != ESUCCESS {
+			return err
+		}
+	}
+	if c.state == TCP_STATE_CLOSED {
+		err := c.err
+		c.err = ESUCCESS
+		return err
+	}
+	return ESUCCESS
+}
+
+func tcpAccept(l *tcpConn, nonblock bool) (*tcpConn, syscall.Errno) {
+	for l.acceptCount == 0 {
+		if l.state != TCP_STATE_LISTEN {
+			return nil, syscall.EINVAL
+		}
+		if nonblock {
+			return nil, syscall.EAGAIN
+		}
+		if err := l.readers.WaitInterruptible(); err != ESUCCESS {
+			return nil, err
+		}
+	}
+	c := l.acceptQueue[l.acceptHead]
+	l.acceptQueue[l.acceptHead] = nil
+	l.acceptHead = (l.acceptHead + 1) % TCP_MAX_BACKLOG
+	l.acceptCount--
+	c.listener = nil
+	return c, ESUCCESS
+}
+
+// With peek the data stays in the buffer
+func tcpRead(c *tcpConn, buf []byte, nonblock bool, peek bool) (int, syscall.Errno) {
+	for c.rxLen == 0 {
+		if c.err != ESUCCESS {
+			err := c.err
+			c.err = ESUCCESS
+			return 0, err
+		}
+		if c.finReceived || c.readShut {
+			return 0, ESUCCESS
+		}
+		switch c.state {
+		case TCP_STATE_LISTEN:
+			return 0, syscall.ENOTCONN
+		case TCP_STATE_CLOSED:
+			if c.remotePort == 0 {
+				return 0, syscall.ENOTCONN
+			}
+			return 0, ESUCCESS
+		}
+		if nonblock {
+			return 0, syscall.EAGAIN
+		}
+		if err := c.readers.WaitInterruptible(); err != ESUCCESS {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(buf) && n < c.rxLen {
+		start := (c.rxHead + n) % TCP_BUFFER_SIZE
+		n += copy(buf[n:], c.rxBuf[start:min(start+c.rxLen-n, TCP_BUFFER_SIZE)])
+	}
+	if peek {
+		return n, ESUCCESS
+	}
+	c.rxHead = (c.rxHead + n) % TCP_BUFFER_SIZE
+	c.rxLen -= n
+	// Tell the peer once a useful window opened again
+	if c.rcvWndSent < c.mss && tcpWindow(c) >= c.mss {
+		switch c.state {
+		case TCP_STATE_ESTABLISHED, TCP_STATE_FIN_WAIT_1, TCP_STATE_FIN_WAIT_2:
+			tcpSendAck(c)
+		}
+	}
+	return n, ESUCCESS
+}
+
+func tcpWrite(c *tcpConn, data []byte, nonblock bool) (int, syscall.Errno) {
+	written := 0
+	for written < len(data) {
+		if c.err != ESUCCESS {
+			if written > 0 {
+				break
+			}
+			err := c.err
+			c.err = ESUCCESS
+			return 0, err
+		}
+		switch c.state {
+		case TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT:
+		case TCP_STATE_SYN_SENT, TCP_STATE_SYN_RECEIVED:
+			if nonblock {
+				return written, syscall.EAGAIN
+			}
+			if err := c.writers.WaitInterruptible(); err != ESUCCESS {
+				return written, err
+			}
+			continue
+		case TCP_STATE_CLOSED, TCP_STATE_LISTEN:
+			if c.remotePort == 0 {
+				return written, syscall.ENOTCONN
+			}
+			return written, syscall.EPIPE
+		default:
+			return written, syscall.EPIPE
+		}
+		if c.finQueued {
+			return written, syscall.EPIPE
+		}
+		free := TCP_BUFFER_SIZE - c.txLen
+		if free == 0 {
+			if nonblock {
+				if written > 0 {
+					break
+				}
+				return 0, syscall.EAGAIN
+			}
+			if err := c.writers.WaitInterruptible(); err != ESUCCESS {
+				if written > 0 {
+					break
+				}
+				return 0, err
+			}
+			continue
+		}
+		size := min(free, len(data)-written)
+		for done := 0; done < size; {
+			done += copy(c.txBuf[(c.txHead+c.txLen+done)%TCP_BUFFER_SIZE:], data[written+done:written+size])
+		}
+		c.txLen += size
+		written += size
+		tcpOutput(c)
+	}
+	return written, ESUCCESS
+}
+
+func tcpPoll(c *tcpConn, pt *PollTable) uint32 {
+	pt.Wait(&c.readers)
+	pt.Wait(&c.writers)
+	events := uint32(0)
+	if c.err != ESUCCESS {
+		events |= POLLERR
+	}
+	switch c.state {
+	case TCP_STATE_LISTEN:
+		if c.acceptCount > 0 {
+			events |= POLLIN | POLLRDNORM
+		}
+		return events
+	case TCP_STATE_SYN_SENT, TCP_STATE_SYN_RECEIVED:
+		return events
+	case TCP_STATE_CLOSED:
+		// Like Linux, also for sockets that were never connected
+		events |= POLLHUP
+	}
+	if c.rxLen > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	if c.finReceived || c.readShut || c.state == TCP_STATE_CLOSED && c.remotePort != 0 {
+		events |= POLLIN | POLLRDNORM | POLLRDHUP
+	}
+	// Writes fail right away once the sending side is closed
+	if c.finQueued || c.state == TCP_STATE_CLOSED || c.txLen < TCP_BUFFER_SIZE {
+		events |= POLLOUT | POLLWRNORM
+	}
+	return events
+}
+
+// Queue the FIN
+func tcpCloseSend(c *tcpConn) {
+	switch c.state {
+	case TCP_STATE_ESTABLISHED:
+		c.state = TCP_STATE_FIN_WAIT_1
+	case TCP_STATE_CLOSE_WAIT:
+		c.state = TCP_STATE_LAST_ACK
+	default:
+		return
+	}
+	c.finQueued = true
+	tcpOutput(c)
+}
+
+func tcpShutdown(c *tcpConn, how int) syscall.Errno {
+	switch c.state {
+	case TCP_STATE_CLOSED, TCP_STATE_LISTEN, TCP_STATE_SYN_SENT:
+		return syscall.ENOTCONN
+	}
+	if how != syscall.SHUT_WR {
+		c.readShut = true
+		c.readers.WakeAll()
+	}
+	if how != syscall.SHUT_RD {
+		tcpCloseSend(c)
+	}
+	return ESUCCESS
+}
+
+// The socket is closed. The connection lingers until the FIN handshake is done.
+func tcpClose(c *tcpConn) {
+	c.open = false
+	switch c.state {
+	case TCP_STATE_LISTEN:
+		for c.acceptCount > 0 {
+			child := c.acceptQueue[c.acceptHead]
+			c.acceptQueue[c.acceptHead] = nil
+			c.acceptHead = (c.acceptHead + 1) % TCP_MAX_BACKLOG
+			c.acceptCount--
+			child.open = false
+			tcpAbort(child)
+		}
+		for i := range tcpConns {
+			if tcpConns[i].used && tcpConns[i].listener == c {
+				tcpAbort(&tcpConns[i])
+			}
+		}
+		tcpSetClosed(c, ESUCCESS)
+	case TCP_STATE_CLOSED:
+		tcpFree(c)
+	case TCP_STATE_SYN_SENT:
+		tcpSetClosed(c, ESUCCESS)
+	default:
+		if c.rxLen > 0 {
+			// Unread data is lost, tell the peer like Linux does
+			tcpAbort(c)
+			return
+		}
+		tcpCloseSend(c)
+		if c.state == TCP_STATE_FIN_WAIT_2 && !c.rtxTimer.IsActive() {
+			StartHrTimer(&c.rtxTimer, MonotonicTime()+TCP_FIN_TIMEOUT)
+		}
+	}
+}
@@ -21,14 +21,16 @@ func (e TextModeErrorWriter) Write(p []byte) (int, error) {
 }
 
 const (
-	fbWidth              = 80
-	fbHeight             = 25
 	fbPhysAddr   uintptr = 0xb8000
 	cursorHeight         = 1  // scanlines
 	cursorStart          = 11 // scanlines
 )
 
 var (
+	// Can change when the console is drawn on a framebuffer
+	fbWidth  = 80
+	fbHeight = 25
+
 	fbCurLine = 0
 	fbCurCol  = 0
 )
@@ -45,6 +47,9 @@ func TextModeFlushScreen() {
 	for i := range fb {
 		fb[i] = 0xf00
 	}
+	if fbConsoleEnabled {
+		fbConsoleRedraw()
+	}
 }
 
 func textModeCheckFbMove() {
@@ -57,6 +62,9 @@ func textModeCheckFbMove() {
 			fb[(fbHeight-1)*fbWidth+i] = 0xf00
 		}
 		fbCurLine--
+		if fbConsoleEnabled {
+			fbConsoleRedraw()
+		}
 	}
 }
 
@@ -91,6 +99,9 @@ func textModePrintCharCol(char uint8, attr uint8) {
 		textModeCheckFbMove()
 	} else if char == '\b' {
 		fb[fbCurCol+fbCurLine*fbWidth] = 0xf00
+		if fbConsoleEnabled {
+			fbConsoleDrawCell(fbCurCol + fbCurLine*fbWidth)
+		}
 		fbCurCol = fbCurCol - 1
 		if fbCurCol < 0 {
 			fbCurCol = 0
@@ -102,6 +113,9 @@ func textModePrintCharCol(char uint8, attr uint8) {
 			return
 		}
 		fb[fbCurCol+fbCurLine*fbWidth] = uint16(attr)<<8 | uint16(char)
+		if fbConsoleEnabled {
+			fbConsoleDrawCell(fbCurCol + fbCurLine*fbWidth)
+		}
 		fbCurCol++
 	}
 	//text_mode_update_cursor(fbCurCol, fbCurLine)
@@ -9,9 +9,42 @@ type Thread struct {
 	userStack   stack
 	kernelStack stack
 	isRemoved   bool
-	// Currently ignored '^^ I don't have to do it thanks to spurious wakeups
+	// Blocked threads are kept in Domain.blockedThreads until ResumeThread is called
 	IsBlocked   bool
 	WaitAddress *uint32
+	WaitBitset  uint32
+
+	// Wait queue the thread is currently in
+	waitQueue *WaitQueue
+	waitNext  *Thread
+	waitPrev  *Thread
+
+	// Sleeping
+	sleepTimer  HrTimer
+	isSleeping  bool
+	interrupted bool // Woken up by a signal
+
+	// Waiting in poll, select or epoll_wait
+	pollQueue WaitQueue
+	pollTable PollTable
+
+	// Scheduling
+	nice       int8
+	policy     uint8
+	rtPriority uint8
+	vruntime   uint64 // Weighted runtime in ns
+	rtSequence uint64
+	rrTimeLeft uint64
+	affinity   uint32 // CPU mask
+	cpu        uint8  // Run queue the thread belongs to
+	onRq       bool   // Runnable and in the run queue of cpu
+	onCpu      bool   // Currently executing on some CPU
+	rqNext     *Thread
+	rqPrev     *Thread
+
+	// Resource usage, time is charged since accountStamp
+	Usage        Rusage
+	accountStamp uint64
 
 	// flag that shows that this thread would be handled as a new process in linux
 	isFork bool
@@ -0,0 +1,105 @@
+package kernel
+
+import (
+	"syscall"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Kernel clocks. The TSC is the clock source, its frequency is measured with
+// the PIT at boot. Timer interrupts come from the clock event devices.
+
+const (
+	CLOCK_REALTIME           = 0
+	CLOCK_MONOTONIC          = 1
+	CLOCK_PROCESS_CPUTIME_ID = 2
+	CLOCK_THREAD_CPUTIME_ID  = 3
+	CLOCK_MONOTONIC_RAW      = 4
+	CLOCK_REALTIME_COARSE    = 5
+	CLOCK_MONOTONIC_COARSE   = 6
+	CLOCK_BOOTTIME           = 7
+
+	NS_PER_SECOND = 1000000000
+
+	TSC_CALIBRATION_US = 50000
+)
+
+var (
+	tscAtBoot    uint64
+	tscPerSecond uint64
+	// The TSCs of the CPUs can be slightly apart, the clock must not go backwards anyway
+	lastMonotonicNs uint64
+	// Time of the last timer interrupt
+	coarseNs       uint64
+	realtimeAtBoot int64 // Wall clock time in ns when monotonic time was 0
+)
+
+// Split up so that the multiplication cannot overflow
+func tscToNs(cycles uint64) uint64 {
+	return cycles/tscPerSecond*NS_PER_SECOND + cycles%tscPerSecond*NS_PER_SECOND/tscPerSecond
+}
+
+// Nanoseconds since boot
+func MonotonicTime() uint64 {
+	now := lastMonotonicNs
+	if tsc := Rdtsc(); tsc > tscAtBoot {
+		now = max(now, tscToNs(tsc-tscAtBoot))
+	}
+	lastMonotonicNs = now
+	return now
+}
+
+// Called by the timer interrupts
+func updateCoarseTime(now uint64) {
+	coarseNs = now
+}
+
+// Nanoseconds since the unix epoch
+func RealTime() int64 {
+	return realtimeAtBoot + int64(MonotonicTime())
+}
+
+// Read a clock in nanoseconds
+func ClockTime(clockId uint32) (int64, syscall.Errno) {
+	switch clockId {
+	case CLOCK_REALTIME:
+		return RealTime(), ESUCCESS
+	case CLOCK_REALTIME_COARSE:
+		return realtimeAtBoot + int64(coarseNs), ESUCCESS
+	case CLOCK_MONOTONIC, CLOCK_MONOTONIC_RAW, CLOCK_BOOTTIME:
+		// There is no suspend, so boottime is the same as monotonic
+		return int64(MonotonicTime()), ESUCCESS
+	case CLOCK_MONOTONIC_COARSE:
+		return int64(coarseNs), ESUCCESS
+	case CLOCK_PROCESS_CPUTIME_ID:
+		usage := &CurrentThread.Domain.Usage
+		return int64(usage.UserTime + usage.SystemTime), ESUCCESS
+	case CLOCK_THREAD_CPUTIME_ID:
+		return int64(CurrentThread.Usage.UserTime + CurrentThread.Usage.SystemTime), ESUCCESS
+	default:
+		return 0, syscall.EINVAL
+	}
+}
+
+// Resolution of a clock in nanoseconds
+func ClockResolution(clockId uint32) (int64, syscall.Errno) {
+	switch clockId {
+	case CLOCK_REALTIME, CLOCK_MONOTONIC, CLOCK_MONOTONIC_RAW, CLOCK_BOOTTIME:
+		return 1, ESUCCESS
+	case CLOCK_REALTIME_COARSE, CLOCK_MONOTONIC_COARSE, CLOCK_PROCESS_CPUTIME_ID, CLOCK_THREAD_CPUTIME_ID:
+		return SCHED_TICK_NS, ESUCCESS
+	default:
+		return 0, syscall.EINVAL
+	}
+}
+
+func InitTime() {
+	start := Rdtsc()
+	pitDelay(TSC_CALIBRATION_US)
+	tscAtBoot = Rdtsc()
+	tscPerSecond = (tscAtBoot - start) * 1000000 / TSC_CALIBRATION_US
+	log.KDebugLn("[TIME] TSC runs at ", tscPerSecond/1000, " kHz")
+
+	realtimeAtBoot = ReadRtcSeconds() * NS_PER_SECOND
+	log.KDebugLn("[TIME] RTC time: ", realtimeAtBoot/NS_PER_SECOND)
+}
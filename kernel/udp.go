@@ -0,0 +1,157 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// UDP. Endpoints bind a local address and port and get every datagram for
+// them through their receive function.
+
+const (
+	UDP_HEADER_SIZE   = 8
+	UDP_MAX_ENDPOINTS = 32
+	UDP_MAX_PAYLOAD   = IPV4_MAX_DATAGRAM - UDP_HEADER_SIZE
+
+	IP_EPHEMERAL_FIRST = 49152
+	IP_EPHEMERAL_LAST  = 65535
+)
+
+type udpEndpoint struct {
+	localAddr Ipv4Address // IPV4_ANY takes datagrams for all addresses
+	localPort uint16
+	// Called in interrupt context, data is only valid during the call
+	receive func(e *udpEndpoint, pkt *ipv4Packet, srcPort uint16, data []byte)
+	bound   bool
+}
+
+var (
+	udpEndpoints     [UDP_MAX_ENDPOINTS]*udpEndpoint
+	udpTxBuf         [IPV4_MAX_DATAGRAM]byte
+	udpNextEphemeral uint16 = IP_EPHEMERAL_FIRST
+)
+
+func udpPortInUse(addr Ipv4Address, port uint16) bool {
+	for _, e := range udpEndpoints {
+		if e != nil && e.localPort == port && (e.localAddr == addr || e.localAddr.IsAny() || addr.IsAny()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bind e to addr and port. Port 0 picks a free ephemeral port.
+func udpBind(e *udpEndpoint, addr Ipv4Address, port uint16) syscall.Errno {
+	if e.bound {
+		return syscall.EINVAL
+	}
+	if !addr.IsAny() && !ipv4IsLocal(addr) && !addr.IsLoopback() {
+		return syscall.EADDRNOTAVAIL
+	}
+	if port == 0 {
+		for i := 0; i <= IP_EPHEMERAL_LAST-IP_EPHEMERAL_FIRST; i++ {
+			candidate := udpNextEphemeral
+			udpNextEphemeral++
+			if udpNextEphemeral == 0 {
+				udpNextEphemeral = IP_EPHEMERAL_FIRST
+			}
+			if !udpPortInUse(addr, candidate) {
+				port = candidate
+				break
+			}
+		}
+		if port == 0 {
+			return syscall.EADDRINUSE
+		}
+	} else if udpPortInUse(addr, port) {
+		return syscall.EADDRINUSE
+	}
+	for i, slot := range udpEndpoints {
+		if slot == nil {
+			e.localAddr = addr
+			e.localPort = port
+			e.bound = true
+			udpEndpoints[i] = e
+			return ESUCCESS
+		}
+	}
+	return syscall.ENOBUFS
+}
+
+func udpUnbind(e *udpEndpoint) {
+	for i, slot := range udpEndpoints {
+		if slot == e {
+			udpEndpoints[i] = nil
+		}
+	}
+	e.bound = false
+}
+
+// Send data from e, which is bound to an ephemeral port first if needed
+func udpSendTo(e *udpEndpoint, dst Ipv4Address, dstPort uint16, data []byte) syscall.Errno {
+	var r ipv4Route
+	if err := ipv4FindRoute(dst, &r); err != ESUCCESS {
+		return err
+	}
+	return udpSendRoute(e, &r, dst, dstPort, data)
+}
+
+// Send along a given route, DHCP uses this before the interface has an address
+func udpSendRoute(e *udpEndpoint, r *ipv4Route, dst Ipv4Address, dstPort uint16, data []byte) syscall.Errno {
+	if len(data) > UDP_MAX_PAYLOAD {
+		return syscall.EMSGSIZE
+	}
+	if !e.bound {
+		if err := udpBind(e, IPV4_ANY, 0); err != ESUCCESS {
+			return err
+		}
+	}
+	if !e.localAddr.IsAny() {
+		r.src = e.localAddr
+	}
+	datagram := udpTxBuf[:UDP_HEADER_SIZE+len(data)]
+	putUint16(datagram[0:], e.localPort)
+	putUint16(datagram[2:], dstPort)
+	putUint16(datagram[4:], uint16(len(datagram)))
+	putUint16(datagram[6:], 0)
+	copy(datagram[UDP_HEADER_SIZE:], data)
+	checksum := inetPseudoChecksum(r.src, dst, IPV4_PROTO_UDP, datagram)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	putUint16(datagram[6:], checksum)
+	return ipv4Output(r, dst, IPV4_PROTO_UDP, datagram)
+}
+
+func udpInput(pkt *ipv4Packet, data []byte) {
+	if len(data) < UDP_HEADER_SIZE {
+		return
+	}
+	length := int(getUint16(data[4:]))
+	if length < UDP_HEADER_SIZE || length > len(data) {
+		return
+	}
+	data = data[:length]
+	if getUint16(data[6:]) != 0 && inetPseudoChecksum(pkt.src, pkt.dst, IPV4_PROTO_UDP, data) != 0 {
+		return
+	}
+	srcPort := getUint16(data[0:])
+	dstPort := getUint16(data[2:])
+	var match *udpEndpoint
+	for _, e := range udpEndpoints {
+		if e == nil || e.localPort != dstPort {
+			continue
+		}
+		if e.localAddr == pkt.dst {
+			match = e
+			break
+		}
+		if e.localAddr.IsAny() {
+			match = e
+		}
+	}
+	if match == nil {
+		icmpSendError(pkt, ICMP_DEST_UNREACHABLE, ICMP_PORT_UNREACHABLE, data)
+		return
+	}
+	match.receive(match, pkt, srcPort, data[UDP_HEADER_SIZE:])
+}
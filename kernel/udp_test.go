@@ -0,0 +1,142 @@
+package kernel
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Last datagram an endpoint received
+type testUdpReceived struct {
+	count   int
+	src     Ipv4Address
+	dst     Ipv4Address
+	srcPort uint16
+	data    [UDP_MAX_PAYLOAD]byte
+	length  int
+}
+
+var testUdpRx [2]testUdpReceived
+
+func testUdpReceive(e *udpEndpoint, pkt *ipv4Packet, srcPort uint16, data []byte) {
+	r := &testUdpRx[e.localPort%2]
+	r.count++
+	r.src = pkt.src
+	r.dst = pkt.dst
+	r.srcPort = srcPort
+	r.length = copy(r.data[:], data)
+}
+
+// Ports are picked so that the even one records to testUdpRx[0] and the odd one to testUdpRx[1]
+func testUdpEndpoints(t *testing.T) (*udpEndpoint, *udpEndpoint) {
+	t.Helper()
+	testUdpRx = [2]testUdpReceived{}
+	a := &udpEndpoint{receive: testUdpReceive}
+	b := &udpEndpoint{receive: testUdpReceive}
+	if err := udpBind(a, IPV4_LOOPBACK, 4000); err != ESUCCESS {
+		t.Fatalf("Could not bind a: %v", err)
+	}
+	if err := udpBind(b, IPV4_ANY, 5001); err != ESUCCESS {
+		t.Fatalf("Could not bind b: %v", err)
+	}
+	return a, b
+}
+
+func TestUdpLoopbackRoundTrip(t *testing.T) {
+	netTestSetup(t)
+	a, b := testUdpEndpoints(t)
+
+	if err := udpSendTo(a, IPV4_LOOPBACK, 5001, []byte("ping")); err != ESUCCESS {
+		t.Fatalf("Send to b returned %v", err)
+	}
+	if testUdpRx[1].count != 0 {
+		t.Fatal("Datagram arrived while it was still sent")
+	}
+	loopbackFlush()
+	rb := &testUdpRx[1]
+	if rb.count != 1 || string(rb.data[:rb.length]) != "ping" {
+		t.Fatalf("b received %d datagrams, last %q", rb.count, rb.data[:rb.length])
+	}
+	if rb.srcPort != 4000 || rb.src != IPV4_LOOPBACK || rb.dst != IPV4_LOOPBACK {
+		t.Errorf("b received from %v:%d to %v", rb.src, rb.srcPort, rb.dst)
+	}
+
+	// Answer to where the datagram came from
+	if err := udpSendTo(b, rb.src, rb.srcPort, []byte("pong")); err != ESUCCESS {
+		t.Fatalf("Send to a returned %v", err)
+	}
+	loopbackFlush()
+	ra := &testUdpRx[0]
+	if ra.count != 1 || string(ra.data[:ra.length]) != "pong" || ra.srcPort != 5001 {
+		t.Errorf("a received %d datagrams, last %q from port %d", ra.count, ra.data[:ra.length], ra.srcPort)
+	}
+	udpUnbind(a)
+	udpUnbind(b)
+}
+
+// Larger than the MTU, so it is fragmented and reassembled
+func TestUdpLoopbackFragments(t *testing.T) {
+	netTestSetup(t)
+	a, b := testUdpEndpoints(t)
+	var data [3 * ETH_MTU]byte
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := udpSendTo(a, IPV4_LOOPBACK, 5001, data[:]); err != ESUCCESS {
+		t.Fatalf("Send returned %v", err)
+	}
+	if frames := loopback.ring.Len(); frames != 4 {
+		t.Errorf("Sent %d fragments, want 4", frames)
+	}
+	loopbackFlush()
+	rb := &testUdpRx[1]
+	if rb.count != 1 || rb.length != len(data) || string(rb.data[:rb.length]) != string(data[:]) {
+		t.Errorf("b received %d datagrams, last with %d bytes", rb.count, rb.length)
+	}
+	udpUnbind(a)
+	udpUnbind(b)
+}
+
+func TestUdpBind(t *testing.T) {
+	netTestSetup(t)
+	a, b := testUdpEndpoints(t)
+	c := &udpEndpoint{receive: testUdpReceive}
+	if err := udpBind(c, IPV4_ANY, 4000); err != syscall.EADDRINUSE {
+		t.Errorf("Binding a used port returned %v", err)
+	}
+	if err := udpBind(c, Ipv4Address{10, 0, 2, 99}, 6000); err != syscall.EADDRNOTAVAIL {
+		t.Errorf("Binding a foreign address returned %v", err)
+	}
+	// Sending binds to an ephemeral port
+	if err := udpSendTo(c, IPV4_LOOPBACK, 5001, []byte("x")); err != ESUCCESS {
+		t.Fatalf("Send returned %v", err)
+	}
+	if !c.bound || c.localPort < IP_EPHEMERAL_FIRST {
+		t.Errorf("Not bound to an ephemeral port: %v %d", c.bound, c.localPort)
+	}
+	loopbackFlush()
+	if rb := &testUdpRx[1]; rb.count != 1 || rb.srcPort != c.localPort {
+		t.Errorf("b received %d datagrams from port %d", rb.count, rb.srcPort)
+	}
+	udpUnbind(a)
+	udpUnbind(b)
+	udpUnbind(c)
+}
+
+func TestUdpDropsBadChecksum(t *testing.T) {
+	netTestSetup(t)
+	a, b := testUdpEndpoints(t)
+	if err := udpSendTo(a, IPV4_LOOPBACK, 5001, []byte("ping")); err != ESUCCESS {
+		t.Fatalf("Send returned %v", err)
+	}
+	i := loopback.ring.Pop()
+	loopback.ring = GenericRing{Cap: LOOPBACK_QUEUE_SIZE}
+	frame := loopback.frames[i][:loopback.lengths[i]]
+	// Flip a payload byte, the IPv4 header stays valid
+	frame[len(frame)-1] ^= 0xff
+	loopback.netif.Receive(frame)
+	if testUdpRx[1].count != 0 {
+		t.Errorf("Datagram with a bad checksum was delivered")
+	}
+	udpUnbind(a)
+	udpUnbind(b)
+}
@@ -0,0 +1,654 @@
+package kernel
+
+import (
+	"syscall"
+)
+
+// Unix domain sockets. Senders put their data straight into the receive buffer
+// of the other socket, as records that also carry the credentials and address
+// of the sender and the files it passes. There is no filesystem, so path names
+// are kept in the socket table like abstract names. They go away when the
+// socket is closed or the path is unlinked.
+
+const (
+	UNIX_PATH_MAX     = 108
+	SOCKADDR_UN_SIZE  = 2 + UNIX_PATH_MAX
+	UNIX_AUTOBIND_LEN = 8 // Family, NUL and five hex digits
+	UNIX_MAX_BACKLOG  = 16
+	UNIX_MAX_FDS      = 16 // Files passed with one message
+	UNIX_CONTROLS     = 64 // Messages with files in flight
+	// Data length, address length, control slot + 1, padding and credentials
+	UNIX_RECORD_HEADER = 20
+)
+
+// Files in flight. The slot holds a reference to each of them. Like on Linux
+// a socket that is passed over itself keeps itself open, but there is no
+// garbage collector to find such cycles.
+type unixControl struct {
+	fds    [UNIX_MAX_FDS]File
+	numFds int
+}
+
+type unixRecord struct {
+	length  int
+	addrLen int // Bytes of sun_path that follow the header
+	slot    int
+	cred    syscall.Ucred
+}
+
+var (
+	unixControls     [UNIX_CONTROLS]unixControl
+	unixAutobindNext uint32
+)
+
+// Everything runs as root
+func currentCred() syscall.Ucred {
+	return syscall.Ucred{Pid: int32(CurrentThread.Domain.Pid)}
+}
+
+// Check a sockaddr_un and bring it into the form names are stored in. Paths
+// end at the first NUL, which counts to the length like on Linux. Returns the
+// length, which is 2 for the unnamed address.
+func (sa *Sockaddr) unix(length int) (int, syscall.Errno) {
+	if length < 2 || length > SOCKADDR_UN_SIZE || sa.Family != syscall.AF_UNIX {
+		return 0, syscall.EINVAL
+	}
+	if length == 2 || sa.Data[0] == 0 {
+		return length, ESUCCESS
+	}
+	n := 0
+	for n < length-2 && sa.Data[n] != 0 {
+		n++
+	}
+	for i := n; i < len(sa.Data); i++ {
+		sa.Data[i] = 0
+	}
+	return min(2+n+1, SOCKADDR_UN_SIZE), ESUCCESS
+}
+
+// Returns the length of the address
+func (sa *Sockaddr) setUnix(s *Socket) int {
+	if s.nameLen == 0 {
+		*sa = Sockaddr{Family: syscall.AF_UNIX}
+		return 2
+	}
+	*sa = s.name
+	return s.nameLen
+}
+
+// sa is in stored form
+func unixLookup(sa *Sockaddr, length int) *Socket {
+	for i := range sockets {
+		s := &sockets[i]
+		if s.used && s.family == syscall.AF_UNIX && s.named && s.nameLen == length &&
+			string(s.name.Data[:length-2]) == string(sa.Data[:length-2]) {
+			return s
+		}
+	}
+	return nil
+}
+
+// The socket bound to the address in sa
+func unixFind(sa *Sockaddr, length int) (*Socket, syscall.Errno) {
+	length, err := sa.unix(length)
+	if err != ESUCCESS {
+		return nil, err
+	}
+	if length == 2 {
+		return nil, syscall.EINVAL
+	}
+	if s := unixLookup(sa, length); s != nil {
+		return s, ESUCCESS
+	}
+	if sa.Data[0] == 0 {
+		return nil, syscall.ECONNREFUSED
+	}
+	return nil, syscall.ENOENT
+}
+
+// Remove a path name, the socket keeps it as its address
+func UnlinkSocketName(path string) syscall.Errno {
+	if len(path) == 0 || len(path) > UNIX_PATH_MAX {
+		return syscall.ENOENT
+	}
+	sa := Sockaddr{Family: syscall.AF_UNIX}
+	copy(sa.Data[:], path)
+	length, _ := sa.unix(2 + len(path))
+	s := unixLookup(&sa, length)
+	if s == nil {
+		return syscall.ENOENT
+	}
+	s.named = false
+	return ESUCCESS
+}
+
+func unixBind(s *Socket, sa *Sockaddr, length int) syscall.Errno {
+	length, err := sa.unix(length)
+	if err != ESUCCESS {
+		return err
+	}
+	if s.nameLen != 0 {
+		return syscall.EINVAL
+	}
+	if length == 2 {
+		unixAutobind(s)
+		return ESUCCESS
+	}
+	if unixLookup(sa, length) != nil {
+		return syscall.EADDRINUSE
+	}
+	s.name = *sa
+	s.nameLen = length
+	s.named = true
+	return ESUCCESS
+}
+
+// Pick an unused abstract name like Linux does. There are fewer sockets than
+// names, so this always finds one.
+func unixAutobind(s *Socket) {
+	const digits = "0123456789abcdef"
+	for {
+		s.name = Sockaddr{Family: syscall.AF_UNIX}
+		n := unixAutobindNext & 0xfffff
+		unixAutobindNext++
+		for d := 0; d < 5; d++ {
+			s.name.Data[5-d] = digits[n>>(4*d)&0xf]
+		}
+		if unixLookup(&s.name, UNIX_AUTOBIND_LEN) == nil {
+			s.nameLen = UNIX_AUTOBIND_LEN
+			s.named = true
+			return
+		}
+	}
+}
+
+func unixConnect(s *Socket, sa *Sockaddr, length int) syscall.Errno {
+	if !s.IsStream() {
+		dst, err := unixFind(sa, length)
+		if err != ESUCCESS {
+			return err
+		}
+		if dst.typ != s.typ {
+			return syscall.EPROTOTYPE
+		}
+		s.peer = dst
+		s.connected = true
+		return ESUCCESS
+	}
+	if s.connected {
+		return syscall.EISCONN
+	}
+	if s.listening {
+		return syscall.EINVAL
+	}
+	var l *Socket
+	for {
+		var err syscall.Errno
+		// Look the listener up again after sleeping, it might be gone
+		if l, err = unixFind(sa, length); err != ESUCCESS {
+			return err
+		}
+		if l.typ != s.typ {
+			return syscall.EPROTOTYPE
+		}
+		if !l.listening {
+			return syscall.ECONNREFUSED
+		}
+		if l.acceptCount < l.backlog {
+			break
+		}
+		if s.nonblock {
+			return syscall.EAGAIN
+		}
+		if err := l.writers.WaitInterruptible(); err != ESUCCESS {
+			return err
+		}
+	}
+	// The other end waits in the accept queue
+	n := socketAlloc()
+	if n == nil {
+		return syscall.ENOBUFS
+	}
+	n.family = s.family
+	n.typ = s.typ
+	n.name = l.name
+	n.nameLen = l.nameLen
+	n.peer = s
+	n.connected = true
+	n.peerCred = currentCred()
+	s.peer = n
+	s.connected = true
+	s.peerCred = l.cred
+	l.acceptQueue[(l.acceptHead+l.acceptCount)%UNIX_MAX_BACKLOG] = n
+	l.acceptCount++
+	l.readers.WakeAll()
+	return ESUCCESS
+}
+
+func unixListen(s *Socket, backlog int) syscall.Errno {
+	if !s.IsStream() {
+		return syscall.EOPNOTSUPP
+	}
+	if s.connected || s.nameLen == 0 {
+		return syscall.EINVAL
+	}
+	s.backlog = min(max(backlog, 1), UNIX_MAX_BACKLOG)
+	s.listening = true
+	s.cred = currentCred()
+	return ESUCCESS
+}
+
+func unixAccept(s *Socket) (*Socket, syscall.Errno) {
+	for s.acceptCount == 0 {
+		if !s.listening {
+			return nil, syscall.EINVAL
+		}
+		if s.nonblock {
+			return nil, syscall.EAGAIN
+		}
+		if err := s.readers.WaitInterruptible(); err != ESUCCESS {
+			return nil, err
+		}
+	}
+	n := s.acceptQueue[s.acceptHead]
+	s.acceptQueue[s.acceptHead] = nil
+	s.acceptHead = (s.acceptHead + 1) % UNIX_MAX_BACKLOG
+	s.acceptCount--
+	s.writers.WakeAll()
+	return n, ESUCCESS
+}
+
+// Two connected sockets
+func NewSocketPair(family, typ, protocol int) (*Socket, *Socket, syscall.Errno) {
+	if family != syscall.AF_UNIX {
+		return nil, nil, syscall.EOPNOTSUPP
+	}
+	a, err := NewSocket(family, typ, protocol)
+	if err != ESUCCESS {
+		return nil, nil, err
+	}
+	b, err := NewSocket(family, typ, protocol)
+	if err != ESUCCESS {
+		a.Close()
+		return nil, nil, err
+	}
+	a.peer = b
+	a.connected = true
+	a.peerCred = currentCred()
+	b.peer = a
+	b.connected = true
+	b.peerCred = a.peerCred
+	return a, b, ESUCCESS
+}
+
+// Take references to the files in ctrl and park them in a free slot. Returns the slot + 1.
+func unixControlAlloc(ctrl *SocketControl) (int, syscall.Errno) {
+	for i := range unixControls {
+		c := &unixControls[i]
+		if c.numFds != 0 {
+			continue
+		}
+		for j := 0; j < ctrl.NumFds; j++ {
+			if err := AcquireFile(ctrl.Fds[j]); err != ESUCCESS {
+				for j--; j >= 0; j-- {
+					ReleaseFile(ctrl.Fds[j])
+					c.fds[j] = nil
+				}
+				return 0, err
+			}
+			c.fds[j] = ctrl.Fds[j]
+		}
+		c.numFds = ctrl.NumFds
+		return i + 1, ESUCCESS
+	}
+	return 0, syscall.ETOOMANYREFS
+}
+
+// Hand the files of a slot to ctrl, they are released if ctrl is nil
+func unixControlTake(slot int, ctrl *SocketControl) {
+	c := &unixControls[slot-1]
+	numFds := c.numFds
+	c.numFds = 0
+	for i := 0; i < numFds; i++ {
+		f := c.fds[i]
+		c.fds[i] = nil
+		if ctrl != nil {
+			ctrl.Fds[i] = f
+		} else {
+			ReleaseFile(f)
+		}
+	}
+	if ctrl != nil {
+		ctrl.NumFds = numFds
+	}
+}
+
+func (s *Socket) unixHeader(offset int) unixRecord {
+	var header [UNIX_RECORD_HEADER]byte
+	s.rxCopyOut(offset, header[:])
+	return unixRecord{
+		length:  int(getUint16(header[0:])),
+		addrLen: int(getUint16(header[2:])),
+		slot:    int(getUint16(header[4:])),
+		cred: syscall.Ucred{
+			Pid: int32(getUint32(header[8:])),
+			Uid: getUint32(header[12:]),
+			Gid: getUint32(header[16:]),
+		},
+	}
+}
+
+func (s *Socket) unixPutHeader(offset int, r *unixRecord) {
+	var header [UNIX_RECORD_HEADER]byte
+	putUint16(header[0:], uint16(r.length))
+	putUint16(header[2:], uint16(r.addrLen))
+	putUint16(header[4:], uint16(r.slot))
+	putUint32(header[8:], uint32(r.cred.Pid))
+	putUint32(header[12:], r.cred.Uid)
+	putUint32(header[16:], r.cred.Gid)
+	s.rxWriteAt(offset, header[:])
+}
+
+// Queue data from src at dst, the caller made sure that it fits
+func unixQueue(dst, src *Socket, data []byte, ctrl *SocketControl) syscall.Errno {
+	r := unixRecord{length: len(data), cred: currentCred()}
+	if ctrl != nil && ctrl.NumFds > 0 {
+		var err syscall.Errno
+		if r.slot, err = unixControlAlloc(ctrl); err != ESUCCESS {
+			return err
+		}
+	}
+	if ctrl != nil && ctrl.HasCred {
+		r.cred = ctrl.Cred
+	}
+	if !dst.IsStream() {
+		r.addrLen = max(src.nameLen-2, 0)
+	}
+	dst.unixPutHeader(dst.rxLen, &r)
+	dst.rxLen += UNIX_RECORD_HEADER
+	dst.rxCopyIn(src.name.Data[:r.addrLen])
+	dst.rxCopyIn(data)
+	dst.rxCount++
+	dst.readers.WakeAll()
+	return ESUCCESS
+}
+
+// Remove the record at the head, its files go to ctrl
+func (s *Socket) unixDequeue(r *unixRecord, ctrl *SocketControl) {
+	if r.slot != 0 {
+		unixControlTake(r.slot, ctrl)
+	}
+	s.rxConsume(UNIX_RECORD_HEADER + r.addrLen + r.length)
+	s.rxCount--
+	s.writers.WakeAll()
+}
+
+func unixSendMsg(s *Socket, data []byte, nonblock bool, sa *Sockaddr, length int, ctrl *SocketControl) (int, syscall.Errno) {
+	if !s.IsStream() {
+		return unixSendDgram(s, data, nonblock, sa, length, ctrl)
+	}
+	if !s.connected {
+		return 0, syscall.ENOTCONN
+	}
+	// Large writes are queued in pieces as the reader makes room
+	sent := 0
+	err := ESUCCESS
+	for sent < len(data) && err == ESUCCESS {
+		p := s.peer
+		switch {
+		case p == nil || s.txShut || p.rxShut:
+			err = syscall.EPIPE
+		case p.rxLen+UNIX_RECORD_HEADER >= SOCKET_BUFFER_SIZE:
+			if nonblock {
+				err = syscall.EAGAIN
+			} else {
+				err = p.writers.WaitInterruptible()
+			}
+		default:
+			size := min(SOCKET_BUFFER_SIZE-p.rxLen-UNIX_RECORD_HEADER, len(data)-sent)
+			if err = unixQueue(p, s, data[sent:sent+size], ctrl); err == ESUCCESS {
+				// The files go with the first piece
+				ctrl = nil
+				sent += size
+			}
+		}
+	}
+	if sent > 0 {
+		return sent, ESUCCESS
+	}
+	return 0, err
+}
+
+// Where a datagram from s goes, checked again after every sleep as it might be gone
+func unixDgramDest(s *Socket, sa *Sockaddr, length int) (*Socket, syscall.Errno) {
+	dst := s.peer
+	if sa != nil {
+		var err syscall.Errno
+		if dst, err = unixFind(sa, length); err != ESUCCESS {
+			return nil, err
+		}
+		if dst.typ != s.typ {
+			return nil, syscall.EPROTOTYPE
+		}
+		if dst.peer != nil && dst.peer != s {
+			return nil, syscall.EPERM
+		}
+	} else if !s.connected {
+		return nil, syscall.ENOTCONN
+	} else if dst == nil {
+		return nil, syscall.ECONNREFUSED
+	}
+	if s.txShut || dst.rxShut {
+		return nil, syscall.EPIPE
+	}
+	return dst, ESUCCESS
+}
+
+// Sleep until a datagram with dataLen bytes fits at its destination
+func unixWaitDgram(s *Socket, dataLen int, nonblock bool, sa *Sockaddr, length int) syscall.Errno {
+	size := UNIX_RECORD_HEADER + max(s.nameLen-2, 0) + dataLen
+	if size > SOCKET_BUFFER_SIZE {
+		return syscall.EMSGSIZE
+	}
+	for {
+		dst, err := unixDgramDest(s, sa, length)
+		if err != ESUCCESS {
+			return err
+		}
+		if size <= SOCKET_BUFFER_SIZE-dst.rxLen {
+			return ESUCCESS
+		}
+		if nonblock {
+			return syscall.EAGAIN
+		}
+		if err := dst.writers.WaitInterruptible(); err != ESUCCESS {
+			return err
+		}
+	}
+}
+
+func unixSendDgram(s *Socket, data []byte, nonblock bool, sa *Sockaddr, length int, ctrl *SocketControl) (int, syscall.Errno) {
+	if err := unixWaitDgram(s, len(data), nonblock, sa, length); err != ESUCCESS {
+		return 0, err
+	}
+	dst, err := unixDgramDest(s, sa, length)
+	if err != ESUCCESS {
+		return 0, err
+	}
+	if err := unixQueue(dst, s, data, ctrl); err != ESUCCESS {
+		return 0, err
+	}
+	return len(data), ESUCCESS
+}
+
+// Files of a peeked message stay queued and are not passed
+func unixRecvMsg(s *Socket, buf []byte, nonblock, peek bool, sa *Sockaddr, ctrl *SocketControl) (int, int, int, syscall.Errno) {
+	if s.IsStream() && !s.connected {
+		return 0, 0, 0, syscall.EINVAL
+	}
+	for s.rxCount == 0 {
+		if s.rxShut || s.IsStream() && s.peer == nil {
+			return 0, 0, 0, ESUCCESS
+		}
+		if nonblock {
+			return 0, 0, 0, syscall.EAGAIN
+		}
+		if err := s.readers.WaitInterruptible(); err != ESUCCESS {
+			return 0, 0, 0, err
+		}
+	}
+	r := s.unixHeader(0)
+	if ctrl != nil && s.passCred {
+		ctrl.Cred = r.cred
+		ctrl.HasCred = true
+	}
+	if !s.IsStream() {
+		n := min(r.length, len(buf))
+		s.rxCopyOut(UNIX_RECORD_HEADER+r.addrLen, buf[:n])
+		addrLen := 0
+		if sa != nil {
+			*sa = Sockaddr{Family: syscall.AF_UNIX}
+			s.rxCopyOut(UNIX_RECORD_HEADER, sa.Data[:r.addrLen])
+			addrLen = 2 + r.addrLen
+		}
+		if !peek {
+			s.unixDequeue(&r, ctrl)
+		}
+		return n, r.length, addrLen, ESUCCESS
+	}
+
+	// Streams read across records, but stop in front of one with files
+	copied := 0
+	for offset := 0; copied < len(buf) && offset < s.rxLen; {
+		r = s.unixHeader(offset)
+		if r.slot != 0 && copied > 0 {
+			break
+		}
+		n := min(r.length, len(buf)-copied)
+		s.rxCopyOut(offset+UNIX_RECORD_HEADER, buf[copied:copied+n])
+		copied += n
+		switch {
+		case peek:
+			offset += UNIX_RECORD_HEADER + r.length
+		case n == r.length:
+			s.unixDequeue(&r, ctrl)
+		default:
+			// Put a header for the rest in front of it
+			if r.slot != 0 {
+				unixControlTake(r.slot, ctrl)
+				r.slot = 0
+			}
+			r.length -= n
+			s.rxConsume(n)
+			s.unixPutHeader(0, &r)
+			s.writers.WakeAll()
+		}
+	}
+	return copied, copied, 0, ESUCCESS
+}
+
+// Bytes a read would return, like FIONREAD on Linux
+func unixAvailable(s *Socket) int {
+	if s.rxCount == 0 {
+		return 0
+	}
+	if !s.IsStream() {
+		return s.unixHeader(0).length
+	}
+	available := 0
+	for offset := 0; offset < s.rxLen; {
+		r := s.unixHeader(offset)
+		available += r.length
+		offset += UNIX_RECORD_HEADER + r.length
+	}
+	return available
+}
+
+func unixPoll(s *Socket, pt *PollTable) uint32 {
+	pt.Wait(&s.readers)
+	pt.Wait(&s.writers)
+	events := uint32(0)
+	if s.listening {
+		if s.acceptCount > 0 {
+			events |= POLLIN | POLLRDNORM
+		}
+		return events
+	}
+	p := s.peer
+	if p != nil {
+		// Senders wait for room at the peer
+		pt.Wait(&p.writers)
+	}
+	if s.rxCount > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	if s.rxShut {
+		events |= POLLIN | POLLRDNORM | POLLRDHUP
+	}
+	if s.rxShut && s.txShut {
+		events |= POLLHUP
+	}
+	if s.IsStream() && (!s.connected || p == nil) {
+		events |= POLLHUP
+		if s.connected {
+			// The peer is gone, reads return EOF
+			events |= POLLIN | POLLRDNORM | POLLRDHUP
+		}
+	}
+	if p == nil || s.txShut || p.rxShut || p.rxLen+UNIX_RECORD_HEADER < SOCKET_BUFFER_SIZE {
+		events |= POLLOUT | POLLWRNORM
+	}
+	return events
+}
+
+func unixShutdown(s *Socket, how int) syscall.Errno {
+	if !s.connected {
+		return syscall.ENOTCONN
+	}
+	p := s.peer
+	if how != syscall.SHUT_WR {
+		s.rxShut = true
+	}
+	if how != syscall.SHUT_RD {
+		s.txShut = true
+		if p != nil && s.IsStream() {
+			// The other side reads EOF
+			p.rxShut = true
+		}
+	}
+	s.readers.WakeAll()
+	s.writers.WakeAll()
+	if p != nil {
+		p.readers.WakeAll()
+		p.writers.WakeAll()
+	}
+	return ESUCCESS
+}
+
+func unixClose(s *Socket) {
+	s.named = false
+	s.listening = false
+	// Connections nobody accepted
+	for ; s.acceptCount > 0; s.acceptCount-- {
+		n := s.acceptQueue[s.acceptHead]
+		s.acceptQueue[s.acceptHead] = nil
+		s.acceptHead = (s.acceptHead + 1) % UNIX_MAX_BACKLOG
+		n.Close()
+	}
+	// Streams read EOF, datagram sockets connected to s get ECONNREFUSED
+	for i := range sockets {
+		o := &sockets[i]
+		if o.used && o.peer == s {
+			o.peer = nil
+			o.readers.WakeAll()
+			o.writers.WakeAll()
+		}
+	}
+	// Release the files of messages that were never received
+	for s.rxCount > 0 {
+		r := s.unixHeader(0)
+		s.unixDequeue(&r, nil)
+	}
+	s.readers.WakeAll()
+	s.writers.WakeAll()
+}
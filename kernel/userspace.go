@@ -110,7 +110,6 @@ const (
 )
 
 var (
-	tss                 tssEntry
 	defaultUserSegments SegmentList
 )
 
@@ -130,9 +129,13 @@ func printFuncName(pc uintptr) {
 }
 
 func KernelThreadInit() {
-	SetInterruptStack(CurrentThread.kernelStack.hi)
-	mm.SwitchPageDir(CurrentThread.Domain.MemorySpace.PageDirectory)
-	JumpUserMode(CurrentThread.Regs, CurrentThread.Info)
+	t := CurrentThread
+	schedulerStarted = true
+	SetInterruptStack(t.kernelStack.hi)
+	// New threads are started by the scheduler, so we still hold the kernel lock
+	leaveKernel()
+	mm.SwitchPageDir(t.Domain.MemorySpace.PageDirectory)
+	JumpUserMode(t.Regs, t.Info)
 }
 
 func JumpUserMode(regs RegisterState, info InterruptInfo)
@@ -140,7 +143,7 @@ func JumpUserMode(regs RegisterState, info InterruptInfo)
 func hackyGetFuncAddr(funcAddr func()) uintptr
 
 func SetInterruptStack(addr uintptr) {
-	tss.esp0 = uint32(addr)
+	thisCpu.tss.esp0 = uint32(addr)
 }
 
 func CreateNewThread(outThread *Thread, newStack uintptr, cloneThread *Thread, targetDomain *Domain) {
@@ -194,6 +197,11 @@ func CreateNewThread(outThread *Thread, newStack uintptr, cloneThread *Thread, t
 		}
 		//outThread.fpState = cloneThread.fpState
 		copy(outThread.tlsSegments[TLS_START:], cloneThread.tlsSegments[TLS_START:])
+
+		outThread.nice = cloneThread.nice
+		outThread.policy = cloneThread.policy
+		outThread.rtPriority = cloneThread.rtPriority
+		outThread.affinity = cloneThread.affinity
 	}
 	if outThread.Next != nil || outThread.prev != nil {
 		kernelPanic("thread should not be in a list yet")
@@ -238,6 +246,7 @@ func startProgramInternal(module *multiboot.MultibootModule, argv uintptr, envp
 	}
 	outDomain.ProgramName = module.Cmdline()
 	outDomain.MemorySpace.Brk = topAddr
+	outDomain.Files.InitStdio()
 
 	var stackPages [defaultStackPages]mm.Page
 	for i := 0; i < defaultStackPages; i++ {
@@ -355,11 +364,13 @@ func InitUserMode(kernelStackStart uintptr, kernelStackEnd uintptr) { // Add use
 	defaultUserSegments.fs = 0
 	defaultUserSegments.gs = 0
 
-	tssIndex := AddSegment(uintptr(unsafe.Pointer(&tss)), unsafe.Sizeof(tss), PRIV_KERNEL|SEG_NORW|TSS_32MODE|SEG_SYSTEM|TSS_IS_TSS, SEG_GRAN_BYTE)
+	tssIndex := AddSegment(uintptr(unsafe.Pointer(&thisCpu.tss)), unsafe.Sizeof(thisCpu.tss), PRIV_KERNEL|SEG_NORW|TSS_32MODE|SEG_SYSTEM|TSS_IS_TSS, SEG_GRAN_BYTE)
 
-	tss.ss0 = KDS_SELECTOR
-	tss.esp0 = uint32(kernelStackStart)
+	thisCpu.tss.ss0 = KDS_SELECTOR
+	thisCpu.tss.esp0 = uint32(kernelStackStart)
+	thisCpu.tssSelector = uint32(tssIndex * 8)
 	scheduleThread.kernelStack.hi = kernelStackStart
 	scheduleThread.kernelStack.lo = kernelStackEnd
+	thisCpu.schedStack = scheduleThread.kernelStack
 	flushTss(tssIndex * 8)
 }
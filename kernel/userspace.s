@@ -22,3 +22,9 @@ TEXT ·JumpUserMode(SB),NOSPLIT,$0
     ADDL $8, SP
     IRETL
     
+
+TEXT ·getTaskRegister(SB),NOSPLIT,$0-4
+    MOVL $0, AX
+    BYTE $0x0F; BYTE $0x00; BYTE $0xC8 // STR AX
+    MOVL AX, ret+0(FP)
+    RET
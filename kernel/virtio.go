@@ -0,0 +1,490 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Virtio devices on PCI. Modern devices describe where their registers are
+// with vendor capabilities, legacy ones have them in IO BAR 0. Transitional
+// devices (what QEMU gives you by default) have both, the modern interface is
+// used then.
+//
+// The queues are split virtqueues: a descriptor table, the available ring the
+// driver puts descriptor chains on and the used ring the device returns them on.
+
+const (
+	VIRTIO_PCI_VENDOR = 0x1af4
+
+	VIRTIO_STATUS_ACKNOWLEDGE = 1
+	VIRTIO_STATUS_DRIVER      = 2
+	VIRTIO_STATUS_DRIVER_OK   = 4
+	VIRTIO_STATUS_FEATURES_OK = 8
+	VIRTIO_STATUS_FAILED      = 0x80
+
+	VIRTIO_F_VERSION_1 = 32
+
+	VIRTIO_ISR_QUEUE  = 1 << 0
+	VIRTIO_ISR_CONFIG = 1 << 1
+
+	// Legacy registers, relative to IO BAR 0
+	VIRTIO_LEGACY_DEVICE_FEATURES = 0x00
+	VIRTIO_LEGACY_DRIVER_FEATURES = 0x04
+	VIRTIO_LEGACY_QUEUE_PFN       = 0x08
+	VIRTIO_LEGACY_QUEUE_SIZE      = 0x0c
+	VIRTIO_LEGACY_QUEUE_SELECT    = 0x0e
+	VIRTIO_LEGACY_QUEUE_NOTIFY    = 0x10
+	VIRTIO_LEGACY_STATUS          = 0x12
+	VIRTIO_LEGACY_ISR             = 0x13
+	VIRTIO_LEGACY_CONFIG          = 0x14 // Without MSI-X
+
+	// Modern capability types
+	VIRTIO_PCI_CAP_COMMON = 1
+	VIRTIO_PCI_CAP_NOTIFY = 2
+	VIRTIO_PCI_CAP_ISR    = 3
+	VIRTIO_PCI_CAP_DEVICE = 4
+
+	// Modern common configuration
+	VIRTIO_COMMON_DEVICE_FEATURE_SELECT = 0x00
+	VIRTIO_COMMON_DEVICE_FEATURE        = 0x04
+	VIRTIO_COMMON_DRIVER_FEATURE_SELECT = 0x08
+	VIRTIO_COMMON_DRIVER_FEATURE        = 0x0c
+	VIRTIO_COMMON_NUM_QUEUES            = 0x12
+	VIRTIO_COMMON_STATUS                = 0x14
+	VIRTIO_COMMON_CONFIG_GENERATION     = 0x15
+	VIRTIO_COMMON_QUEUE_SELECT          = 0x16
+	VIRTIO_COMMON_QUEUE_SIZE            = 0x18
+	VIRTIO_COMMON_QUEUE_ENABLE          = 0x1c
+	VIRTIO_COMMON_QUEUE_NOTIFY_OFF      = 0x1e
+	VIRTIO_COMMON_QUEUE_DESC            = 0x20
+	VIRTIO_COMMON_QUEUE_DRIVER          = 0x28
+	VIRTIO_COMMON_QUEUE_DEVICE          = 0x30
+
+	VIRTQ_DESC_F_NEXT      = 1
+	VIRTQ_DESC_F_WRITE     = 2
+	VIRTQ_USED_F_NO_NOTIFY = 1
+
+	// Legacy devices dictate the queue size, bigger queues are not supported
+	VIRTQ_MAX_SIZE = 256
+	// Modern devices let the driver pick a smaller one
+	VIRTQ_MODERN_SIZE = 64
+	// Legacy devices expect the used ring on the next page
+	VIRTQ_LEGACY_ALIGN = PAGE_SIZE
+)
+
+type VirtioDevice struct {
+	Pci    *PciDevice
+	modern bool
+	// Legacy
+	ioBase uint16
+	// Modern
+	common           uintptr
+	notify           uintptr
+	notifyMultiplier uint32
+	isr              uintptr
+	config           uintptr
+	// Negotiated
+	Features uint64
+}
+
+type virtqDesc struct {
+	addr  uint64
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+// One buffer of a descriptor chain. The address is physical.
+type VirtqBuffer struct {
+	Addr uintptr
+	Len  uint32
+	// The device writes the buffer instead of reading it
+	Writable bool
+}
+
+type Virtqueue struct {
+	Index uint16
+	Size  uint16
+	dev   *VirtioDevice
+
+	desc   uintptr
+	avail  uintptr
+	used   uintptr
+	notify uintptr // Modern only
+
+	freeHead uint16
+	numFree  uint16
+	lastUsed uint16
+	// Returned with the chain when the device is done with it, indexed by the head descriptor
+	tokens [VIRTQ_MAX_SIZE]uintptr
+}
+
+func virtioMmioRead8(addr uintptr) uint8 {
+	return *(*uint8)(unsafe.Pointer(addr))
+}
+
+func virtioMmioRead16(addr uintptr) uint16 {
+	return *(*uint16)(unsafe.Pointer(addr))
+}
+
+func virtioMmioRead32(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func virtioMmioWrite8(addr uintptr, value uint8) {
+	*(*uint8)(unsafe.Pointer(addr)) = value
+}
+
+func virtioMmioWrite16(addr uintptr, value uint16) {
+	*(*uint16)(unsafe.Pointer(addr)) = value
+}
+
+func virtioMmioWrite32(addr uintptr, value uint32) {
+	*(*uint32)(unsafe.Pointer(addr)) = value
+}
+
+func virtioMmioWrite64(addr uintptr, value uint64) {
+	virtioMmioWrite32(addr, uint32(value))
+	virtioMmioWrite32(addr+4, uint32(value>>32))
+}
+
+// Find the register regions of a modern device. Returns false if one is missing
+// or its BAR could not be mapped.
+func (v *VirtioDevice) findModernRegions() bool {
+	pci := v.Pci
+	for cap := pci.FindCapability(PCI_CAP_VENDOR); cap != 0; cap = pci.FindNextCapability(cap, PCI_CAP_VENDOR) {
+		cfgType := pci.Addr.ReadConfig8(cap + 3)
+		barIndex := int(pci.Addr.ReadConfig8(cap + 4))
+		offset := uintptr(pci.Addr.ReadConfig32(cap + 8))
+		length := uintptr(pci.Addr.ReadConfig32(cap + 12))
+		if cfgType < VIRTIO_PCI_CAP_COMMON || cfgType > VIRTIO_PCI_CAP_DEVICE || barIndex >= PCI_MAX_BARS {
+			continue
+		}
+		if offset+length > pci.Bars[barIndex].Size {
+			continue
+		}
+		bar := pci.MapBar(barIndex)
+		if bar == 0 {
+			continue
+		}
+		// The first capability of each type is the preferred one
+		switch cfgType {
+		case VIRTIO_PCI_CAP_COMMON:
+			if v.common == 0 {
+				v.common = bar + offset
+			}
+		case VIRTIO_PCI_CAP_NOTIFY:
+			if v.notify == 0 {
+				v.notify = bar + offset
+				v.notifyMultiplier = pci.Addr.ReadConfig32(cap + 16)
+			}
+		case VIRTIO_PCI_CAP_ISR:
+			if v.isr == 0 {
+				v.isr = bar + offset
+			}
+		case VIRTIO_PCI_CAP_DEVICE:
+			if v.config == 0 {
+				v.config = bar + offset
+			}
+		}
+	}
+	return v.common != 0 && v.notify != 0 && v.isr != 0
+}
+
+func (v *VirtioDevice) Status() uint8 {
+	if v.modern {
+		return virtioMmioRead8(v.common + VIRTIO_COMMON_STATUS)
+	}
+	return Inb(v.ioBase + VIRTIO_LEGACY_STATUS)
+}
+
+func (v *VirtioDevice) SetStatus(status uint8) {
+	if v.modern {
+		virtioMmioWrite8(v.common+VIRTIO_COMMON_STATUS, status)
+	} else {
+		Outb(v.ioBase+VIRTIO_LEGACY_STATUS, status)
+	}
+}
+
+func (v *VirtioDevice) addStatus(status uint8) {
+	v.SetStatus(v.Status() | status)
+}
+
+// Reset the device and tell it that there is a driver. Returns false if the
+// device has neither a usable modern nor a legacy interface.
+func (v *VirtioDevice) Init(pci *PciDevice) bool {
+	v.Pci = pci
+	pci.Enable()
+	// Interrupts come in as legacy INTx
+	pci.setCommand(0, PCI_COMMAND_INTX_DISABLE)
+	if v.findModernRegions() {
+		v.modern = true
+	} else if pci.Bars[0].IsIo && pci.Bars[0].Base != 0 {
+		v.ioBase = uint16(pci.Bars[0].Base)
+	} else {
+		log.KErrorLn("[VIRTIO] Device ", pci.DeviceId, " has no usable interface")
+		return false
+	}
+	v.SetStatus(0)
+	// Modern devices may take a while to reset
+	for i := 0; v.Status() != 0 && i < 100000; i++ {
+		Pause()
+	}
+	v.addStatus(VIRTIO_STATUS_ACKNOWLEDGE | VIRTIO_STATUS_DRIVER)
+	return true
+}
+
+func (v *VirtioDevice) deviceFeatures() uint64 {
+	if !v.modern {
+		return uint64(Inl(v.ioBase + VIRTIO_LEGACY_DEVICE_FEATURES))
+	}
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DEVICE_FEATURE_SELECT, 0)
+	low := virtioMmioRead32(v.common + VIRTIO_COMMON_DEVICE_FEATURE)
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DEVICE_FEATURE_SELECT, 1)
+	high := virtioMmioRead32(v.common + VIRTIO_COMMON_DEVICE_FEATURE)
+	return uint64(high)<<32 | uint64(low)
+}
+
+// Accept the wanted features the device offers. Modern devices also get
+// VIRTIO_F_VERSION_1 and have to agree to the selection.
+func (v *VirtioDevice) NegotiateFeatures(wanted uint64) bool {
+	if v.modern {
+		wanted |= 1 << VIRTIO_F_VERSION_1
+	}
+	v.Features = v.deviceFeatures() & wanted
+	if !v.modern {
+		Outl(v.ioBase+VIRTIO_LEGACY_DRIVER_FEATURES, uint32(v.Features))
+		return true
+	}
+	if v.Features&(1<<VIRTIO_F_VERSION_1) == 0 {
+		log.KErrorLn("[VIRTIO] Modern device without VIRTIO_F_VERSION_1")
+		v.Fail()
+		return false
+	}
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DRIVER_FEATURE_SELECT, 0)
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DRIVER_FEATURE, uint32(v.Features))
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DRIVER_FEATURE_SELECT, 1)
+	virtioMmioWrite32(v.common+VIRTIO_COMMON_DRIVER_FEATURE, uint32(v.Features>>32))
+	v.addStatus(VIRTIO_STATUS_FEATURES_OK)
+	if v.Status()&VIRTIO_STATUS_FEATURES_OK == 0 {
+		log.KErrorLn("[VIRTIO] Device did not accept the features")
+		v.Fail()
+		return false
+	}
+	return true
+}
+
+func (v *VirtioDevice) HasFeature(bit uint) bool {
+	return v.Features&(1<<bit) != 0
+}
+
+// Done with the setup, the device may use the queues from now on
+func (v *VirtioDevice) DriverOk() {
+	v.addStatus(VIRTIO_STATUS_DRIVER_OK)
+}
+
+func (v *VirtioDevice) Fail() {
+	v.addStatus(VIRTIO_STATUS_FAILED)
+}
+
+// Reading the ISR status acknowledges the interrupt
+func (v *VirtioDevice) InterruptStatus() uint8 {
+	if v.modern {
+		return virtioMmioRead8(v.isr)
+	}
+	return Inb(v.ioBase + VIRTIO_LEGACY_ISR)
+}
+
+func (v *VirtioDevice) ConfigRead8(offset uintptr) uint8 {
+	if v.modern {
+		return virtioMmioRead8(v.config + offset)
+	}
+	return Inb(v.ioBase + VIRTIO_LEGACY_CONFIG + uint16(offset))
+}
+
+func (v *VirtioDevice) ConfigRead16(offset uintptr) uint16 {
+	if v.modern {
+		return virtioMmioRead16(v.config + offset)
+	}
+	return Inw(v.ioBase + VIRTIO_LEGACY_CONFIG + uint16(offset))
+}
+
+func (v *VirtioDevice) ConfigRead32(offset uintptr) uint32 {
+	if v.modern {
+		return virtioMmioRead32(v.config + offset)
+	}
+	return Inl(v.ioBase + VIRTIO_LEGACY_CONFIG + uint16(offset))
+}
+
+// Read twice until both halves belong together
+func (v *VirtioDevice) ConfigRead64(offset uintptr) uint64 {
+	for {
+		high := v.ConfigRead32(offset + 4)
+		low := v.ConfigRead32(offset)
+		if v.ConfigRead32(offset+4) == high {
+			return uint64(high)<<32 | uint64(low)
+		}
+	}
+}
+
+func (v *VirtioDevice) ConfigWrite16(offset uintptr, value uint16) {
+	if v.modern {
+		virtioMmioWrite16(v.config+offset, value)
+	} else {
+		Outw(v.ioBase+VIRTIO_LEGACY_CONFIG+uint16(offset), value)
+	}
+}
+
+func (v *VirtioDevice) ConfigWrite32(offset uintptr, value uint32) {
+	if v.modern {
+		virtioMmioWrite32(v.config+offset, value)
+	} else {
+		Outl(v.ioBase+VIRTIO_LEGACY_CONFIG+uint16(offset), value)
+	}
+}
+
+func virtqSizes(size uint16) (descSize uintptr, availSize uintptr, usedSize uintptr) {
+	descSize = 16 * uintptr(size)
+	availSize = 6 + 2*uintptr(size)
+	usedSize = 6 + 8*uintptr(size)
+	return
+}
+
+// Allocate the rings of queue index and hand them to the device. The legacy
+// layout is used for both interfaces.
+func (v *VirtioDevice) SetupQueue(q *Virtqueue, index uint16) bool {
+	var size uint16
+	if v.modern {
+		virtioMmioWrite16(v.common+VIRTIO_COMMON_QUEUE_SELECT, index)
+		size = min(virtioMmioRead16(v.common+VIRTIO_COMMON_QUEUE_SIZE), VIRTQ_MODERN_SIZE)
+	} else {
+		Outw(v.ioBase+VIRTIO_LEGACY_QUEUE_SELECT, index)
+		size = Inw(v.ioBase + VIRTIO_LEGACY_QUEUE_SIZE)
+	}
+	if size == 0 || size > VIRTQ_MAX_SIZE {
+		log.KErrorLn("[VIRTIO] Unsupported size ", size, " of queue ", index)
+		return false
+	}
+	descSize, availSize, usedSize := virtqSizes(size)
+	usedOffset := (descSize + availSize + VIRTQ_LEGACY_ALIGN - 1) &^ (VIRTQ_LEGACY_ALIGN - 1)
+	mem := dmaAlloc(usedOffset+usedSize, PAGE_SIZE)
+	if mem == 0 {
+		return false
+	}
+
+	q.Index = index
+	q.Size = size
+	q.dev = v
+	q.desc = mem
+	q.avail = mem + descSize
+	q.used = mem + usedOffset
+	for i := uint16(0); i < size; i++ {
+		q.descAt(i).next = i + 1
+	}
+	q.freeHead = 0
+	q.numFree = size
+	q.lastUsed = 0
+
+	if !v.modern {
+		Outl(v.ioBase+VIRTIO_LEGACY_QUEUE_PFN, uint32(mem/PAGE_SIZE))
+		return true
+	}
+	virtioMmioWrite16(v.common+VIRTIO_COMMON_QUEUE_SIZE, size)
+	virtioMmioWrite64(v.common+VIRTIO_COMMON_QUEUE_DESC, uint64(q.desc))
+	virtioMmioWrite64(v.common+VIRTIO_COMMON_QUEUE_DRIVER, uint64(q.avail))
+	virtioMmioWrite64(v.common+VIRTIO_COMMON_QUEUE_DEVICE, uint64(q.used))
+	notifyOff := uintptr(virtioMmioRead16(v.common + VIRTIO_COMMON_QUEUE_NOTIFY_OFF))
+	q.notify = v.notify + notifyOff*uintptr(v.notifyMultiplier)
+	virtioMmioWrite16(v.common+VIRTIO_COMMON_QUEUE_ENABLE, 1)
+	return true
+}
+
+func (q *Virtqueue) descAt(i uint16) *virtqDesc {
+	return (*virtqDesc)(unsafe.Pointer(q.desc + uintptr(i)*16))
+}
+
+func (q *Virtqueue) availIdx() *uint16 {
+	return (*uint16)(unsafe.Pointer(q.avail + 2))
+}
+
+func (q *Virtqueue) usedIdx() uint16 {
+	return *(*uint16)(unsafe.Pointer(q.used + 2))
+}
+
+func (q *Virtqueue) NumFree() uint16 {
+	return q.numFree
+}
+
+// Put a descriptor chain on the available ring. The buffers the device reads
+// have to come before the ones it writes. Returns false if there are not
+// enough free descriptors, the device is not told about the chain until Kick.
+func (q *Virtqueue) Add(bufs []VirtqBuffer, token uintptr) bool {
+	if len(bufs) == 0 || len(bufs) > int(q.numFree) {
+		return false
+	}
+	head := q.freeHead
+	i := head
+	for n := range bufs {
+		d := q.descAt(i)
+		d.addr = uint64(bufs[n].Addr)
+		d.len = bufs[n].Len
+		d.flags = 0
+		if bufs[n].Writable {
+			d.flags |= VIRTQ_DESC_F_WRITE
+		}
+		if n < len(bufs)-1 {
+			d.flags |= VIRTQ_DESC_F_NEXT
+		}
+		i = d.next
+	}
+	q.freeHead = i
+	q.numFree -= uint16(len(bufs))
+	q.tokens[head] = token
+
+	// x86 does not reorder the stores, the ring entry is visible before the index
+	idx := q.availIdx()
+	*(*uint16)(unsafe.Pointer(q.avail + 4 + uintptr(*idx%q.Size)*2)) = head
+	*idx++
+	return true
+}
+
+// Tell the device about new chains unless it asked not to
+func (q *Virtqueue) Kick() {
+	// The device must see the new avail index before we read whether it wants a notification
+	Mfence()
+	if *(*uint16)(unsafe.Pointer(q.used))&VIRTQ_USED_F_NO_NOTIFY != 0 {
+		return
+	}
+	if q.dev.modern {
+		virtioMmioWrite16(q.notify, q.Index)
+	} else {
+		Outw(q.dev.ioBase+VIRTIO_LEGACY_QUEUE_NOTIFY, q.Index)
+	}
+}
+
+// Take the next chain the device is done with off the used ring and free its
+// descriptors. length is how much the device wrote.
+func (q *Virtqueue) GetUsed() (token uintptr, length uint32, ok bool) {
+	if q.lastUsed == q.usedIdx() {
+		return 0, 0, false
+	}
+	elem := q.used + 4 + uintptr(q.lastUsed%q.Size)*8
+	head := uint16(*(*uint32)(unsafe.Pointer(elem)))
+	length = *(*uint32)(unsafe.Pointer(elem + 4))
+	q.lastUsed++
+
+	token = q.tokens[head]
+	i := head
+	for {
+		q.numFree++
+		d := q.descAt(i)
+		if d.flags&VIRTQ_DESC_F_NEXT == 0 {
+			d.next = q.freeHead
+			break
+		}
+		i = d.next
+	}
+	q.freeHead = head
+	return token, length, true
+}
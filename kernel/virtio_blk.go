@@ -0,0 +1,234 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+)
+
+// Virtio block devices. Every request is a chain of a header, the data and a
+// status byte the device fills in. Several requests can be on the queue at
+// the same time, the thread that made one sleeps until the interrupt for it
+// comes in. Before there are threads the queue is polled.
+
+const (
+	VIRTIO_BLK_LEGACY_DEVICE = 0x1001
+	VIRTIO_BLK_MODERN_DEVICE = 0x1042
+
+	VIRTIO_BLK_MAX_DEVICES  = 4
+	VIRTIO_BLK_MAX_REQUESTS = 16
+
+	VIRTIO_BLK_F_RO    = 5
+	VIRTIO_BLK_F_FLUSH = 9
+
+	VIRTIO_BLK_CONFIG_CAPACITY = 0
+
+	VIRTIO_BLK_T_IN    = 0
+	VIRTIO_BLK_T_OUT   = 1
+	VIRTIO_BLK_T_FLUSH = 4
+
+	VIRTIO_BLK_S_OK = 0
+	// Not written by the device yet
+	VIRTIO_BLK_S_PENDING = 0xff
+)
+
+type virtioBlkHeader struct {
+	reqType  uint32
+	reserved uint32
+	sector   uint64
+}
+
+type virtioBlkRequest struct {
+	header virtioBlkHeader
+	status uint8
+	inUse  bool
+	done   bool
+	waiter WaitQueue
+}
+
+type virtioBlkDevice struct {
+	dev      VirtioDevice
+	queue    Virtqueue
+	capacity uint64
+	readOnly bool
+	// No interrupt line, always poll
+	polling  bool
+	requests [VIRTIO_BLK_MAX_REQUESTS]virtioBlkRequest
+	// Threads waiting for a free request or free descriptors
+	freeWaiters WaitQueue
+}
+
+var (
+	virtioBlkDriver = PciDriver{
+		Name: "virtio-blk",
+		Matches: []PciMatch{
+			{Vendor: VIRTIO_PCI_VENDOR, Device: VIRTIO_BLK_LEGACY_DEVICE, Class: PCI_ANY_CLASS},
+			{Vendor: VIRTIO_PCI_VENDOR, Device: VIRTIO_BLK_MODERN_DEVICE, Class: PCI_ANY_CLASS},
+		},
+		Probe: virtioBlkProbe,
+	}
+
+	virtioBlkDevices [VIRTIO_BLK_MAX_DEVICES]virtioBlkDevice
+	numVirtioBlk     = 0
+	virtioBlkNames   = [VIRTIO_BLK_MAX_DEVICES]string{"vda", "vdb", "vdc", "vdd"}
+	// IRQs the interrupt handler is registered for
+	virtioBlkIrqs uint32
+)
+
+func (b *virtioBlkDevice) Sectors() uint64 {
+	return b.capacity
+}
+
+func (b *virtioBlkDevice) ReadSectors(address int, count uint8, buffer []byte) syscall.Errno {
+	if err := blockCheckRequest(b.capacity, address, count, buffer); err != ESUCCESS {
+		return err
+	}
+	if count == 0 {
+		return ESUCCESS
+	}
+	return b.request(VIRTIO_BLK_T_IN, uint64(address), buffer[:int(count)*BLOCK_SECTOR_SIZE])
+}
+
+func (b *virtioBlkDevice) WriteSectors(address int, count uint8, buffer []byte) syscall.Errno {
+	if b.readOnly {
+		return syscall.EROFS
+	}
+	if err := blockCheckRequest(b.capacity, address, count, buffer); err != ESUCCESS {
+		return err
+	}
+	if count == 0 {
+		return ESUCCESS
+	}
+	err := b.request(VIRTIO_BLK_T_OUT, uint64(address), buffer[:int(count)*BLOCK_SECTOR_SIZE])
+	if err != ESUCCESS || !b.dev.HasFeature(VIRTIO_BLK_F_FLUSH) {
+		return err
+	}
+	// Writes go through to the disk like with ATA
+	return b.request(VIRTIO_BLK_T_FLUSH, 0, nil)
+}
+
+// Sleep on q until something completes
+func (b *virtioBlkDevice) wait(q *WaitQueue) {
+	if b.polling || !schedulerStarted {
+		Pause()
+		b.complete()
+		return
+	}
+	q.Wait()
+}
+
+func (b *virtioBlkDevice) allocRequest() *virtioBlkRequest {
+	for {
+		for i := range b.requests {
+			if !b.requests[i].inUse {
+				b.requests[i].inUse = true
+				return &b.requests[i]
+			}
+		}
+		b.wait(&b.freeWaiters)
+	}
+}
+
+// The buffer is a kernel address, which is the same as the physical one
+func (b *virtioBlkDevice) request(reqType uint32, sector uint64, buffer []byte) syscall.Errno {
+	req := b.allocRequest()
+	req.header = virtioBlkHeader{reqType: reqType, sector: sector}
+	req.status = VIRTIO_BLK_S_PENDING
+	req.done = false
+
+	var bufs [3]VirtqBuffer
+	n := 0
+	bufs[n] = VirtqBuffer{Addr: uintptr(unsafe.Pointer(&req.header)), Len: uint32(unsafe.Sizeof(req.header))}
+	n++
+	if len(buffer) > 0 {
+		bufs[n] = VirtqBuffer{Addr: uintptr(unsafe.Pointer(&buffer[0])), Len: uint32(len(buffer)), Writable: reqType == VIRTIO_BLK_T_IN}
+		n++
+	}
+	bufs[n] = VirtqBuffer{Addr: uintptr(unsafe.Pointer(&req.status)), Len: 1, Writable: true}
+	n++
+
+	for !b.queue.Add(bufs[:n], uintptr(unsafe.Pointer(req))) {
+		b.wait(&b.freeWaiters)
+	}
+	b.queue.Kick()
+	for !req.done {
+		b.wait(&req.waiter)
+	}
+
+	status := req.status
+	req.inUse = false
+	b.freeWaiters.WakeOne()
+	if status != VIRTIO_BLK_S_OK {
+		log.KErrorLn("[VIRTIO-BLK] Request ", reqType, " for sector ", sector, " failed with ", status)
+		return syscall.EIO
+	}
+	return ESUCCESS
+}
+
+// Finish all requests the device is done with
+func (b *virtioBlkDevice) complete() {
+	for {
+		token, _, ok := b.queue.GetUsed()
+		if !ok {
+			return
+		}
+		req := (*virtioBlkRequest)(unsafe.Pointer(token))
+		req.done = true
+		req.waiter.WakeAll()
+		// The descriptors are free again
+		b.freeWaiters.WakeOne()
+	}
+}
+
+// The line may be shared, every device checks if it raised the interrupt
+func virtioBlkInterrupt() {
+	for i := 0; i < numVirtioBlk; i++ {
+		b := &virtioBlkDevices[i]
+		if !b.polling && b.dev.InterruptStatus()&VIRTIO_ISR_QUEUE != 0 {
+			b.complete()
+		}
+	}
+}
+
+func virtioBlkProbe(pci *PciDevice) bool {
+	if numVirtioBlk == VIRTIO_BLK_MAX_DEVICES {
+		return false
+	}
+	b := &virtioBlkDevices[numVirtioBlk]
+	if !b.dev.Init(pci) {
+		return false
+	}
+	if !b.dev.NegotiateFeatures(1<<VIRTIO_BLK_F_RO | 1<<VIRTIO_BLK_F_FLUSH) {
+		return false
+	}
+	if !b.dev.SetupQueue(&b.queue, 0) {
+		b.dev.Fail()
+		return false
+	}
+	b.readOnly = b.dev.HasFeature(VIRTIO_BLK_F_RO)
+	b.capacity = b.dev.ConfigRead64(VIRTIO_BLK_CONFIG_CAPACITY)
+
+	irq := pci.IrqLine
+	if irq < IRQ_COUNT {
+		if virtioBlkIrqs&(1<<irq) == 0 {
+			virtioBlkIrqs |= 1 << irq
+			AddIRQHandler(irq, virtioBlkInterrupt)
+			EnableIRQ(irq)
+		}
+	} else {
+		log.KErrorLn("[VIRTIO-BLK] No interrupt line, polling")
+		b.polling = true
+	}
+	b.dev.DriverOk()
+
+	pci.DriverData = uintptr(unsafe.Pointer(b))
+	RegisterBlockDevice(virtioBlkNames[numVirtioBlk], b)
+	numVirtioBlk++
+	return true
+}
+
+// Has to run before InitPci
+func InitVirtioBlk() {
+	RegisterPciDriver(&virtioBlkDriver)
+}
@@ -0,0 +1,530 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/sanserogames/letsgo-os/kernel/log"
+	"github.com/sanserogames/letsgo-os/kernel/mm"
+)
+
+// Virtio console (QEMU -device virtio-serial + virtconsole/virtserialport).
+// Every port has a receive and a transmit queue. With the multiport feature
+// ports come and go through messages on a control queue pair, otherwise there
+// is just port 0, which is a console.
+//
+// Ports are device files /dev/vport0pN, the first console port is also
+// /dev/hvc0 and the kernel log writer VirtioConsole. The log writer never
+// sleeps so it can be used from anywhere, its output is dropped while all
+// transmit buffers are in flight. Writes to the files wait for buffers.
+
+const (
+	VIRTIO_CONSOLE_LEGACY_DEVICE = 0x1003
+	VIRTIO_CONSOLE_MODERN_DEVICE = 0x1043
+
+	VIRTIO_CONSOLE_F_SIZE      = 0
+	VIRTIO_CONSOLE_F_MULTIPORT = 1
+
+	VIRTIO_CONSOLE_CONFIG_COLS      = 0
+	VIRTIO_CONSOLE_CONFIG_ROWS      = 2
+	VIRTIO_CONSOLE_CONFIG_MAX_PORTS = 4
+
+	// Control messages
+	VIRTIO_CONSOLE_DEVICE_READY  = 0
+	VIRTIO_CONSOLE_DEVICE_ADD    = 1
+	VIRTIO_CONSOLE_DEVICE_REMOVE = 2
+	VIRTIO_CONSOLE_PORT_READY    = 3
+	VIRTIO_CONSOLE_CONSOLE_PORT  = 4
+	VIRTIO_CONSOLE_RESIZE        = 5
+	VIRTIO_CONSOLE_PORT_OPEN     = 6
+	VIRTIO_CONSOLE_PORT_NAME     = 7
+	VIRTIO_CONSOLE_BAD_ID        = 0xffffffff
+
+	VIRTIO_CONSOLE_MAX_PORTS    = 4
+	VIRTIO_CONSOLE_BUF_SIZE     = 512
+	VIRTIO_CONSOLE_RX_BUFFERS   = 4
+	VIRTIO_CONSOLE_TX_BUFFERS   = 4
+	VIRTIO_CONSOLE_INPUT_SIZE   = 1024
+	VIRTIO_CONSOLE_CTRL_BUFFERS = 4
+	// Spins waiting for the device to take a control message
+	VIRTIO_CONSOLE_TX_TIMEOUT = 1000000
+
+	TIOCGWINSZ = 0x5413
+)
+
+type virtioConsoleControl struct {
+	id    uint32
+	event uint16
+	value uint16
+}
+
+type virtioConsoleResize struct {
+	cols uint16
+	rows uint16
+}
+
+// struct winsize of Linux
+type ttyWinsize struct {
+	rows   uint16
+	cols   uint16
+	xpixel uint16
+	ypixel uint16
+}
+
+type virtioConsolePort struct {
+	FileBase
+	id         uint32
+	added      bool
+	registered bool
+	isConsole  bool
+	// A program on the host has the port open
+	hostOpen bool
+	// Open files of the port in the guest
+	opens int
+	rows  uint16
+	cols  uint16
+
+	rx     Virtqueue
+	tx     Virtqueue
+	rxBufs [VIRTIO_CONSOLE_RX_BUFFERS][VIRTIO_CONSOLE_BUF_SIZE]byte
+	txBufs [VIRTIO_CONSOLE_TX_BUFFERS][VIRTIO_CONSOLE_BUF_SIZE]byte
+	txBusy [VIRTIO_CONSOLE_TX_BUFFERS]bool
+
+	// Received data that was not read yet
+	input     [VIRTIO_CONSOLE_INPUT_SIZE]byte
+	inputRing GenericRing
+	readers   WaitQueue
+	// Woken when the device is done with transmit buffers
+	writers WaitQueue
+}
+
+type virtioConsoleDevice struct {
+	dev       VirtioDevice
+	ready     bool
+	multiport bool
+	numPorts  int
+	ports     [VIRTIO_CONSOLE_MAX_PORTS]virtioConsolePort
+	// Port the log goes to, nil if there is no console port
+	console *virtioConsolePort
+
+	ctrlRx     Virtqueue
+	ctrlTx     Virtqueue
+	ctrlRxBufs [VIRTIO_CONSOLE_CTRL_BUFFERS][VIRTIO_CONSOLE_BUF_SIZE]byte
+	ctrlTxBuf  virtioConsoleControl
+}
+
+// Kernel log writer
+type VirtioConsoleWriter struct{}
+
+var (
+	virtioConsoleDriver = PciDriver{
+		Name: "virtio-console",
+		Matches: []PciMatch{
+			{Vendor: VIRTIO_PCI_VENDOR, Device: VIRTIO_CONSOLE_LEGACY_DEVICE, Class: PCI_ANY_CLASS},
+			{Vendor: VIRTIO_PCI_VENDOR, Device: VIRTIO_CONSOLE_MODERN_DEVICE, Class: PCI_ANY_CLASS},
+		},
+		Probe: virtioConsoleProbe,
+	}
+
+	// Only one device is supported, it has enough ports
+	virtioConsole          virtioConsoleDevice
+	virtioConsolePortPaths = [VIRTIO_CONSOLE_MAX_PORTS]string{"/dev/vport0p0", "/dev/vport0p1", "/dev/vport0p2", "/dev/vport0p3"}
+
+	VirtioConsole VirtioConsoleWriter
+)
+
+func (w VirtioConsoleWriter) Write(arr []byte) (int, error) {
+	c := &virtioConsole
+	if !c.ready || c.console == nil {
+		return len(arr), nil
+	}
+	start := 0
+	for i, v := range arr {
+		if v == '\n' {
+			// Same as serial
+			c.console.write(arr[start:i])
+			c.console.write([]byte{'\r', '\n'})
+			start = i + 1
+		}
+	}
+	c.console.write(arr[start:])
+	return len(arr), nil
+}
+
+// Queue index of the receive queue of port id, transmit is the one after
+func (c *virtioConsoleDevice) portQueue(id int) uint16 {
+	if id == 0 {
+		return 0
+	}
+	return uint16(2 + 2*id)
+}
+
+func (p *virtioConsolePort) queueRx(i int) {
+	buf := VirtqBuffer{Addr: uintptr(unsafe.Pointer(&p.rxBufs[i])), Len: VIRTIO_CONSOLE_BUF_SIZE, Writable: true}
+	p.rx.Add(unsafe.Slice(&buf, 1), uintptr(i))
+}
+
+// Free the transmit buffers the device is done with
+func (p *virtioConsolePort) reclaimTx() {
+	freed := false
+	for {
+		token, _, ok := p.tx.GetUsed()
+		if !ok {
+			break
+		}
+		p.txBusy[token] = false
+		freed = true
+	}
+	if freed {
+		p.writers.WakeAll()
+	}
+}
+
+// Returns -1 if the device did not send any of the buffers yet
+func (p *virtioConsolePort) freeTxBuffer() int {
+	p.reclaimTx()
+	for i := range p.txBusy {
+		if !p.txBusy[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// Copy the data to transmit buffers. Does not wait for the device to send it,
+// returns how much fit into the free buffers.
+func (p *virtioConsolePort) write(data []byte) int {
+	num := 0
+	for num < len(data) {
+		i := p.freeTxBuffer()
+		if i < 0 {
+			// The device is busy or nobody takes the data
+			break
+		}
+		n := copy(p.txBufs[i][:], data[num:])
+		num += n
+		p.txBusy[i] = true
+		buf := VirtqBuffer{Addr: uintptr(unsafe.Pointer(&p.txBufs[i])), Len: uint32(n)}
+		p.tx.Add(unsafe.Slice(&buf, 1), uintptr(i))
+		p.tx.Kick()
+	}
+	return num
+}
+
+// Move received data to the input ring and give the buffers back to the device
+func (p *virtioConsolePort) receive() {
+	received := false
+	for {
+		token, length, ok := p.rx.GetUsed()
+		if !ok {
+			break
+		}
+		for _, b := range p.rxBufs[token][:min(length, VIRTIO_CONSOLE_BUF_SIZE)] {
+			// Dropped if nobody reads it
+			if i := p.inputRing.Push(); i != -1 {
+				p.input[i] = b
+			}
+		}
+		p.queueRx(int(token))
+		received = true
+	}
+	if received {
+		p.rx.Kick()
+		p.readers.WakeAll()
+	}
+}
+
+func (p *virtioConsolePort) Read(buf []byte) (int, syscall.Errno) {
+	if len(buf) == 0 {
+		return 0, ESUCCESS
+	}
+	for p.inputRing.Len() == 0 {
+		p.readers.Wait()
+	}
+	num := 0
+	for num < len(buf) {
+		i := p.inputRing.Pop()
+		if i == -1 {
+			break
+		}
+		buf[num] = p.input[i]
+		num++
+	}
+	return num, ESUCCESS
+}
+
+func (p *virtioConsolePort) Poll(pt *PollTable) uint32 {
+	pt.Wait(&p.readers)
+	pt.Wait(&p.writers)
+	events := uint32(0)
+	if p.inputRing.Len() > 0 {
+		events |= POLLIN | POLLRDNORM
+	}
+	if p.freeTxBuffer() >= 0 {
+		events |= POLLOUT | POLLWRNORM
+	}
+	return events
+}
+
+// Waits until all data is in transmit buffers, unlike the log writer nothing is dropped
+func (p *virtioConsolePort) Write(buf []byte) (int, syscall.Errno) {
+	num := 0
+	for p.added {
+		num += p.write(buf[num:])
+		if num == len(buf) {
+			return num, ESUCCESS
+		}
+		if err := p.writers.WaitInterruptible(); err != ESUCCESS {
+			if num > 0 {
+				return num, ESUCCESS
+			}
+			return 0, err
+		}
+	}
+	if num > 0 {
+		return num, ESUCCESS
+	}
+	return 0, syscall.EIO
+}
+
+func (p *virtioConsolePort) Ioctl(space *mm.MemSpace, cmd uint32, arg uintptr) (uint32, syscall.Errno) {
+	switch cmd {
+	case TIOCGWINSZ:
+		if !p.isConsole {
+			return 0, syscall.ENOTTY
+		}
+		size := ttyWinsize{rows: p.rows, cols: p.cols}
+		return 0, space.WriteBytesToUserSpace(arg, unsafe.Slice((*byte)(unsafe.Pointer(&size)), unsafe.Sizeof(size)))
+	default:
+		return 0, syscall.ENOTTY
+	}
+}
+
+// Tell the host when the first file of a port is opened and the last one closed
+func openVirtioConsolePort(f File) syscall.Errno {
+	p := f.(*virtioConsolePort)
+	if !p.added {
+		return syscall.ENXIO
+	}
+	if p.opens == 0 && !p.isConsole && virtioConsole.multiport {
+		virtioConsole.sendControl(p.id, VIRTIO_CONSOLE_PORT_OPEN, 1)
+	}
+	p.opens++
+	return ESUCCESS
+}
+
+func (p *virtioConsolePort) Close() {
+	if p.opens == 0 {
+		return
+	}
+	p.opens--
+	// The console port stays open for the kernel log
+	if p.opens == 0 && !p.isConsole && p.added && virtioConsole.multiport {
+		virtioConsole.sendControl(p.id, VIRTIO_CONSOLE_PORT_OPEN, 0)
+	}
+}
+
+func (c *virtioConsoleDevice) sendControl(id uint32, event uint16, value uint16) {
+	c.ctrlTxBuf = virtioConsoleControl{id: id, event: event, value: value}
+	buf := VirtqBuffer{Addr: uintptr(unsafe.Pointer(&c.ctrlTxBuf)), Len: uint32(unsafe.Sizeof(c.ctrlTxBuf))}
+	if !c.ctrlTx.Add(unsafe.Slice(&buf, 1), 0) {
+		return
+	}
+	c.ctrlTx.Kick()
+	// The buffer is reused for the next message
+	for spins := 0; spins < VIRTIO_CONSOLE_TX_TIMEOUT; spins++ {
+		if _, _, ok := c.ctrlTx.GetUsed(); ok {
+			return
+		}
+		Pause()
+	}
+	log.KErrorLn("[VIRTIO-CONSOLE] Control message ", event, " was not taken")
+}
+
+// Device files stay when the port is removed, a port with the same id may come back
+func (c *virtioConsoleDevice) registerPort(p *virtioConsolePort) {
+	if !p.registered {
+		RegisterDeviceFile(virtioConsolePortPaths[p.id], p, openVirtioConsolePort)
+		p.registered = true
+	}
+}
+
+func (c *virtioConsoleDevice) setConsole(p *virtioConsolePort) {
+	p.isConsole = true
+	if c.console == nil {
+		c.console = p
+		RegisterDeviceFile("/dev/hvc0", p, openVirtioConsolePort)
+	}
+}
+
+func (c *virtioConsoleDevice) handleControl(msg *virtioConsoleControl, data []byte) {
+	if msg.id >= uint32(c.numPorts) {
+		if msg.event == VIRTIO_CONSOLE_DEVICE_ADD {
+			// Tell the device so it does not wait for the port
+			c.sendControl(msg.id, VIRTIO_CONSOLE_PORT_READY, 0)
+		}
+		return
+	}
+	p := &c.ports[msg.id]
+	switch msg.event {
+	case VIRTIO_CONSOLE_DEVICE_ADD:
+		p.added = true
+		c.registerPort(p)
+		c.sendControl(msg.id, VIRTIO_CONSOLE_PORT_READY, 1)
+		if p.opens > 0 {
+			// The port came back while it was still open here
+			c.sendControl(msg.id, VIRTIO_CONSOLE_PORT_OPEN, 1)
+		}
+	case VIRTIO_CONSOLE_DEVICE_REMOVE:
+		p.added = false
+		p.hostOpen = false
+		p.writers.WakeAll()
+	case VIRTIO_CONSOLE_CONSOLE_PORT:
+		c.setConsole(p)
+		c.sendControl(msg.id, VIRTIO_CONSOLE_PORT_OPEN, 1)
+	case VIRTIO_CONSOLE_RESIZE:
+		var size virtioConsoleResize
+		if len(data) >= int(unsafe.Sizeof(size)) {
+			size = *(*virtioConsoleResize)(unsafe.Pointer(&data[0]))
+			p.cols = size.cols
+			p.rows = size.rows
+		}
+	case VIRTIO_CONSOLE_PORT_OPEN:
+		p.hostOpen = msg.value != 0
+	case VIRTIO_CONSOLE_PORT_NAME:
+		log.KDebugLn("[VIRTIO-CONSOLE] Port ", msg.id, " is ", unsafe.String(unsafe.SliceData(data), len(data)))
+	}
+}
+
+// Returns true if there were messages
+func (c *virtioConsoleDevice) receiveControl() bool {
+	received := false
+	for {
+		token, length, ok := c.ctrlRx.GetUsed()
+		if !ok {
+			break
+		}
+		msgSize := uint32(unsafe.Sizeof(virtioConsoleControl{}))
+		if length >= msgSize && length <= VIRTIO_CONSOLE_BUF_SIZE {
+			buf := &c.ctrlRxBufs[token]
+			c.handleControl((*virtioConsoleControl)(unsafe.Pointer(buf)), buf[msgSize:length])
+		}
+		rx := VirtqBuffer{Addr: uintptr(unsafe.Pointer(&c.ctrlRxBufs[token])), Len: VIRTIO_CONSOLE_BUF_SIZE, Writable: true}
+		c.ctrlRx.Add(unsafe.Slice(&rx, 1), token)
+		received = true
+	}
+	if received {
+		c.ctrlRx.Kick()
+	}
+	return received
+}
+
+// Console size of a device without multiport
+func (c *virtioConsoleDevice) readSize() {
+	if !c.dev.HasFeature(VIRTIO_CONSOLE_F_SIZE) {
+		return
+	}
+	c.ports[0].cols = c.dev.ConfigRead16(VIRTIO_CONSOLE_CONFIG_COLS)
+	c.ports[0].rows = c.dev.ConfigRead16(VIRTIO_CONSOLE_CONFIG_ROWS)
+}
+
+func virtioConsoleInterrupt() {
+	c := &virtioConsole
+	if !c.ready {
+		return
+	}
+	isr := c.dev.InterruptStatus()
+	if isr&VIRTIO_ISR_CONFIG != 0 && !c.multiport {
+		c.readSize()
+	}
+	if isr&VIRTIO_ISR_QUEUE == 0 {
+		return
+	}
+	if c.multiport {
+		c.receiveControl()
+	}
+	for i := 0; i < c.numPorts; i++ {
+		c.ports[i].receive()
+		c.ports[i].reclaimTx()
+	}
+}
+
+func virtioConsoleProbe(pci *PciDevice) bool {
+	c := &virtioConsole
+	if c.ready {
+		return false
+	}
+	if !c.dev.Init(pci) {
+		return false
+	}
+	if !c.dev.NegotiateFeatures(1<<VIRTIO_CONSOLE_F_SIZE | 1<<VIRTIO_CONSOLE_F_MULTIPORT) {
+		return false
+	}
+	c.multiport = c.dev.HasFeature(VIRTIO_CONSOLE_F_MULTIPORT)
+	c.numPorts = 1
+	if c.multiport {
+		c.numPorts = int(min(c.dev.ConfigRead32(VIRTIO_CONSOLE_CONFIG_MAX_PORTS), VIRTIO_CONSOLE_MAX_PORTS))
+	}
+
+	// Queues can only be set up before the device is started, so all ports get theirs now
+	for i := 0; i < c.numPorts; i++ {
+		p := &c.ports[i]
+		p.id = uint32(i)
+		p.inputRing.Cap = VIRTIO_CONSOLE_INPUT_SIZE
+		if !c.dev.SetupQueue(&p.rx, c.portQueue(i)) || !c.dev.SetupQueue(&p.tx, c.portQueue(i)+1) {
+			c.dev.Fail()
+			return false
+		}
+		for b := range p.rxBufs {
+			p.queueRx(b)
+		}
+	}
+	if c.multiport {
+		if !c.dev.SetupQueue(&c.ctrlRx, 2) || !c.dev.SetupQueue(&c.ctrlTx, 3) {
+			c.dev.Fail()
+			return false
+		}
+		for b := range c.ctrlRxBufs {
+			rx := VirtqBuffer{Addr: uintptr(unsafe.Pointer(&c.ctrlRxBufs[b])), Len: VIRTIO_CONSOLE_BUF_SIZE, Writable: true}
+			c.ctrlRx.Add(unsafe.Slice(&rx, 1), uintptr(b))
+		}
+	}
+
+	if irq := pci.IrqLine; irq < IRQ_COUNT {
+		AddIRQHandler(irq, virtioConsoleInterrupt)
+		EnableIRQ(irq)
+	} else {
+		log.KErrorLn("[VIRTIO-CONSOLE] No interrupt line, there will be no input")
+	}
+	c.dev.DriverOk()
+	for i := 0; i < c.numPorts; i++ {
+		c.ports[i].rx.Kick()
+	}
+	c.ready = true
+
+	if !c.multiport {
+		c.ports[0].added = true
+		c.readSize()
+		c.registerPort(&c.ports[0])
+		c.setConsole(&c.ports[0])
+	} else {
+		c.ctrlRx.Kick()
+		c.sendControl(VIRTIO_CONSOLE_BAD_ID, VIRTIO_CONSOLE_DEVICE_READY, 1)
+		// Interrupts are off during boot. Handle the port announcements here
+		// so the console can be used right away.
+		for spins := 0; spins < 1000; spins++ {
+			if c.receiveControl() {
+				spins = 0
+			}
+			Pause()
+		}
+	}
+	pci.DriverData = uintptr(unsafe.Pointer(c))
+	log.KDebugLn("[VIRTIO-CONSOLE] ", c.numPorts, " ports, console: ", c.console != nil)
+	return true
+}
+
+// Has to run before InitPci
+func InitVirtioConsole() {
+	RegisterPciDriver(&virtioConsoleDriver)
+}
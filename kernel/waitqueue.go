@@ -0,0 +1,128 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Threads waiting for the same event. A thread is in at most one wait queue at a time.
+type WaitQueue struct {
+	head    *Thread
+	tail    *Thread
+	pollers int // Poll entries on the queue, see poll.go
+}
+
+func (q *WaitQueue) Empty() bool {
+	return q.head == nil
+}
+
+func (q *WaitQueue) Enqueue(t *Thread) {
+	if t.waitQueue != nil {
+		t.waitQueue.Remove(t)
+	}
+	t.waitQueue = q
+	t.waitNext = nil
+	t.waitPrev = q.tail
+	if q.tail == nil {
+		q.head = t
+	} else {
+		q.tail.waitNext = t
+	}
+	q.tail = t
+}
+
+func (q *WaitQueue) Remove(t *Thread) {
+	if t.waitQueue != q {
+		return
+	}
+	if t.waitPrev == nil {
+		q.head = t.waitNext
+	} else {
+		t.waitPrev.waitNext = t.waitNext
+	}
+	if t.waitNext == nil {
+		q.tail = t.waitPrev
+	} else {
+		t.waitNext.waitPrev = t.waitPrev
+	}
+	t.waitQueue = nil
+	t.waitNext = nil
+	t.waitPrev = nil
+}
+
+// Calls f for every waiting thread in order until f returns false. f may remove the thread from the queue.
+func (q *WaitQueue) ForEach(f func(t *Thread) bool) {
+	for t := q.head; t != nil; {
+		next := t.waitNext
+		if !f(t) {
+			return
+		}
+		t = next
+	}
+}
+
+// Remove the thread from the queue and make it runnable again
+func (q *WaitQueue) Wake(t *Thread) {
+	q.Remove(t)
+	ResumeThread(t)
+}
+
+// Wake the thread that waits the longest
+func (q *WaitQueue) WakeOne() {
+	if q.head != nil {
+		q.Wake(q.head)
+	}
+	if q.pollers > 0 {
+		pollWake(q)
+	}
+}
+
+func (q *WaitQueue) WakeAll() {
+	for q.head != nil {
+		q.Wake(q.head)
+	}
+	if q.pollers > 0 {
+		pollWake(q)
+	}
+}
+
+// Block the current thread until it is woken up through the queue
+func (q *WaitQueue) Wait() {
+	t := CurrentThread
+	q.Enqueue(t)
+	Block()
+	// Only needed if something else resumed the thread
+	q.Remove(t)
+}
+
+// Like Wait, but signals interrupt it and it gives up at the deadline (monotonic
+// ns, 0 waits forever). Returns false if it was interrupted or timed out.
+func (q *WaitQueue) WaitUntil(deadline uint64) bool {
+	t := CurrentThread
+	if deadline != 0 && deadline <= MonotonicTime() {
+		return false
+	}
+	t.interrupted = false
+	t.isSleeping = true
+	if deadline != 0 {
+		t.sleepTimer.Callback = wakeSleeper
+		t.sleepTimer.Arg = uintptr(unsafe.Pointer(t))
+		StartHrTimer(&t.sleepTimer, deadline)
+	}
+	q.Enqueue(t)
+	Block()
+	// Wake takes us off the queue, the timer and signals do not
+	woken := t.waitQueue != q
+	q.Remove(t)
+	CancelHrTimer(&t.sleepTimer)
+	t.isSleeping = false
+	return woken && !t.interrupted
+}
+
+// Wait until woken, signals make it return EINTR
+func (q *WaitQueue) WaitInterruptible() syscall.Errno {
+	if !q.WaitUntil(0) && CurrentThread.interrupted {
+		return syscall.EINTR
+	}
+	return ESUCCESS
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FBIOGET_VSCREENINFO = 0x4600
+	FBIOGET_FSCREENINFO = 0x4602
+)
+
+type fbBitfield struct {
+	Offset   uint32
+	Length   uint32
+	MsbRight uint32
+}
+
+type fbVarScreeninfo struct {
+	Xres         uint32
+	Yres         uint32
+	XresVirtual  uint32
+	YresVirtual  uint32
+	Xoffset      uint32
+	Yoffset      uint32
+	BitsPerPixel uint32
+	Grayscale    uint32
+	Red          fbBitfield
+	Green        fbBitfield
+	Blue         fbBitfield
+	Transp       fbBitfield
+	Rest         [20]uint32
+}
+
+type fbFixScreeninfo struct {
+	Id         [16]byte
+	SmemStart  uintptr
+	SmemLen    uint32
+	Type       uint32
+	TypeAux    uint32
+	Visual     uint32
+	Xpanstep   uint16
+	Ypanstep   uint16
+	Ywrapstep  uint16
+	LineLength uint32
+	Rest       [20]byte
+}
+
+func ioctl(fd int, cmd uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func channel(value uint32, field fbBitfield) uint32 {
+	return (value >> (8 - field.Length)) << field.Offset
+}
+
+func main() {
+	fd, err := syscall.Open("/dev/fb0", syscall.O_RDWR, 0)
+	if err != nil {
+		fmt.Println("Could not open framebuffer:", err)
+		return
+	}
+	defer syscall.Close(fd)
+
+	var varInfo fbVarScreeninfo
+	var fixInfo fbFixScreeninfo
+	if err := ioctl(fd, FBIOGET_VSCREENINFO, unsafe.Pointer(&varInfo)); err != nil {
+		fmt.Println("FBIOGET_VSCREENINFO failed:", err)
+		return
+	}
+	if err := ioctl(fd, FBIOGET_FSCREENINFO, unsafe.Pointer(&fixInfo)); err != nil {
+		fmt.Println("FBIOGET_FSCREENINFO failed:", err)
+		return
+	}
+	fmt.Printf("%s: %dx%d %d bpp\n", string(fixInfo.Id[:]), varInfo.Xres, varInfo.Yres, varInfo.BitsPerPixel)
+	if varInfo.BitsPerPixel != 32 {
+		fmt.Println("Only 32 bpp is supported by this demo")
+		return
+	}
+
+	mem, err := syscall.Mmap(fd, 0, int(fixInfo.SmemLen), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		fmt.Println("Could not map framebuffer:", err)
+		return
+	}
+	defer syscall.Munmap(mem)
+
+	for y := uint32(0); y < varInfo.Yres; y++ {
+		line := unsafe.Slice((*uint32)(unsafe.Pointer(&mem[y*fixInfo.LineLength])), varInfo.Xres)
+		for x := range line {
+			r := uint32(x) * 255 / varInfo.Xres
+			g := y * 255 / varInfo.Yres
+			b := 255 - r
+			line[x] = channel(r, varInfo.Red) | channel(g, varInfo.Green) | channel(b, varInfo.Blue)
+		}
+	}
+}